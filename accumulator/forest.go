@@ -3,6 +3,7 @@ package accumulator
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"sort"
 	"time"
@@ -558,6 +559,52 @@ func (f *Forest) PosMapSanity() error {
 	return nil
 }
 
+// Sanity checks the forest the way sanity does, and also hashes everything
+// up again from the leaves to make sure every node, the roots included,
+// still adds up.  Meant for checking a forest that was just restored from
+// disk.  It reads the whole forest.
+func (f *Forest) Sanity() error {
+	err := f.sanity()
+	if err != nil {
+		return err
+	}
+	rootPositions, rootRows := getRootsReverse(f.numLeaves, f.rows)
+	for i, pos := range rootPositions {
+		_, err = f.subtreeHash(pos, rootRows[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subtreeHash hashes the leaves under pos, which is at row, up to pos, and
+// checks each node on the way against what's stored
+func (f *Forest) subtreeHash(pos uint64, row uint8) (Hash, error) {
+	if row == 0 {
+		return f.data.read(pos), nil
+	}
+	l := child(pos, f.rows)
+	lh, err := f.subtreeHash(l, row-1)
+	if err != nil {
+		return empty, err
+	}
+	rh, err := f.subtreeHash(l|1, row-1)
+	if err != nil {
+		return empty, err
+	}
+	// parentHash panics on these
+	if lh == empty || rh == empty {
+		return empty, fmt.Errorf("node @%d has an empty child", pos)
+	}
+	h := parentHash(lh, rh)
+	if h != f.data.read(pos) {
+		return empty, fmt.Errorf("node @%d is %x but the leaves under it "+
+			"hash to %x", pos, f.data.read(pos).Prefix(), h.Prefix())
+	}
+	return h, nil
+}
+
 // RestoreForest restores the forest on restart. Needed when resuming after exiting.
 // miscForestFile is where numLeaves and rows is stored
 func RestoreForest(
@@ -637,17 +684,7 @@ func RestoreForest(
 	}
 
 	// Restore positionMap by rebuilding from all leaves
-	f.positionMap = make(map[MiniHash]uint64)
-	fmt.Printf("%d leaves for position map\n", f.numLeaves)
-	for i := uint64(0); i < f.numLeaves; i++ {
-		f.positionMap[f.data.read(i).Mini()] = i
-		if i%100000 == 0 && i != 0 {
-			fmt.Printf("Added %d leaves %x\n", i, f.data.read(i).Mini())
-		}
-	}
-	if f.positionMap == nil {
-		return nil, fmt.Errorf("Generated positionMap is nil")
-	}
+	f.buildPositionMap()
 
 	fmt.Println("Done restoring forest")
 
@@ -658,6 +695,18 @@ func RestoreForest(
 	return f, nil
 }
 
+// buildPositionMap makes the positionMap from all the leaves
+func (f *Forest) buildPositionMap() {
+	f.positionMap = make(map[MiniHash]uint64)
+	fmt.Printf("%d leaves for position map\n", f.numLeaves)
+	for i := uint64(0); i < f.numLeaves; i++ {
+		f.positionMap[f.data.read(i).Mini()] = i
+		if i%100000 == 0 && i != 0 {
+			fmt.Printf("Added %d leaves %x\n", i, f.data.read(i).Mini())
+		}
+	}
+}
+
 func (f *Forest) PrintPositionMap() string {
 	var s string
 	for pos := uint64(0); pos < f.numLeaves; pos++ {
@@ -688,13 +737,37 @@ func (f *Forest) WriteMiscData(miscForestFile *os.File) error {
 	return nil
 }
 
+// FlushMiscData is like WriteMiscData, but leaves the forest open so it
+// can keep being modified.  Before writing numLeaves and rows it pushes any
+// forest data that's only in ram out to disk and fsyncs it, so that the
+// forest on disk matches what's written.  A ram forest isn't touched; use
+// WriteForestToDisk for that.  With a journal nothing is pushed out, as the
+// forest on disk only changes on CommitJournal.
+func (f *Forest) FlushMiscData(miscForestFile io.Writer) error {
+	err := syncForestData(f.data)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(miscForestFile, binary.BigEndian, f.numLeaves)
+	if err != nil {
+		return err
+	}
+	return binary.Write(miscForestFile, binary.BigEndian, f.rows)
+}
+
 // WriteForestToDisk writes the whole forest to disk
 // this only makes sense to do if the forest is in ram.  So it'll return
-// an error if it's not a ramForestData
+// an error if it's not a ramForestData.  With a journal it's what's been
+// committed that gets written.
 func (f *Forest) WriteForestToDisk(dumpFile *os.File, ram, cow bool) error {
 
 	if ram {
-		ramForest, ok := f.data.(*ramForestData)
+		data := f.data
+		if j, ok := data.(*journalForestData); ok {
+			data = j.data
+		}
+		ramForest, ok := data.(*ramForestData)
 		if !ok {
 			return fmt.Errorf("WriteForest only possible with ram forest")
 		}
@@ -731,6 +804,16 @@ func (f *Forest) getRoots() []Hash {
 	return roots
 }
 
+// GetRoots gives the roots of the forest, biggest tree first, same as
+// Pollard.GetRoots.  NewPollardFromRoots takes them in this order.
+func (f *Forest) GetRoots() []Hash {
+	roots := f.getRoots()
+	for i, j := 0, len(roots)-1; i < j; i, j = i+1, j-1 {
+		roots[i], roots[j] = roots[j], roots[i]
+	}
+	return roots
+}
+
 // Stats :
 func (f *Forest) Stats() string {
 
@@ -51,6 +51,54 @@ func TestForestAddDel(t *testing.T) {
 	}
 }
 
+// TestForestSanity checks that Sanity passes on a good forest and catches
+// a root or a leaf that doesn't match.
+func TestForestSanity(t *testing.T) {
+	f := NewForest(nil, false, "", 0)
+
+	sc := NewSimChain(0x07)
+	sc.lookahead = 400
+
+	for b := 0; b < 100; b++ {
+		adds, _, delHashes := sc.NextBlock(10)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Sanity()
+		if err != nil {
+			t.Fatalf("block %d: %s", b, err.Error())
+		}
+	}
+
+	// mess up the biggest root
+	rootPositions, _ := getRootsReverse(f.numLeaves, f.rows)
+	top := rootPositions[len(rootPositions)-1]
+	f.data.write(top, Hash{0xff})
+	if f.Sanity() == nil {
+		t.Fatal("Sanity passed with a bad root")
+	}
+	f.data.write(top, parentHash(f.data.read(child(top, f.rows)),
+		f.data.read(child(top, f.rows)|1)))
+	if f.Sanity() != nil {
+		t.Fatal("root put back but Sanity fails")
+	}
+
+	// and a leaf under it, with the root left as it was
+	f.data.write(3, Hash{0xff})
+	if f.Sanity() == nil {
+		t.Fatal("Sanity passed with a bad leaf")
+	}
+	f.data.write(3, empty)
+	if f.Sanity() == nil {
+		t.Fatal("Sanity passed with an empty leaf")
+	}
+}
+
 func TestCowForestAddDelComp(t *testing.T) {
 	numAdds := uint32(1000)
 
@@ -448,3 +496,25 @@ func TestSmallRandomForests(t *testing.T) {
 		}
 	}
 }
+
+// TestForestGetRoots checks that forest and pollard give their roots in the
+// same order
+func TestForestGetRoots(t *testing.T) {
+	f := NewForest(nil, false, "", 0)
+	var p Pollard
+	for i := uint8(1); i < 12; i++ {
+		adds := []Leaf{{Hash: Hash{i}}}
+		_, err := f.Modify(adds, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.Modify(adds, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(f.GetRoots(), p.GetRoots()) {
+			t.Fatalf("%d leaves: forest roots %x, pollard roots %x",
+				i, f.GetRoots(), p.GetRoots())
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package accumulator
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+/*
+A forest on disk gets written to all the time, so if the program stops the
+forest on disk is wherever it was at.  The journal keeps it at a point
+that's known instead: after StartJournal every change to the forest is
+kept in ram, and only goes to the forest's data on CommitJournal.  Before
+that, WriteJournal gives everything that's changed, so that if it stops
+while committing, ReplayJournal can finish the commit.
+
+A journal is:
+8 bytes numLeaves
+1 byte rows
+8 bytes size the forest data gets resized to, 0 for no resize
+8 bytes number of changed positions, then for each
+    8 bytes position, 32 bytes hash
+all big endian.
+
+Every position written since the last commit is in the journal with what's
+there now, so replaying it over the forest data from any point during the
+commit gives the same thing.
+
+The changes are all held in ram until they're committed, so commit every so
+often, and before JournalSize gets too big for the ram there is.  Each
+changed position takes about 100 bytes.
+
+WriteUndoJournal gives a journal the other way: what's in the forest data
+now at every changed position, and the numLeaves and rows from the last
+commit.  Replaying it once the changes are committed takes the forest back
+to the commit before, which is how a forest goes back a few blocks.
+*/
+
+// journalForestData holds the changes to the forest data since the last
+// commit
+type journalForestData struct {
+	data     ForestData      // as of the last commit
+	changes  map[uint64]Hash // positions written since then
+	baseSize uint64          // data.size()
+	newSize  uint64          // what it'll get resized to, 0 if not resized
+
+	// the forest's numLeaves and rows as of the last commit
+	baseLeaves uint64
+	baseRows   uint8
+}
+
+func newJournalForestData(
+	data ForestData, numLeaves uint64, rows uint8) *journalForestData {
+
+	return &journalForestData{
+		data:       data,
+		changes:    make(map[uint64]Hash),
+		baseSize:   data.size(),
+		baseLeaves: numLeaves,
+		baseRows:   rows,
+	}
+}
+
+func (j *journalForestData) read(pos uint64) Hash {
+	h, ok := j.changes[pos]
+	if ok {
+		return h
+	}
+	// resized, but not in the data yet
+	if pos >= j.baseSize {
+		return empty
+	}
+	return j.data.read(pos)
+}
+
+func (j *journalForestData) write(pos uint64, h Hash) {
+	j.changes[pos] = h
+}
+
+func (j *journalForestData) swapHash(a, b uint64) {
+	ha := j.read(a)
+	hb := j.read(b)
+	j.write(a, hb)
+	j.write(b, ha)
+}
+
+func (j *journalForestData) swapHashRange(a, b, w uint64) {
+	for i := uint64(0); i < w; i++ {
+		j.swapHash(a+i, b+i)
+	}
+}
+
+func (j *journalForestData) size() uint64 {
+	if j.newSize > j.baseSize {
+		return j.newSize
+	}
+	return j.baseSize
+}
+
+func (j *journalForestData) resize(newSize uint64) {
+	if newSize > j.newSize {
+		j.newSize = newSize
+	}
+}
+
+// close closes the data.  Anything not committed is gone.
+func (j *journalForestData) close() {
+	j.data.close()
+}
+
+// commit puts the changes in the data and syncs it
+func (j *journalForestData) commit() error {
+	if j.newSize > j.baseSize {
+		j.data.resize(j.newSize)
+	}
+	for _, pos := range j.positions() {
+		j.data.write(pos, j.changes[pos])
+	}
+	err := syncForestData(j.data)
+	if err != nil {
+		return err
+	}
+	j.changes = make(map[uint64]Hash)
+	j.baseSize = j.data.size()
+	j.newSize = 0
+	return nil
+}
+
+// positions gives the changed positions in order
+func (j *journalForestData) positions() []uint64 {
+	positions := make([]uint64, 0, len(j.changes))
+	for pos := range j.changes {
+		positions = append(positions, pos)
+	}
+	sort.Slice(positions, func(a, b int) bool {
+		return positions[a] < positions[b]
+	})
+	return positions
+}
+
+// syncForestData gets forest data that's only in ram out to disk and fsyncs
+// it.  Ram forest data is left alone, and journaled data only goes to disk
+// when committed.
+func syncForestData(data ForestData) error {
+	switch d := data.(type) {
+	case *diskForestData:
+		return d.file.Sync()
+	case *cacheForestData:
+		flushCacheToDisk(d)
+		return d.file.Sync()
+	case *cowForest:
+		return d.flush()
+	}
+	return nil
+}
+
+// StartJournal keeps changes to the forest in ram from now on, until
+// CommitJournal.  Does nothing if it's already started.
+func (f *Forest) StartJournal() {
+	if _, ok := f.data.(*journalForestData); ok {
+		return
+	}
+	f.data = newJournalForestData(f.data, f.numLeaves, f.rows)
+}
+
+// journal gives the journaled data, or an error if there's no journal
+func (f *Forest) journal() (*journalForestData, error) {
+	j, ok := f.data.(*journalForestData)
+	if !ok {
+		return nil, fmt.Errorf("forest has no journal, call StartJournal")
+	}
+	return j, nil
+}
+
+// JournalSize gives how many positions have changed since the last commit,
+// 0 if there's no journal
+func (f *Forest) JournalSize() int {
+	j, ok := f.data.(*journalForestData)
+	if !ok {
+		return 0
+	}
+	return len(j.changes)
+}
+
+// WriteJournal writes out the changes since the last commit, and the
+// numLeaves and rows they go with
+func (f *Forest) WriteJournal(w io.Writer) error {
+	j, err := f.journal()
+	if err != nil {
+		return err
+	}
+	return writeJournal(w, f.numLeaves, f.rows, j.newSize,
+		j.positions(), j.read)
+}
+
+// WriteUndoJournal writes out a journal that takes the forest back to the
+// last commit: what's there now at every position changed since then, and
+// the numLeaves and rows from then.  Replaying it after the changes are
+// committed undoes them.  Positions past the old end of the data go back
+// to empty, as the data can't be made smaller again.
+func (f *Forest) WriteUndoJournal(w io.Writer) error {
+	j, err := f.journal()
+	if err != nil {
+		return err
+	}
+	old := func(pos uint64) Hash {
+		if pos >= j.baseSize {
+			return empty
+		}
+		return j.data.read(pos)
+	}
+	return writeJournal(w, j.baseLeaves, j.baseRows, 0, j.positions(), old)
+}
+
+// writeJournal writes a journal with the hash from read for each position
+func writeJournal(w io.Writer, numLeaves uint64, rows uint8, newSize uint64,
+	positions []uint64, read func(uint64) Hash) error {
+
+	for _, v := range []interface{}{
+		numLeaves, rows, newSize, uint64(len(positions))} {
+
+		err := binary.Write(w, binary.BigEndian, v)
+		if err != nil {
+			return err
+		}
+	}
+	for _, pos := range positions {
+		err := binary.Write(w, binary.BigEndian, pos)
+		if err != nil {
+			return err
+		}
+		h := read(pos)
+		_, err = w.Write(h[:])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CommitJournal puts the changes since the last commit in the forest's
+// data and syncs it
+func (f *Forest) CommitJournal() error {
+	j, err := f.journal()
+	if err != nil {
+		return err
+	}
+	err = j.commit()
+	if err != nil {
+		return err
+	}
+	j.baseLeaves, j.baseRows = f.numLeaves, f.rows
+	return nil
+}
+
+// ReplayJournal commits a journal from WriteJournal.  It's for after a
+// restart, with the forest restored from the data the journal was being
+// committed to.  Changes that aren't committed yet are thrown away.
+func (f *Forest) ReplayJournal(r io.Reader) error {
+	j, err := f.journal()
+	if err != nil {
+		return err
+	}
+	var numLeaves, newSize, count uint64
+	var rows uint8
+	for _, v := range []interface{}{&numLeaves, &rows, &newSize, &count} {
+		err = binary.Read(r, binary.BigEndian, v)
+		if err != nil {
+			return err
+		}
+	}
+	changes := make(map[uint64]Hash)
+	for i := uint64(0); i < count; i++ {
+		var pos uint64
+		var h Hash
+		err = binary.Read(r, binary.BigEndian, &pos)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(r, h[:])
+		if err != nil {
+			return err
+		}
+		changes[pos] = h
+	}
+
+	j.changes, j.newSize = changes, newSize
+	err = j.commit()
+	if err != nil {
+		return err
+	}
+	f.numLeaves, f.rows = numLeaves, rows
+	j.baseLeaves, j.baseRows = numLeaves, rows
+	f.buildPositionMap()
+	return nil
+}
@@ -0,0 +1,322 @@
+package accumulator
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// journalTest is a journaled forest on disk of some type, with a ram forest
+// that gets the same blocks to check it against
+type journalTest struct {
+	t     *testing.T
+	kind  string // disk, cache or cow
+	dir   string
+	f     *Forest
+	ram   *Forest
+	sc    *SimChain
+	misc  []byte // misc data at the last commit
+	saved *Forest
+	done  []simBlock // every block so far
+}
+
+// simBlock is what a block from the SimChain does to the forest
+type simBlock struct {
+	adds      []Leaf
+	delHashes []Hash
+}
+
+func newJournalTest(t *testing.T, kind string) *journalTest {
+	jt := &journalTest{t: t, kind: kind, dir: t.TempDir()}
+	switch kind {
+	case "cow":
+		jt.f = NewForest(nil, false, jt.cowDir(), 2)
+	default:
+		file, err := os.OpenFile(jt.forestFile(), os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jt.f = NewForest(file, kind == "cache", "", 0)
+	}
+	jt.f.StartJournal()
+	jt.ram = NewForest(nil, false, "", 0)
+	jt.sc = NewSimChain(0x07)
+	jt.sc.lookahead = 10
+	jt.commit()
+	return jt
+}
+
+func (jt *journalTest) forestFile() string {
+	return filepath.Join(jt.dir, "forest")
+}
+
+func (jt *journalTest) cowDir() string {
+	return filepath.Join(jt.dir, "cow")
+}
+
+// blocks does n blocks to both forests
+func (jt *journalTest) blocks(n int) {
+	for b := 0; b < n; b++ {
+		adds, _, delHashes := jt.sc.NextBlock(20)
+		blk := simBlock{adds: adds, delHashes: delHashes}
+		jt.modify(jt.f, blk)
+		jt.modify(jt.ram, blk)
+		jt.done = append(jt.done, blk)
+	}
+	jt.same(jt.f, jt.ram)
+}
+
+// modify does blk to f
+func (jt *journalTest) modify(f *Forest, blk simBlock) {
+	bp, err := f.ProveBatch(blk.delHashes)
+	if err != nil {
+		jt.t.Fatal(err)
+	}
+	_, err = f.Modify(blk.adds, bp.Targets)
+	if err != nil {
+		jt.t.Fatal(err)
+	}
+}
+
+// journal writes the journal and the misc data
+func (jt *journalTest) journal() []byte {
+	var buf, misc bytes.Buffer
+	err := jt.f.WriteJournal(&buf)
+	if err != nil {
+		jt.t.Fatal(err)
+	}
+	err = jt.f.FlushMiscData(&misc)
+	if err != nil {
+		jt.t.Fatal(err)
+	}
+	jt.misc = misc.Bytes()
+	return buf.Bytes()
+}
+
+// commit commits the journal and keeps a copy of the ram forest as it is
+func (jt *journalTest) commit() {
+	jt.journal()
+	err := jt.f.CommitJournal()
+	if err != nil {
+		jt.t.Fatal(err)
+	}
+	jt.save()
+}
+
+// save keeps a copy of the ram forest to check the forest on disk against
+func (jt *journalTest) save() {
+	saved := NewForest(nil, false, "", 0)
+	saved.numLeaves, saved.rows = jt.ram.numLeaves, jt.ram.rows
+	d := jt.ram.data.(*ramForestData)
+	saved.data = &ramForestData{m: append([]byte{}, d.m...)}
+	saved.buildPositionMap()
+	jt.saved = saved
+}
+
+// restore restores the forest from what's on disk, with misc as the misc
+// data
+func (jt *journalTest) restore(misc []byte) *Forest {
+	miscName := filepath.Join(jt.dir, "misc")
+	err := ioutil.WriteFile(miscName, misc, 0600)
+	if err != nil {
+		jt.t.Fatal(err)
+	}
+	miscFile, err := os.Open(miscName)
+	if err != nil {
+		jt.t.Fatal(err)
+	}
+	defer miscFile.Close()
+
+	var f *Forest
+	switch jt.kind {
+	case "cow":
+		f, err = RestoreForest(miscFile, nil, false, false, jt.cowDir(), 2)
+	default:
+		var file *os.File
+		file, err = os.OpenFile(jt.forestFile(), os.O_RDWR, 0600)
+		if err != nil {
+			jt.t.Fatal(err)
+		}
+		f, err = RestoreForest(miscFile, file, false, jt.kind == "cache",
+			"", 0)
+	}
+	if err != nil {
+		jt.t.Fatal(err)
+	}
+	f.StartJournal()
+	return f
+}
+
+// same checks that f has the same leaves and roots as want
+func (jt *journalTest) same(f, want *Forest) {
+	jt.t.Helper()
+	if f.numLeaves != want.numLeaves || f.rows != want.rows {
+		jt.t.Fatalf("%s forest has %d leaves %d rows, expected %d %d",
+			jt.kind, f.numLeaves, f.rows, want.numLeaves, want.rows)
+	}
+	for pos := uint64(0); pos < want.numLeaves; pos++ {
+		if f.data.read(pos) != want.data.read(pos) {
+			jt.t.Fatalf("%s forest leaf %d differs", jt.kind, pos)
+		}
+	}
+	if !equalHashes(f.GetRoots(), want.GetRoots()) {
+		jt.t.Fatalf("%s forest roots differ", jt.kind)
+	}
+	if len(f.positionMap) != len(want.positionMap) {
+		jt.t.Fatalf("%s forest position map has %d, expected %d", jt.kind,
+			len(f.positionMap), len(want.positionMap))
+	}
+}
+
+func equalHashes(a, b []Hash) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestForestJournal checks that a journaled forest on disk only changes
+// when the journal's committed
+func TestForestJournal(t *testing.T) {
+	for _, kind := range []string{"disk", "cache", "cow"} {
+		jt := newJournalTest(t, kind)
+		// enough to remap a few times
+		for i := 0; i < 5; i++ {
+			jt.blocks(7)
+			jt.commit()
+		}
+
+		// blocks that don't get committed aren't on disk
+		misc := jt.misc
+		jt.blocks(8)
+		jt.journal()
+		jt.same(jt.restore(misc), jt.saved)
+		j := jt.f.data.(*journalForestData)
+		if jt.f.JournalSize() == 0 || jt.f.JournalSize() != len(j.changes) {
+			t.Fatalf("JournalSize %d with %d changes",
+				jt.f.JournalSize(), len(j.changes))
+		}
+
+		// and after committing they are
+		err := jt.f.CommitJournal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		jt.same(jt.restore(jt.misc), jt.ram)
+		if jt.f.JournalSize() != 0 {
+			t.Fatalf("JournalSize %d after committing", jt.f.JournalSize())
+		}
+	}
+}
+
+// TestForestJournalReplay stops partway through committing, and checks
+// that replaying the journal finishes it
+func TestForestJournalReplay(t *testing.T) {
+	for _, kind := range []string{"disk", "cache", "cow"} {
+		for _, part := range []int{0, 1, 2} {
+			jt := newJournalTest(t, kind)
+			jt.blocks(20)
+			jt.commit()
+			oldMisc := jt.misc
+			// crosses a power of 2, so there's a resize too
+			jt.blocks(30)
+			journal := jt.journal()
+
+			// commit some of it: none, half, or all but the resize
+			j := jt.f.data.(*journalForestData)
+			if part > 0 && j.newSize > j.baseSize {
+				j.data.resize(j.newSize)
+			}
+			positions := j.positions()
+			for _, pos := range positions[:len(positions)*part/2] {
+				j.data.write(pos, j.changes[pos])
+			}
+			err := syncForestData(j.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// whichever misc data made it, the journal has numLeaves
+			for _, misc := range [][]byte{oldMisc, jt.misc} {
+				f := jt.restore(misc)
+				err = f.ReplayJournal(bytes.NewReader(journal))
+				if err != nil {
+					t.Fatal(err)
+				}
+				jt.same(f, jt.ram)
+			}
+
+			// and it keeps going from there
+			jt.f = jt.restore(jt.misc)
+			jt.blocks(5)
+			jt.commit()
+			jt.same(jt.restore(jt.misc), jt.ram)
+
+			// a journal that's cut off is an error
+			f := jt.restore(jt.misc)
+			err = f.ReplayJournal(bytes.NewReader(journal[:len(journal)-1]))
+			if err == nil {
+				t.Fatalf("%s: cut off journal replayed", kind)
+			}
+		}
+	}
+}
+
+// TestForestUndoJournal commits blocks with undo journals, then undoes them
+// one commit at a time and checks the forest is back where it was, and
+// that the same blocks can be done over again from there
+func TestForestUndoJournal(t *testing.T) {
+	for _, kind := range []string{"disk", "cache", "cow"} {
+		jt := newJournalTest(t, kind)
+		jt.blocks(10)
+		jt.commit()
+
+		// the forest after each commit, and how many blocks it had
+		saved := []*Forest{jt.saved}
+		numBlocks := []int{len(jt.done)}
+		var undos [][]byte
+		// across a few remaps
+		for _, n := range []int{3, 20, 30} {
+			jt.blocks(n)
+			var undo bytes.Buffer
+			err := jt.f.WriteUndoJournal(&undo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			undos = append(undos, undo.Bytes())
+			jt.commit()
+			saved = append(saved, jt.saved)
+			numBlocks = append(numBlocks, len(jt.done))
+		}
+
+		for i := len(undos) - 1; i >= 0; i-- {
+			err := jt.f.ReplayJournal(bytes.NewReader(undos[i]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			jt.same(jt.f, saved[i])
+			// and it's on disk
+			var misc bytes.Buffer
+			err = jt.f.FlushMiscData(&misc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jt.same(jt.restore(misc.Bytes()), saved[i])
+		}
+
+		// doing the blocks again gets back to the same forest
+		for _, blk := range jt.done[numBlocks[0]:] {
+			jt.modify(jt.f, blk)
+		}
+		jt.same(jt.f, jt.ram)
+		jt.commit()
+		jt.same(jt.restore(jt.misc), jt.ram)
+	}
+}
@@ -1,6 +1,8 @@
 package accumulator
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"math/rand"
 	"testing"
@@ -60,6 +62,142 @@ func TestPollardSimpleIngest(t *testing.T) {
 	}
 }
 
+// TestPollardVerifyNoMutate checks that verifying a proof doesn't touch the
+// pollard, whether the proof is good or bad.
+func TestPollardVerifyNoMutate(t *testing.T) {
+	f := NewForest(nil, false, "", 0)
+	adds := make([]Leaf, 15)
+	for i := 0; i < len(adds); i++ {
+		adds[i].Hash[0] = uint8(i + 1)
+	}
+	f.Modify(adds, nil)
+
+	var p Pollard
+	p.Modify(adds, nil)
+
+	bp, err := f.ProveBatch([]Hash{adds[2].Hash, adds[9].Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// roots of a pollard that remembers nothing have no nieces
+	noNieces := func() bool {
+		for _, r := range p.roots {
+			if r.niece[0] != nil || r.niece[1] != nil {
+				return false
+			}
+		}
+		return true
+	}
+
+	bad := BatchProof{Targets: bp.Targets, Proof: make([]Hash, len(bp.Proof))}
+	copy(bad.Proof, bp.Proof)
+	bad.Proof[len(bad.Proof)-1][0] ^= 0xFF
+	_, err = p.VerifyBatchProof(bad)
+	if err == nil {
+		t.Fatal("VerifyBatchProof accepted a modified proof")
+	}
+	if !noNieces() {
+		t.Fatal("VerifyBatchProof populated the pollard with a bad proof")
+	}
+
+	vp, err := p.VerifyBatchProof(bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !noNieces() {
+		t.Fatal("VerifyBatchProof populated the pollard")
+	}
+
+	err = p.PopulateBatchProof(vp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Modify(nil, bp.Targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Modify(nil, bp.Targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the pollard should now accept proofs from the forest after the deletion
+	bp, err = f.ProveBatch([]Hash{adds[5].Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.VerifyBatchProof(bp)
+	if err != nil {
+		t.Fatal("pollard and forest differ after deletion", err)
+	}
+}
+
+// TestNewPollardFromRoots checks that a pollard made from just the roots of
+// another one keeps up with it.
+func TestNewPollardFromRoots(t *testing.T) {
+	f := NewForest(nil, false, "", 0)
+	var p Pollard
+
+	sn := NewSimChain(0x07)
+	sn.lookahead = 0
+	for b := 0; b < 50; b++ {
+		adds, _, delHashes := sn.NextBlock(rand.Uint32() & 0x3f)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.IngestBatchProof(bp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	roots := p.GetRoots()
+	if len(roots) != len(p.roots) {
+		t.Fatalf("GetRoots gave %d roots but pollard has %d",
+			len(roots), len(p.roots))
+	}
+	_, err := NewPollardFromRoots(roots[1:], p.numLeaves)
+	if err == nil {
+		t.Fatal("NewPollardFromRoots accepted too few roots")
+	}
+	p2, err := NewPollardFromRoots(roots, p.numLeaves)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for b := 0; b < 50; b++ {
+		adds, _, delHashes := sn.NextBlock(rand.Uint32() & 0x3f)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p2.IngestBatchProof(bp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p2.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !p2.equalToForestIfThere(f) {
+		t.Fatal("pollard from roots differs from forest")
+	}
+}
+
 func pollardRandomRemember(blocks int32) error {
 
 	// ffile, err := os.Create("/dev/shm/forfile")
@@ -290,3 +428,101 @@ func TestCache(t *testing.T) {
 		}
 	}
 }
+
+// TestPollardSerialize saves and restores sparse and full pollards while
+// they're being used, and checks that nothing cached gets lost.
+func TestPollardSerialize(t *testing.T) {
+	rand.Seed(3)
+	var p Pollard
+	fp := NewFullPollard()
+
+	sn := NewSimChain(0x07)
+	sn.lookahead = 40
+	for b := 0; b < 60; b++ {
+		adds, _, delHashes := sn.NextBlock(rand.Uint32() & 0x1f)
+
+		bp, err := fp.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.IngestBatchProof(bp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fp.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b%10 != 9 {
+			continue
+		}
+
+		// round trip the sparse pollard and keep going with the restored one
+		ser, err := p.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p2 Pollard
+		err = p2.Deserialize(ser)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ser2, err := p2.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ser, ser2) {
+			t.Fatalf("block %d pollard changed in serialization", b)
+		}
+		// a pollard that remembers things is bigger than just the roots
+		if len(ser) <= 12+len(p.roots)*33 {
+			t.Fatalf("block %d only serialized %d bytes", b, len(ser))
+		}
+		p = p2
+
+		// same for the full pollard; its position map has to come back
+		ser, err = fp.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fp2 := NewFullPollard()
+		err = fp2.Deserialize(ser)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fp2.positionMap) != int(fp2.numLeaves) {
+			t.Fatalf("block %d restored posmap has %d of %d leaves",
+				b, len(fp2.positionMap), fp2.numLeaves)
+		}
+		err = fp2.PosMapSanity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fp = fp2
+	}
+
+	// the old roots only format should still restore
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, p.numLeaves)
+	for _, r := range p.GetRoots() {
+		buf.Write(r[:])
+	}
+	var p3 Pollard
+	err := p3.RestorePollard(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p3.numLeaves != p.numLeaves || len(p3.roots) != len(p.roots) {
+		t.Fatal("old format restored wrong")
+	}
+	for i, r := range p3.GetRoots() {
+		if r != p.roots[i].data {
+			t.Fatalf("old format root %d restored wrong", i)
+		}
+	}
+}
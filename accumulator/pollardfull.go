@@ -37,7 +37,8 @@ func (p *Pollard) PosMapSanity() error {
 
 // TODO make interface to reduce code dupe
 
-// ProveBatch but for pollard.
+// ProveBatch but for pollard.  A full pollard can prove any leaf; a sparse
+// one only the leaves it remembers, see proveSparse.
 // Now getting really obvious that forest and pollard should both satisfy some
 // kind of utreexo-like interface.  And maybe forest shouldn't be called forest.
 // Anyway do that after this.
@@ -50,6 +51,10 @@ func (p *Pollard) ProveBatch(hs []Hash) (BatchProof, error) {
 	if p.numLeaves < 2 {
 		return bp, nil
 	}
+	// without a positionMap, only remembered leaves can be proven
+	if p.positionMap == nil {
+		return p.proveSparse(hs)
+	}
 
 	// for h, p := range f.positionMap {
 	// 	fmt.Printf("%x@%d ", h[:4], p)
@@ -83,10 +88,13 @@ func (p *Pollard) ProveBatch(hs []Hash) (BatchProof, error) {
 	// NOTE that this is a big deal -- we lose in-block positional information
 	// because of this sorting.  Does that hurt locality or performance?  My
 	// guess is no, but that's untested.
-	sortUint64s(bp.Targets)
+	// Same as forest, bp.Targets stays in the order of hs.
+	sortedTargets := make([]uint64, len(bp.Targets))
+	copy(sortedTargets, bp.Targets)
+	sortUint64s(sortedTargets)
 
-	proofPositions, _ := ProofPositions(bp.Targets, p.numLeaves, p.rows())
-	targetsAndProof := mergeSortedSlices(proofPositions, bp.Targets)
+	proofPositions, _ := ProofPositions(sortedTargets, p.numLeaves, p.rows())
+	targetsAndProof := mergeSortedSlices(proofPositions, sortedTargets)
 	bp.Proof = make([]Hash, len(targetsAndProof))
 	for i, proofPos := range targetsAndProof {
 		bp.Proof[i] = p.read(proofPos)
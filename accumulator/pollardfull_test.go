@@ -3,6 +3,7 @@ package accumulator
 import (
 	"fmt"
 	"math/rand"
+	"reflect"
 	"testing"
 )
 
@@ -100,3 +101,442 @@ func pollardFullRandomRemember(blocks int32) error {
 
 	return nil
 }
+
+// TestPollardSparseProve remembers some leaves in a sparse pollard and checks
+// that it proves them the same as a full pollard does, block after block.
+func TestPollardSparseProve(t *testing.T) {
+	for z := 0; z < 10; z++ {
+		rand.Seed(int64(z))
+		err := pollardSparseProve(30)
+		if err != nil {
+			t.Fatalf("randseed %d: %s", z, err.Error())
+		}
+	}
+}
+
+func pollardSparseProve(blocks int32) error {
+	fp := NewFullPollard()
+	var p Pollard
+
+	// leaves the sparse pollard was told to remember and are still there
+	pinned := make(map[Hash]bool)
+
+	sn := NewSimChain(0x07)
+	sn.lookahead = 0
+	for b := int32(0); b < blocks; b++ {
+		adds, _, delHashes := sn.NextBlock(rand.Uint32() & 0x07)
+		for i := range adds {
+			if rand.Uint32()&0x03 == 0 {
+				adds[i].Remember = true
+				pinned[adds[i].Hash] = true
+			}
+		}
+
+		bp, err := fp.ProveBatch(delHashes)
+		if err != nil {
+			return err
+		}
+		err = p.IngestBatchProof(bp)
+		if err != nil {
+			return err
+		}
+		err = fp.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		err = p.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		for _, h := range delHashes {
+			delete(pinned, h)
+		}
+
+		var hs []Hash
+		for h := range pinned {
+			hs = append(hs, h)
+		}
+		want, err := fp.ProveBatch(hs)
+		if err != nil {
+			return err
+		}
+		got, err := p.ProveBatch(hs)
+		if err != nil {
+			return fmt.Errorf("block %d: %s", sn.blockHeight, err.Error())
+		}
+		if !reflect.DeepEqual(want, got) {
+			return fmt.Errorf("block %d: sparse proof %s, full proof %s",
+				sn.blockHeight, got.ToString(), want.ToString())
+		}
+		_, err = p.VerifyBatchProof(got)
+		if err != nil {
+			return fmt.Errorf("block %d: %s", sn.blockHeight, err.Error())
+		}
+	}
+	return nil
+}
+
+// TestPollardSparseProveMissing checks the error when a sparse pollard
+// can't prove something
+func TestPollardSparseProveMissing(t *testing.T) {
+	var p Pollard
+	adds := make([]Leaf, 8)
+	for i := range adds {
+		adds[i].Hash[0] = uint8(i + 1)
+		adds[i].Remember = i < 2
+	}
+	err := p.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bp, err := p.ProveBatch([]Hash{adds[1].Hash, adds[0].Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bp.Targets, []uint64{1, 0}) {
+		t.Fatalf("targets %v, expected [1 0]", bp.Targets)
+	}
+	_, err = p.VerifyBatchProof(bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// leaf 5 was never remembered
+	_, err = p.ProveBatch([]Hash{adds[0].Hash, adds[5].Hash})
+	merr, ok := err.(*MissingProofError)
+	if !ok {
+		t.Fatalf("expected MissingProofError, got %v", err)
+	}
+	if len(merr.Targets) != 1 || merr.Targets[0].Found ||
+		merr.Targets[0].Hash != adds[5].Hash {
+		t.Fatalf("wrong missing targets %+v", merr.Targets)
+	}
+
+	// lose the hash at 13, which leaf 0 needs
+	n, _, _, err := p.readPos(13)
+	if err != nil || n == nil {
+		t.Fatalf("no node at 13")
+	}
+	n.data = empty
+	_, err = p.ProveBatch([]Hash{adds[0].Hash})
+	merr, ok = err.(*MissingProofError)
+	if !ok {
+		t.Fatalf("expected MissingProofError, got %v", err)
+	}
+	if len(merr.Targets) != 1 || !merr.Targets[0].Found ||
+		merr.Targets[0].Position != 0 ||
+		!reflect.DeepEqual(merr.Targets[0].Missing, []uint64{13}) {
+		t.Fatalf("wrong missing targets %+v", merr.Targets)
+	}
+	t.Log(err.Error())
+}
+
+// TestPollardRememberLeaves ingests proofs for leaves that were already in
+// the pollard, remembers them, and checks they can still be proven blocks
+// later.
+func TestPollardRememberLeaves(t *testing.T) {
+	for z := 0; z < 10; z++ {
+		rand.Seed(int64(z))
+		err := pollardRememberLeaves(30)
+		if err != nil {
+			t.Fatalf("randseed %d: %s", z, err.Error())
+		}
+	}
+}
+
+func pollardRememberLeaves(blocks int32) error {
+	fp := NewFullPollard()
+	var p Pollard
+
+	// every leaf still there, and the ones p was told to remember later
+	var all []Hash
+	pinned := make(map[Hash]bool)
+
+	sn := NewSimChain(0x07)
+	sn.lookahead = 0
+	for b := int32(0); b < blocks; b++ {
+		adds, _, delHashes := sn.NextBlock(rand.Uint32() & 0x07)
+
+		bp, err := fp.ProveBatch(delHashes)
+		if err != nil {
+			return err
+		}
+		err = p.IngestBatchProof(bp)
+		if err != nil {
+			return err
+		}
+		err = fp.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		err = p.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		dels := make(map[Hash]bool)
+		for _, h := range delHashes {
+			dels[h] = true
+			delete(pinned, h)
+		}
+		left := all[:0]
+		for _, h := range all {
+			if !dels[h] {
+				left = append(left, h)
+			}
+		}
+		all = left
+		for _, a := range adds {
+			all = append(all, a.Hash)
+		}
+
+		// remember a leaf that's already there, and forget one.  With one
+		// leaf there's no proof.
+		if len(all) > 1 {
+			h := all[rand.Intn(len(all))]
+			bp, err := fp.ProveBatch([]Hash{h})
+			if err != nil {
+				return err
+			}
+			err = p.IngestBatchProof(bp)
+			if err != nil {
+				return err
+			}
+			marked, err := p.RememberLeaves(bp.Targets)
+			if err != nil {
+				return err
+			}
+			if len(marked) != 0 {
+				pinned[h] = true
+			}
+		}
+		for h := range pinned {
+			if rand.Uint32()&0x07 != 0 {
+				continue
+			}
+			bp, err := p.ProveBatch([]Hash{h})
+			if err != nil {
+				return err
+			}
+			err = p.ForgetLeaves(bp.Targets)
+			if err != nil {
+				return err
+			}
+			delete(pinned, h)
+			break
+		}
+
+		var hs []Hash
+		for h := range pinned {
+			hs = append(hs, h)
+		}
+		want, err := fp.ProveBatch(hs)
+		if err != nil {
+			return err
+		}
+		got, err := p.ProveBatch(hs)
+		if err != nil {
+			return fmt.Errorf("block %d: %s", sn.blockHeight, err.Error())
+		}
+		if !reflect.DeepEqual(want, got) {
+			return fmt.Errorf("block %d: sparse proof %s, full proof %s",
+				sn.blockHeight, got.ToString(), want.ToString())
+		}
+		if !reflect.DeepEqual(fp.GetRoots(), p.GetRoots()) {
+			return fmt.Errorf("block %d: roots don't match", sn.blockHeight)
+		}
+	}
+	return nil
+}
+
+// TestLeafMoves moves leaves with LeafMoves and checks they end up where a
+// full pollard has them, block after block.
+func TestLeafMoves(t *testing.T) {
+	for z := 0; z < 10; z++ {
+		rand.Seed(int64(z))
+		err := leafMoves(40)
+		if err != nil {
+			t.Fatalf("randseed %d: %s", z, err.Error())
+		}
+	}
+}
+
+func leafMoves(blocks int32) error {
+	fp := NewFullPollard()
+	// where each leaf is, moved only with LeafMoves
+	where := make(map[Hash]uint64)
+
+	sn := NewSimChain(0x07)
+	sn.lookahead = 0
+	for b := int32(0); b < blocks; b++ {
+		adds, _, delHashes := sn.NextBlock(rand.Uint32() & 0x07)
+		bp, err := fp.ProveBatch(delHashes)
+		if err != nil {
+			return err
+		}
+		for _, h := range delHashes {
+			delete(where, h)
+		}
+		var hs []Hash
+		var positions []uint64
+		for h, pos := range where {
+			hs = append(hs, h)
+			positions = append(positions, pos)
+		}
+		moved := LeafMoves(positions, bp.Targets, fp.numLeaves)
+		for i, h := range hs {
+			where[h] = moved[i]
+		}
+		// adds go on the end, after the deletions
+		firstAdd := fp.numLeaves - uint64(len(bp.Targets))
+		for i, a := range adds {
+			where[a.Hash] = firstAdd + uint64(i)
+		}
+
+		err = fp.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		for h, pos := range where {
+			if fp.positionMap[h.Mini()] != pos {
+				return fmt.Errorf("block %d: leaf %x at %d, LeafMoves says %d",
+					sn.blockHeight, h[:4], fp.positionMap[h.Mini()], pos)
+			}
+		}
+	}
+	return nil
+}
+
+// TestPollardProveAt keeps track of remembered leaves with LeafMoves and
+// proves them with ProveAt, which has to give what ProveBatch gives.
+func TestPollardProveAt(t *testing.T) {
+	for z := 0; z < 10; z++ {
+		rand.Seed(int64(z))
+		err := pollardProveAt(30)
+		if err != nil {
+			t.Fatalf("randseed %d: %s", z, err.Error())
+		}
+	}
+}
+
+func pollardProveAt(blocks int32) error {
+	fp := NewFullPollard()
+	var p Pollard
+	where := make(map[Hash]uint64)
+
+	sn := NewSimChain(0x07)
+	sn.lookahead = 0
+	for b := int32(0); b < blocks; b++ {
+		adds, _, delHashes := sn.NextBlock(rand.Uint32() & 0x07)
+		bp, err := fp.ProveBatch(delHashes)
+		if err != nil {
+			return err
+		}
+		err = p.IngestBatchProof(bp)
+		if err != nil {
+			return err
+		}
+		for _, h := range delHashes {
+			delete(where, h)
+		}
+		var hs []Hash
+		var positions []uint64
+		for h, pos := range where {
+			hs = append(hs, h)
+			positions = append(positions, pos)
+		}
+		moved := LeafMoves(positions, bp.Targets, p.numLeaves)
+		firstAdd := p.numLeaves - uint64(len(bp.Targets))
+		for i := range adds {
+			if rand.Uint32()&0x03 == 0 {
+				adds[i].Remember = true
+				hs = append(hs, adds[i].Hash)
+				moved = append(moved, firstAdd+uint64(i))
+			}
+		}
+		err = fp.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		err = p.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		for i, h := range hs {
+			where[h] = moved[i]
+		}
+
+		want, err := fp.ProveBatch(hs)
+		if err != nil {
+			return err
+		}
+		got, err := p.ProveAt(hs, moved)
+		if err != nil {
+			return fmt.Errorf("block %d: %s", sn.blockHeight, err.Error())
+		}
+		if !reflect.DeepEqual(want, got) {
+			return fmt.Errorf("block %d: ProveAt %s, ProveBatch %s",
+				sn.blockHeight, got.ToString(), want.ToString())
+		}
+	}
+	return nil
+}
+
+// TestPollardForgetOnlyMarked checks that RememberLeaves only gives back
+// leaves that weren't remembered yet, so forgetting those leaves the ones
+// remembered for other reasons alone.
+func TestPollardForgetOnlyMarked(t *testing.T) {
+	fp := NewFullPollard()
+	var p Pollard
+	adds := make([]Leaf, 8)
+	for i := range adds {
+		adds[i].Hash[0] = uint8(i + 1)
+		// like lookahead would
+		adds[i].Remember = i == 2
+	}
+	err := fp.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs := []Hash{adds[2].Hash, adds[5].Hash}
+	bp, err := fp.ProveBatch(hs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.IngestBatchProof(bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marked, err := p.RememberLeaves(bp.Targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(marked, []uint64{5}) {
+		t.Fatalf("marked %v, expected [5]", marked)
+	}
+	// again, nothing new
+	again, err := p.RememberLeaves(bp.Targets)
+	if err != nil || len(again) != 0 {
+		t.Fatalf("marked %v again, %v", again, err)
+	}
+
+	err = p.ForgetLeaves(marked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pos, want := range map[uint64]bool{2: true, 5: false} {
+		_, nsib, _, err := p.readPos(pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if remembered := nsib.niece[0] != nil; remembered != want {
+			t.Errorf("leaf %d remembered %v, expected %v",
+				pos, remembered, want)
+		}
+	}
+}
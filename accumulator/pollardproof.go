@@ -2,12 +2,33 @@ package accumulator
 
 import (
 	"fmt"
+	"strings"
 )
 
+// VerifiedProof is a BatchProof that's been checked against the roots of a
+// Pollard.  It holds the partial proof tree that verifyBatchProof computed
+// so that the Pollard can be populated later without hashing again.
+type VerifiedProof struct {
+	trees      [][3]node
+	roots      []node
+	rootHashes []Hash
+	numLeaves  uint64
+}
+
 // IngestBatchProof populates the Pollard with all needed data to delete the
 // targets in the block proof
 func (p *Pollard) IngestBatchProof(bp BatchProof) error {
-	// verify the batch proof.
+	vp, err := p.VerifyBatchProof(bp)
+	if err != nil {
+		return err
+	}
+	return p.PopulateBatchProof(vp)
+}
+
+// VerifyBatchProof checks a batch proof against the Pollard's roots and any
+// cached nodes.  It doesn't change the Pollard at all, so a bad proof can be
+// thrown out before anything else is done with the block.
+func (p *Pollard) VerifyBatchProof(bp BatchProof) (*VerifiedProof, error) {
 	rootHashes := p.rootHashesReverse()
 	ok, trees, roots := verifyBatchProof(bp, rootHashes, p.numLeaves,
 		// pass a closure that checks the pollard for cached nodes.
@@ -25,21 +46,80 @@ func (p *Pollard) IngestBatchProof(bp BatchProof) error {
 			return false, empty
 		})
 	if !ok {
-		return fmt.Errorf("block proof mismatch")
+		return nil, fmt.Errorf("block proof mismatch")
+	}
+	return &VerifiedProof{
+		trees:      trees,
+		roots:      roots,
+		rootHashes: rootHashes,
+		numLeaves:  p.numLeaves,
+	}, nil
+}
+
+// PopulateBatchProof fills in the Pollard with the nodes of a proof that
+// VerifyBatchProof said was OK.  The Pollard can't have been modified in
+// between.
+func (p *Pollard) PopulateBatchProof(vp *VerifiedProof) error {
+	if vp.numLeaves != p.numLeaves {
+		return fmt.Errorf("proof verified at %d leaves but pollard has %d",
+			vp.numLeaves, p.numLeaves)
 	}
 	// preallocating polNodes helps with garbage collection
-	polNodes := make([]polNode, len(trees)*3)
+	polNodes := make([]polNode, len(vp.trees)*3)
 	i := 0
 	nodesAllocated := 0
-	for _, root := range roots {
-		for root.Val != rootHashes[i] {
+	for _, root := range vp.roots {
+		for root.Val != vp.rootHashes[i] {
 			i++
 		}
 		// populate the pollard
 		nodesAllocated += p.populate(p.roots[len(p.roots)-i-1], root.Pos,
-			trees, polNodes[nodesAllocated:])
+			vp.trees, polNodes[nodesAllocated:])
+	}
+
+	return nil
+}
+
+// RememberLeaves makes the pollard remember the leaves at the given
+// positions, as if they were added with Remember set, so it keeps them and
+// can prove them later.  Their proofs have to be in the pollard already,
+// after PopulateBatchProof.  It gives the positions of the leaves that
+// weren't remembered already, which are the ones to give ForgetLeaves to
+// undo it.
+func (p *Pollard) RememberLeaves(targets []uint64) ([]uint64, error) {
+	var marked []uint64
+	for _, pos := range targets {
+		// the remember marker goes on the sibling
+		_, nsib, _, err := p.readPos(pos)
+		if err != nil {
+			return nil, err
+		}
+		if nsib == nil || nsib.data == empty {
+			return nil, fmt.Errorf("can't remember %d, pollard doesn't "+
+				"have its sibling", pos)
+		}
+		if nsib.niece[0] == nil {
+			nsib.niece[0] = nsib
+			marked = append(marked, pos)
+		}
 	}
+	return marked, nil
+}
 
+// ForgetLeaves undoes RememberLeaves.  It takes the marker off whatever the
+// reason it was put there, so only give it positions RememberLeaves gave
+// back (moved along with the leaves since, see LeafMoves).  The nodes stay
+// around until they get pruned as the pollard is modified.
+func (p *Pollard) ForgetLeaves(targets []uint64) error {
+	for _, pos := range targets {
+		_, nsib, _, err := p.readPos(pos)
+		if err != nil {
+			return err
+		}
+		if nsib != nil {
+			nsib.niece[0] = nil
+		}
+	}
 	return nil
 }
 
@@ -101,3 +181,264 @@ func (p *Pollard) populate(root *polNode, pos uint64, trees [][3]node, polNodes
 	}
 	return nodesAllocated
 }
+
+/*
+A sparse pollard (no positionMap) can still prove the leaves it remembers:
+the ones added with Remember, and any leaf whose sibling is remembered, as
+then it's there too.  That's the CSN's own utxos and whatever else it caches,
+so it can give proofs to others.
+
+There's no map from hash to position, so the leaves get looked for in the
+pollard.  The node of a remembered leaf usually gets pruned; what stays is
+its sibling, with a remember marker as niece.  So each wanted hash is tried
+at every remembered position by hashing it up with the siblings the pollard
+has, until it gets to a node the pollard has to compare with.  That's slow
+with a big pollard but fine for a few leaves.
+*/
+
+// MissingProofError is the error from ProveBatch on a sparse pollard that
+// doesn't have everything needed.  It lists each target that can't be
+// proven.
+type MissingProofError struct {
+	Targets []MissingTarget
+}
+
+// MissingTarget is a leaf ProveBatch couldn't prove and why.
+type MissingTarget struct {
+	Hash Hash
+	// false if the pollard doesn't remember the leaf at all
+	Found    bool
+	Position uint64
+	// positions of proof hashes for this leaf the pollard doesn't have
+	Missing []uint64
+}
+
+func (e *MissingProofError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "can't prove %d leaves:", len(e.Targets))
+	for _, t := range e.Targets {
+		if !t.Found {
+			fmt.Fprintf(&b, " %x not remembered;", t.Hash[:4])
+			continue
+		}
+		fmt.Fprintf(&b, " %x@%d missing %v;", t.Hash[:4], t.Position,
+			t.Missing)
+	}
+	return strings.TrimSuffix(b.String(), ";")
+}
+
+// proveSparse is ProveBatch for a pollard without a positionMap.  If
+// anything's missing it gives a *MissingProofError with all the targets
+// that couldn't be proven.
+func (p *Pollard) proveSparse(hs []Hash) (BatchProof, error) {
+	var missingErr MissingProofError
+	found := p.findLeaves(hs)
+	targets := make([]uint64, 0, len(hs))
+	foundHashes := make([]Hash, 0, len(hs))
+	for _, h := range hs {
+		pos, ok := found[h]
+		if !ok {
+			missingErr.Targets = append(missingErr.Targets,
+				MissingTarget{Hash: h})
+			continue
+		}
+		targets = append(targets, pos)
+		foundHashes = append(foundHashes, h)
+	}
+	return p.proveTargets(foundHashes, targets, missingErr)
+}
+
+// ProveAt is ProveBatch for leaves whose positions are already known, like
+// ones kept up to date with LeafMoves, so a sparse pollard doesn't have to
+// look for them.  hs[i] has to be the leaf at targets[i], or the proof
+// won't verify.
+func (p *Pollard) ProveAt(hs []Hash, targets []uint64) (BatchProof, error) {
+	if len(hs) != len(targets) {
+		return BatchProof{}, fmt.Errorf("%d hashes but %d targets",
+			len(hs), len(targets))
+	}
+	if len(hs) == 0 || p.numLeaves < 2 {
+		return BatchProof{}, nil
+	}
+	return p.proveTargets(hs, targets, MissingProofError{})
+}
+
+// proveTargets proves the leaves hs at targets with what the pollard has.
+// missingErr has the targets that were already found to be missing.
+func (p *Pollard) proveTargets(hs []Hash, targets []uint64,
+	missingErr MissingProofError) (BatchProof, error) {
+
+	var bp BatchProof
+	bp.Targets = make([]uint64, len(targets))
+	copy(bp.Targets, targets)
+	targetHashes := make(map[uint64]Hash, len(hs))
+	for i, pos := range targets {
+		targetHashes[pos] = hs[i]
+	}
+
+	sortedTargets := make([]uint64, len(bp.Targets))
+	copy(sortedTargets, bp.Targets)
+	sortUint64s(sortedTargets)
+	forestRows := p.rows()
+	proofPositions, _ := ProofPositions(sortedTargets, p.numLeaves, forestRows)
+	targetsAndProof := mergeSortedSlices(proofPositions, sortedTargets)
+
+	bp.Proof = make([]Hash, len(targetsAndProof))
+	missing := make(map[uint64]bool)
+	for i, pos := range targetsAndProof {
+		// the pollard doesn't always have the targets themselves, but we
+		// already know what they are
+		if h, ok := targetHashes[pos]; ok {
+			bp.Proof[i] = h
+			continue
+		}
+		// read doesn't work here as grabPos hooks in empty nodes
+		n, _, _, err := p.readPos(pos)
+		if err != nil || n == nil || n.data == empty {
+			missing[pos] = true
+			continue
+		}
+		bp.Proof[i] = n.data
+	}
+
+	// say which targets each missing position is for
+	if len(missing) != 0 {
+		for _, pos := range bp.Targets {
+			own, _ := ProofPositions([]uint64{pos}, p.numLeaves, forestRows)
+			var lacks []uint64
+			for _, ownPos := range own {
+				if missing[ownPos] {
+					lacks = append(lacks, ownPos)
+				}
+			}
+			if len(lacks) != 0 {
+				missingErr.Targets = append(missingErr.Targets, MissingTarget{
+					Hash: targetHashes[pos], Found: true, Position: pos,
+					Missing: lacks})
+			}
+		}
+	}
+	if len(missingErr.Targets) != 0 {
+		return BatchProof{}, &missingErr
+	}
+
+	if verbose {
+		fmt.Printf("blockproof targets: %v\n", bp.Targets)
+	}
+	return bp, nil
+}
+
+// rememberedLeaf is where the pollard remembers a leaf and the hash of that
+// leaf's sibling
+type rememberedLeaf struct {
+	pos uint64
+	sib Hash
+}
+
+// leafSearch is what findLeaves keeps track of as it goes through the
+// pollard
+type leafSearch struct {
+	want       map[Hash]bool
+	found      map[Hash]uint64
+	remembered []rememberedLeaf
+}
+
+// findLeaves looks through the pollard for the leaves in hs and gives the
+// positions of the ones it has.
+func (p *Pollard) findLeaves(hs []Hash) map[Hash]uint64 {
+	s := leafSearch{
+		want:  make(map[Hash]bool, len(hs)),
+		found: make(map[Hash]uint64, len(hs)),
+	}
+	for _, h := range hs {
+		s.want[h] = true
+	}
+	rows := rootRows(p.numLeaves)
+	var start uint64 // first leaf position of the tree
+	for i, root := range p.roots {
+		if rows[i] == 0 {
+			// a single leaf tree; the root is the leaf
+			if s.want[root.data] {
+				s.found[root.data] = start
+			}
+		} else {
+			p.walkLeaves(root, rows[i]-1, 0, rows[i], start, &s)
+		}
+		start += 1 << rows[i]
+	}
+
+	for _, r := range s.remembered {
+		for _, h := range hs {
+			if _, ok := s.found[h]; ok {
+				continue
+			}
+			if p.leafAt(h, r) {
+				s.found[h] = r.pos
+				break
+			}
+		}
+	}
+	return s.found
+}
+
+// walkLeaves goes down from n the same way readPos does, building up the
+// bits that readPos would use.  Leaves that are there get compared to what
+// we want right away; ones that are only remembered get appended to
+// s.remembered.  h is the bit n's nieces are picked with.
+func (p *Pollard) walkLeaves(n *polNode, h uint8, bits uint64,
+	treeRows uint8, start uint64, s *leafSearch) {
+
+	for lr := uint64(0); lr < 2; lr++ {
+		next := n.niece[lr]
+		if next == nil {
+			continue
+		}
+		if h != 0 {
+			p.walkLeaves(next, h-1, bits|lr<<h, treeRows, start, s)
+			continue
+		}
+		if next.data == empty {
+			continue
+		}
+		// on row 0 readPos takes the sibling of what the bit says, and bits
+		// from detectOffset are the position within the tree, flipped
+		offset := ^(bits | (lr ^ 1)) & (1<<treeRows - 1)
+		if s.want[next.data] {
+			s.found[next.data] = start + offset
+		}
+		// a remember marker on a leaf means its sibling is remembered
+		if next.niece[0] != nil {
+			s.remembered = append(s.remembered, rememberedLeaf{
+				pos: (start + offset) ^ 1,
+				sib: next.data,
+			})
+		}
+	}
+}
+
+// leafAt tells if h is the remembered leaf r.  It hashes h up until it gets
+// to a node the pollard has, and compares with that.
+func (p *Pollard) leafAt(h Hash, r rememberedLeaf) bool {
+	forestRows := p.rows()
+	pos, sib := r.pos, r.sib
+	for row := uint8(0); row < forestRows; row++ {
+		if pos&1 == 0 {
+			h = parentHash(h, sib)
+		} else {
+			h = parentHash(sib, h)
+		}
+		pos = parent(pos, forestRows)
+		n, nsib, _, err := p.readPos(pos)
+		if err != nil {
+			return false
+		}
+		if n != nil && n.data != empty {
+			return n.data == h
+		}
+		if nsib == nil || nsib.data == empty {
+			return false
+		}
+		sib = nsib.data
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package accumulator
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"fmt"
@@ -94,45 +95,189 @@ func (p *Pollard) rootHashesReverse() []Hash {
 }
 
 //  ------------------ pollard serialization
-// currently saving /restoring pollard to disk only does the roots.
-// so you lose all the caching
-// TODO have the option to save restore sparse pollards.  Could use the same
-// idea as verifyBatchProof
+// The whole sparse pollard gets saved, cached nodes and remember markers
+// included, so a restarted node doesn't have to refill its cache.
 
-// current serialization is just 8byte numleaves, followed by all the hashes
-// (in small to big order)
+/*
+Pollard serialization is:
+4 bytes magic "pol" + version (1)
+8 bytes numLeaves
+then for each root, big to small, the tree under it in preorder:
+  32 bytes hash
+  1 byte flags: bit 0 set if niece[0] is there, bit 1 if niece[1] is
+  then the niece[0] subtree, then the niece[1] subtree (if they're there)
+On row 0 the nieces are just the remember markers and have no subtrees.
+When restoring, markers come back as pointers to the node itself.
 
-// WritePollard writes the numLeaves field and only the roots into the given writer.
-// Cached leaves are not included in the writer
+The old format without the magic was just numLeaves and the root hashes.
+RestorePollard can still read that; numLeaves always starts with a 0 byte
+so it can't be mistaken for the magic.
+*/
+
+// pollardMagic starts a serialized pollard.  Last byte is the version
+var pollardMagic = [4]byte{'p', 'o', 'l', 0x01}
+
+// nieces that are there, in the flags byte
+const (
+	niece0Flag = 1 << iota
+	niece1Flag
+)
+
+// polStackElem is a node to serialize / deserialize and its row
+type polStackElem struct {
+	node *polNode
+	slot **polNode // where to put the node when deserializing
+	row  uint8
+}
+
+// rootRows gives the rows of the roots of a forest with numLeaves leaves,
+// big to small, same as the roots slice
+func rootRows(numLeaves uint64) []uint8 {
+	_, rows := getRootsReverse(numLeaves, treeRows(numLeaves))
+	for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+		rows[i], rows[j] = rows[j], rows[i]
+	}
+	return rows
+}
+
+// WritePollard writes the whole pollard, including cached nodes, into the
+// given writer.
 func (p *Pollard) WritePollard(w io.Writer) error {
-	var err error
-	err = binary.Write(w, binary.BigEndian, p.numLeaves)
+	bw := bufio.NewWriter(w)
+	_, err := bw.Write(pollardMagic[:])
 	if err != nil {
 		return err
 	}
-	for _, t := range p.roots {
-		_, err = w.Write(t.data[:])
-		if err != nil {
-			return err
+	err = binary.Write(bw, binary.BigEndian, p.numLeaves)
+	if err != nil {
+		return err
+	}
+
+	rows := rootRows(p.numLeaves)
+	if len(rows) != len(p.roots) {
+		return fmt.Errorf("%d leaves but %d roots", p.numLeaves, len(p.roots))
+	}
+	var stack []polStackElem
+	for i, root := range p.roots {
+		stack = append(stack, polStackElem{node: root, row: rows[i]})
+		for len(stack) > 0 {
+			elem := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			var flags byte
+			if elem.node.niece[0] != nil {
+				flags |= niece0Flag
+			}
+			if elem.node.niece[1] != nil {
+				flags |= niece1Flag
+			}
+			_, err = bw.Write(elem.node.data[:])
+			if err != nil {
+				return err
+			}
+			err = bw.WriteByte(flags)
+			if err != nil {
+				return err
+			}
+			if elem.row == 0 {
+				// nieces are only markers here
+				continue
+			}
+			// push niece[1] first so niece[0] comes out first
+			for j := 1; j >= 0; j-- {
+				if elem.node.niece[j] != nil {
+					stack = append(stack,
+						polStackElem{node: elem.node.niece[j], row: elem.row - 1})
+				}
+			}
 		}
 	}
-	return nil
+	return bw.Flush()
 }
 
-// RestorePollard restores the pollard from the given reader
+// RestorePollard restores the pollard from the given reader.  If the
+// pollard has a position map (from NewFullPollard) it gets rebuilt.
+// It does lots of small reads, so give it something buffered.
 func (p *Pollard) RestorePollard(r io.Reader) error {
-	err := binary.Read(r, binary.BigEndian, &p.numLeaves)
+	var start [8]byte
+	_, err := io.ReadFull(r, start[:4])
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(start[:4], pollardMagic[:]) {
+		// old format; those 4 bytes were the start of numLeaves
+		_, err = io.ReadFull(r, start[4:])
+		if err != nil {
+			return err
+		}
+		p.numLeaves = binary.BigEndian.Uint64(start[:])
+		return p.restoreRoots(r)
+	}
+
+	err = binary.Read(r, binary.BigEndian, &p.numLeaves)
 	if err != nil {
 		return err
 	}
 
+	rows := rootRows(p.numLeaves)
+	p.roots = make([]*polNode, len(rows))
+	var stack []polStackElem
+	var flagBuf [1]byte
+	for i := range p.roots {
+		stack = append(stack, polStackElem{slot: &p.roots[i], row: rows[i]})
+		for len(stack) > 0 {
+			elem := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			n := new(polNode)
+			_, err = io.ReadFull(r, n.data[:])
+			if err != nil {
+				return err
+			}
+			_, err = io.ReadFull(r, flagBuf[:])
+			if err != nil {
+				return err
+			}
+			flags := flagBuf[0]
+			*elem.slot = n
+			if elem.row == 0 {
+				// markers point to the node itself
+				if flags&niece0Flag != 0 {
+					n.niece[0] = n
+				}
+				if flags&niece1Flag != 0 {
+					n.niece[1] = n
+				}
+				continue
+			}
+			if flags&niece1Flag != 0 {
+				stack = append(stack,
+					polStackElem{slot: &n.niece[1], row: elem.row - 1})
+			}
+			if flags&niece0Flag != 0 {
+				stack = append(stack,
+					polStackElem{slot: &n.niece[0], row: elem.row - 1})
+			}
+		}
+	}
+
+	if p.positionMap != nil {
+		p.positionMap = make(map[MiniHash]uint64)
+		for i := uint64(0); i < p.numLeaves; i++ {
+			p.positionMap[p.read(i).Mini()] = i
+		}
+	}
+	return nil
+}
+
+// restoreRoots reads the roots of the old roots only format
+func (p *Pollard) restoreRoots(r io.Reader) error {
 	p.roots = make([]*polNode, numRoots(p.numLeaves))
 	fmt.Printf("%d leaves %d roots ", p.numLeaves, len(p.roots))
 	for i, _ := range p.roots {
 		p.roots[i] = new(polNode)
-		bytesRead, err := r.Read(p.roots[i].data[:])
-		// ignore EOF error at the end of successful reading
-		if err != nil && !(bytesRead == 32 && err == io.EOF) {
+		bytesRead, err := io.ReadFull(r, p.roots[i].data[:])
+		if err != nil {
 			s := fmt.Errorf("err: %v on hash %d read %d", err, i, bytesRead)
 			return s
 		}
@@ -140,51 +285,34 @@ func (p *Pollard) RestorePollard(r io.Reader) error {
 	return nil
 }
 
-// Serialize serializes the numLeaves field and only the roots into a byte slice.
-// Cached leaves are not included in the byte slice
-func (p *Pollard) Serialize() ([]byte, error) {
-	size := 8 + len(p.roots) // 8 for uint64 numLeaves
-	serialized := make([]byte, 0, size)
-
-	buf := bytes.NewBuffer(serialized)
+// NewPollardFromRoots gives a Pollard with the given roots and nothing cached.
+// Roots go biggest tree first, same as GetRoots gives them.
+func NewPollardFromRoots(roots []Hash, numLeaves uint64) (Pollard, error) {
+	var p Pollard
+	if len(roots) != int(numRoots(numLeaves)) {
+		return p, fmt.Errorf("%d leaves need %d roots but got %d",
+			numLeaves, numRoots(numLeaves), len(roots))
+	}
+	p.numLeaves = numLeaves
+	p.roots = make([]*polNode, len(roots))
+	for i, r := range roots {
+		p.roots[i] = &polNode{data: r}
+	}
+	return p, nil
+}
 
-	err := binary.Write(buf, binary.BigEndian, p.numLeaves)
+// Serialize serializes the whole pollard into a byte slice, same as
+// WritePollard.
+func (p *Pollard) Serialize() ([]byte, error) {
+	var buf bytes.Buffer
+	err := p.WritePollard(&buf)
 	if err != nil {
 		return nil, err
 	}
-
-	for _, t := range p.roots {
-		_, err = buf.Write(t.data[:])
-		if err != nil {
-			return nil, err
-		}
-	}
-
 	return buf.Bytes(), nil
 }
 
-// Deserialize decodes the bytes into a Pollard
+// Deserialize decodes the bytes into a Pollard, same as RestorePollard
 func (p *Pollard) Deserialize(serialized []byte) error {
-	reader := bytes.NewReader(serialized)
-
-	err := binary.Read(reader, binary.BigEndian, &p.numLeaves)
-	if err != nil {
-		return err
-	}
-	fmt.Println(p.numLeaves)
-
-	p.roots = make([]*polNode, numRoots(p.numLeaves))
-
-	for i, _ := range p.roots {
-		p.roots[i] = new(polNode)
-		bytesRead, err := reader.Read(p.roots[i].data[:])
-
-		// ignore EOF error at the end of successful reading
-		if err != nil && !(bytesRead == 32 && err == io.EOF) {
-			s := fmt.Errorf("err: %v on hash %d read %d", err, i, bytesRead)
-			return s
-		}
-	}
-
-	return nil
+	return p.RestorePollard(bytes.NewReader(serialized))
 }
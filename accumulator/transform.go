@@ -241,3 +241,42 @@ func floorTransform(
 	}
 	return floor
 }
+
+// LeafMoves gives where the leaves at positions end up after the leaves at
+// dels are deleted from a forest with numLeaves leaves.  The leaves get
+// moved along with the nodes above them, same as in Modify.  Adding leaves
+// doesn't move any, so it's also where they are after a whole block.  None
+// of positions can be in dels.
+func LeafMoves(positions, delsUn []uint64, numLeaves uint64) []uint64 {
+	moved := make([]uint64, len(positions))
+	copy(moved, positions)
+	if len(delsUn) == 0 {
+		return moved
+	}
+	dels := make([]uint64, len(delsUn))
+	copy(dels, delsUn)
+	sortUint64s(dels)
+
+	forestRows := treeRows(numLeaves)
+	swapRows := remTrans2(dels, numLeaves, forestRows)
+	for r, row := range swapRows {
+		h := uint8(r)
+		for _, a := range row {
+			if a.from == a.to {
+				continue
+			}
+			for i, pos := range moved {
+				// the leaf's offset under the node at row h stays the same
+				above := parentMany(pos, h, forestRows)
+				offset := pos - childMany(above, h, forestRows)
+				switch above {
+				case a.from:
+					moved[i] = childMany(a.to, h, forestRows) + offset
+				case a.to:
+					moved[i] = childMany(a.from, h, forestRows) + offset
+				}
+			}
+		}
+	}
+	return moved
+}
@@ -0,0 +1,149 @@
+package bridgenode
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/utreexo/util"
+)
+
+/*
+BuildProofs doesn't care where blocks come from, as long as they come in
+order with the rev data for them.  Anything that can do that is a
+BlockSource.  The one used by default is blkRevSource, which reads
+bitcoind's blk*.dat and rev*.dat files through the offset file.  Others can
+be put in Config.Source; MemBlockSource is a chain held in memory.
+
+Sources that don't have rev blocks can leave Rev empty, as long as the
+bridge node is run with -norev so it doesn't need them.
+*/
+
+// BlockSource gives blocks along with their rev blocks, in height order
+type BlockSource interface {
+	// TipHeight is the height after the last block the source has, so
+	// blocks up to but not including it can be read.
+	TipHeight() (int32, error)
+
+	// ReadBlocks sends the blocks from curHeight up to but not including
+	// maxHeight to blockChan, in order.  It returns once they're all sent,
+	// or on the first error.
+	ReadBlocks(blockChan chan BlockAndRev, curHeight, maxHeight int32) error
+}
+
+// blkRevSource reads bitcoind's blk and rev files, using the offset file to
+// find blocks by height
+type blkRevSource struct {
+	cfg *Config
+	// the height after the last block in the offset file
+	tip int32
+	// if bitcoind is pruned, and which blocks are left
+	prune pruneInfo
+}
+
+// newBlkRevSource gets the offset file ready, indexing the blk files if
+// it's not there yet, or just the blocks added since if it is.
+// offsetFinished gets a true once the offset file is usable.
+func newBlkRevSource(
+	cfg *Config, offsetFinished chan bool) (*blkRevSource, error) {
+
+	// If there's an offset file and the state saying how far it got, only
+	// the new blocks need indexing.  Offset files from before there was a
+	// state are made anew.
+	var tip int32
+	var err error
+	if util.HasAccess(cfg.UtreeDir.OffsetDir.OffsetFile) &&
+		util.HasAccess(cfg.UtreeDir.OffsetDir.offsetStateFile) {
+		// what's there is good, so don't remove it if interrupted
+		offsetFinished <- true
+		fmt.Println("Indexing offset for new blocks in blk*.dat files...")
+		tip, err = updateOffsetFile(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("updateOffsetFile error: %s", err.Error())
+		}
+		fmt.Printf("tip height %d\n", tip)
+	} else {
+		fmt.Println("Offsetfile not present or half present. " +
+			"Indexing offset for blocks blk*.dat files...")
+		tip, err = createOffsetData(cfg, offsetFinished)
+		if err != nil {
+			return nil, fmt.Errorf("createOffsetData error: %s", err.Error())
+		}
+		fmt.Printf("tip height %d\n", tip)
+	}
+
+	pi, err := readPruneInfoFromDir(cfg.BlockDir)
+	if err != nil {
+		return nil, err
+	}
+	if pi.pruned {
+		fmt.Printf("bitcoind in %s is pruned, blocks before %d are gone\n",
+			cfg.BlockDir, pi.firstHeight)
+	}
+	return &blkRevSource{cfg: cfg, tip: tip, prune: pi}, nil
+}
+
+// TipHeight is the height the offset file was built up to
+func (s *blkRevSource) TipHeight() (int32, error) {
+	return s.tip, nil
+}
+
+// ReadBlocks reads blocks from disk with GetRawBlocksFromDisk, as many as
+// are in one blk file at a time
+func (s *blkRevSource) ReadBlocks(
+	blockChan chan BlockAndRev, curHeight, maxHeight int32) error {
+
+	err := s.prune.check(s.cfg.BlockDir, curHeight)
+	if err != nil {
+		return err
+	}
+	offsetFilePath := s.cfg.UtreeDir.OffsetDir.OffsetFile
+	for curHeight < maxHeight {
+		blocks, revs, err := GetRawBlocksFromDisk(
+			curHeight, 100000, offsetFilePath, s.cfg.BlockDir)
+		if err != nil {
+			return err
+		}
+		if len(blocks) == 0 {
+			return fmt.Errorf("no block %d in %s", curHeight, s.cfg.BlockDir)
+		}
+
+		for i := 0; i < len(blocks) && curHeight < maxHeight; i++ {
+			blockChan <- BlockAndRev{
+				Height: curHeight,
+				Blk:    blocks[i],
+				Rev:    revs[i],
+			}
+			curHeight++
+		}
+	}
+	return nil
+}
+
+// MemBlockSource is a chain held in memory, for tests or blocks made up on
+// the spot.  Blocks[0] is block 1, as block 0 doesn't go in the forest.
+type MemBlockSource struct {
+	Blocks []BlockAndRev
+}
+
+// TipHeight is the height after the last block in Blocks
+func (s *MemBlockSource) TipHeight() (int32, error) {
+	return int32(len(s.Blocks)) + 1, nil
+}
+
+// ReadBlocks sends blocks out of Blocks, setting their heights
+func (s *MemBlockSource) ReadBlocks(
+	blockChan chan BlockAndRev, curHeight, maxHeight int32) error {
+
+	if curHeight < 1 {
+		return fmt.Errorf("block %d isn't in a MemBlockSource", curHeight)
+	}
+	for ; curHeight < maxHeight; curHeight++ {
+		if int(curHeight) > len(s.Blocks) {
+			return fmt.Errorf("MemBlockSource has %d blocks, asked for %d",
+				len(s.Blocks), curHeight)
+		}
+		bnr := s.Blocks[curHeight-1]
+		bnr.Height = curHeight
+		blockChan <- bnr
+	}
+	return nil
+}
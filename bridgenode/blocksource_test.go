@@ -0,0 +1,45 @@
+package bridgenode
+
+import "testing"
+
+func TestMemBlockSource(t *testing.T) {
+	tc := newTestChain()
+	tc.extend(10)
+	src := &MemBlockSource{}
+	for _, bnr := range tc.blocks {
+		// the heights come from where they are in Blocks
+		bnr.Height = 0
+		src.Blocks = append(src.Blocks, bnr)
+	}
+	tip, err := src.TipHeight()
+	if err != nil || tip != 11 {
+		t.Fatalf("tip %d %v with 10 blocks, expected 11", tip, err)
+	}
+
+	blockChan := make(chan BlockAndRev, 10)
+	err = src.ReadBlocks(blockChan, 3, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(blockChan)
+	h := int32(3)
+	for bnr := range blockChan {
+		if bnr.Height != h ||
+			bnr.Blk.BlockHash() != tc.blocks[h-1].Blk.BlockHash() {
+			t.Fatalf("got block %d %s, expected %d %s", bnr.Height,
+				bnr.Blk.BlockHash(), h, tc.blocks[h-1].Blk.BlockHash())
+		}
+		h++
+	}
+	if h != 8 {
+		t.Fatalf("read up to block %d, expected 7", h-1)
+	}
+
+	// past the tip, or block 0
+	for _, r := range [][2]int32{{9, 12}, {0, 2}} {
+		err = src.ReadBlocks(make(chan BlockAndRev, 10), r[0], r[1])
+		if err == nil {
+			t.Fatalf("read blocks %d to %d of 10", r[0], r[1]-1)
+		}
+	}
+}
@@ -0,0 +1,460 @@
+package bridgenode
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+/*
+The bridge node keeps its state in a bunch of files that are written at
+different times: the forest, miscforestfile, the height file, the proof
+files, proofoffset.dat and the ttldb.  After a crash they can all be at
+different heights.  A checkpoint syncs all of them to the same height and
+then writes checkpoint.dat, which says what that height is.
+
+checkpoint.dat is:
+4 bytes magic "bnc" + version (3)
+4 bytes height (the next block to process)
+8 bytes numLeaves of the forest
+1 byte forest rows
+8 bytes where the proofs end: 4 bytes proof file, 4 bytes size of that file
+32 bytes hash of the block before height, all zeros if it's not known
+32 bytes sha256 of everything before it
+
+The block hash is so that on resuming, BuildProofs can check that the next
+block from the BlockSource still builds on the last one it did.  If the
+chain reorged below the tip (over RPC, or in the blk files) it's an error.
+Version 2 doesn't have the block hash, so the first block after resuming
+isn't checked.  Version 1 has the size of proof.dat instead of where the
+proofs end, from before the proofs were split into files.
+migrateProofFile turns it into version 3.
+
+It's written with util.WriteFileAtomic so a crash leaves either the old
+checkpoint or the new one.
+
+On startup anything past the checkpoint is thrown away: the proof files and
+proofoffset.dat are truncated back and the blocks after it are processed
+again.  The ttldb doesn't need truncating as DbWorker only deletes once a
+checkpoint is written (a few checkpoints later, see checkpointundo.go), and
+doing a block over again only rewrites the same entries.  It records the
+height it's synced to under ttldbHeightKey.  The leafdb, with -norev, works
+the same way.
+
+The forest is the hard part.  A ram forest is only written to disk at
+checkpoints so it always matches.  The disk, cache and cow forests keep
+their changes in ram with a journal (see accumulator/forestjournal.go), so
+that on disk they stay at the last checkpoint.  (The ram forest has a
+journal too, for the undo files in checkpointundo.go.)  So that the journal
+doesn't outgrow the ram, BuildProofs also makes a checkpoint once it has
+maxJournalSize changes.  At a checkpoint the journal is written to
+forestjournal.dat first, then checkpoint.dat, then the changes go into the
+forest and forestjournal.dat is removed.  On startup a
+forestjournal.dat for the height in checkpoint.dat is replayed, as the
+forest may be partway through taking it in.  One for another height is from
+a checkpoint that never got written, and is thrown away.
+
+forestjournal.dat is:
+4 bytes magic "bfj" + version (1)
+4 bytes height of the checkpoint it's for
+the forest journal
+32 bytes sha256 of everything before it
+
+miscforestfile is written after checkpoint.dat, and on startup it's
+written again from checkpoint.dat in case it didn't get there.
+*/
+
+// checkpointMagic starts checkpoint.dat.  Last byte is the version
+var checkpointMagic = [4]byte{'b', 'n', 'c', 0x03}
+
+// forestJournalMagic starts forestjournal.dat.  Last byte is the version
+var forestJournalMagic = [4]byte{'b', 'f', 'j', 0x01}
+
+// bridgeCheckpoint is one height that all the bridge node files agree on
+type bridgeCheckpoint struct {
+	height    int32 // next block to process
+	numLeaves uint64
+	rows      uint8
+	proofEnd  proofPos       // where the proof for height goes
+	tipHash   chainhash.Hash // block before height, zero if not known
+
+	// version 1 checkpoints have the size of proof.dat instead of proofEnd
+	oldProofs    bool
+	oldProofSize int64
+}
+
+// serialize gives the checkpoint.dat bytes, checksum included
+func (cp *bridgeCheckpoint) serialize() []byte {
+	var buf bytes.Buffer
+	buf.Write(checkpointMagic[:])
+	// writes to a bytes.Buffer can't fail
+	binary.Write(&buf, binary.BigEndian, cp.height)
+	binary.Write(&buf, binary.BigEndian, cp.numLeaves)
+	binary.Write(&buf, binary.BigEndian, cp.rows)
+	end := cp.proofEnd.bytes()
+	buf.Write(end[:])
+	buf.Write(cp.tipHash[:])
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+	return buf.Bytes()
+}
+
+// checkpointSize gives how many bytes checkpoint.dat is for version
+func checkpointSize(version byte) int {
+	if version < 3 {
+		return 4 + 4 + 8 + 1 + 8 + sha256.Size
+	}
+	return 4 + 4 + 8 + 1 + 8 + 32 + sha256.Size
+}
+
+// readCheckpoint reads checkpoint.dat.  ok is false if there isn't one,
+// which is the case for datadirs from before checkpoints existed.
+func readCheckpoint(cfg *Config) (cp bridgeCheckpoint, ok bool, err error) {
+	name := cfg.UtreeDir.ForestDir.checkpointFile
+	if !util.HasAccess(name) {
+		return
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return
+	}
+	cp, err = parseCheckpoint(b, name)
+	ok = err == nil
+	return
+}
+
+// parseCheckpoint parses the bytes of checkpoint.dat, which came from name
+func parseCheckpoint(b []byte, name string) (cp bridgeCheckpoint, err error) {
+	if len(b) < 4 || len(b) != checkpointSize(b[3]) ||
+		!bytes.Equal(b[:3], checkpointMagic[:3]) {
+		err = fmt.Errorf("%s is not a checkpoint file", name)
+		return
+	}
+	payload := b[:len(b)-sha256.Size]
+	sum := sha256.Sum256(payload)
+	if !bytes.Equal(sum[:], b[len(payload):]) {
+		err = fmt.Errorf("%s checksum mismatch, file is corrupt", name)
+		return
+	}
+	r := bytes.NewReader(payload[4:])
+	binary.Read(r, binary.BigEndian, &cp.height)
+	binary.Read(r, binary.BigEndian, &cp.numLeaves)
+	binary.Read(r, binary.BigEndian, &cp.rows)
+	switch b[3] {
+	case 1:
+		cp.oldProofs = true
+		binary.Read(r, binary.BigEndian, &cp.oldProofSize)
+	case 2:
+		cp.proofEnd = proofPosFromBytes(payload[len(payload)-8:])
+	case checkpointMagic[3]:
+		cp.proofEnd = proofPosFromBytes(payload[17:25])
+		copy(cp.tipHash[:], payload[25:])
+	default:
+		err = fmt.Errorf("%s is version %d, only know up to %d",
+			name, b[3], checkpointMagic[3])
+	}
+	return
+}
+
+// saveCheckpoint makes everything on disk agree on height and then records
+// it in checkpoint.dat.  All the workers must be done with the blocks before
+// height (wait on their waitgroups first), and dbFlushChan is the
+// DbWorker's flush channel.  leaves is the leafdb, nil without -norev.
+// tipHash is the hash of the block before height.
+func saveCheckpoint(forest *accumulator.Forest, height int32,
+	tipHash chainhash.Hash, cfg *Config, dbFlushChan chan dbFlush,
+	leaves *leafStore) error {
+
+	// all the new txos up to here
+	errChan := make(chan error)
+	dbFlushChan <- dbFlush{height: height, errChan: errChan}
+	err := <-errChan
+	if err != nil {
+		return err
+	}
+	if leaves != nil {
+		err = leaves.sync(height)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the proof and offset files
+	proofDir := cfg.UtreeDir.ProofDir
+	offsetSize, proofEnd, err := syncProofFiles(proofDir)
+	if err != nil {
+		return err
+	}
+	if offsetSize != int64(height)*8 {
+		return fmt.Errorf("checkpoint at height %d but %s has %d offsets",
+			height, proofDir.pOffsetFile, offsetSize/8)
+	}
+
+	// a way back to the checkpoint before, if there is one.  There's
+	// nothing to undo if it's at the same height.
+	prev, ok, err := readCheckpoint(cfg)
+	if err != nil {
+		return err
+	}
+	if ok && !prev.oldProofs && prev.height < height {
+		err = writeUndo(forest, height, prev, cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the forest, or its journal
+	if cfg.forestType == ramForest {
+		err = forest.CommitJournal()
+		if err == nil {
+			err = writeRamForest(forest, cfg.UtreeDir.ForestDir.forestFile)
+		}
+	} else {
+		err = writeForestJournal(forest, height, cfg)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the height file isn't needed when there's a checkpoint, but the
+	// server and older versions read it
+	var heightBytes [4]byte
+	binary.BigEndian.PutUint32(heightBytes[:], uint32(height))
+	err = util.WriteFileAtomic(cfg.UtreeDir.ForestDir.
+		forestLastSyncedBlockHeightFile, heightBytes[:], 0600)
+	if err != nil {
+		return err
+	}
+
+	cp := bridgeCheckpoint{
+		height: height, proofEnd: proofEnd, tipHash: tipHash}
+	cp.numLeaves, cp.rows = forest.ReconstructStats()
+	err = util.WriteFileAtomic(
+		cfg.UtreeDir.ForestDir.checkpointFile, cp.serialize(), 0600)
+	if err != nil {
+		return err
+	}
+
+	// the journal is part of the checkpoint now, so it can go in
+	err = writeMiscForest(forest, cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.forestType != ramForest {
+		err = commitForestJournal(forest, cfg)
+		if err != nil {
+			return err
+		}
+	}
+	err = pruneUndo(cfg, height)
+	if err != nil {
+		return err
+	}
+
+	// the spent txos from before the checkpoints there are undo files for
+	// can go
+	dbFlushChan <- dbFlush{dels: true, errChan: errChan}
+	err = <-errChan
+	if err != nil {
+		return err
+	}
+	if leaves != nil {
+		return leaves.flushDels()
+	}
+	return nil
+}
+
+// writeMiscForest writes numLeaves and rows to miscforestfile
+func writeMiscForest(forest *accumulator.Forest, cfg *Config) error {
+	var misc bytes.Buffer
+	err := forest.FlushMiscData(&misc)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(
+		cfg.UtreeDir.ForestDir.miscForestFile, misc.Bytes(), 0600)
+}
+
+// writeForestJournal writes the forest's changes since the last checkpoint
+// to forestjournal.dat, for the checkpoint at height
+func writeForestJournal(
+	forest *accumulator.Forest, height int32, cfg *Config) error {
+
+	var journal bytes.Buffer
+	err := forest.WriteJournal(&journal)
+	if err != nil {
+		return err
+	}
+	return writeJournalFile(journal.Bytes(), height, cfg)
+}
+
+// writeJournalFile writes a forest journal to forestjournal.dat, for the
+// checkpoint at height
+func writeJournalFile(journal []byte, height int32, cfg *Config) error {
+	var buf bytes.Buffer
+	buf.Write(forestJournalMagic[:])
+	binary.Write(&buf, binary.BigEndian, height)
+	buf.Write(journal)
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+	return util.WriteFileAtomic(
+		cfg.UtreeDir.ForestDir.forestJournalFile, buf.Bytes(), 0600)
+}
+
+// commitForestJournal puts the journaled changes in the forest on disk and
+// removes forestjournal.dat
+func commitForestJournal(forest *accumulator.Forest, cfg *Config) error {
+	err := forest.CommitJournal()
+	if err != nil {
+		return err
+	}
+	err = os.Remove(cfg.UtreeDir.ForestDir.forestJournalFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return util.SyncDir(cfg.UtreeDir.ForestDir.base)
+}
+
+// replayForestJournal replays forestjournal.dat if it's for the checkpoint
+// at height, and removes it
+func replayForestJournal(
+	forest *accumulator.Forest, height int32, cfg *Config) error {
+
+	name := cfg.UtreeDir.ForestDir.forestJournalFile
+	b, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(b) < 8+sha256.Size ||
+		!bytes.Equal(b[:4], forestJournalMagic[:]) {
+		return fmt.Errorf("%s is not a forest journal", name)
+	}
+	payload := b[:len(b)-sha256.Size]
+	sum := sha256.Sum256(payload)
+	if !bytes.Equal(sum[:], b[len(payload):]) {
+		return fmt.Errorf("%s checksum mismatch, file is corrupt", name)
+	}
+	jHeight := int32(binary.BigEndian.Uint32(payload[4:8]))
+	if jHeight == height {
+		fmt.Printf("Finishing putting the forest journal for height %d "+
+			"in the forest\n", height)
+		err = forest.ReplayJournal(bytes.NewReader(payload[8:]))
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err.Error())
+		}
+		// a ram forest only gets to disk as a whole
+		if cfg.forestType == ramForest {
+			err = writeRamForest(forest, cfg.UtreeDir.ForestDir.forestFile)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		// the checkpoint it was for never got written
+		fmt.Printf("Throwing away forest journal for height %d, "+
+			"checkpoint is at %d\n", jHeight, height)
+	}
+	err = os.Remove(name)
+	if err != nil {
+		return err
+	}
+	return util.SyncDir(cfg.UtreeDir.ForestDir.base)
+}
+
+// rollBackToCheckpoint throws away the proofs written after the checkpoint
+// so that they're made again when the blocks are processed again.
+func rollBackToCheckpoint(cfg *Config, cp bridgeCheckpoint) error {
+	if cp.oldProofs {
+		return fmt.Errorf("checkpoint is for proof.dat, which isn't there")
+	}
+	err := truncateFile(cfg.UtreeDir.ProofDir.pOffsetFile, int64(cp.height)*8)
+	if err != nil {
+		return err
+	}
+	return truncateProofs(cfg.UtreeDir.ProofDir, cp.proofEnd)
+}
+
+// truncateFile cuts a file down to size.  It's an error for the file to be
+// shorter than that, as then data from before the checkpoint is gone.
+func truncateFile(name string, size int64) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < size {
+		return fmt.Errorf("%s is %d bytes but checkpoint needs %d",
+			name, fi.Size(), size)
+	}
+	if fi.Size() == size {
+		return nil
+	}
+	fmt.Printf("truncating %s from %d to %d bytes\n", name, fi.Size(), size)
+	err = f.Truncate(size)
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// syncFile fsyncs the named file and returns its size
+func syncFile(name string) (int64, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	err = f.Sync()
+	if err != nil {
+		return 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// writeRamForest dumps a ram forest to a temp file and renames it over the
+// forest file, so the forest file is always a whole forest.
+func writeRamForest(forest *accumulator.Forest, name string) error {
+	tmpName := name + ".tmp"
+	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	err = forest.WriteForestToDisk(f, true, false)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpName, name)
+	if err != nil {
+		return err
+	}
+	return util.SyncDir(filepath.Dir(name))
+}
@@ -0,0 +1,203 @@
+package bridgenode
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// forestTest is a bridge node forest with proof files, without the ttldb,
+// and a ram forest that gets the same blocks to check it against
+type forestTest struct {
+	t      *testing.T
+	cfg    *Config
+	forest *accumulator.Forest
+	ram    *accumulator.Forest
+	sc     *accumulator.SimChain
+	ff     *flatFileState
+	height int32 // next block
+	roots  map[int32][]accumulator.Hash
+}
+
+func newForestTest(t *testing.T, ft forestType) *forestTest {
+	cfg := &Config{
+		forestType:  ft,
+		cowMaxCache: 2,
+		UtreeDir:    initUtreeDir(t.TempDir()),
+	}
+	makePaths(cfg.UtreeDir)
+	forest, height, err := InitBridgeNodeState(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &forestTest{
+		t:      t,
+		cfg:    cfg,
+		forest: forest,
+		ram:    accumulator.NewForest(nil, false, "", 0),
+		sc:     accumulator.NewSimChain(0x07),
+		ff:     openFlatFile(t, cfg.UtreeDir.ProofDir),
+		height: height,
+		roots:  make(map[int32][]accumulator.Hash),
+	}
+}
+
+// blocks does n blocks to both forests and writes their proofs
+func (ft *forestTest) blocks(n int) {
+	for i := 0; i < n; i++ {
+		adds, _, delHashes := ft.sc.NextBlock(30)
+		for _, f := range []*accumulator.Forest{ft.forest, ft.ram} {
+			bp, err := f.ProveBatch(delHashes)
+			if err != nil {
+				ft.t.Fatal(err)
+			}
+			_, err = f.Modify(adds, bp.Targets)
+			if err != nil {
+				ft.t.Fatal(err)
+			}
+		}
+		writeProofs(ft.t, ft.ff, ft.height)
+		ft.height++
+		ft.roots[ft.height] = ft.ram.GetRoots()
+	}
+}
+
+// checkpoint saves a checkpoint, with a DbWorker that has nothing to do
+func (ft *forestTest) checkpoint() {
+	dbFlushChan := make(chan dbFlush)
+	go func() {
+		for i := 0; i < 2; i++ {
+			f := <-dbFlushChan
+			f.errChan <- nil
+		}
+	}()
+	err := saveCheckpoint(ft.forest, ft.height, chainhash.Hash{}, ft.cfg,
+		dbFlushChan, nil)
+	if err != nil {
+		ft.t.Fatal(err)
+	}
+}
+
+// resume restores the forest like on startup, and checks it's at the
+// height it should be, with the roots it had then
+func (ft *forestTest) resume(want int32) {
+	ft.t.Helper()
+	forest, height, err := resumeForest(ft.cfg)
+	if err != nil {
+		ft.t.Fatal(err)
+	}
+	ft.check(forest, height, want)
+	if util.HasAccess(ft.cfg.UtreeDir.ForestDir.forestJournalFile) {
+		ft.t.Fatal("forest journal still there after resuming")
+	}
+}
+
+// check checks forest is at want, with the roots it had then
+func (ft *forestTest) check(
+	forest *accumulator.Forest, height, want int32) {
+
+	ft.t.Helper()
+	if height != want {
+		ft.t.Fatalf("resumed at %d, expected %d", height, want)
+	}
+	roots := forest.GetRoots()
+	if len(roots) != len(ft.roots[want]) {
+		ft.t.Fatalf("resumed forest has %d roots, expected %d",
+			len(roots), len(ft.roots[want]))
+	}
+	for i, r := range roots {
+		if r != ft.roots[want][i] {
+			ft.t.Fatalf("resumed forest root %d differs", i)
+		}
+	}
+}
+
+// TestResumeForest stops a disk, cache and cow forest at each point of
+// writing a checkpoint, and after blocks that didn't get one, and checks
+// that it resumes from the checkpoint that got written
+// TestCheckpointVersions reads checkpoint.dat from before it had the tip
+// hash
+func TestCheckpointVersions(t *testing.T) {
+	cp := bridgeCheckpoint{height: 12, numLeaves: 300, rows: 9,
+		proofEnd: proofPos{file: 2, offset: 1000}, tipHash: chainhash.Hash{7}}
+	got, err := parseCheckpoint(cp.serialize(), "checkpoint.dat")
+	if err != nil || got != cp {
+		t.Fatalf("read %+v %v, expected %+v", got, err, cp)
+	}
+
+	// version 2 is the same without the tip hash
+	b := cp.serialize()
+	b = append(b[:25:25], make([]byte, sha256.Size)...)
+	b[3] = 2
+	sum := sha256.Sum256(b[:25])
+	copy(b[25:], sum[:])
+	cp.tipHash = chainhash.Hash{}
+	got, err = parseCheckpoint(b, "checkpoint.dat")
+	if err != nil || got != cp {
+		t.Fatalf("read %+v %v, expected %+v", got, err, cp)
+	}
+	b[20] ^= 0x01
+	_, err = parseCheckpoint(b, "checkpoint.dat")
+	if err == nil {
+		t.Fatal("read corrupt version 2 checkpoint")
+	}
+}
+
+func TestResumeForest(t *testing.T) {
+	types := map[string]forestType{
+		"disk": diskForest, "cache": cacheForest, "cow": cowForest}
+	for name, typ := range types {
+		// blocks past the checkpoint
+		ft := newForestTest(t, typ)
+		ft.blocks(10)
+		ft.checkpoint()
+		ft.blocks(10)
+		ft.resume(11)
+		t.Logf("%s: resumed after blocks past the checkpoint", name)
+
+		// each step of the checkpoint
+		steps := []string{"journal", "checkpoint", "misc", "commit"}
+		for stop := range steps {
+			ft = newForestTest(t, typ)
+			ft.blocks(10)
+			ft.checkpoint()
+			// enough to resize the forest
+			ft.blocks(30)
+
+			err := writeForestJournal(ft.forest, ft.height, ft.cfg)
+			if err == nil && stop > 0 {
+				cp := bridgeCheckpoint{height: ft.height}
+				var offsetSize int64
+				offsetSize, cp.proofEnd, err = syncProofFiles(
+					ft.cfg.UtreeDir.ProofDir)
+				if err != nil || offsetSize != int64(ft.height)*8 {
+					t.Fatalf("%d offsets, %v", offsetSize/8, err)
+				}
+				cp.numLeaves, cp.rows = ft.forest.ReconstructStats()
+				err = ioutil.WriteFile(ft.cfg.UtreeDir.ForestDir.
+					checkpointFile, cp.serialize(), 0600)
+			}
+			if err == nil && stop > 1 {
+				err = writeMiscForest(ft.forest, ft.cfg)
+			}
+			if err == nil && stop > 2 {
+				// but the journal doesn't get removed
+				err = ft.forest.CommitJournal()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := int32(11)
+			if stop > 0 {
+				want = ft.height
+			}
+			ft.resume(want)
+			t.Logf("%s: resumed after %s", name, steps[stop])
+		}
+	}
+}
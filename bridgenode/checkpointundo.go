@@ -0,0 +1,233 @@
+package bridgenode
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+/*
+The forest can't go backwards by itself, so to be able to go back to an
+earlier checkpoint, every checkpoint also writes an undo file.  It has the
+checkpoint before, and a forest undo journal (see WriteUndoJournal in
+accumulator/forestjournal.go) that takes the forest back to it.  The last
+undoCheckpoints of them are kept in forestdata/undo, named by the height of
+the checkpoint they undo.  -repair uses them to go back to the last height
+where everything checks out.
+
+An undo file is:
+4 bytes magic "bfu" + version (1)
+4 bytes height of the checkpoint it undoes
+checkpoint.dat of the checkpoint before, sha256 and all
+the forest undo journal
+32 bytes sha256 of everything before it
+
+Going back a checkpoint writes the undo journal to forestjournal.dat for
+the height before, then writes that height's checkpoint.dat, then puts the
+journal in the forest, same as a checkpoint does.  A crash partway through
+is finished on startup by replaying forestjournal.dat.  The proofs past the
+height before are then cut off like any data past the forest's height.
+
+Blocks after the checkpoint gone back to spend txos that the ttldb and the
+leafdb deleted at checkpoints since.  So their deletes are held back for
+undoCheckpoints checkpoints too.  Deletes still held back when the bridge
+node stops are never done, which only costs space.
+
+An undo file for a height past checkpoint.dat is from a checkpoint that
+never got written, and is removed on startup.
+*/
+
+// undoMagic starts an undo file.  Last byte is the version
+var undoMagic = [4]byte{'b', 'f', 'u', 0x01}
+
+// undoCheckpoints is how many checkpoints back the bridge node can go
+const undoCheckpoints = 3
+
+// undoFile gives the name of the undo file for the checkpoint at height
+func (fd forestDir) undoFile(height int32) string {
+	return filepath.Join(fd.undoDir, fmt.Sprintf("undo%08d.dat", height))
+}
+
+// undoHeights gives the heights there are undo files for, lowest first
+func (fd forestDir) undoHeights() ([]int32, error) {
+	infos, err := ioutil.ReadDir(fd.undoDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var heights []int32
+	for _, fi := range infos {
+		name := fi.Name()
+		if !strings.HasPrefix(name, "undo") ||
+			!strings.HasSuffix(name, ".dat") || len(name) != 16 {
+			continue
+		}
+		h, err := strconv.ParseInt(name[4:12], 10, 32)
+		if err != nil {
+			continue
+		}
+		heights = append(heights, int32(h))
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	return heights, nil
+}
+
+// writeUndo writes the undo file for the checkpoint at height, which takes
+// the forest back to prev.  Call it before the forest's journal is
+// committed.
+func writeUndo(forest *accumulator.Forest, height int32,
+	prev bridgeCheckpoint, cfg *Config) error {
+
+	var buf bytes.Buffer
+	buf.Write(undoMagic[:])
+	binary.Write(&buf, binary.BigEndian, height)
+	buf.Write(prev.serialize())
+	err := forest.WriteUndoJournal(&buf)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+	fd := cfg.UtreeDir.ForestDir
+	err = os.MkdirAll(fd.undoDir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(fd.undoFile(height), buf.Bytes(), 0600)
+}
+
+// readUndo reads the undo file for the checkpoint at height.  ok is false
+// if there isn't one.
+func readUndo(cfg *Config, height int32) (
+	prev bridgeCheckpoint, journal []byte, ok bool, err error) {
+
+	name := cfg.UtreeDir.ForestDir.undoFile(height)
+	b, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	if len(b) < 12 || !bytes.Equal(b[:4], undoMagic[:]) ||
+		len(b) < 8+checkpointSize(b[11])+sha256.Size {
+		err = fmt.Errorf("%s is not an undo file", name)
+		return
+	}
+	cpSize := checkpointSize(b[11])
+	payload := b[:len(b)-sha256.Size]
+	sum := sha256.Sum256(payload)
+	if !bytes.Equal(sum[:], b[len(payload):]) {
+		err = fmt.Errorf("%s checksum mismatch, file is corrupt", name)
+		return
+	}
+	if int32(binary.BigEndian.Uint32(payload[4:8])) != height {
+		err = fmt.Errorf("%s is for height %d", name,
+			binary.BigEndian.Uint32(payload[4:8]))
+		return
+	}
+	prev, err = parseCheckpoint(payload[8:8+cpSize], name)
+	if err != nil {
+		return
+	}
+	if prev.height >= height {
+		err = fmt.Errorf("%s goes from height %d to %d",
+			name, height, prev.height)
+		return
+	}
+	journal = payload[8+cpSize:]
+	ok = true
+	return
+}
+
+// pruneUndo removes the undo files past the checkpoint at height, which
+// never got written, and all but the last undoCheckpoints up to it
+func pruneUndo(cfg *Config, height int32) error {
+	fd := cfg.UtreeDir.ForestDir
+	heights, err := fd.undoHeights()
+	if err != nil {
+		return err
+	}
+	var kept int
+	for i := len(heights) - 1; i >= 0; i-- {
+		if heights[i] <= height && kept < undoCheckpoints {
+			kept++
+			continue
+		}
+		err = os.Remove(fd.undoFile(heights[i]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// undoCheckpoint takes the bridge node from the checkpoint at height back
+// to the one before it, and gives that one's height.  ok is false if
+// there's no undo file to do it with.  forest has to be as restored from
+// the checkpoint at height, with its journal started.  The proofs past the
+// height before are left for checkProofs to cut off.
+func undoCheckpoint(forest *accumulator.Forest, height int32,
+	cfg *Config) (prevHeight int32, ok bool, err error) {
+
+	prev, journal, ok, err := readUndo(cfg, height)
+	if err != nil || !ok {
+		return
+	}
+	fmt.Printf("Going back from the checkpoint at height %d to %d\n",
+		height, prev.height)
+
+	fd := cfg.UtreeDir.ForestDir
+	err = writeJournalFile(journal, prev.height, cfg)
+	if err != nil {
+		return
+	}
+	// once checkpoint.dat is written, startup finishes going back if it
+	// stops partway
+	var heightBytes [4]byte
+	binary.BigEndian.PutUint32(heightBytes[:], uint32(prev.height))
+	err = util.WriteFileAtomic(
+		fd.forestLastSyncedBlockHeightFile, heightBytes[:], 0600)
+	if err != nil {
+		return
+	}
+	err = util.WriteFileAtomic(fd.checkpointFile, prev.serialize(), 0600)
+	if err != nil {
+		return
+	}
+
+	err = replayForestJournal(forest, prev.height, cfg)
+	if err != nil {
+		return
+	}
+	numLeaves, rows := forest.ReconstructStats()
+	if numLeaves != prev.numLeaves || rows != prev.rows {
+		err = fmt.Errorf("forest has %d leaves %d rows after going back "+
+			"but checkpoint at height %d has %d leaves %d rows",
+			numLeaves, rows, prev.height, prev.numLeaves, prev.rows)
+		return
+	}
+	err = writeMiscForest(forest, cfg)
+	if err != nil {
+		return
+	}
+	err = pruneUndo(cfg, prev.height)
+	if err != nil {
+		return
+	}
+	prevHeight = prev.height
+	return
+}
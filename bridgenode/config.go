@@ -2,11 +2,14 @@ package bridgenode
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcutil"
+	uwire "github.com/mit-dci/utreexo/wire"
 )
 
 var HelpMsg = `
@@ -17,6 +20,9 @@ The bridgenode server generates proofs and serves to the CSN node.
 OPTIONS:
   -net=mainnet                 configure whether to use mainnet. Optional.
   -net=regtest                 configure whether to use regtest. Optional.
+  -net=signet                  configure whether to use signet. Optional.
+  -netparams=<file>            use the network in a json params file, like
+                               a private signet. Overrides -net
   -forest                      select forest type to use (ram, cow, cache, disk). Defaults to disk
   -datadir="path/to/directory" set a custom DATADIR.
                                Defaults to the Bitcoin Core DATADIR path
@@ -26,6 +32,31 @@ OPTIONS:
   -cpuprof                     configure whether to use use cpu profiling
   -memprof                     configure whether to use use heap profiling
   -serve		       immediately serve whatever data is built
+  -checkpointblocks=n          sync all data to disk every n blocks (10000)
+  -checkpointsecs=n            sync all data to disk at least every n
+                               seconds (1800)
+  -repair                      if the data on disk doesn't check out on
+                               startup, cut off what's past the forest's
+                               height, or go back to an earlier checkpoint,
+                               instead of quitting
+  -startover                   with -repair, if no checkpoint is good,
+                               remove the forest, proofs and ttldb and
+                               start over from block 1
+  -norev                       keep the data of unspent txos in leafdb
+                               instead of reading it from rev files. Has to
+                               be used from block 1
+  -rpc=host:port               get blocks from a node's JSON-RPC instead of
+                               blk files, and keep following it as new
+                               blocks come in. Needs -norev, so it's on
+  -rpcuser, -rpcpass           login for -rpc. Defaults to the .cookie file
+                               in the datadir
+  -rpcconf=n                   only take blocks with n confirmations (6).
+                               1 stays right at the tip
+  -proofretain=n               only keep the proofs of the last n blocks,
+                               removing older proof files as it goes.
+                               0 keeps everything
+  -proofarchive=<dir>          move the proof files -proofretain drops
+                               into dir instead of removing them
 `
 
 // bit of a hack. Standard flag lib doesn't allow flag.Parse(os.Args[2]).
@@ -33,7 +64,10 @@ OPTIONS:
 var (
 	argCmd = flag.NewFlagSet("", flag.ExitOnError)
 	netCmd = argCmd.String("net", "testnet",
-		"Target network. (testnet, regtest, mainnet) Usage: '-net=regtest'")
+		"Target network. (testnet, regtest, mainnet, signet) "+
+			"Usage: '-net=regtest'")
+	netParamsCmd = argCmd.String("netparams", "",
+		`json file with a custom network. Usage: '-netparams=mysignet.json'`)
 	dataDirCmd = argCmd.String("datadir", "",
 		`Set a custom datadir. Usage: "-datadir='path/to/directory'"`)
 	bridgeDirCmd = argCmd.String("bridgedir", "",
@@ -48,6 +82,28 @@ var (
 		`immediately start server without building or checking proof data`)
 	noServeCmd = argCmd.Bool("noserve", false,
 		`don't serve proofs after finishing generating them`)
+	checkpointBlocksCmd = argCmd.Int("checkpointblocks", 10000,
+		`sync all data to disk every n blocks`)
+	checkpointSecsCmd = argCmd.Int("checkpointsecs", 1800,
+		`sync all data to disk at least every n seconds`)
+	repairCmd = argCmd.Bool("repair", false,
+		`go back to the last good height if data on disk is inconsistent`)
+	startOverCmd = argCmd.Bool("startover", false,
+		`with -repair, start over from block 1 if no checkpoint is good`)
+	noRevCmd = argCmd.Bool("norev", false,
+		`keep utxo data in leafdb instead of reading rev files`)
+	rpcCmd = argCmd.String("rpc", "",
+		`follow a node over JSON-RPC. Usage: "-rpc=127.0.0.1:18332"`)
+	rpcUserCmd = argCmd.String("rpcuser", "",
+		`username for -rpc`)
+	rpcPassCmd = argCmd.String("rpcpass", "",
+		`password for -rpc`)
+	rpcConfCmd = argCmd.Int("rpcconf", 6,
+		`confirmations a block needs before it's taken with -rpc`)
+	proofRetainCmd = argCmd.Int("proofretain", 0,
+		`only keep proofs for the last n blocks (0 keeps all)`)
+	proofArchiveCmd = argCmd.String("proofarchive", "",
+		`move pruned proof files here. Usage: "-proofarchive='path/to/dir'"`)
 	traceCmd = argCmd.String("trace", "",
 		`Enable trace. Usage: 'trace='path/to/file'`)
 	cpuProfCmd = argCmd.String("cpuprof", "",
@@ -66,11 +122,15 @@ type forestDir struct {
 	forestLastSyncedBlockHeightFile string
 	cowForestCurFile                string
 	cowForestDir                    string
+	checkpointFile                  string
+	forestDirtyFile                 string // from before forestJournalFile
+	forestJournalFile               string
+	undoDir                         string
 }
 
 type proofDir struct {
 	base        string
-	pFile       string
+	oldPFile    string // proof.dat, from before the proofs were in files
 	pOffsetFile string
 	lastPOffset string
 }
@@ -79,6 +139,7 @@ type offsetDir struct {
 	base                      string
 	OffsetFile                string
 	lastIndexOffsetHeightFile string
+	offsetStateFile           string
 }
 
 // All your utreexo bridgenode file paths in a nice and convinent struct
@@ -87,6 +148,7 @@ type utreeDir struct {
 	ProofDir  proofDir
 	ForestDir forestDir
 	Ttldb     string
+	LeafDb    string
 }
 
 // init an utreeDir with a selected basepath. Has all the names for the forest
@@ -96,12 +158,13 @@ func initUtreeDir(basePath string) utreeDir {
 		base:                      offBase,
 		OffsetFile:                filepath.Join(offBase, "offsetfile.dat"),
 		lastIndexOffsetHeightFile: filepath.Join(offBase, "lastindexoffsetheightfile.dat"),
+		offsetStateFile:           filepath.Join(offBase, "offsetstate.dat"),
 	}
 
 	proofBase := filepath.Join(basePath, "proofdata")
 	proof := proofDir{
 		base:        proofBase,
-		pFile:       filepath.Join(proofBase, "proof.dat"),
+		oldPFile:    filepath.Join(proofBase, "proof.dat"),
 		pOffsetFile: filepath.Join(proofBase, "proofoffset.dat"),
 		lastPOffset: filepath.Join(proofBase, "lastproofoffset.dat"),
 	}
@@ -115,15 +178,21 @@ func initUtreeDir(basePath string) utreeDir {
 		forestLastSyncedBlockHeightFile: filepath.Join(forestBase, "forestlastsyncedheight.dat"),
 		cowForestDir:                    cowDir,
 		cowForestCurFile:                filepath.Join(cowDir, "CURRENT"),
+		checkpointFile:                  filepath.Join(forestBase, "checkpoint.dat"),
+		forestDirtyFile:                 filepath.Join(forestBase, "forestdirty.dat"),
+		forestJournalFile:               filepath.Join(forestBase, "forestjournal.dat"),
+		undoDir:                         filepath.Join(forestBase, "undo"),
 	}
 
 	ttldb := filepath.Join(basePath, "ttldb")
+	leafdb := filepath.Join(basePath, "leafdb")
 
 	return utreeDir{
 		OffsetDir: off,
 		ProofDir:  proof,
 		ForestDir: forest,
 		Ttldb:     ttldb,
+		LeafDb:    leafdb,
 	}
 }
 
@@ -133,6 +202,7 @@ func makePaths(dir utreeDir) {
 	os.MkdirAll(dir.ProofDir.base, os.ModePerm)
 	os.MkdirAll(dir.ForestDir.base, os.ModePerm)
 	os.MkdirAll(dir.ForestDir.cowForestDir, os.ModePerm)
+	os.MkdirAll(dir.ForestDir.undoDir, os.ModePerm)
 }
 
 type forestType int
@@ -155,7 +225,8 @@ const (
 // all the configs for utreexoserver
 type Config struct {
 	// what params do we use? Different params depend on
-	// which bitcoin network are we on (mainnet, testnet3, regnet)
+	// which bitcoin network are we on (mainnet, testnet3, regnet, signet,
+	// or one from a params file)
 	params chaincfg.Params
 
 	// the block path from bitcoind's datadir we'll be directly reading from
@@ -164,6 +235,9 @@ type Config struct {
 	// where will the bridgenode data be saved to?
 	UtreeDir utreeDir
 
+	// where the blocks come from.  If nil, the blk and rev files in BlockDir
+	Source BlockSource
+
 	// type of the forest we're using
 	forestType forestType
 
@@ -179,6 +253,23 @@ type Config struct {
 	// don't serve after generating proofs
 	noServe bool
 
+	// how often to sync everything to disk at one height
+	checkpointBlocks   int32
+	checkpointInterval time.Duration
+
+	// fix up inconsistent data on startup instead of quitting
+	repair bool
+	// with repair, start over if there's nothing good to go back to
+	startOver bool
+
+	// keep the LeafData of utxos in the leafdb instead of using rev blocks
+	noRev bool
+
+	// only keep the proofs of this many blocks back, 0 for all of them.
+	// Pruned proof files go to proofArchiveDir if it's set.
+	proofRetain     int32
+	proofArchiveDir string
+
 	// enable tracing
 	TraceProf string
 
@@ -214,26 +305,19 @@ func Parse(args []string) (*Config, error) {
 	}
 
 	// set network
-	if *netCmd == "testnet" {
-		cfg.params = chaincfg.TestNet3Params
-		cfg.BlockDir = filepath.Join(
-			filepath.Join(dataDir, chaincfg.TestNet3Params.Name),
-			"blocks")
-		base := filepath.Join(bridgeDir, chaincfg.TestNet3Params.Name)
-		cfg.UtreeDir = initUtreeDir(base)
-	} else if *netCmd == "regtest" {
-		cfg.params = chaincfg.RegressionNetParams
-		cfg.BlockDir = filepath.Join(
-			filepath.Join(dataDir, chaincfg.RegressionNetParams.Name),
-			"blocks")
-		base := filepath.Join(bridgeDir, chaincfg.RegressionNetParams.Name)
-		cfg.UtreeDir = initUtreeDir(base)
-	} else if *netCmd == "mainnet" {
-		cfg.params = chaincfg.MainNetParams
-		cfg.BlockDir = filepath.Join(dataDir, "blocks")
+	params, err := uwire.NetParams(*netCmd, *netParamsCmd)
+	if err != nil {
+		return nil, errInvalidNetwork(err.Error())
+	}
+	cfg.params = *params
+	// bitcoind keeps mainnet right in the datadir, and the others in a
+	// directory for each.  Our data for networks other than mainnet goes in
+	// a directory named after the network.
+	cfg.BlockDir = filepath.Join(dataDir, uwire.BitcoindDir(params), "blocks")
+	if params.Name == chaincfg.MainNetParams.Name {
 		cfg.UtreeDir = initUtreeDir(bridgeDir)
 	} else {
-		return nil, errInvalidNetwork(*netCmd)
+		cfg.UtreeDir = initUtreeDir(filepath.Join(bridgeDir, params.Name))
 	}
 
 	makePaths(cfg.UtreeDir)
@@ -260,6 +344,39 @@ func Parse(args []string) (*Config, error) {
 	cfg.quitAt = *quitAtCmd
 	cfg.noServe = *noServeCmd
 	cfg.serve = *serve
+	cfg.checkpointBlocks = int32(*checkpointBlocksCmd)
+	cfg.checkpointInterval = time.Duration(*checkpointSecsCmd) * time.Second
+	cfg.repair = *repairCmd
+	cfg.startOver = *startOverCmd
+	cfg.noRev = *noRevCmd
+
+	if *proofRetainCmd < 0 {
+		return nil, fmt.Errorf("-proofretain can't be negative")
+	}
+	cfg.proofRetain = int32(*proofRetainCmd)
+	if *proofArchiveCmd != "" {
+		if cfg.proofRetain == 0 {
+			return nil, fmt.Errorf("-proofarchive needs -proofretain")
+		}
+		cfg.proofArchiveDir = *proofArchiveCmd
+		err = os.MkdirAll(cfg.proofArchiveDir, os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if *rpcCmd != "" {
+		// bitcoind puts the cookie next to the blocks directory
+		cookieFile := filepath.Join(filepath.Dir(cfg.BlockDir), ".cookie")
+		src, err := NewRPCSource(*rpcCmd, *rpcUserCmd, *rpcPassCmd,
+			cookieFile, int32(*rpcConfCmd))
+		if err != nil {
+			return nil, err
+		}
+		cfg.Source = src
+		// there's no rev data over rpc
+		cfg.noRev = true
+	}
 
 	return &cfg, nil
 }
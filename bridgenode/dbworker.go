@@ -6,18 +6,73 @@ import (
 	"sync"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
+// ttldbHeightKey holds the height the ttldb has all the txos for.  Keys
+// for txos are 36 byte outpoints so this can't collide with them.
+var ttldbHeightKey = []byte("ttldbheight")
+
+// dbFlush is a checkpoint asking DbWorker to sync.  Without dels it syncs
+// all the txos written so far and records height under ttldbHeightKey.
+// With dels it applies the deletes held back from undoCheckpoints
+// checkpoints ago.  errChan gets the result.
+type dbFlush struct {
+	height  int32
+	dels    bool
+	errChan chan error
+}
+
 // DbWorker writes & reads/deletes everything to the db.
 // It also generates TTLResultBlocks to send to the flat file worker
+//
+// Deletes of spent txos are held back until a checkpoint asks for them over
+// flushChan, which it does after checkpoint.dat is written, and then until
+// undoCheckpoints more checkpoints are written.  That way after a crash,
+// or after going back to one of those checkpoints, the db never has less
+// in it than it did at the checkpoint, and blocks after the checkpoint can
+// be replayed: writing a new txo again is harmless, and the spent ones are
+// still there to be read.  (A crash leaves the deletes held back in the db
+// for good, which only costs space.)
 func DbWorker(
-	dbWorkChan chan ttlRawBlock, ttlResultChan chan ttlResultBlock,
+	dbWorkChan chan ttlRawBlock, flushChan chan dbFlush,
+	ttlResultChan chan ttlResultBlock,
 	lvdb *leveldb.DB, wg *sync.WaitGroup) {
 
 	val := make([]byte, 4)
 
+	// spent txos to delete, since the last checkpoint and for each
+	// checkpoint being held back
+	dels := new(leveldb.Batch)
+	var heldDels []*leveldb.Batch
+
 	for {
-		dbBlock := <-dbWorkChan
+		var dbBlock ttlRawBlock
+		select {
+		case dbBlock = <-dbWorkChan:
+		case fl := <-flushChan:
+			// sync so that everything written before is on disk too
+			sync := &opt.WriteOptions{Sync: true}
+			if fl.dels {
+				// a checkpoint with nothing to delete, like one at the
+				// same height again, doesn't count
+				if dels.Len() > 0 {
+					heldDels = append(heldDels, dels)
+					dels = new(leveldb.Batch)
+				}
+				var err error
+				if len(heldDels) > undoCheckpoints {
+					err = lvdb.Write(heldDels[0], sync)
+					heldDels = heldDels[1:]
+				}
+				fl.errChan <- err
+				continue
+			}
+			var hBytes [4]byte
+			binary.BigEndian.PutUint32(hBytes[:], uint32(fl.height))
+			fl.errChan <- lvdb.Put(ttldbHeightKey, hBytes[:], sync)
+			continue
+		}
 		var batch leveldb.Batch
 		// build the batch for writing to levelDB.
 		// Just outpoints to index within block
@@ -30,7 +85,6 @@ func DbWorker(
 		if err != nil {
 			fmt.Println(err.Error())
 		}
-		batch.Reset()
 
 		var trb ttlResultBlock
 
@@ -40,7 +94,7 @@ func DbWorker(
 		// now read from the DB all the spent txos and find their
 		// position within their creation block
 		for i, op := range dbBlock.spentTxos {
-			batch.Delete(op[:]) // add this outpoint for deletion
+			dels.Delete(op[:]) // add this outpoint for deletion
 			idxBytes, err := lvdb.Get(op[:], nil)
 			if err != nil {
 				fmt.Printf("can't find %x in db\n", op)
@@ -56,10 +110,6 @@ func DbWorker(
 		}
 		// send to flat ttl writer
 		ttlResultChan <- trb
-		err = lvdb.Write(&batch, nil) // actually delete everything
-		if err != nil {
-			fmt.Println(err.Error())
-		}
 
 		wg.Done()
 	}
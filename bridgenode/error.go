@@ -11,6 +11,8 @@ var (
 	ErrInvalidNetwork  = errors.New("Invalid/not supported net flag given")
 	ErrBuildProofs     = errors.New("BuildProofs error")
 	ErrArchiveServer   = errors.New("ArchiveServer error")
+	ErrBadProof        = errors.New("Bad proof record")
+	ErrProofPruned     = errors.New("Proof has been pruned")
 )
 
 func errNoDataDir(path string) error {
@@ -33,3 +35,7 @@ func errBuildProofs(s error) error {
 func errArchiveServer(s error) error {
 	return fmt.Errorf("%s: %s", ErrArchiveServer, s)
 }
+
+func errBadProof(height int32, pos proofPos, s error) error {
+	return fmt.Errorf("%s: block %d at %v: %s", ErrBadProof, height, pos, s)
+}
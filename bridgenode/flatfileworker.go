@@ -1,8 +1,8 @@
 package bridgenode
 
 import (
-	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"sync"
 
@@ -14,16 +14,16 @@ Proof file format is somewhat like the blk.dat and rev.dat files.  But it's
 always in order!  The offset file is in 8 byte chunks, so to find the proof
 data for block 100 (really 101), seek to byte 800 and read 8 bytes.
 
-The proof file is: 4 bytes empty (zeros for now, could do something else later)
-4 bytes proof length, then the proof data.
+A proof record is a header with the magic, proof length and checksums, then
+the proof data.  (see proofrecord.go)
 
-Offset file is: 8 byte int64 offset.  Right now it's all 1 big file, can
-change to 4 byte which file and 4 byte offset within file like the blk/rev but
-we're not running on fat32 so works OK for now.
+Offset file is: 4 byte which proof file and 4 byte offset within that file,
+like the blk/rev.  (see prooffile.go)
 
 the offset file will start with 16 zero-bytes.  The first offset is 0 because
-there is no block 0.  The next is 0 because block 1 starts at byte 0 of proof.dat.
-then the second offset, at byte 16, is 12 or so, as that's block 2 in the proof.dat.
+there is no block 0.  The next is 0 because block 1 starts at byte 0 of
+proof00000.dat.  then the second offset, at byte 16, is 12 or so, as that's
+block 2 in proof00000.dat.
 */
 
 /*
@@ -42,15 +42,23 @@ to those locations.
 Then it writes all the TTL values to the correct places in by checking all the
 offsetInRam values and writing to the correct 4-byte location in the proof file.
 
+	With -proofretain it also gets prune requests after checkpoints, and
+removes the old proof files.  (see proofprune.go)
+
 */
 
+// maxTTLFiles is how many proof files are kept open for writing TTLs
+const maxTTLFiles = 64
+
 // shared state for the flat file worker methods
 type flatFileState struct {
-	offsets               []int64
-	proofFile, offsetFile *os.File
-	currentHeight         int32
-	currentOffset         int64
-	fileWait              *sync.WaitGroup
+	offsets       []proofPos
+	offsetFile    *os.File
+	proofs        proofWriter
+	ttlFiles      map[uint32]*os.File
+	firstFile     uint32 // files before this have been pruned
+	currentHeight int32
+	fileWait      *sync.WaitGroup
 }
 
 // pFileWorker takes in blockproof and height information from the channel
@@ -59,6 +67,7 @@ type flatFileState struct {
 func flatFileWorker(
 	proofChan chan btcacc.UData,
 	ttlResultChan chan ttlResultBlock,
+	pruneChan chan proofPrune,
 	utreeDir utreeDir,
 	fileWait *sync.WaitGroup) {
 
@@ -71,12 +80,8 @@ func flatFileWorker(
 		panic(err)
 	}
 
-	ff.proofFile, err = os.OpenFile(
-		utreeDir.ProofDir.pFile, os.O_CREATE|os.O_WRONLY, 0600)
-	if err != nil {
-		panic(err)
-	}
-
+	ff.proofs.dir = utreeDir.ProofDir
+	ff.ttlFiles = make(map[uint32]*os.File)
 	ff.fileWait = fileWait
 
 	err = ff.ffInit()
@@ -124,6 +129,8 @@ func flatFileWorker(
 			if err != nil {
 				panic(err)
 			}
+		case p := <-pruneChan:
+			p.errChan <- ff.prune(p)
 		}
 	}
 }
@@ -148,20 +155,32 @@ func (ff *flatFileState) ffInit() error {
 		if err != nil {
 			return err
 		}
-		ff.offsets = make([]int64, maxHeight)
+		ff.offsets = make([]proofPos, maxHeight)
 		// run through the file, read everything and push into the channel
+		var b [8]byte
 		for ff.currentHeight < maxHeight {
-			err = binary.Read(ff.offsetFile, binary.BigEndian, &ff.currentOffset)
+			_, err = io.ReadFull(ff.offsetFile, b[:])
 			if err != nil {
 				fmt.Printf("couldn't populate in-ram offsets on startup")
 				return err
 			}
-			ff.offsets[ff.currentHeight] = ff.currentOffset
+			ff.offsets[ff.currentHeight] = proofPosFromBytes(b[:])
 			ff.currentHeight++
 		}
 
-		// set currentOffset to the end of the proof file
-		ff.currentOffset, _ = ff.proofFile.Seek(0, 2)
+		// the next proof goes at the end of the last proof file
+		ff.proofs.pos, err = ff.proofs.dir.end()
+		if err != nil {
+			return err
+		}
+		// and anything before the first one has been pruned
+		nums, err := ff.proofs.dir.fileNums()
+		if err != nil {
+			return err
+		}
+		if len(nums) != 0 {
+			ff.firstFile = nums[0]
+		}
 
 	} else { // first time startup
 		// there is no block 0 so leave that empty
@@ -171,7 +190,7 @@ func (ff *flatFileState) ffInit() error {
 			return err
 		}
 		// do the same with the in-ram slice
-		ff.offsets = make([]int64, 1)
+		ff.offsets = make([]proofPos, 1)
 		// start writing at block 1
 		ff.currentHeight = 1
 	}
@@ -185,82 +204,94 @@ func (ff *flatFileState) writeProofBlock(ud btcacc.UData) error {
 	// fmt.Printf("writeProofBlock gets h %d ud %d utxodatas\n",
 	// ud.Height, len(ud.Stxos))
 
-	// get the new block proof
-	// put offset in ram
-	ff.offsets = append(ff.offsets, ff.currentOffset)
-	// fmt.Printf("expand offsets to %d\n", len(ff.offsets))
-	// write to offset file so we can resume; offset file is only
-	// read on startup and always incremented so we shouldn't need to seek
-	err := binary.Write(ff.offsetFile, binary.BigEndian, ff.currentOffset)
-	if err != nil {
-		return err
-	}
-
-	// seek to next block proof location, this file is open in ttl worker
-	// and may write point may have moved
-	_, _ = ff.proofFile.Seek(ff.currentOffset, 0)
-
-	// write to proof file
-	// first write magic 4 bytes
-	_, err = ff.proofFile.Write([]byte{0xaa, 0xff, 0xaa, 0xff})
+	// header with the size and checksums, then the whole proof
+	rec, err := makeProofRecord(ud)
 	if err != nil {
 		return err
 	}
 
-	// prefix with size
-	err = binary.Write(ff.proofFile, binary.BigEndian, uint32(ud.SerializeSize()))
+	// write to the proof files, which may start a new one
+	pos, err := ff.proofs.write(rec)
 	if err != nil {
 		return err
 	}
 
-	// then write the whole proof
-	err = ud.Serialize(ff.proofFile)
-	if err != nil {
-		return err
-	}
-
-	// verify that offset is calculated correctly
-	off, err := ff.proofFile.Seek(0, 1)
+	// put offset in ram
+	ff.offsets = append(ff.offsets, pos)
+	// fmt.Printf("expand offsets to %d\n", len(ff.offsets))
+	// write to offset file so we can resume; offset file is only
+	// read on startup and always incremented so we shouldn't need to seek
+	posBytes := pos.bytes()
+	_, err = ff.offsetFile.Write(posBytes[:])
 	if err != nil {
 		return err
 	}
-	if off != ff.currentOffset+int64(ud.SerializeSize())+8 {
-		return fmt.Errorf("h %d offset %x calculated length %d but observed %d",
-			ff.currentHeight, ff.currentOffset,
-			int64(ud.SerializeSize())+8, off-ff.currentOffset)
-	}
 
-	// 4B magic & 4B size comes first
-	ff.currentOffset += int64(ud.SerializeSize()) + 8
 	ff.currentHeight++
 
 	ff.fileWait.Done()
-	// fmt.Printf("flatFileBlockWorker h %d wrote %d bytes to offset %d\n",
-	// ff.currentHeight, ud.SerializeSize()+8, ff.currentOffset)
+	// fmt.Printf("flatFileBlockWorker h %d wrote %d bytes to %v\n",
+	// ff.currentHeight, len(rec), pos)
 	return nil
 }
 
+// ttlFile gives proof file num open for reading and writing TTLs.  If too many are
+// open they're all closed first.
+func (ff *flatFileState) ttlFile(num uint32) (*os.File, error) {
+	f, ok := ff.ttlFiles[num]
+	if ok {
+		return f, nil
+	}
+	if len(ff.ttlFiles) >= maxTTLFiles {
+		for n, f := range ff.ttlFiles {
+			err := f.Close()
+			if err != nil {
+				return nil, err
+			}
+			delete(ff.ttlFiles, n)
+		}
+	}
+	f, err := os.OpenFile(ff.proofs.dir.fileName(num), os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	ff.ttlFiles[num] = f
+	return f, nil
+}
+
 func (ff *flatFileState) writeTTLs(ttlRes ttlResultBlock) error {
-	var ttlArr [4]byte
 	// fmt.Printf("height %d got %d ttls\n",
 	// ttlRes.Height, len(ttlRes.Created))
-	// for all the TTLs, seek and overwrite the empty values there
+	// group the TTLs by the block that created the txo, since the TTL
+	// checksum of each of those records has to be redone
+	byBlock := make(map[int32][]txoTTL)
+	var heights []int32
 	for _, c := range ttlRes.Created {
-		// seek to the location of that txo's ttl value in the proof file
-
-		// fmt.Printf("write ttl back to block %d\n", c.createHeight)
-		binary.BigEndian.PutUint32(
-			ttlArr[:], uint32(ttlRes.Height-c.createHeight))
-
-		// write it's lifespan as a 4 byte int32 (bit of a waste as
+		if _, ok := byBlock[c.createHeight]; !ok {
+			heights = append(heights, c.createHeight)
+		}
+		// it's lifespan as a 4 byte int32 (bit of a waste as
 		// 2 or 3 bytes would work)
-		// add 16: 4 for magic, 4 for size, 4 for height, 4 numTTL, then ttls start
-		_, err := ff.proofFile.WriteAt(ttlArr[:],
-			ff.offsets[c.createHeight]+16+int64(c.indexWithinBlock*4))
+		byBlock[c.createHeight] = append(byBlock[c.createHeight], txoTTL{
+			index: c.indexWithinBlock,
+			ttl:   uint32(ttlRes.Height - c.createHeight),
+		})
+	}
+	for _, h := range heights {
+		// fmt.Printf("write ttls back to block %d\n", h)
+		pos := ff.offsets[h]
+		if pos.file < ff.firstFile {
+			// that proof's been pruned
+			continue
+		}
+		f, err := ff.ttlFile(pos.file)
+		if err != nil {
+			return err
+		}
+		err = writeRecordTTLs(f, int64(pos.offset), byBlock[h])
 		if err != nil {
 			return err
 		}
-
 	}
 	ff.fileWait.Done()
 	return nil
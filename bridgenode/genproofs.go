@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/mit-dci/utreexo/btcacc"
 	"github.com/mit-dci/utreexo/util"
 
@@ -22,7 +23,7 @@ The tricky part is that we read blocks, but that block data goes to 2 places.
 It goes to the accumulator to generate a proof, and it goes to the DB to
 get the TTL data.  The proof then gets written to a flat file,
 
-BlockAndRevReader reads from bitcoind flat files
+the BlockSource reads blocks, by default from bitcoind flat files
 -> blockAndRevReadQueue -> read by main loop, sent to 2 places
 
 
@@ -43,6 +44,15 @@ it grabs all that before trying to look for TTL data.
 
 */
 
+// idleCheckpoint is how long BuildProofs waits for the next block before
+// syncing to disk, so a bridge node that's caught up has it all on disk
+const idleCheckpoint = 30 * time.Second
+
+// maxJournalSize is how many forest positions can change before
+// BuildProofs makes a checkpoint whatever -checkpointblocks says, as the
+// forest journal keeps them all in ram until then.  About 1.6GB.
+var maxJournalSize = 16 << 20
+
 // build the bridge node / proofs
 func BuildProofs(cfg *Config, sig chan bool) error {
 	// Channel to alert the tell the main loop it's ok to exit
@@ -58,15 +68,43 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 	// Handle user interruptions
 	go stopBuildProofs(cfg, sig, offsetFinished, haltRequest, haltAccept)
 
-	// Init forest and variables. Resumes if the data directory exists
-	forest, height, knownTipHeight, err :=
-		InitBridgeNodeState(cfg, offsetFinished)
+	// Where the blocks come from.  The blk/rev files need indexing first
+	src := cfg.Source
+	if src == nil {
+		blkRev, err := newBlkRevSource(cfg, offsetFinished)
+		if err != nil {
+			err := fmt.Errorf("initialization error: %s\nIf your .blk and "+
+				".dat files are not in %s, specify alternate path with "+
+				"-datadir\n.", err.Error(), cfg.BlockDir)
+			return err
+		}
+		src = blkRev
+	} else {
+		// no offset file to leave half built
+		offsetFinished <- true
+	}
+	knownTipHeight, err := src.TipHeight()
 	if err != nil {
-		err := fmt.Errorf("initialization error.  If your .blk and .dat files are "+
-			"not in %s, specify alternate path with -datadir\n.", cfg.BlockDir)
 		return err
 	}
 
+	// Init forest and variables. Resumes if the data directory exists
+	forest, height, err := InitBridgeNodeState(cfg)
+	if err != nil {
+		return fmt.Errorf("initialization error: %s", err.Error())
+	}
+
+	// the last block done, to check the next one builds on it.  Not known
+	// at the start, or from a checkpoint from before it was recorded.
+	cp, _, err := readCheckpoint(cfg)
+	if err != nil {
+		return fmt.Errorf("initialization error: %s", err.Error())
+	}
+	tipHash := cp.tipHash
+	if cp.height != height {
+		tipHash = chainhash.Hash{}
+	}
+
 	// Open leveldb
 	o := opt.Options{
 		CompactionTableSizeMultiplier: 8,
@@ -80,32 +118,75 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 	}
 	defer lvdb.Close()
 
+	// With -norev we keep the LeafData of the utxos ourselves
+	var leaves *leafStore
+	if cfg.noRev {
+		leaves, err = openLeafStore(cfg, height)
+		if err != nil {
+			return fmt.Errorf("leafdb error: %s", err.Error())
+		}
+		defer leaves.close()
+	}
+
 	var dbwg sync.WaitGroup
 
-	// To send/receive blocks from blockreader()
+	// To send/receive blocks from the BlockSource
 	blockAndRevReadQueue := make(chan BlockAndRev, 10) // blocks from disk to processing
+	readErr := make(chan error, 1)                     // why the reader stopped
 
 	dbWriteChan := make(chan ttlRawBlock, 10)      // from block processing to db worker
+	dbFlushChan := make(chan dbFlush)              // from checkpoints to db worker
 	ttlResultChan := make(chan ttlResultBlock, 10) // from db worker to flat ttl writer
 	proofChan := make(chan btcacc.UData, 10)       // from proof processing to proof writer
+	pruneChan := make(chan proofPrune)             // from checkpoints to proof writer
 	// Start 16 workers. Just an arbitrary number
 	//	for j := 0; j < 16; j++ {
 	// I think we can only have one dbworker now, since it needs to all happen in order?
-	go DbWorker(dbWriteChan, ttlResultChan, lvdb, &dbwg)
+	go DbWorker(dbWriteChan, dbFlushChan, ttlResultChan, lvdb, &dbwg)
 	//	}
 
-	// Reads block asynchronously from .dat files
-	// Reads util the lastIndexOffsetHeight
-	go BlockAndRevReader(blockAndRevReadQueue, cfg, knownTipHeight, height)
+	// Reads blocks asynchronously from the source
+	// Reads until the knownTipHeight
+	go func(from int32) {
+		readErr <- src.ReadBlocks(blockAndRevReadQueue, from, knownTipHeight)
+		close(blockAndRevReadQueue)
+	}(height)
 
 	var fileWait sync.WaitGroup
 
-	go flatFileWorker(proofChan, ttlResultChan, cfg.UtreeDir, &fileWait)
+	go flatFileWorker(
+		proofChan, ttlResultChan, pruneChan, cfg.UtreeDir, &fileWait)
 
 	fmt.Println("Building Proofs and ttldb...")
 
 	var stop bool // bool for stopping the main loop
 
+	// when everything was last synced to disk
+	var sinceSave int32
+	lastSave := time.Now()
+
+	// checkpoint syncs everything up to (not including) block h
+	checkpoint := func(h int32) error {
+		dbwg.Wait()
+		fileWait.Wait()
+		err := saveCheckpoint(
+			forest, h, tipHash, cfg, dbFlushChan, leaves)
+		if err != nil {
+			return err
+		}
+		// old proofs can go once there's no going back before h
+		err = pruneProofs(cfg, h, pruneChan)
+		if err != nil {
+			return err
+		}
+		sinceSave = 0
+		lastSave = time.Now()
+		return nil
+	}
+
+	// goes off if the next block takes a while
+	idle := time.NewTimer(idleCheckpoint)
+
 	for ; height != knownTipHeight && !stop; height++ {
 		if cfg.quitAt != -1 && int(height) == cfg.quitAt {
 			fmt.Println("quitAfter value reached. Quitting...")
@@ -116,11 +197,67 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 			pprof.StopCPUProfile()
 			break
 		}
-		// Receive txs from the asynchronous blk*.dat reader
-		bnr := <-blockAndRevReadQueue
+		// Receive txs from the asynchronous block reader.  If the next
+		// block is a while coming, like when following a node at the tip,
+		// get everything on disk while waiting.
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(idleCheckpoint)
+		var bnr BlockAndRev
+		ok := true
+		select {
+		case bnr, ok = <-blockAndRevReadQueue:
+		case stop = <-haltRequest:
+		case <-idle.C:
+			if sinceSave > 0 {
+				err = checkpoint(height)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Synced to disk, waiting for block %d\n", height)
+			}
+			select {
+			case bnr, ok = <-blockAndRevReadQueue:
+			case stop = <-haltRequest:
+			}
+		}
+		if stop {
+			break
+		}
+		if !ok {
+			err = <-readErr
+			if err == nil {
+				err = fmt.Errorf("block source ended early")
+			}
+			return fmt.Errorf("reading block %d: %s", height, err.Error())
+		}
+
+		// a block that doesn't build on the last one means the chain
+		// reorged below blocks that are already in the forest
+		if tipHash != (chainhash.Hash{}) &&
+			bnr.Blk.Header.PrevBlock != tipHash {
+			return fmt.Errorf("block %d %s doesn't connect to block %d %s. "+
+				"The chain reorged below the bridge node's tip, and "+
+				"the bridge node can't undo blocks", height,
+				bnr.Blk.BlockHash().String(), height-1, tipHash.String())
+		}
+		tipHash = bnr.Blk.BlockHash()
 
 		inskip, outskip := util.DedupeBlock(&bnr.Blk)
 
+		// Get the add and remove data needed from the block & undo block
+		// (or the leafdb)
+		// wants the skiplist to omit proofs
+		blockAdds, delLeaves, err :=
+			blockToAddDel(bnr, inskip, outskip, leaves)
+		if err != nil {
+			return err
+		}
+
 		// start waitgroups, beyond this point we have to finish all the
 		// disk writes for this iteration of the loop
 		dbwg.Add(1)     // DbWorker calls Done()
@@ -129,14 +266,7 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 		// Writes the new txos to leveldb,
 		// and generates TTL for txos spent in the block
 		// also wants the skiplist to omit 0-ttl txos
-		dbWriteChan <- ParseBlockForDB(bnr, inskip, outskip)
-
-		// Get the add and remove data needed from the block & undo block
-		// wants the skiplist to omit proofs
-		blockAdds, delLeaves, err := blockToAddDel(bnr, inskip, outskip)
-		if err != nil {
-			return err
-		}
+		dbWriteChan <- ParseBlockForDB(bnr, delLeaves, inskip, outskip)
 
 		// use the accumulator to get inclusion proofs, and produce a block
 		// proof with all data needed to verify the block
@@ -160,6 +290,21 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 			fmt.Println("On block :", bnr.Height+1)
 		}
 
+		// every so often get everything on disk to the same height, so
+		// that after a crash we can pick up from there.  The forest
+		// journal holds everything since the last checkpoint in ram, so
+		// it's a checkpoint too if that's getting big.
+		sinceSave++
+		if (cfg.checkpointBlocks > 0 && sinceSave >= cfg.checkpointBlocks) ||
+			(cfg.checkpointInterval > 0 &&
+				time.Since(lastSave) >= cfg.checkpointInterval) ||
+			forest.JournalSize() >= maxJournalSize {
+			err = checkpoint(height + 1)
+			if err != nil {
+				return err
+			}
+		}
+
 		// Check if stopSig is no longer false
 		// stop = true makes the loop exit
 		select {
@@ -178,7 +323,12 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 	fileWait.Wait()
 
 	// Save the current state so genproofs can be resumed
-	err = saveBridgeNodeData(forest, height, cfg)
+	err = saveBridgeNodeData(
+		forest, height, tipHash, cfg, dbFlushChan, leaves)
+	if err != nil {
+		panic(err)
+	}
+	err = pruneProofs(cfg, height, pruneChan)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,159 @@
+package bridgenode
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// buildProofs runs BuildProofs on the blocks tc has so far
+func buildProofs(t *testing.T, cfg *Config, tc *testChain) {
+	t.Helper()
+	cfg.Source = &MemBlockSource{Blocks: tc.blocks}
+	err := BuildProofs(cfg, make(chan bool))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkBuiltProofs checks the proofs of all the blocks tc has with a
+// pollard, like a CSN would, and that their TTLs are right
+func checkBuiltProofs(t *testing.T, cfg *Config, tc *testChain) {
+	t.Helper()
+	tip := int32(len(tc.blocks)) + 1
+	var p accumulator.Pollard
+	for h := int32(1); h < tip; h++ {
+		b, err := GetUDataBytesFromFile(cfg.UtreeDir.ProofDir, h)
+		if err != nil {
+			t.Fatalf("block %d: %v", h, err)
+		}
+		ub := uwire.UBlock{Block: tc.blocks[h-1].Blk}
+		err = ub.UtreexoData.Deserialize(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("block %d: %v", h, err)
+		}
+		ud := ub.UtreexoData
+		if ud.Height != h {
+			t.Fatalf("proof for block %d is for %d", h, ud.Height)
+		}
+		sameLeaves(t, h, ud.Stxos, tc.spends(h))
+
+		inskip, outskip := util.DedupeBlock(&ub.Block)
+		nl, rows := p.ReconstructStats()
+		err = ub.ProofSanity(inskip, nl, rows)
+		if err != nil {
+			t.Fatalf("block %d: %v", h, err)
+		}
+		vp, err := p.VerifyBatchProof(ud.AccProof)
+		if err == nil {
+			err = p.PopulateBatchProof(vp)
+		}
+		if err == nil {
+			err = p.Modify(uwire.BlockToAddLeaves(ub.Block, nil, outskip, h),
+				ud.AccProof.Targets)
+		}
+		if err != nil {
+			t.Fatalf("block %d: %v", h, err)
+		}
+
+		want := tc.ttls(h, tip)
+		if len(ud.TxoTTLs) != len(want) {
+			t.Fatalf("block %d has %d TTLs, expected %d",
+				h, len(ud.TxoTTLs), len(want))
+		}
+		for i := range want {
+			if ud.TxoTTLs[i] != want[i] {
+				t.Fatalf("block %d TTLs %v, expected %v",
+					h, ud.TxoTTLs, want)
+			}
+		}
+	}
+}
+
+// TestBuildProofs builds proofs for blocks without rev data from a
+// MemBlockSource, then resumes with more blocks, and checks the proofs and
+// TTLs all come out right
+func TestBuildProofs(t *testing.T) {
+	types := map[string]forestType{"disk": diskForest, "ram": ramForest}
+	for name, typ := range types {
+		t.Logf("%s forest", name)
+		cfg := &Config{
+			forestType:       typ,
+			UtreeDir:         initUtreeDir(t.TempDir()),
+			noRev:            true,
+			checkpointBlocks: 7,
+			quitAt:           -1,
+		}
+		makePaths(cfg.UtreeDir)
+		tc := newTestChain()
+		tc.extend(30)
+		buildProofs(t, cfg, tc)
+		checkBuiltProofs(t, cfg, tc)
+
+		// txos from before spent after
+		tc.extend(55)
+		buildProofs(t, cfg, tc)
+		checkBuiltProofs(t, cfg, tc)
+		err := checkLeafDB(cfg, 56)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestBuildProofsReorg resumes on a chain that reorged below the tip, like
+// blk files that got reindexed after a reorg, and checks it's an error
+func TestBuildProofsReorg(t *testing.T) {
+	cfg := &Config{
+		forestType: ramForest,
+		UtreeDir:   initUtreeDir(t.TempDir()),
+		noRev:      true,
+		quitAt:     -1,
+	}
+	makePaths(cfg.UtreeDir)
+	tc := newTestChain()
+	tc.extend(30)
+	buildProofs(t, cfg, tc)
+
+	fork := newTestChain()
+	fork.extend(25)
+	fork.tag = 1
+	fork.extend(40)
+	cfg.Source = &MemBlockSource{Blocks: fork.blocks}
+	err := BuildProofs(cfg, make(chan bool))
+	if err == nil {
+		t.Fatal("resumed on a chain that reorged below the tip")
+	}
+}
+
+// TestBuildProofsJournalSize checks that a checkpoint is made when the
+// forest journal gets big, even with no -checkpointblocks
+func TestBuildProofsJournalSize(t *testing.T) {
+	old := maxJournalSize
+	maxJournalSize = 20
+	defer func() { maxJournalSize = old }()
+
+	cfg := &Config{
+		forestType: diskForest,
+		UtreeDir:   initUtreeDir(t.TempDir()),
+		noRev:      true,
+		quitAt:     -1,
+	}
+	makePaths(cfg.UtreeDir)
+	tc := newTestChain()
+	tc.extend(30)
+	buildProofs(t, cfg, tc)
+	checkBuiltProofs(t, cfg, tc)
+	// the last few checkpoints have undo files, the one at the end too
+	heights, err := cfg.UtreeDir.ForestDir.undoHeights()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(heights) != undoCheckpoints {
+		t.Fatalf("undo files for %v, expected checkpoints before 31",
+			heights)
+	}
+}
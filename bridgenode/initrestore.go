@@ -1,59 +1,81 @@
 package bridgenode
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"os"
 
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/mit-dci/utreexo/util"
 )
 
-// initBridgeNodeState attempts to load and initialize the chain state from the disk.
+// InitBridgeNodeState attempts to load and initialize the chain state from the disk.
 // If a chain state is not present, chain is initialized to the genesis
-// returns forest, height, lastIndexOffsetHeight, pOffset and error
-func InitBridgeNodeState(cfg *Config, offsetFinished chan bool) (forest *accumulator.Forest,
-	height int32, knownTipHeight int32, err error) {
+// returns forest, height and error
+func InitBridgeNodeState(cfg *Config) (forest *accumulator.Forest,
+	height int32, err error) {
 
-	// Default behavior is that the user should delete all offsetdata
-	// if they have new blk*.dat files to sync
-	// User needs to re-index blk*.dat files when added new files to sync
-
-	// Both the blk*.dat offset and rev*.dat offset is checked at the same time
-	// If either is incomplete or not complete, they're both removed and made
-	// anew
-	// Check if the offsetfiles for both rev*.dat and blk*.dat are present
-	if util.HasAccess(cfg.UtreeDir.OffsetDir.OffsetFile) {
-		knownTipHeight, err = restoreLastIndexOffsetHeight(cfg.UtreeDir.OffsetDir, offsetFinished)
-		if err != nil {
-			err = fmt.Errorf("restoreLastIndexOffsetHeight error: %s", err.Error())
-			return
+	if checkForestExists(cfg) {
+		fmt.Println("Has access to forest, resuming")
+		forest, height, err = resumeForest(cfg)
+		if err == nil {
+			err = checkBridgeNodeData(cfg, forest, height)
+		}
+		// go back a checkpoint at a time until it all checks out
+		for err != nil && cfg.repair && forest != nil {
+			fmt.Printf("repair: %s\n", err.Error())
+			prevHeight, ok, undoErr := undoCheckpoint(forest, height, cfg)
+			if undoErr != nil {
+				fmt.Printf("repair: can't go back from height %d: %s\n",
+					height, undoErr.Error())
+				break
+			}
+			if !ok {
+				fmt.Printf("repair: no checkpoint before height %d to go "+
+					"back to\n", height)
+				break
+			}
+			height = prevHeight
+			err = checkBridgeNodeData(cfg, forest, height)
 		}
-	} else {
-		fmt.Println("Offsetfile not present or half present. " +
-			"Indexing offset for blocks blk*.dat files...")
-		knownTipHeight, err = createOffsetData(cfg, offsetFinished)
 		if err != nil {
-			err = fmt.Errorf("createOffsetData error: %s", err.Error())
-			return
+			if !cfg.repair {
+				err = fmt.Errorf("%s\nBridge node data doesn't check out. "+
+					"Run with -repair to cut off data past the forest's "+
+					"height, or go back to an earlier checkpoint",
+					err.Error())
+				return
+			}
+			// no checkpoint left that checks out.  Throwing away the
+			// whole datadir has to be asked for.
+			if !cfg.startOver {
+				err = fmt.Errorf("%s\nNo checkpoint to go back to checks "+
+					"out. Run with -repair -startover to remove the "+
+					"forest, proofs and ttldb and start over from block 1",
+					err.Error())
+				return
+			}
+			fmt.Printf("repair: %s\nrepair: starting over from block 1\n",
+				err.Error())
+			err = resetBridgeNodeData(cfg)
+			if err != nil {
+				err = fmt.Errorf("resetBridgeNodeData error: %s", err.Error())
+				return
+			}
+			forest = nil
 		}
-		fmt.Printf("tip height %d\n", knownTipHeight)
 	}
 
-	if checkForestExists(cfg) {
-		fmt.Println("Has access to forest, resuming")
-		forest, err = restoreForest(cfg)
-		if err != nil {
-			err = fmt.Errorf("restoreForest error: %s", err.Error())
-			return
-		}
-		height, err = restoreHeight(cfg)
+	if forest == nil {
+		fmt.Println("Creating new forest")
+		// proofs from a run that never got to a checkpoint are of no use
+		// without the forest
+		err = removeProofFiles(cfg.UtreeDir.ProofDir)
 		if err != nil {
-			err = fmt.Errorf("restoreHeight error: %s", err.Error())
 			return
 		}
-	} else {
-		fmt.Println("Creating new forest")
 		// TODO Add a path for CowForest here
 		forest, err = createForest(cfg)
 		height = 1 // note that blocks start at 1, block 0 doesn't go into set
@@ -61,60 +83,102 @@ func InitBridgeNodeState(cfg *Config, offsetFinished chan bool) (forest *accumul
 			err = fmt.Errorf("createForest error: %s", err.Error())
 			return
 		}
+		forest.StartJournal()
 	}
 
 	return
 }
 
-// saveBridgeNodeData saves the state of the bridgenode so that when the
-// user restarts, they'll be able to resume.
-// Saves height, forest fields, and pOffset
-func saveBridgeNodeData(
-	forest *accumulator.Forest, height int32, cfg *Config) error {
-
-	switch cfg.forestType {
-	case ramForest:
-		forestFile, err := os.OpenFile(
-			cfg.UtreeDir.ForestDir.forestFile,
-			os.O_CREATE|os.O_RDWR, 0600)
-		if err != nil {
-			return err
-		}
-		err = forest.WriteForestToDisk(forestFile, true, false)
+// resumeForest restores the forest and the height it's at.  If there's a
+// checkpoint, proofs past it are thrown away so they're made again.  If
+// that fails the forest and height are still given, so -repair can go back
+// from there.
+func resumeForest(cfg *Config) (
+	forest *accumulator.Forest, height int32, err error) {
+
+	// from before the forest journal, a forest changed in place that
+	// wasn't checkpointed has blocks in it that nothing else on disk
+	// knows about
+	if cfg.forestType != ramForest &&
+		util.HasAccess(cfg.UtreeDir.ForestDir.forestDirtyFile) {
+		err = fmt.Errorf("forest in %s was being written when the "+
+			"bridge node stopped and is past the last checkpoint",
+			cfg.UtreeDir.ForestDir.base)
+		return
+	}
+	cp, ok, err := readCheckpoint(cfg)
+	if err != nil {
+		err = fmt.Errorf("readCheckpoint error: %s", err.Error())
+		return
+	}
+	if !ok {
+		// older datadir, all we've got is the height file
+		forest, err = restoreForest(cfg)
 		if err != nil {
-			return err
+			err = fmt.Errorf("restoreForest error: %s", err.Error())
+			return
 		}
-
-	case cowForest:
-		err := forest.WriteForestToDisk(nil, false, true)
+		forest.StartJournal()
+		height, err = restoreHeight(cfg)
 		if err != nil {
-			return err
+			err = fmt.Errorf("restoreHeight error: %s", err.Error())
 		}
+		return
 	}
 
-	heightFile, err := os.OpenFile(
-		cfg.UtreeDir.ForestDir.forestLastSyncedBlockHeightFile,
-		os.O_CREATE|os.O_RDWR, 0600)
+	// miscforestfile is written after checkpoint.dat, so it may be from
+	// the one before
+	var misc bytes.Buffer
+	binary.Write(&misc, binary.BigEndian, cp.numLeaves)
+	binary.Write(&misc, binary.BigEndian, cp.rows)
+	err = util.WriteFileAtomic(
+		cfg.UtreeDir.ForestDir.miscForestFile, misc.Bytes(), 0600)
 	if err != nil {
-		return err
+		return
 	}
-	err = binary.Write(heightFile, binary.BigEndian, height)
+	forest, err = restoreForest(cfg)
 	if err != nil {
-		return err
+		err = fmt.Errorf("restoreForest error: %s", err.Error())
+		return
 	}
-
-	// write other misc forest data
-	miscForestFile, err := os.OpenFile(
-		cfg.UtreeDir.ForestDir.miscForestFile, os.O_CREATE|os.O_RDWR, 0600)
+	// the forest may have stopped partway through taking in the journal
+	// for the checkpoint
+	forest.StartJournal()
+	err = replayForestJournal(forest, cp.height, cfg)
 	if err != nil {
-		return err
+		err = fmt.Errorf("replayForestJournal error: %s", err.Error())
+		return
+	}
+	numLeaves, rows := forest.ReconstructStats()
+	if numLeaves != cp.numLeaves || rows != cp.rows {
+		err = fmt.Errorf("forest has %d leaves %d rows but checkpoint "+
+			"at height %d has %d leaves %d rows", numLeaves, rows,
+			cp.height, cp.numLeaves, cp.rows)
+		return
 	}
-	err = forest.WriteMiscData(miscForestFile)
+	height = cp.height
+	err = pruneUndo(cfg, cp.height)
 	if err != nil {
-		return err
+		err = fmt.Errorf("pruneUndo error: %s", err.Error())
+		return
 	}
+	err = rollBackToCheckpoint(cfg, cp)
+	if err != nil {
+		err = fmt.Errorf("rollBackToCheckpoint error: %s", err.Error())
+		return
+	}
+	fmt.Printf("Resuming from checkpoint at height %d\n", height)
+	return
+}
 
-	return nil
+// saveBridgeNodeData saves the state of the bridgenode so that when the
+// user restarts, they'll be able to resume.
+// It's the same as the checkpoints taken while running.
+func saveBridgeNodeData(forest *accumulator.Forest, height int32,
+	tipHash chainhash.Hash, cfg *Config, dbFlushChan chan dbFlush,
+	leaves *leafStore) error {
+
+	return saveCheckpoint(forest, height, tipHash, cfg, dbFlushChan, leaves)
 }
 
 // createOffsetData restores the offsetfile needed to index the
@@ -246,29 +310,6 @@ func restoreHeight(cfg *Config) (height int32, err error) {
 	return
 }
 
-// restoreLastIndexOffsetHeight restores the lastIndexOffsetHeight
-func restoreLastIndexOffsetHeight(offsetDir offsetDir, offsetFinished chan bool) (
-	lastIndexOffsetHeight int32, err error) {
-
-	f, err := os.OpenFile(
-		offsetDir.lastIndexOffsetHeightFile, os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		return 0, err
-	}
-
-	// grab the last block height from currentoffsetheight
-	// currentoffsetheight saves the last height from the offsetfile
-	err = binary.Read(f, binary.BigEndian, &lastIndexOffsetHeight)
-	if err != nil {
-		return 0, err
-	}
-	// if there is a offset file, we should pass true to offsetFinished
-	// to let stopParse() know that it shouldn't delete offsetfile
-	offsetFinished <- true
-
-	return
-}
-
 // Check that the data for this forest type specified in the config
 // is present and should be resumed off of
 func checkForestExists(cfg *Config) bool {
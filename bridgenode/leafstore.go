@@ -0,0 +1,189 @@
+package bridgenode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+/*
+Normally the LeafData of the txos a block spends comes from bitcoind's rev
+files.  With -norev the bridge node keeps it itself instead, in the leafdb:
+every txo that goes in the forest is written there when its block is
+processed, and read back when it's spent.  Then blocks are all that's
+needed, so they can come from a BlockSource with no rev data.
+
+leafdb keys are 36 byte outpoints, and the values are
+4 bytes height << 1 | coinbase
+8 bytes amount
+the rest is the PkScript
+
+Deletes are held back until a checkpoint and undoCheckpoints more, same as
+in the ttldb, so the blocks after a checkpoint can be processed again after
+a crash or after going back to it.  The height the leafdb has all the txos
+for is kept under leafdbHeightKey.
+*/
+
+// leafdbHeightKey holds the height the leafdb is synced to
+var leafdbHeightKey = []byte("leafdbheight")
+
+// leafStore is the leafdb.  It's only used from the BuildProofs loop.
+type leafStore struct {
+	db *leveldb.DB
+	// spent txos to delete, since the last checkpoint and for each
+	// checkpoint being held back
+	dels     leveldb.Batch
+	heldDels []*leveldb.Batch
+}
+
+// openLeafStore opens the leafdb for processing blocks from height on.
+// Starting at block 1 it's made anew; otherwise it has to have all the
+// txos from before height.
+func openLeafStore(cfg *Config, height int32) (*leafStore, error) {
+	if height == 1 {
+		err := os.RemoveAll(cfg.UtreeDir.LeafDb)
+		if err != nil {
+			return nil, err
+		}
+	}
+	o := opt.Options{
+		CompactionTableSizeMultiplier: 8,
+		Compression:                   opt.NoCompression,
+	}
+	db, err := leveldb.OpenFile(cfg.UtreeDir.LeafDb, &o)
+	if err != nil {
+		return nil, err
+	}
+	if height == 1 {
+		return &leafStore{db: db}, nil
+	}
+
+	hBytes, err := db.Get(leafdbHeightKey, nil)
+	if err == leveldb.ErrNotFound || (err == nil && len(hBytes) != 4) {
+		db.Close()
+		return nil, fmt.Errorf("%s doesn't have the txos before block %d. "+
+			"-norev has to be used from block 1", cfg.UtreeDir.LeafDb, height)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	dbHeight := int32(binary.BigEndian.Uint32(hBytes))
+	if dbHeight < height {
+		db.Close()
+		return nil, fmt.Errorf("%s only has the txos before block %d, "+
+			"resuming at %d.  Was the bridge node run without -norev?",
+			cfg.UtreeDir.LeafDb, dbHeight, height)
+	}
+	return &leafStore{db: db}, nil
+}
+
+// close closes the leafdb.  Deletes not flushed yet are lost, which is OK
+// as they'll be done again from the last checkpoint.
+func (ls *leafStore) close() error {
+	return ls.db.Close()
+}
+
+// spend gives the LeafData of the txos blk spends, leaving out the inputs
+// on inskip, in the same order blockNRevToDelLeaves gives them.
+func (ls *leafStore) spend(
+	blk *wire.MsgBlock, inskip []uint32) ([]btcacc.LeafData, error) {
+
+	ops := util.BlockToDelOPs(blk, inskip)
+	delLeaves := make([]btcacc.LeafData, len(ops))
+	for i, op := range ops {
+		key := util.OutpointToBytes(&op)
+		val, err := ls.db.Get(key[:], nil)
+		if err == leveldb.ErrNotFound {
+			return nil, fmt.Errorf("block %s spends %s which isn't in "+
+				"the leafdb", blk.BlockHash().String(), op.String())
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(val) < 12 {
+			return nil, fmt.Errorf("leafdb entry for %s is %d bytes",
+				op.String(), len(val))
+		}
+		hcb := binary.BigEndian.Uint32(val[0:4])
+		delLeaves[i] = btcacc.LeafData{
+			TxHash:   btcacc.Hash(op.Hash),
+			Index:    op.Index,
+			Height:   int32(hcb >> 1),
+			Coinbase: hcb&1 == 1,
+			Amt:      int64(binary.BigEndian.Uint64(val[4:12])),
+			PkScript: append([]byte(nil), val[12:]...),
+		}
+		ls.dels.Delete(key[:])
+	}
+	return delLeaves, nil
+}
+
+// add writes the txos blk creates, except the ones on outskip and the
+// unspendable ones, same as what BlockToAddLeaves puts in the forest.
+func (ls *leafStore) add(
+	blk *wire.MsgBlock, outskip []uint32, height int32) error {
+
+	var batch leveldb.Batch
+	var txoInBlock uint32
+	for txInBlock, tx := range blk.Transactions {
+		txid := tx.TxHash()
+		hcb := uint32(height) << 1
+		if txInBlock == 0 {
+			hcb |= 1
+		}
+		for i, out := range tx.TxOut {
+			if util.IsUnspendable(out) {
+				txoInBlock++
+				continue
+			}
+			if len(outskip) > 0 && outskip[0] == txoInBlock {
+				outskip = outskip[1:]
+				txoInBlock++
+				continue
+			}
+			key := util.OutpointToBytes(wire.NewOutPoint(&txid, uint32(i)))
+			val := make([]byte, 12+len(out.PkScript))
+			binary.BigEndian.PutUint32(val[0:4], hcb)
+			binary.BigEndian.PutUint64(val[4:12], uint64(out.Value))
+			copy(val[12:], out.PkScript)
+			batch.Put(key[:], val)
+			txoInBlock++
+		}
+	}
+	return ls.db.Write(&batch, nil)
+}
+
+// sync gets everything written so far on disk and records that the leafdb
+// has all the txos before height
+func (ls *leafStore) sync(height int32) error {
+	var hBytes [4]byte
+	binary.BigEndian.PutUint32(hBytes[:], uint32(height))
+	return ls.db.Put(leafdbHeightKey, hBytes[:], &opt.WriteOptions{Sync: true})
+}
+
+// flushDels holds back the txos spent since the last checkpoint, and
+// deletes the ones held back from undoCheckpoints checkpoints ago.  Call it
+// only once the checkpoint is written.
+func (ls *leafStore) flushDels() error {
+	// a checkpoint with nothing to delete doesn't count, like in DbWorker
+	if ls.dels.Len() > 0 {
+		held := new(leveldb.Batch)
+		// replaying into a batch can't fail
+		ls.dels.Replay(held)
+		ls.heldDels = append(ls.heldDels, held)
+		ls.dels.Reset()
+	}
+	if len(ls.heldDels) <= undoCheckpoints {
+		return nil
+	}
+	err := ls.db.Write(ls.heldDels[0], &opt.WriteOptions{Sync: true})
+	ls.heldDels = ls.heldDels[1:]
+	return err
+}
@@ -0,0 +1,323 @@
+package bridgenode
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// testChain is a chain of blocks that spend each other's txos, for a
+// MemBlockSource.  Every block has a coinbase with an OP_RETURN output, and
+// after the first few a tx spending two older txos and one spending an
+// output of that tx in the same block.  Blocks made after tag is changed
+// are a different chain from those made before.
+type testChain struct {
+	tag     byte
+	blocks  []BlockAndRev
+	utxos   []wire.OutPoint // oldest first
+	leaves  map[wire.OutPoint]btcacc.LeafData
+	spentAt map[wire.OutPoint]int32
+}
+
+func newTestChain() *testChain {
+	return &testChain{
+		leaves:  make(map[wire.OutPoint]btcacc.LeafData),
+		spentAt: make(map[wire.OutPoint]int32),
+	}
+}
+
+// extend makes blocks up to and including height
+func (tc *testChain) extend(height int32) {
+	for h := int32(len(tc.blocks)) + 1; h <= height; h++ {
+		cb := wire.NewMsgTx(1)
+		cb.AddTxIn(&wire.TxIn{
+			PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+			SignatureScript: []byte{
+				txscript.OP_DATA_4, byte(h), byte(h >> 8), 0, tc.tag},
+		})
+		cb.AddTxOut(wire.NewTxOut(50e8, []byte{txscript.OP_TRUE}))
+		cb.AddTxOut(wire.NewTxOut(0, []byte{txscript.OP_RETURN, byte(h)}))
+		blk := wire.MsgBlock{Transactions: []*wire.MsgTx{cb}}
+		tc.created(cb, 0, h, true)
+
+		if len(tc.utxos) >= 4 {
+			// the oldest one, and one from the middle
+			spend := []int{0, len(tc.utxos) / 2}
+			tx := wire.NewMsgTx(1)
+			for _, i := range spend {
+				op := tc.utxos[i]
+				tx.AddTxIn(wire.NewTxIn(&op, nil, nil))
+				tc.spentAt[op] = h
+			}
+			tc.utxos = append(tc.utxos[1:spend[1]], tc.utxos[spend[1]+1:]...)
+			tx.AddTxOut(wire.NewTxOut(int64(h), []byte{txscript.OP_TRUE}))
+			tx.AddTxOut(wire.NewTxOut(int64(h)+1,
+				[]byte{txscript.OP_TRUE, byte(h)}))
+			blk.Transactions = append(blk.Transactions, tx)
+			tc.created(tx, 1, h, false)
+
+			// spends the first output of tx right away
+			txid := tx.TxHash()
+			same := wire.NewMsgTx(1)
+			same.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&txid, 0), nil, nil))
+			same.AddTxOut(wire.NewTxOut(int64(h), []byte{txscript.OP_TRUE}))
+			blk.Transactions = append(blk.Transactions, same)
+			tc.created(same, 0, h, false)
+		}
+		if h > 1 {
+			blk.Header.PrevBlock = tc.blocks[h-2].Blk.BlockHash()
+		}
+		var txs []*btcutil.Tx
+		for _, tx := range blk.Transactions {
+			txs = append(txs, btcutil.NewTx(tx))
+		}
+		merkles := blockchain.BuildMerkleTreeStore(txs, false)
+		blk.Header.MerkleRoot = *merkles[len(merkles)-1]
+		tc.blocks = append(tc.blocks, BlockAndRev{Height: h, Blk: blk})
+	}
+}
+
+// created puts the outputs of tx from first on in the utxo set
+func (tc *testChain) created(tx *wire.MsgTx, first int, h int32, cb bool) {
+	txid := tx.TxHash()
+	for i := first; i < len(tx.TxOut); i++ {
+		if util.IsUnspendable(tx.TxOut[i]) {
+			continue
+		}
+		op := wire.OutPoint{Hash: txid, Index: uint32(i)}
+		tc.utxos = append(tc.utxos, op)
+		tc.leaves[op] = btcacc.LeafData{
+			TxHash:   btcacc.Hash(txid),
+			Index:    uint32(i),
+			Height:   h,
+			Coinbase: cb,
+			Amt:      tx.TxOut[i].Value,
+			PkScript: tx.TxOut[i].PkScript,
+		}
+	}
+}
+
+// spends gives the LeafData of the txos block h spends from earlier blocks
+func (tc *testChain) spends(h int32) []btcacc.LeafData {
+	blk := &tc.blocks[h-1].Blk
+	inskip, _ := util.DedupeBlock(blk)
+	var lds []btcacc.LeafData
+	for _, op := range util.BlockToDelOPs(blk, inskip) {
+		lds = append(lds, tc.leaves[op])
+	}
+	return lds
+}
+
+// ttls gives the TTLs of the txos block h makes, as of when the chain's at
+// tip: blocks till they're spent, 0 if they aren't yet
+func (tc *testChain) ttls(h, tip int32) []int32 {
+	blk := &tc.blocks[h-1].Blk
+	var ttls []int32
+	for _, add := range forestAdds(blk) {
+		ttl := int32(0)
+		if s, ok := tc.spentAt[add]; ok && s < tip {
+			ttl = s - h
+		}
+		ttls = append(ttls, ttl)
+	}
+	return ttls
+}
+
+// forestAdds gives the outpoints of the txos blk puts in the forest, in
+// order
+func forestAdds(blk *wire.MsgBlock) []wire.OutPoint {
+	_, outskip := util.DedupeBlock(blk)
+	var ops []wire.OutPoint
+	var txoInBlock uint32
+	for _, tx := range blk.Transactions {
+		txid := tx.TxHash()
+		for i, out := range tx.TxOut {
+			skip := util.IsUnspendable(out)
+			if len(outskip) > 0 && outskip[0] == txoInBlock {
+				outskip = outskip[1:]
+				skip = true
+			}
+			txoInBlock++
+			if !skip {
+				ops = append(ops, wire.OutPoint{Hash: txid, Index: uint32(i)})
+			}
+		}
+	}
+	return ops
+}
+
+// sameLeaves checks that the LeafData from the leafdb is what's expected.
+// The leafdb doesn't have the block hash.
+func sameLeaves(t *testing.T, h int32, got, want []btcacc.LeafData) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("block %d spends %d txos, expected %d",
+			h, len(got), len(want))
+	}
+	for i := range want {
+		if got[i].ToString() != want[i].ToString() ||
+			string(got[i].PkScript) != string(want[i].PkScript) {
+			t.Fatalf("block %d spend %d is %s, expected %s",
+				h, i, got[i].ToString(), want[i].ToString())
+		}
+	}
+}
+
+// doBlocks does blocks from up to but not including to with ls, checking
+// the txos spent
+func doBlocks(t *testing.T, ls *leafStore, tc *testChain, from, to int32) {
+	t.Helper()
+	for h := from; h < to; h++ {
+		blk := &tc.blocks[h-1].Blk
+		inskip, outskip := util.DedupeBlock(blk)
+		lds, err := ls.spend(blk, inskip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sameLeaves(t, h, lds, tc.spends(h))
+		err = ls.add(blk, outskip, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkpointLeaves syncs ls at height and flushes its deletes, like a
+// checkpoint does
+func checkpointLeaves(t *testing.T, ls *leafStore, height int32) {
+	t.Helper()
+	err := ls.sync(height)
+	if err == nil {
+		err = ls.flushDels()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// outPoint gives the outpoint of the txo ld is for
+func outPoint(ld btcacc.LeafData) wire.OutPoint {
+	return wire.OutPoint{Hash: chainhash.Hash(ld.TxHash), Index: ld.Index}
+}
+
+// hasTxo says if the leafdb has op
+func hasTxo(t *testing.T, ls *leafStore, op wire.OutPoint) bool {
+	t.Helper()
+	key := util.OutpointToBytes(&op)
+	has, err := ls.db.Has(key[:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return has
+}
+
+func TestLeafStore(t *testing.T) {
+	tc := newTestChain()
+	tc.extend(60)
+	cfg := &Config{UtreeDir: initUtreeDir(t.TempDir())}
+
+	// needs the txos from before
+	_, err := openLeafStore(cfg, 5)
+	if err == nil {
+		t.Fatal("opened a new leafdb at height 5")
+	}
+
+	ls, err := openLeafStore(cfg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doBlocks(t, ls, tc, 1, 11)
+	checkpointLeaves(t, ls, 11)
+
+	// spending what's not there is an error
+	_, err = ls.spend(&tc.blocks[9].Blk, nil)
+	if err == nil {
+		t.Fatal("spent block 10's txos twice")
+	}
+	ls.dels.Reset()
+
+	// spent txos are held back for undoCheckpoints checkpoints, counting
+	// the one they're spent before
+	firstOp := outPoint(tc.spends(5)[0])
+	for cp := int32(0); cp < undoCheckpoints; cp++ {
+		if !hasTxo(t, ls, firstOp) {
+			t.Fatalf("txo spent in block 5 gone after %d more checkpoints",
+				cp)
+		}
+		doBlocks(t, ls, tc, 11+cp*10, 21+cp*10)
+		checkpointLeaves(t, ls, 21+cp*10)
+	}
+	if hasTxo(t, ls, firstOp) {
+		t.Fatalf("txo spent in block 5 still there")
+	}
+	doBlocks(t, ls, tc, 41, 51)
+	checkpointLeaves(t, ls, 51)
+	// one with nothing spent doesn't count
+	checkpointLeaves(t, ls, 51)
+	if !hasTxo(t, ls, outPoint(tc.spends(25)[0])) {
+		t.Fatal("checkpoint at the same height flushed deletes")
+	}
+	err = ls.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// picks up at the height it's synced to, or before
+	_, err = openLeafStore(cfg, 52)
+	if err == nil {
+		t.Fatal("opened leafdb synced to 51 at 52")
+	}
+	ls, err = openLeafStore(cfg, 51)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doBlocks(t, ls, tc, 51, 61)
+	ls.close()
+}
+
+// TestLeafStoreCrash stops before the leafdb's deletes are flushed, and
+// with blocks done past the checkpoint, and checks they can be done again
+func TestLeafStoreCrash(t *testing.T) {
+	tc := newTestChain()
+	tc.extend(40)
+	cfg := &Config{UtreeDir: initUtreeDir(t.TempDir())}
+	ls, err := openLeafStore(cfg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doBlocks(t, ls, tc, 1, 11)
+	checkpointLeaves(t, ls, 11)
+
+	// checkpoint.dat written at 21, but not flushDels
+	doBlocks(t, ls, tc, 11, 21)
+	err = ls.sync(21)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// and more blocks
+	doBlocks(t, ls, tc, 21, 26)
+	ls.close()
+
+	// blocks after the checkpoint again
+	ls, err = openLeafStore(cfg, 21)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doBlocks(t, ls, tc, 21, 31)
+	checkpointLeaves(t, ls, 31)
+	ls.close()
+
+	// and even from the checkpoint before, as if it went back one
+	ls, err = openLeafStore(cfg, 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doBlocks(t, ls, tc, 11, 41)
+	ls.close()
+}
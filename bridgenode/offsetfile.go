@@ -2,67 +2,254 @@ package bridgenode
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"os"
 	"path/filepath"
+	"sort"
 
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/wire"
 	"github.com/mit-dci/utreexo/util"
+	"github.com/syndtr/goleveldb/leveldb"
+	dbutil "github.com/syndtr/goleveldb/leveldb/util"
 )
 
+/*
+The offset file has 12 bytes for every block in height order: the blk file
+number, where the block starts in it, and where its undo data is in the rev
+file.  Building it means reading through all the blk files, so once that's
+done offsetstate.dat remembers how far it got, and the next time only the
+data added since is read and put on the end.
+
+offsetstate.dat is:
+4 bytes magic "bos" + version (1)
+32 bytes hash of the last block in the offset file
+4 bytes its height
+4 bytes blk file number it read up to
+4 bytes how far into that file
+4 bytes number of pending headers, then for each
+    32 bytes hash, 32 bytes prev hash, 4 bytes blk file, 4 bytes offset
+32 bytes sha256 of everything before it
+
+Pending headers are blocks that were read but aren't in the offset file yet,
+either because the block before them hasn't shown up or because they had no
+undo data yet.  They're tried again the next time.
+
+The offset file is synced before offsetstate.dat is written, and anything in
+it past the state's height is cut off when starting, so a crash in the
+middle just means reading some of it again.
+
+bitcoind keeps blocks that got reorged out, in its blk files and in the
+block index.  The offset file follows bitcoind's active chain, which comes
+from the index: its tip is the block with the most work out of the ones
+whose scripts were checked and that aren't marked invalid.  Blocks that
+aren't on it are left out, and pending headers that are on it but already
+in the offset file are dropped, since neither will ever connect.  If the
+offset file's tip isn't on the active chain anymore, the offset file is cut
+back to where they fork and the blk files are read again from the first
+one with an active block after that.
+*/
+
+// offsetStateMagic starts offsetstate.dat.  Last byte is the version
+var offsetStateMagic = [4]byte{'b', 'o', 's', 0x01}
+
+// offsetState is how far building the offset file got
+type offsetState struct {
+	tip     util.Hash // last block in the offset file
+	height  int32     // its height, which is how many blocks are in the file
+	fileNum uint32    // blk file read up to
+	offset  uint32    // where in fileNum to start reading
+	pending []RawHeaderData
+}
+
+// serialize gives the offsetstate.dat bytes, checksum included
+func (st *offsetState) serialize() []byte {
+	var buf bytes.Buffer
+	buf.Write(offsetStateMagic[:])
+	// writes to a bytes.Buffer can't fail
+	buf.Write(st.tip[:])
+	binary.Write(&buf, binary.BigEndian, st.height)
+	binary.Write(&buf, binary.BigEndian, st.fileNum)
+	binary.Write(&buf, binary.BigEndian, st.offset)
+	binary.Write(&buf, binary.BigEndian, uint32(len(st.pending)))
+	for _, h := range st.pending {
+		buf.Write(h.CurrentHeaderHash[:])
+		buf.Write(h.Prevhash[:])
+		buf.Write(h.FileNum[:])
+		buf.Write(h.Offset[:])
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+	return buf.Bytes()
+}
+
+// readOffsetState reads offsetstate.dat
+func readOffsetState(name string) (st offsetState, err error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return
+	}
+	if len(b) < 4+32+4+4+4+4+sha256.Size ||
+		!bytes.Equal(b[:4], offsetStateMagic[:]) {
+		err = fmt.Errorf("%s is not an offset state file", name)
+		return
+	}
+	payload := b[:len(b)-sha256.Size]
+	sum := sha256.Sum256(payload)
+	if !bytes.Equal(sum[:], b[len(payload):]) {
+		err = fmt.Errorf("%s checksum mismatch, file is corrupt", name)
+		return
+	}
+	r := bytes.NewReader(payload[4:])
+	r.Read(st.tip[:])
+	binary.Read(r, binary.BigEndian, &st.height)
+	binary.Read(r, binary.BigEndian, &st.fileNum)
+	binary.Read(r, binary.BigEndian, &st.offset)
+	var count uint32
+	binary.Read(r, binary.BigEndian, &count)
+	if int64(count)*72 != int64(r.Len()) {
+		err = fmt.Errorf("%s says %d pending headers but has %d bytes "+
+			"for them", name, count, r.Len())
+		return
+	}
+	st.pending = make([]RawHeaderData, count)
+	for i := range st.pending {
+		h := &st.pending[i]
+		r.Read(h.CurrentHeaderHash[:])
+		r.Read(h.Prevhash[:])
+		r.Read(h.FileNum[:])
+		r.Read(h.Offset[:])
+	}
+	return
+}
+
 // buildOffsetFile builds an offsetFile which acts as an index
 // for block locations since blk*.dat files generated by Bitcoin Core
 // has blocks out of order.
 //
-// If you have more blk*.dat files to generate an index for, just
-// delete the current offsetfile directory and run genproofs again.
-// Fairly quick process with one blk*.dat file taking a few seconds.
+// It starts over from blk00000.dat; updateOffsetFile carries on from where
+// the last build left off.  Fairly quick process with one blk*.dat file
+// taking a few seconds.
 //
 // Returns the last block height that it processed.
 func buildOffsetFile(cfg *Config, tip util.Hash,
 	cOffsetFile, cLastOffsetHeightFile string) (int32, error) {
 
-	// Map to store Block Header Hashes for sorting purposes
-	// blk*.dat files aren't in block order so this is needed
-	nextMap := make(map[[32]byte]RawHeaderData)
+	st := offsetState{tip: tip}
+	return indexBlkFiles(cfg, &st, cOffsetFile, cLastOffsetHeightFile)
+}
 
-	var offsetFile *os.File
+// updateOffsetFile adds the blocks that were written to the blk files since
+// the offset file was last built or updated.  Returns the last block height
+// in it.
+func updateOffsetFile(cfg *Config) (int32, error) {
+	st, err := readOffsetState(cfg.UtreeDir.OffsetDir.offsetStateFile)
+	if err != nil {
+		return 0, err
+	}
+	return indexBlkFiles(cfg, &st, "", "")
+}
 
-	// If empty string is given, just use the default path
-	// If not, then use the custom one given
-	if cOffsetFile == "" {
-		var err error
-		offsetFile, err = os.OpenFile(cfg.UtreeDir.OffsetDir.OffsetFile, os.O_CREATE|os.O_WRONLY, 0600)
-		if err != nil {
-			panic(err)
-		}
-	} else {
-		var err error
-		offsetFile, err = os.OpenFile(cOffsetFile,
-			os.O_CREATE|os.O_WRONLY, 0600)
-		if err != nil {
-			panic(err)
-		}
+// indexBlkFiles reads the blk files from where st left off and puts the
+// blocks that go on the tip on the end of the offset file.  Then it writes
+// out st and the last height.  Empty file names mean the default paths.
+func indexBlkFiles(cfg *Config, st *offsetState,
+	cOffsetFile, cLastOffsetHeightFile string) (int32, error) {
+
+	offsetFileName := cfg.UtreeDir.OffsetDir.OffsetFile
+	lastHeightFileName := cfg.UtreeDir.OffsetDir.lastIndexOffsetHeightFile
+	stateFileName := cfg.UtreeDir.OffsetDir.offsetStateFile
+	if cOffsetFile != "" {
+		offsetFileName = cOffsetFile
+		stateFileName = cOffsetFile + ".state"
+	}
+	if cLastOffsetHeightFile != "" {
+		lastHeightFileName = cLastOffsetHeightFile
 	}
 
 	lvdb, err := OpenIndexFile(cfg.BlockDir)
 	if err != nil {
 		return 0, err
 	}
+	chain, err := readActiveChain(lvdb)
+	if err == nil {
+		err = st.followReorg(chain)
+	}
+	if err != nil {
+		lvdb.Close()
+		return 0, err
+	}
+
+	// blocks have to go in the offset file in order, so the next one
+	// can't be pruned away
+	pi, err := readPruneInfo(lvdb)
+	if err == nil {
+		err = pi.check(cfg.BlockDir, st.height+1)
+	}
+	if err != nil {
+		lvdb.Close()
+		return 0, err
+	}
 
 	bufDB := BufferDB(lvdb)
 	lvdb.Close()
 
-	var lastOffsetHeight int32
+	offsetFile, err := os.OpenFile(offsetFileName, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer offsetFile.Close()
+	// anything past the height in the state is from a run that stopped
+	// before writing the state, or from before a reorg
+	err = offsetFile.Truncate(int64(st.height) * 12)
+	if err != nil {
+		return 0, err
+	}
+	_, err = offsetFile.Seek(int64(st.height)*12, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := readXorKey(cfg.BlockDir)
+	if err != nil {
+		return 0, err
+	}
+
+	// Map to store Block Header Hashes for sorting purposes
+	// blk*.dat files aren't in block order so this is needed
+	nextMap := make(map[[32]byte]RawHeaderData)
 
 	// Allocate buffered reader for readRawHeadersFromFile
 	// Less overhead to pre allocate and reuse
 	bufReader := bufio.NewReaderSize(nil, (1<<20)*128) // 128M
 	wr := bufio.NewWriter(nil)
 
-	defer offsetFile.Close()
-	for fileNum := 0; ; fileNum++ {
+	// first the ones left over from last time.  Some may have undo data now
+	var noUndo []RawHeaderData
+	var pending []RawHeaderData
+	for _, b := range chain.connectable(st.pending, st.height) {
+		var ok bool
+		b.UndoPos, ok = bufDB[b.CurrentHeaderHash]
+		if !ok {
+			noUndo = append(noUndo, b)
+			continue
+		}
+		pending = append(pending, b)
+	}
+	tip, height, err := writeBlockOffset(
+		pending, nextMap, wr, offsetFile, st.height, st.tip)
+	if err != nil {
+		return 0, err
+	}
+
+	offset := st.offset
+	for fileNum := st.fileNum; ; fileNum++ {
 		fileName := fmt.Sprintf("blk%05d.dat", fileNum)
 		filePath := filepath.Join(cfg.BlockDir, fileName)
 		fmt.Printf("Building offsetfile... %s\n", fileName)
@@ -73,94 +260,248 @@ func buildOffsetFile(cfg *Config, tip util.Hash,
 			break
 		}
 		// grab headers from the .dat file as RawHeaderData type
-		rawheaders, err := readRawHeadersFromFile(bufReader, filePath, uint32(fileNum), bufDB)
+		rawheaders, missing, end, err := readRawHeadersFromFile(
+			bufReader, filePath, fileNum, offset, key, cfg.params.Net, bufDB)
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
-		tip, lastOffsetHeight, err = writeBlockOffset(
-			rawheaders, nextMap, wr, offsetFile, lastOffsetHeight, tip)
+		noUndo = append(noUndo, chain.connectable(missing, height)...)
+		tip, height, err = writeBlockOffset(chain.connectable(rawheaders,
+			height), nextMap, wr, offsetFile, height, tip)
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
+		st.fileNum, st.offset = fileNum, end
+		offset = 0
+	}
+
+	err = offsetFile.Sync()
+	if err != nil {
+		return 0, err
+	}
+
+	st.tip, st.height = tip, height
+	st.pending = chain.connectable(noUndo, height)
+	for _, b := range nextMap {
+		st.pending = append(st.pending, chain.connectable(
+			[]RawHeaderData{b}, height)...)
+	}
+	err = util.WriteFileAtomic(stateFileName, st.serialize(), 0600)
+	if err != nil {
+		return 0, err
+	}
+
+	// write the last height of the offsetfile
+	// needed info for the main genproofs processes
+	var heightBytes [4]byte
+	binary.BigEndian.PutUint32(heightBytes[:], uint32(height))
+	err = util.WriteFileAtomic(lastHeightFileName, heightBytes[:], 0600)
+	if err != nil {
+		return 0, err
 	}
 
-	// If empty string is given, just use the default path
-	// If not, then use the custom one given
-	if cLastOffsetHeightFile == "" {
-		var err error
-		// write the last height of the offsetfile
-		// needed info for the main genproofs processes
-		LastIndexOffsetHeightFile, err := os.OpenFile(cfg.UtreeDir.OffsetDir.lastIndexOffsetHeightFile, os.O_CREATE|os.O_WRONLY, 0600)
+	return height, nil
+}
+
+// indexBlock is what the offset file needs from a block in bitcoind's
+// block index
+type indexBlock struct {
+	prev   util.Hash
+	height int32
+	file   int32    // blk file it's in, -1 if it has no data
+	work   *big.Int // of the chain up to and including it
+	active bool     // on bitcoind's active chain
+}
+
+// activeChain is every block in bitcoind's block index, with the ones on
+// its active chain marked
+type activeChain map[util.Hash]*indexBlock
+
+// readActiveChain reads the block index and finds the active chain
+func readActiveChain(lvdb *leveldb.DB) (activeChain, error) {
+	chain := make(activeChain)
+	type entry struct {
+		hash   util.Hash
+		status int32
+		bits   uint32
+	}
+	var entries []entry
+	iter := lvdb.NewIterator(dbutil.BytesPrefix([]byte{0x62}), nil)
+	for iter.Next() {
+		var e entry
+		copy(e.hash[:], iter.Key()[1:])
+		r := bytes.NewReader(iter.Value())
+		cbIdx := ReadCBlockFileIndex(r)
+		// the header comes after the positions
+		var hdr wire.BlockHeader
+		err := hdr.Deserialize(r)
 		if err != nil {
-			panic(err)
+			iter.Release()
+			return nil, fmt.Errorf("block index entry for %x: %s",
+				e.hash, err.Error())
 		}
-		defer LastIndexOffsetHeightFile.Close()
-		// write to the file
-		err = binary.Write(LastIndexOffsetHeightFile, binary.BigEndian, lastOffsetHeight)
-		if err != nil {
-			panic(err)
+		e.status, e.bits = cbIdx.Status, hdr.Bits
+		b := &indexBlock{
+			prev:   util.Hash(hdr.PrevBlock),
+			height: cbIdx.Height,
+			file:   cbIdx.File,
 		}
-	} else {
-		var err error
-		// write the last height of the offsetfile
-		// needed info for the main genproofs processes
-		LastIndexOffsetHeightFile, err := os.OpenFile(
-			cLastOffsetHeightFile, os.O_CREATE|os.O_WRONLY, 0600)
-		if err != nil {
-			panic(err)
+		if cbIdx.Status&BlockHaveData == 0 {
+			b.file = -1
 		}
-		defer LastIndexOffsetHeightFile.Close()
-		// write to the file
-		err = binary.Write(LastIndexOffsetHeightFile, binary.BigEndian, lastOffsetHeight)
-		if err != nil {
-			panic(err)
+		chain[e.hash] = b
+		entries = append(entries, e)
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		return nil, err
+	}
+
+	// parents first, so their work is there for their children
+	sort.Slice(entries, func(i, j int) bool {
+		return chain[entries[i].hash].height < chain[entries[j].hash].height
+	})
+	var tip *indexBlock
+	for _, e := range entries {
+		b := chain[e.hash]
+		b.work = blockchain.CalcWork(e.bits)
+		if parent, ok := chain[b.prev]; ok && parent.work != nil {
+			b.work.Add(b.work, parent.work)
 		}
+		if e.status&BlockValidMask >= BlockValidScripts &&
+			e.status&BlockFailedMask == 0 &&
+			(tip == nil || b.work.Cmp(tip.work) > 0) {
+			tip = b
+		}
+	}
+	for b := tip; b != nil; b = chain[b.prev] {
+		b.active = true
+	}
+	return chain, nil
+}
+
+// connectable leaves out the headers that can't go on the offset file at
+// height: the ones that aren't on the active chain, and the ones that are
+// but are in the offset file already.  Headers that aren't in the index at
+// all are kept.
+func (chain activeChain) connectable(
+	headers []RawHeaderData, height int32) []RawHeaderData {
+
+	var keep []RawHeaderData
+	for _, h := range headers {
+		b, ok := chain[h.CurrentHeaderHash]
+		if ok && (!b.active || b.height <= height) {
+			continue
+		}
+		keep = append(keep, h)
+	}
+	return keep
+}
+
+// followReorg checks that the tip is still on the active chain.  If not, it
+// goes back to where the tip forks off and to the first blk file with an
+// active block after that, so that indexing goes on from there.
+func (st *offsetState) followReorg(chain activeChain) error {
+	if st.height == 0 {
+		return nil
+	}
+	fork := st.tip
+	for {
+		b, ok := chain[fork]
+		if !ok {
+			return fmt.Errorf("block %x in the offset file isn't in "+
+				"bitcoind's block index.  Delete the offsetdata "+
+				"directory to index again", fork)
+		}
+		if b.active {
+			break
+		}
+		fork = b.prev
+	}
+	if fork == st.tip {
+		return nil
 	}
 
-	return lastOffsetHeight, nil
+	forkHeight := chain[fork].height
+	fileNum := int32(-1)
+	for _, b := range chain {
+		if b.active && b.height > forkHeight && b.file != -1 &&
+			(fileNum == -1 || b.file < fileNum) {
+			fileNum = b.file
+		}
+	}
+	fmt.Printf("bitcoind reorged from block %d, indexing from there again\n",
+		forkHeight)
+	st.tip, st.height = fork, forkHeight
+	if fileNum != -1 && uint32(fileNum) <= st.fileNum {
+		st.fileNum, st.offset = uint32(fileNum), 0
+	}
+	// they'll be read again if they're still needed
+	st.pending = nil
+	return nil
 }
 
-// readRawHeadersFromFile reads only the headers from the given .dat file
+// readRawHeadersFromFile reads only the headers from the given .dat file,
+// starting at offset, un-obfuscating with key.  Blocks have to start with
+// the magic of network net.  Headers of blocks without undo data come back
+// in noUndo.  end is where the last whole block in the file ends.
 func readRawHeadersFromFile(
-	bufReader *bufio.Reader, fileDir string,
-	fileNum uint32, bufMap map[[32]byte]uint32) ([]RawHeaderData, error) {
-	var blockHeaders []RawHeaderData
+	bufReader *bufio.Reader, fileDir string, fileNum uint32, offset uint32,
+	key xorKey, net wire.BitcoinNet, bufMap map[[32]byte]uint32) (
+	blockHeaders, noUndo []RawHeaderData, end uint32, err error) {
 
 	f, err := os.Open(fileDir)
 	if err != nil {
-		panic(err)
+		return
 	}
 	defer f.Close()
 
 	fStat, err := f.Stat()
 	if err != nil {
-		panic(err)
+		return
 	}
 	fSize := fStat.Size()
 
-	bufReader.Reset(f)
+	_, err = f.Seek(int64(offset), 0)
+	if err != nil {
+		return
+	}
+	bufReader.Reset(&xorReader{r: f, key: key, pos: int64(offset)})
 
-	var buf [88]byte    // buffer for magicbytes, size, and 80 byte header
-	offset := uint32(0) // where the block is located from the beginning of the file
+	var buf [88]byte // buffer for magicbytes, size, and 80 byte header
 
-	// until offset is at the end of the file
-	for int64(offset) != fSize {
+	// until offset is at the end of the file.  offset is where the block
+	// is located from the beginning of the file
+	for int64(offset)+88 <= fSize {
 		b := new(RawHeaderData)
 		binary.BigEndian.PutUint32(b.FileNum[:], fileNum)
 		binary.BigEndian.PutUint32(b.Offset[:], offset)
 
-		_, err := bufReader.Read(buf[:])
+		_, err = io.ReadFull(bufReader, buf[:])
 		if err != nil {
-			panic(err)
+			return
 		}
-		// check if Bitcoin magic bytes were read
-		if !util.CheckMagicByte(buf[:4]) {
+		// check if Bitcoin magic bytes were read.  After the last block
+		// bitcoind leaves zeros
+		if !util.CheckMagicByte(buf[:4], net) {
 			break
 		}
 
 		// read the 4 byte size of the load of the block
 		size := binary.LittleEndian.Uint32(buf[4:8])
 
+		// a block that's still being written
+		if size < 80 || int64(offset)+8+int64(size) > fSize {
+			break
+		}
+
+		// offset for the next block from the current position
+		_, err = bufReader.Discard(int(size) - 80)
+		if err != nil {
+			return
+		}
+
 		// add 8bytes for the magic bytes (4bytes) and size (4bytes)
 		offset = offset + size + uint32(8)
 
@@ -171,23 +512,21 @@ func readRawHeadersFromFile(
 		first := sha256.Sum256(buf[8 : 8+80])
 		b.CurrentHeaderHash = sha256.Sum256(first[:])
 
-		// offset for the next block from the current position
-		bufReader.Discard(int(size) - 80)
-
 		// grab bitcoin core block index info
 		var ok bool
 		b.UndoPos, ok = bufMap[b.CurrentHeaderHash]
 		if !ok {
 			fmt.Printf("WARNING: block in blk file with header: %x\nexists without"+
 				" a corresponding rev block. May be wasting disk space\n", b.CurrentHeaderHash)
-			// skip block headers that don't have undo data
+			// try blocks without undo data again next time
+			noUndo = append(noUndo, *b)
 			continue
 		}
 
 		blockHeaders = append(blockHeaders, *b)
 	}
 
-	return blockHeaders, nil
+	return blockHeaders, noUndo, offset, nil
 }
 
 // Sorts and writes the block offset from the passed in blockHeaders.
@@ -2,132 +2,462 @@ package bridgenode
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
 	"github.com/mit-dci/utreexo/util"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
-func BenchmarkBuildOffsetFile(b *testing.B) {
-	tmpDir, err := ioutil.TempDir("", "test")
+// testBlocks is a regtest blocks dir with blk files and a block index, like
+// bitcoind's
+type testBlocks struct {
+	t      *testing.T
+	cfg    *Config
+	index  map[util.Hash][]byte // block index entries
+	nonce  uint32
+	hashes map[int32]util.Hash // what was made at each height, last one
+	pos    map[util.Hash][2]uint32
+}
+
+func newTestBlocks(t *testing.T) *testBlocks {
+	cfg := &Config{
+		params:   chaincfg.RegressionNetParams,
+		BlockDir: t.TempDir(),
+		UtreeDir: initUtreeDir(t.TempDir()),
+	}
+	makePaths(cfg.UtreeDir)
+	tb := &testBlocks{
+		t:      t,
+		cfg:    cfg,
+		index:  make(map[util.Hash][]byte),
+		hashes: make(map[int32]util.Hash),
+		pos:    make(map[util.Hash][2]uint32),
+	}
+	// genesis goes first in blk00000.dat, like in bitcoind
+	tb.write(0, 0, cfg.params.GenesisBlock, BlockValidScripts|BlockHaveData)
+	return tb
+}
+
+// block makes a block on top of prev at height and writes it to blk file
+// num with status
+func (tb *testBlocks) block(num uint32, prev util.Hash, height int32,
+	status int32) util.Hash {
+
+	return tb.write(num, height, tb.newBlock(prev, height), status)
+}
+
+// newBlock makes a block on top of prev at height, with just a coinbase
+func (tb *testBlocks) newBlock(prev util.Hash, height int32) *wire.MsgBlock {
+	tb.nonce++
+	cb := wire.NewMsgTx(1)
+	cb.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+		SignatureScript:  []byte{txscript.OP_DATA_4, byte(height), 0, 0, 0},
+	})
+	cb.AddTxOut(wire.NewTxOut(50e8, []byte{txscript.OP_TRUE}))
+	blk := &wire.MsgBlock{
+		Header: wire.BlockHeader{
+			PrevBlock:  chainhash.Hash(prev),
+			MerkleRoot: cb.TxHash(),
+			Bits:       tb.cfg.params.PowLimitBits,
+			Nonce:      tb.nonce,
+		},
+		Transactions: []*wire.MsgTx{cb},
+	}
+	return blk
+}
+
+// chain makes blocks on top of prev up to height in blk file num, all valid
+// with undo data
+func (tb *testBlocks) chain(num uint32, prev util.Hash, from, to int32) {
+	for h := from; h <= to; h++ {
+		prev = tb.block(num, prev, h,
+			BlockValidScripts|BlockHaveData|BlockHaveUndo)
+	}
+}
+
+func (tb *testBlocks) write(num uint32, height int32, blk *wire.MsgBlock,
+	status int32) util.Hash {
+
+	name := filepath.Join(tb.cfg.BlockDir, fmt.Sprintf("blk%05d.dat", num))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		tb.t.Fatal(err)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		tb.t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(tb.cfg.params.Net))
+	binary.Write(&buf, binary.LittleEndian, uint32(blk.SerializeSize()))
+	blk.Serialize(&buf)
+	_, err = f.Write(buf.Bytes())
 	if err != nil {
-		b.Fatal(err)
+		tb.t.Fatal(err)
 	}
-	defer os.RemoveAll(tmpDir) // clean up. Always runs
 
-	// grab the datadir for this system
-	// use testnet3
-	testnetDataDir := filepath.Join(util.GetBitcoinDataDir(), "testnet3/blocks")
-	tmpOffsetFile := filepath.Join(tmpDir, "offsetfile")
-	tmpLastOffsetHeightFile := filepath.Join(tmpDir, "loffsetfile")
+	hash := util.Hash(blk.BlockHash())
+	tb.hashes[height] = hash
+	tb.pos[hash] = [2]uint32{num, uint32(st.Size())}
+	tb.setStatus(hash, height, status, &blk.Header)
+	return hash
+}
+
+// setStatus puts the block index entry for the block in, like
+// CDiskBlockIndex.  The undo position is its height times 100.  Blocks
+// that are only headers have no tx count.
+func (tb *testBlocks) setStatus(hash util.Hash, height int32, status int32,
+	hdr *wire.BlockHeader) {
 
-	db, err := OpenIndexFile(testnetDataDir)
+	if hdr == nil {
+		// keep the header that's there
+		old := tb.index[hash]
+		r := bytes.NewReader(old)
+		ReadCBlockFileIndex(r)
+		hdr = new(wire.BlockHeader)
+		hdr.Deserialize(r)
+	}
+	var b [5]byte
+	var entry []byte
+	var txCount uint64
+	if status&BlockValidMask >= BlockValidTransactions {
+		txCount = 1
+	}
+	for _, n := range []uint64{1, uint64(height), uint64(status), txCount} {
+		entry = append(entry, b[:putVLQ(b[:], n)]...)
+	}
+	pos := tb.pos[hash]
+	if status&BlockHaveMask != 0 {
+		entry = append(entry, b[:putVLQ(b[:], uint64(pos[0]))]...)
+	}
+	if status&BlockHaveData != 0 {
+		entry = append(entry, b[:putVLQ(b[:], uint64(pos[1]+8))]...)
+	}
+	if status&BlockHaveUndo != 0 {
+		entry = append(entry, b[:putVLQ(b[:], uint64(height)*100)]...)
+	}
+	var hbuf bytes.Buffer
+	hdr.Serialize(&hbuf)
+	tb.index[hash] = append(entry, hbuf.Bytes()...)
+}
+
+// writeIndex writes the block index out to blocks/index.  It's only open
+// while it's written, since indexBlkFiles opens it too.
+func (tb *testBlocks) writeIndex() {
+	db, err := leveldb.OpenFile(filepath.Join(tb.cfg.BlockDir, "index"),
+		&opt.Options{Compression: opt.NoCompression})
 	if err != nil {
-		b.Fatal(err)
+		tb.t.Fatal(err)
 	}
 	defer db.Close()
+	for hash, v := range tb.index {
+		err = db.Put(append([]byte{0x62}, hash[:]...), v, nil)
+		if err != nil {
+			tb.t.Fatal(err)
+		}
+	}
+}
 
-	hash, err := util.GenHashForNet(chaincfg.TestNet3Params)
+// build builds the offset file from the start
+func (tb *testBlocks) build() int32 {
+	tb.writeIndex()
+	height, err := buildOffsetFile(tb.cfg,
+		util.Hash(*tb.cfg.params.GenesisHash), "", "")
 	if err != nil {
-		b.Fatal(err)
+		tb.t.Fatal(err)
 	}
+	return height
+}
 
-	_, err = buildOffsetFile(testnetDataDir, *hash, tmpOffsetFile, tmpLastOffsetHeightFile)
+// update adds to the offset file
+func (tb *testBlocks) update() int32 {
+	tb.writeIndex()
+	height, err := updateOffsetFile(tb.cfg)
 	if err != nil {
-		b.Fatal(err)
+		tb.t.Fatal(err)
 	}
+	return height
 }
 
-func TestBuildOffsetFile(t *testing.T) {
-	tmpDir, err := ioutil.TempDir("", "test")
+// check checks that the offset file has the blocks in hashes, in order, and
+// that the state and last height files agree with it
+func (tb *testBlocks) check(hashes []util.Hash) []byte {
+	b, err := ioutil.ReadFile(tb.cfg.UtreeDir.OffsetDir.OffsetFile)
 	if err != nil {
-		t.Fatal(err)
+		tb.t.Fatal(err)
+	}
+	if len(b) != len(hashes)*12 {
+		tb.t.Fatalf("offset file has %d blocks, expected %d",
+			len(b)/12, len(hashes))
+	}
+	for i, hash := range hashes {
+		height := int32(i + 1)
+		pos := tb.pos[hash]
+		e := b[i*12 : i*12+12]
+		if binary.BigEndian.Uint32(e[0:4]) != pos[0] ||
+			binary.BigEndian.Uint32(e[4:8]) != pos[1] ||
+			binary.BigEndian.Uint32(e[8:12]) != uint32(height)*100 {
+			tb.t.Fatalf("block %d at %x, expected file %d offset %d",
+				height, e, pos[0], pos[1])
+		}
 	}
-	defer os.RemoveAll(tmpDir) // clean up. Always runs
 
-	// grab the datadir for this system
-	// use testnet3
-	testnetDataDir := filepath.Join(util.GetBitcoinDataDir(), "testnet3/blocks")
-	// grab testnet3 hash
-	testnetHash, err := util.GenHashForNet(chaincfg.TestNet3Params)
+	st, err := readOffsetState(tb.cfg.UtreeDir.OffsetDir.offsetStateFile)
 	if err != nil {
-		t.Fatal(err)
+		tb.t.Fatal(err)
 	}
-
-	tmpOffsetFile := filepath.Join(tmpDir, "offsetfile")
-	tmpLastOffsetHeightFile := filepath.Join(tmpDir, "loffsetfile")
-
-	// build offsetfile
-	fmt.Println("creating offestfile...")
-	lastOffsetHeight, err := buildOffsetFile(testnetDataDir,
-		*testnetHash, tmpOffsetFile, tmpLastOffsetHeightFile)
+	tip := util.Hash(*tb.cfg.params.GenesisHash)
+	if len(hashes) > 0 {
+		tip = hashes[len(hashes)-1]
+	}
+	if st.height != int32(len(hashes)) || st.tip != tip {
+		tb.t.Fatalf("state at %d %x, expected %d %x",
+			st.height, st.tip, len(hashes), tip)
+	}
+	lh, err := ioutil.ReadFile(
+		tb.cfg.UtreeDir.OffsetDir.lastIndexOffsetHeightFile)
 	if err != nil {
-		t.Fatal(err)
+		tb.t.Fatal(err)
+	}
+	if binary.BigEndian.Uint32(lh) != uint32(len(hashes)) {
+		tb.t.Fatalf("last height file says %d", binary.BigEndian.Uint32(lh))
 	}
+	return b
+}
 
-	lvdb, err := OpenIndexFile(testnetDataDir)
+// pending gives the hashes of the pending headers in the state
+func (tb *testBlocks) pending() map[util.Hash]bool {
+	st, err := readOffsetState(tb.cfg.UtreeDir.OffsetDir.offsetStateFile)
 	if err != nil {
-		t.Fatal(err)
+		tb.t.Fatal(err)
 	}
-	bnrChan := make(chan BlockAndRev, 10)
-
-	fmt.Println("checking the offestfile created...")
-
-	// Start the reader
-	go BlockAndRevReader(bnrChan, testnetDataDir, tmpOffsetFile,
-		lastOffsetHeight, 1)
+	p := make(map[util.Hash]bool)
+	for _, h := range st.pending {
+		p[h.CurrentHeaderHash] = true
+	}
+	return p
+}
 
-	// Check that things in the offsetfile are correct
-	// 200,000 blocks is prob enough
-	for i := int32(1); i < 200000; i++ { // skip genesis
-		bnr := <-bnrChan
+// hashesTo gives the hashes of the blocks made last at heights 1 to height
+func (tb *testBlocks) hashesTo(height int32) []util.Hash {
+	var hs []util.Hash
+	for h := int32(1); h <= height; h++ {
+		hs = append(hs, tb.hashes[h])
+	}
+	return hs
+}
 
-		cbIdx := GetBlockIndexInfo(bnr.Blk.BlockHash(), lvdb)
-		// Check that the height is correct
-		if cbIdx.Height != i {
-			err := fmt.Errorf(
-				"CBlockFileIndex height is: %d but it should be %d",
-				cbIdx.Height, i)
+func TestOffsetStateSerialize(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "offsetstate.dat")
+	for _, st := range []offsetState{
+		{},
+		{tip: util.Hash{1, 2}, height: 300, fileNum: 4, offset: 12345},
+		{tip: util.Hash{3}, height: 7, fileNum: 1, offset: 88,
+			pending: []RawHeaderData{
+				{CurrentHeaderHash: [32]byte{4}, Prevhash: [32]byte{5},
+					FileNum: [4]byte{0, 0, 0, 1}, Offset: [4]byte{0, 0, 1, 0}},
+				{CurrentHeaderHash: [32]byte{6}, Prevhash: [32]byte{4}},
+			}},
+	} {
+		err := ioutil.WriteFile(name, st.serialize(), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readOffsetState(name)
+		if err != nil {
 			t.Fatal(err)
 		}
-		// Check that there are same number of txs and rev txs (minus coinbase)
-		if len(bnr.Blk.Transactions)-1 != len(bnr.Rev.Txs) {
-			err := fmt.Errorf(
-				"block height: %d has %d txs but rev block has: %d txs",
-				i, len(bnr.Blk.Transactions), len(bnr.Rev.Txs))
+		// UndoPos isn't kept, it's looked up again
+		if len(st.pending) == 0 {
+			st.pending = []RawHeaderData{}
+		}
+		if !reflect.DeepEqual(got, st) {
+			t.Fatalf("got %+v, expected %+v", got, st)
+		}
+	}
+
+	st := offsetState{tip: util.Hash{9}, height: 2,
+		pending: []RawHeaderData{{CurrentHeaderHash: [32]byte{8}}}}
+	good := st.serialize()
+	bad := map[string][]byte{
+		"empty":     nil,
+		"truncated": good[:len(good)-1],
+		"flipped":   append([]byte{}, good...),
+		"magic":     append([]byte{}, good...),
+	}
+	bad["flipped"][40] ^= 1
+	bad["magic"][3] = 0x02
+	// a count that doesn't match what's there, with a good checksum
+	count := append([]byte{}, good[:len(good)-32]...)
+	binary.BigEndian.PutUint32(count[4+32+12:], 2)
+	sum := sha256.Sum256(count)
+	bad["count"] = append(count, sum[:]...)
+	for what, b := range bad {
+		err := ioutil.WriteFile(name, b, 0600)
+		if err != nil {
 			t.Fatal(err)
 		}
-		if i%20000 == 0 {
-			fmt.Println("# of tested blocks: ", i)
+		_, err = readOffsetState(name)
+		if err == nil {
+			t.Errorf("%s state file read without error", what)
 		}
 	}
+	_, err := readOffsetState(filepath.Join(t.TempDir(), "none"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("missing state file gave %v", err)
+	}
+}
+
+func TestIndexBlkFiles(t *testing.T) {
+	tb := newTestBlocks(t)
+	genesis := util.Hash(*tb.cfg.params.GenesisHash)
+
+	// blocks out of order in the first file
+	h1 := tb.block(0, genesis, 1, BlockValidScripts|BlockHaveMask)
+	b2 := tb.newBlock(h1, 2)
+	b3 := tb.newBlock(util.Hash(b2.BlockHash()), 3)
+	h3 := tb.write(0, 3, b3, BlockValidScripts|BlockHaveMask)
+	tb.write(0, 2, b2, BlockValidScripts|BlockHaveMask)
+	tb.chain(0, h3, 4, 5)
+	if tb.build() != 5 {
+		t.Fatal("didn't build to 5")
+	}
+	first := tb.check(tb.hashesTo(5))
+	if len(tb.pending()) != 0 {
+		t.Fatalf("pending after building: %v", tb.pending())
+	}
+
+	// more in the same file and the next.  11 has no undo data yet.
+	tb.chain(0, tb.hashes[5], 6, 8)
+	tb.chain(1, tb.hashes[8], 9, 10)
+	h11 := tb.block(1, tb.hashes[10], 11, BlockValidScripts|BlockHaveData)
+	if tb.update() != 10 {
+		t.Fatal("didn't update to 10")
+	}
+	b := tb.check(tb.hashesTo(10))
+	if !bytes.Equal(b[:len(first)], first) {
+		t.Fatal("update changed what was there")
+	}
+	if !reflect.DeepEqual(tb.pending(), map[util.Hash]bool{h11: true}) {
+		t.Fatalf("pending %v, expected block 11", tb.pending())
+	}
+
+	// nothing new
+	if tb.update() != 10 {
+		t.Fatal("update with nothing new changed the height")
+	}
+
+	// 11 gets its undo data, and the state alone finds it
+	tb.setStatus(h11, 11, BlockValidScripts|BlockHaveMask, nil)
+	if tb.update() != 11 {
+		t.Fatal("didn't update to 11")
+	}
+	tb.check(tb.hashesTo(11))
+	if len(tb.pending()) != 0 {
+		t.Fatalf("pending %v after 11 connected", tb.pending())
+	}
+
+	// a state past the end of the offset file, like after a crash
+	f, err := os.OpenFile(tb.cfg.UtreeDir.OffsetDir.OffsetFile,
+		os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, 30))
+	f.Close()
+	if tb.update() != 11 {
+		t.Fatal("update after junk changed the height")
+	}
+	tb.check(tb.hashesTo(11))
 }
 
-// GetBlockIndexInfo returns a CBlockFileIndex based on the hash given as a key
-func GetBlockIndexInfo(h [32]byte, lvdb *leveldb.DB) CBlockFileIndex {
-	// 0x62 is hex representation of ascii 'b' (98), which is used
-	// appended to block keys in leveldb
-	lookup := append([]byte{0x62}, h[:]...)
+func TestIndexBlkFilesStale(t *testing.T) {
+	tb := newTestBlocks(t)
+	genesis := util.Hash(*tb.cfg.params.GenesisHash)
+	tb.chain(0, genesis, 1, 4)
+	main := tb.hashesTo(4)
 
-	value, err := lvdb.Get(lookup, nil)
-	if err == leveldb.ErrClosed { // Handle db closed err
-		panic(err)
+	// a block 3 and 4 that lost, one without undo data, and one that was
+	// invalid
+	s3 := tb.block(0, main[1], 3, BlockValidScripts|BlockHaveData)
+	s4 := tb.block(0, s3, 4, BlockValidTree|BlockHaveData)
+	bad := tb.block(0, main[3], 5,
+		BlockValidTree|BlockHaveData|BlockFailedValid)
+	tb.hashes[3], tb.hashes[4] = main[2], main[3]
+	delete(tb.hashes, 5)
+	if tb.build() != 4 {
+		t.Fatal("didn't build to 4")
+	}
+	tb.check(main)
+	for _, hash := range []util.Hash{s3, s4, bad} {
+		if tb.pending()[hash] {
+			t.Fatalf("stale block %x still pending", hash)
+		}
 	}
-	// Sometimes there may be a block in blk that is not verified but is just sitting there
-	// Warn the user about it but ignore it since it doesn't effect the actual validation
-	if err != nil { // all other returned errors are from reading the db
-		str := fmt.Errorf("%s WARNING: A block in blk file exists without"+
-			"a corresponding rev block location. May be wasting disk space", err)
-		fmt.Println(str)
+	if len(tb.pending()) != 0 {
+		t.Fatalf("pending %v", tb.pending())
+	}
+}
+
+func TestIndexBlkFilesReorg(t *testing.T) {
+	tb := newTestBlocks(t)
+	genesis := util.Hash(*tb.cfg.params.GenesisHash)
+	tb.chain(0, genesis, 1, 8)
+	tb.chain(1, tb.hashes[8], 9, 11)
+	if tb.build() != 11 {
+		t.Fatal("didn't build to 11")
 	}
+	before := tb.check(tb.hashesTo(11))
+	old := tb.hashesTo(11)
 
-	r := bytes.NewReader(value)
-	cbIdx := ReadCBlockFileIndex(r)
+	// a longer chain from 8, partly in the file it already read
+	tb.chain(1, old[7], 9, 10)
+	tb.chain(2, tb.hashes[10], 11, 12)
+	if tb.update() != 12 {
+		t.Fatal("didn't follow the reorg to 12")
+	}
+	b := tb.check(tb.hashesTo(12))
+	if !bytes.Equal(b[:8*12], before[:8*12]) {
+		t.Fatal("blocks before the fork changed")
+	}
+	for _, hash := range tb.hashesTo(12)[8:] {
+		for _, o := range old[8:] {
+			if hash == o {
+				t.Fatal("old chain still in the offset file")
+			}
+		}
+	}
+	if len(tb.pending()) != 0 {
+		t.Fatalf("pending %v after reorg", tb.pending())
+	}
 
-	return cbIdx
+	// a tip bitcoind doesn't know about
+	st, err := readOffsetState(tb.cfg.UtreeDir.OffsetDir.offsetStateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.tip = util.Hash{0xff}
+	err = ioutil.WriteFile(tb.cfg.UtreeDir.OffsetDir.offsetStateFile,
+		st.serialize(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = updateOffsetFile(tb.cfg)
+	if err == nil {
+		t.Fatal("unknown tip didn't give an error")
+	}
 }
@@ -104,12 +104,23 @@ type txoStart struct {
 	indexWithinBlock uint32 // index in that block where the txo is created
 }
 
-// blockToAddDel turns a block into add leaves and del leaves
-func blockToAddDel(bnr BlockAndRev, inskip, outskip []uint32) (
+// blockToAddDel turns a block into add leaves and del leaves.  The del
+// leaves come from the rev block, or from the leafdb if leaves isn't nil,
+// in which case the new txos go in the leafdb too.
+func blockToAddDel(bnr BlockAndRev, inskip, outskip []uint32,
+	leaves *leafStore) (
 	blockAdds []accumulator.Leaf, delLeaves []btcacc.LeafData, err error) {
 
 	// fmt.Printf("inskip %v outskip %v\n", inskip, outskip)
-	delLeaves, err = blockNRevToDelLeaves(bnr, inskip)
+	if leaves != nil {
+		delLeaves, err = leaves.spend(&bnr.Blk, inskip)
+		if err != nil {
+			return
+		}
+		err = leaves.add(&bnr.Blk, outskip, bnr.Height)
+	} else {
+		delLeaves, err = blockNRevToDelLeaves(bnr, inskip)
+	}
 	if err != nil {
 		return
 	}
@@ -175,9 +186,10 @@ func blockNRevToDelLeaves(bnr BlockAndRev, skiplist []uint32) (
 	return
 }
 
-// ParseBlockForDB gets a block and creates a ttlRawBlock to send to the DB worker
-func ParseBlockForDB(
-	bnr BlockAndRev, inskip, outskip []uint32) ttlRawBlock {
+// ParseBlockForDB gets a block and creates a ttlRawBlock to send to the DB worker.
+// delLeaves are the txos the block spends, from blockToAddDel.
+func ParseBlockForDB(bnr BlockAndRev, delLeaves []btcacc.LeafData,
+	inskip, outskip []uint32) ttlRawBlock {
 
 	var trb ttlRawBlock
 	trb.blockHeight = bnr.Height
@@ -214,7 +226,7 @@ func ParseBlockForDB(
 
 		// for all the txins, throw that into the work as well; just a bunch of
 		// outpoints
-		for txinInTx, in := range tx.TxIn { // bit of a tounge twister
+		for _, in := range tx.TxIn { // bit of a tounge twister
 			if txInBlock == 0 {
 				txinInBlock += uint32(len(tx.TxIn))
 				break // skip coinbase input
@@ -226,12 +238,13 @@ func ParseBlockForDB(
 				txinInBlock++
 				continue
 			}
+			// append start height to slice (get from the del leaves,
+			// which are 1:1 with the spent txos)
+			trb.spentStartHeights = append(trb.spentStartHeights,
+				delLeaves[len(trb.spentTxos)].Height)
 			// append outpoint to slice
 			trb.spentTxos = append(trb.spentTxos,
 				util.OutpointToBytes(&in.PreviousOutPoint))
-			// append start height to slice (get from rev data)
-			trb.spentStartHeights = append(trb.spentStartHeights,
-				bnr.Rev.Txs[txInBlock-1].TxIn[txinInTx].Height)
 
 			txinInBlock++
 		}
@@ -0,0 +1,349 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mit-dci/utreexo/util"
+)
+
+/*
+Proofs are kept in numbered files, proof00000.dat, proof00001.dat and so on,
+like the blk files.  A record is never split between files; once the next
+one doesn't fit in maxProofFileSize a new file is started.  Files other than
+the last are never appended to, so they can be copied or archived one by
+one.  (The TTLs in them still get written as the txos are spent.)
+
+proofoffset.dat has 8 bytes for every height: 4 bytes which proof file and
+4 bytes where the record starts in it.  Height 0 has no proof and is all
+zeros.
+
+Before this all the proofs were in proof.dat and the offsets were int64s.
+migrateProofFile moves them over.
+*/
+
+// maxProofFileSize is how big a proof file gets before the next one is
+// started.  Same as bitcoind's blk files.
+var maxProofFileSize int64 = 128 << 20
+
+// proofPos is where a proof record is
+type proofPos struct {
+	file   uint32 // proofNNNNN.dat
+	offset uint32 // bytes into the file
+}
+
+// bytes is the 8 bytes of a proofPos in proofoffset.dat
+func (p proofPos) bytes() (b [8]byte) {
+	binary.BigEndian.PutUint32(b[0:4], p.file)
+	binary.BigEndian.PutUint32(b[4:8], p.offset)
+	return
+}
+
+func (p proofPos) String() string {
+	return fmt.Sprintf("proof file %d offset %d", p.file, p.offset)
+}
+
+func proofPosFromBytes(b []byte) proofPos {
+	return proofPos{
+		file:   binary.BigEndian.Uint32(b[0:4]),
+		offset: binary.BigEndian.Uint32(b[4:8]),
+	}
+}
+
+// fileName gives the name of proof file num
+func (pd proofDir) fileName(num uint32) string {
+	return filepath.Join(pd.base, fmt.Sprintf("proof%05d.dat", num))
+}
+
+// fileNums gives the numbers of the proof files there are, lowest first
+func (pd proofDir) fileNums() ([]uint32, error) {
+	infos, err := ioutil.ReadDir(pd.base)
+	if err != nil {
+		return nil, err
+	}
+	var nums []uint32
+	for _, fi := range infos {
+		name := fi.Name()
+		if !strings.HasPrefix(name, "proof") ||
+			!strings.HasSuffix(name, ".dat") || len(name) != 14 {
+			continue
+		}
+		num, err := strconv.ParseUint(name[5:10], 10, 32)
+		if err != nil {
+			continue
+		}
+		nums = append(nums, uint32(num))
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums, nil
+}
+
+// end is where the next record goes: the end of the last proof file
+func (pd proofDir) end() (proofPos, error) {
+	nums, err := pd.fileNums()
+	if err != nil || len(nums) == 0 {
+		return proofPos{}, err
+	}
+	last := nums[len(nums)-1]
+	fi, err := os.Stat(pd.fileName(last))
+	if err != nil {
+		return proofPos{}, err
+	}
+	return proofPos{file: last, offset: uint32(fi.Size())}, nil
+}
+
+// readProofPos reads where the proof for height is from the offset file
+func readProofPos(offsetFile *os.File, height int32) (proofPos, error) {
+	var b [8]byte
+	_, err := offsetFile.ReadAt(b[:], int64(height)*8)
+	if err != nil {
+		return proofPos{}, fmt.Errorf("no offset for block %d in %s: %s",
+			height, offsetFile.Name(), err.Error())
+	}
+	return proofPosFromBytes(b[:]), nil
+}
+
+// removeProofFiles removes all the proof files and the offset file
+func removeProofFiles(pd proofDir) error {
+	nums, err := pd.fileNums()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, num := range nums {
+		err = os.Remove(pd.fileName(num))
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Remove(pd.pOffsetFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// syncProofFiles fsyncs the offset file and every proof file, since TTLs
+// can be written to any of them, and gives where the proofs end
+func syncProofFiles(pd proofDir) (offsetSize int64, end proofPos, err error) {
+	offsetSize, err = syncFile(pd.pOffsetFile)
+	if err != nil {
+		return
+	}
+	nums, err := pd.fileNums()
+	if err != nil {
+		return
+	}
+	for _, num := range nums {
+		var size int64
+		size, err = syncFile(pd.fileName(num))
+		if err != nil {
+			return
+		}
+		end = proofPos{file: num, offset: uint32(size)}
+	}
+	return
+}
+
+// truncateProofs cuts off everything in the proof files from end on,
+// removing the files after the one end is in
+func truncateProofs(pd proofDir, end proofPos) error {
+	nums, err := pd.fileNums()
+	if err != nil {
+		return err
+	}
+	for _, num := range nums {
+		if num > end.file {
+			fmt.Printf("removing %s\n", pd.fileName(num))
+			err = os.Remove(pd.fileName(num))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if end == (proofPos{}) && !util.HasAccess(pd.fileName(0)) {
+		// nothing written yet
+		return nil
+	}
+	return truncateFile(pd.fileName(end.file), int64(end.offset))
+}
+
+// proofWriter adds records to the end of the proof files
+type proofWriter struct {
+	dir  proofDir
+	pos  proofPos // where the next record goes
+	file *os.File // file pos is in, nil if not opened yet
+}
+
+// write writes a whole record and gives where it went
+func (w *proofWriter) write(rec []byte) (proofPos, error) {
+	if w.pos.offset != 0 &&
+		int64(w.pos.offset)+int64(len(rec)) > maxProofFileSize {
+		// the file's done, make sure it's all on disk and start the next
+		err := w.close()
+		if err != nil {
+			return proofPos{}, err
+		}
+		w.pos = proofPos{file: w.pos.file + 1}
+	}
+	if w.file == nil {
+		var err error
+		w.file, err = os.OpenFile(
+			w.dir.fileName(w.pos.file), os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return proofPos{}, err
+		}
+	}
+	_, err := w.file.WriteAt(rec, int64(w.pos.offset))
+	if err != nil {
+		return proofPos{}, err
+	}
+	pos := w.pos
+	w.pos.offset += uint32(len(rec))
+	return pos, nil
+}
+
+// close syncs and closes the file being written to
+func (w *proofWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Sync()
+	if err != nil {
+		w.file.Close()
+		return err
+	}
+	err = w.file.Close()
+	w.file = nil
+	return err
+}
+
+// migrateProofFile moves the proofs in proof.dat to proof files.  The new
+// offsets go in proofoffset.dat.new, then proof.dat is removed, then the
+// new offsets are renamed over the old ones, so if it's interrupted it
+// either starts over or just does the rename.  A checkpoint from before
+// proof files is updated to say where the proofs end in the new files.
+func migrateProofFile(cfg *Config) error {
+	pd := cfg.UtreeDir.ProofDir
+	newOffsetFile := pd.pOffsetFile + ".new"
+	if !util.HasAccess(pd.oldPFile) {
+		if !util.HasAccess(newOffsetFile) {
+			return nil
+		}
+		err := os.Rename(newOffsetFile, pd.pOffsetFile)
+		if err != nil {
+			return err
+		}
+		return util.SyncDir(pd.base)
+	}
+	fmt.Printf("Moving proofs in %s to proof files\n", pd.oldPFile)
+
+	offBytes, err := ioutil.ReadFile(pd.pOffsetFile)
+	if err != nil {
+		return err
+	}
+	cp, haveCP, err := readCheckpoint(cfg)
+	if err != nil {
+		return err
+	}
+	// whatever's there is from a move that didn't finish
+	nums, err := pd.fileNums()
+	if err != nil {
+		return err
+	}
+	for _, num := range nums {
+		err = os.Remove(pd.fileName(num))
+		if err != nil {
+			return err
+		}
+	}
+
+	in, err := os.Open(pd.oldPFile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	w := proofWriter{dir: pd}
+	var newOffsets bytes.Buffer
+	// nothing for block 0
+	newOffsets.Write(make([]byte, 8))
+	// where the checkpoint's proofs end in the new files
+	cpEnd, foundCP := proofPos{}, cp.oldProofSize == 0
+
+	for h := 8; h+8 <= len(offBytes); h += 8 {
+		offset := int64(binary.BigEndian.Uint64(offBytes[h : h+8]))
+		var header [8]byte
+		_, err = in.ReadAt(header[:], offset)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// cut off by a crash, so it's past the checkpoint
+			break
+		}
+		if err != nil {
+			return err
+		}
+		rec := make([]byte, 8+binary.BigEndian.Uint32(header[4:]))
+		_, err = in.ReadAt(rec, offset)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		pos, err := w.write(rec)
+		if err != nil {
+			return err
+		}
+		b := pos.bytes()
+		newOffsets.Write(b[:])
+		if offset+int64(len(rec)) == cp.oldProofSize {
+			cpEnd, foundCP = w.pos, true
+		}
+	}
+	err = w.close()
+	if err != nil {
+		return err
+	}
+
+	err = util.WriteFileAtomic(newOffsetFile, newOffsets.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+	if haveCP && cp.oldProofs {
+		if !foundCP {
+			return fmt.Errorf("checkpoint at height %d says %s is %d bytes, "+
+				"but no proof ends there", cp.height, pd.oldPFile,
+				cp.oldProofSize)
+		}
+		cp.oldProofs = false
+		cp.proofEnd = cpEnd
+		err = util.WriteFileAtomic(
+			cfg.UtreeDir.ForestDir.checkpointFile, cp.serialize(), 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Remove(pd.oldPFile)
+	if err != nil {
+		return err
+	}
+	err = util.SyncDir(pd.base)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(newOffsetFile, pd.pOffsetFile)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Moved %d proofs to %d proof files\n",
+		newOffsets.Len()/8-1, w.pos.file+1)
+	return util.SyncDir(pd.base)
+}
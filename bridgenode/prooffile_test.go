@@ -0,0 +1,325 @@
+package bridgenode
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mit-dci/utreexo/util"
+)
+
+// checkProofFiles checks the proofs for blocks 1 to height can be read
+// back, and that records are where they should be with n to a file
+func checkProofFiles(t *testing.T, pd proofDir, height int32, n int64) {
+	t.Helper()
+	rec, err := makeProofRecord(testUData(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsetFile, err := os.Open(pd.pOffsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offsetFile.Close()
+	fi, err := offsetFile.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(height+1)*8 {
+		t.Fatalf("%d offsets, expected %d", fi.Size()/8, height+1)
+	}
+	for h := int32(1); h <= height; h++ {
+		pos, err := readProofPos(offsetFile, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := proofPos{file: uint32(int64(h-1) / n),
+			offset: uint32(int64(h-1) % n * int64(len(rec)))}
+		if pos != want {
+			t.Fatalf("block %d at %v, expected %v", h, pos, want)
+		}
+		b, err := GetUDataBytesFromFile(pd, h)
+		if err != nil {
+			t.Fatalf("block %d: %v", h, err)
+		}
+		if int32(binary.BigEndian.Uint32(b[:4])) != h {
+			t.Fatalf("proof for block %d is for %d",
+				h, binary.BigEndian.Uint32(b[:4]))
+		}
+	}
+	nums, err := pd.fileNums()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// after truncating, the last one can be empty
+	var files int64
+	for _, num := range nums {
+		fi, err := os.Stat(pd.fileName(num))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > maxProofFileSize {
+			t.Fatalf("%s is %d bytes, more than %d", pd.fileName(num),
+				fi.Size(), maxProofFileSize)
+		}
+		if fi.Size() > 0 {
+			files++
+		}
+	}
+	if files != (int64(height)+n-1)/n {
+		t.Fatalf("proof files %v for %d blocks", nums, height)
+	}
+}
+
+func TestProofFileRollover(t *testing.T) {
+	smallProofFiles(t, 4)
+	pd := testProofDir(t)
+	ff := openFlatFile(t, pd)
+	writeProofs(t, ff, 10)
+	checkProofFiles(t, pd, 10, 4)
+
+	// picks up in the last file
+	ff.close()
+	ff = openFlatFile(t, pd)
+	writeProofs(t, ff, 14)
+	checkProofFiles(t, pd, 14, 4)
+}
+
+func TestTruncateProofs(t *testing.T) {
+	smallProofFiles(t, 4)
+	cfg := &Config{UtreeDir: utreeDir{ProofDir: testProofDir(t)}}
+	pd := cfg.UtreeDir.ProofDir
+	ff := openFlatFile(t, pd)
+	writeProofs(t, ff, 14)
+	ff.close()
+
+	// back to the middle of a file, then to the start of one, then to
+	// nothing at all.  Writing again after gives the same files.
+	for _, height := range []int32{7, 5, 1} {
+		offsetFile, err := os.Open(pd.pOffsetFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		end, err := readProofPos(offsetFile, height)
+		offsetFile.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = rollBackToCheckpoint(cfg,
+			bridgeCheckpoint{height: height, proofEnd: end})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkProofFiles(t, pd, height-1, 4)
+		newEnd, err := pd.end()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if newEnd != end {
+			t.Fatalf("proofs end at %v after truncating to %v", newEnd, end)
+		}
+
+		ff = openFlatFile(t, pd)
+		writeProofs(t, ff, 14)
+		ff.close()
+		checkProofFiles(t, pd, 14, 4)
+	}
+}
+
+// oldProofs makes proof.dat and its offsets, with records for blocks 1 to
+// height, and a version 1 checkpoint at cpHeight
+func oldProofs(t *testing.T, height, cpHeight int32) *Config {
+	cfg := &Config{UtreeDir: initUtreeDir(t.TempDir())}
+	makePaths(cfg.UtreeDir)
+	pd := cfg.UtreeDir.ProofDir
+	var proofs, offsets bytes.Buffer
+	var cpSize int64
+	binary.Write(&offsets, binary.BigEndian, int64(0))
+	for h := int32(1); h <= height; h++ {
+		if h == cpHeight {
+			cpSize = int64(proofs.Len())
+		}
+		binary.Write(&offsets, binary.BigEndian, int64(proofs.Len()))
+		proofs.Write(oldProofRecord(t, testUData(h)))
+	}
+	err := ioutil.WriteFile(pd.oldPFile, proofs.Bytes(), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(pd.pOffsetFile, offsets.Bytes(), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cp bytes.Buffer
+	cp.Write([]byte{'b', 'n', 'c', 0x01})
+	binary.Write(&cp, binary.BigEndian, cpHeight)
+	binary.Write(&cp, binary.BigEndian, uint64(5))
+	binary.Write(&cp, binary.BigEndian, uint8(3))
+	binary.Write(&cp, binary.BigEndian, cpSize)
+	sum := sha256.Sum256(cp.Bytes())
+	cp.Write(sum[:])
+	err = ioutil.WriteFile(
+		cfg.UtreeDir.ForestDir.checkpointFile, cp.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// checkMigrated checks that proof.dat was moved to proof files with n
+// records to a file, and the checkpoint at cpHeight updated
+func checkMigrated(t *testing.T, cfg *Config, height, cpHeight int32,
+	n int64) {
+
+	t.Helper()
+	pd := cfg.UtreeDir.ProofDir
+	if util.HasAccess(pd.oldPFile) || util.HasAccess(pd.pOffsetFile+".new") {
+		t.Fatal("proof.dat or the new offsets still there")
+	}
+	rec := oldProofRecord(t, testUData(1))
+	cp, ok, err := readCheckpoint(cfg)
+	want := proofPos{file: uint32(int64(cpHeight-1) / n),
+		offset: uint32(int64(cpHeight-1) % n * int64(len(rec)))}
+	if err != nil || !ok || cp.oldProofs || cp.height != cpHeight ||
+		cp.numLeaves != 5 || cp.rows != 3 || cp.proofEnd != want {
+		t.Fatalf("checkpoint %+v %v %v, expected proofs to end at %v",
+			cp, ok, err, want)
+	}
+	offsetFile, err := os.Open(pd.pOffsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offsetFile.Close()
+	for h := int32(1); h <= height; h++ {
+		pos, err := readProofPos(offsetFile, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := proofPos{file: uint32(int64(h-1) / n),
+			offset: uint32(int64(h-1) % n * int64(len(rec)))}
+		if pos != want {
+			t.Fatalf("block %d at %v, expected %v", h, pos, want)
+		}
+		b, err := GetUDataBytesFromFile(pd, h)
+		if err != nil {
+			t.Fatalf("block %d: %v", h, err)
+		}
+		if !bytes.Equal(b, oldProofRecord(t, testUData(h))[8:]) {
+			t.Fatalf("proof for block %d changed", h)
+		}
+	}
+}
+
+func TestMigrateProofFile(t *testing.T) {
+	rec := oldProofRecord(t, testUData(1))
+	old := maxProofFileSize
+	maxProofFileSize = 4 * int64(len(rec))
+	defer func() { maxProofFileSize = old }()
+
+	cfg := oldProofs(t, 10, 8)
+	err := migrateProofFile(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMigrated(t, cfg, 10, 8, 4)
+	// nothing to do the second time
+	err = migrateProofFile(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMigrated(t, cfg, 10, 8, 4)
+	done, err := ioutil.ReadFile(cfg.UtreeDir.ForestDir.checkpointFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newOffsets, err := ioutil.ReadFile(cfg.UtreeDir.ProofDir.pOffsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stopped at each step, and run again
+	steps := map[string]func(cfg *Config){
+		// partway through writing proof files
+		"proof files": func(cfg *Config) {
+			pd := cfg.UtreeDir.ProofDir
+			for _, num := range []uint32{0, 1, 7} {
+				err := ioutil.WriteFile(pd.fileName(num), rec[:9], 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		},
+		// new offsets written, but part of them
+		"new offsets": func(cfg *Config) {
+			err := ioutil.WriteFile(cfg.UtreeDir.ProofDir.pOffsetFile+
+				".new", newOffsets[:20], 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		},
+		// the checkpoint's updated, proof.dat still there
+		"checkpoint": func(cfg *Config) {
+			err := ioutil.WriteFile(
+				cfg.UtreeDir.ForestDir.checkpointFile, done, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		},
+		// proof.dat's gone but the new offsets aren't renamed yet
+		"removed": func(cfg *Config) {
+			pd := cfg.UtreeDir.ProofDir
+			oldOffsets, err := ioutil.ReadFile(pd.pOffsetFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = migrateProofFile(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.Rename(pd.pOffsetFile, pd.pOffsetFile+".new")
+			if err == nil {
+				err = ioutil.WriteFile(pd.pOffsetFile, oldOffsets, 0600)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+	for name, step := range steps {
+		cfg := oldProofs(t, 10, 8)
+		step(cfg)
+		err := migrateProofFile(cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		checkMigrated(t, cfg, 10, 8, 4)
+	}
+
+	// a checkpoint that's not at the end of a proof is an error
+	cfg = oldProofs(t, 10, 8)
+	cp, _, err := readCheckpoint(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(cfg.UtreeDir.ForestDir.checkpointFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint64(b[17:25], uint64(cp.oldProofSize+1))
+	sum := sha256.Sum256(b[:25])
+	copy(b[25:], sum[:])
+	err = ioutil.WriteFile(cfg.UtreeDir.ForestDir.checkpointFile, b, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = migrateProofFile(cfg)
+	if err == nil {
+		t.Fatal("migrated with a checkpoint in the middle of a proof")
+	}
+	if !util.HasAccess(cfg.UtreeDir.ProofDir.oldPFile) {
+		t.Fatal("proof.dat removed after a failed migration")
+	}
+}
@@ -0,0 +1,170 @@
+package bridgenode
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mit-dci/utreexo/util"
+)
+
+/*
+With -proofretain=n only the proofs of the last n blocks are kept.  Proof
+files are dropped whole: once every record in a file is for a block more
+than n blocks before the last checkpoint, the file is removed, or moved to
+-proofarchive.  That only happens right after a checkpoint is written, so
+going back to the checkpoint never needs a file that's gone.
+
+proofoffset.dat still has an offset for every height.  A height is pruned
+if its offset is in a file before the first proof file there is.
+
+The TTLs of txos created in a pruned block are dropped, as there's no record
+to write them to anymore.  The server sends a pruned response for pruned
+heights (see wire/umsgblock.go).
+*/
+
+// proofPrune asks the flat file worker to prune
+type proofPrune struct {
+	before     int32  // drop the files with only records before this height
+	archiveDir string // move them here instead, if not empty
+	errChan    chan error
+}
+
+// pruneProofs has the flat file worker drop the proofs more than
+// cfg.proofRetain blocks before height.  Only call it once a checkpoint at
+// height is written.
+func pruneProofs(cfg *Config, height int32, pruneChan chan proofPrune) error {
+	if cfg.proofRetain == 0 {
+		return nil
+	}
+	errChan := make(chan error)
+	pruneChan <- proofPrune{
+		before:     height - cfg.proofRetain,
+		archiveDir: cfg.proofArchiveDir,
+		errChan:    errChan,
+	}
+	return <-errChan
+}
+
+// prune removes (or archives) the proof files before the one with the
+// proof for p.before.  Lowest first, so if it's interrupted the files left
+// still start at some file and go on from there.
+func (ff *flatFileState) prune(p proofPrune) error {
+	if p.before < 1 || p.before >= int32(len(ff.offsets)) {
+		return nil
+	}
+	keep := ff.offsets[p.before].file
+	if keep <= ff.firstFile {
+		return nil
+	}
+	nums, err := ff.proofs.dir.fileNums()
+	if err != nil {
+		return err
+	}
+	for _, num := range nums {
+		if num >= keep {
+			break
+		}
+		f, ok := ff.ttlFiles[num]
+		if ok {
+			err = f.Close()
+			if err != nil {
+				return err
+			}
+			delete(ff.ttlFiles, num)
+		}
+		name := ff.proofs.dir.fileName(num)
+		if p.archiveDir != "" {
+			fmt.Printf("archiving %s\n", name)
+			err = archiveFile(name, p.archiveDir)
+		} else {
+			fmt.Printf("pruning %s\n", name)
+			err = os.Remove(name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	ff.firstFile = keep
+	return util.SyncDir(ff.proofs.dir.base)
+}
+
+// archiveFile moves the named file into dir.  If it can't be renamed there,
+// like when dir is on another disk, it's copied and then removed.
+func archiveFile(name, dir string) error {
+	dest := filepath.Join(dir, filepath.Base(name))
+	err := os.Rename(name, dest)
+	if err == nil {
+		return util.SyncDir(dir)
+	}
+
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	err = util.SyncDir(dir)
+	if err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+// proofPruned says if the proof at pos has been pruned
+func proofPruned(pd proofDir, pos proofPos) (bool, error) {
+	nums, err := pd.fileNums()
+	if err != nil {
+		return false, err
+	}
+	return len(nums) != 0 && pos.file < nums[0], nil
+}
+
+// firstProofHeight gives the lowest height whose proof isn't pruned
+func firstProofHeight(pd proofDir) (int32, error) {
+	nums, err := pd.fileNums()
+	if err != nil || len(nums) == 0 {
+		return 1, err
+	}
+	offsetFile, err := os.Open(pd.pOffsetFile)
+	if err != nil {
+		return 0, err
+	}
+	defer offsetFile.Close()
+	fi, err := offsetFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// records are in order, so search for the first one in the first file
+	numHeights := int(fi.Size()/8) - 1
+	i := sort.Search(numHeights, func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var pos proofPos
+		pos, err = readProofPos(offsetFile, int32(i+1))
+		return pos.file >= nums[0]
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int32(i + 1), nil
+}
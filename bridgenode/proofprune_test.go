@@ -0,0 +1,235 @@
+package bridgenode
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+// testProofDir is a proofDir in a temp dir
+func testProofDir(t *testing.T) proofDir {
+	dir := t.TempDir()
+	return proofDir{
+		base:        dir,
+		oldPFile:    filepath.Join(dir, "proof.dat"),
+		pOffsetFile: filepath.Join(dir, "proofoffset.dat"),
+		lastPOffset: filepath.Join(dir, "lastproofoffset.dat"),
+	}
+}
+
+// testUData is the udata of a block with 2 txos, both unspent
+func testUData(height int32) btcacc.UData {
+	return btcacc.UData{Height: height, TxoTTLs: make([]int32, 2)}
+}
+
+// smallProofFiles makes proof files hold n records of testUData, for the
+// length of the test
+func smallProofFiles(t *testing.T, n int64) {
+	rec, err := makeProofRecord(testUData(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := maxProofFileSize
+	maxProofFileSize = n * int64(len(rec))
+	t.Cleanup(func() { maxProofFileSize = old })
+}
+
+// openFlatFile starts a flat file worker's state on pd, like
+// flatFileWorker does
+func openFlatFile(t *testing.T, pd proofDir) *flatFileState {
+	var ff flatFileState
+	var err error
+	ff.offsetFile, err = os.OpenFile(
+		pd.pOffsetFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ff.proofs.dir = pd
+	ff.ttlFiles = make(map[uint32]*os.File)
+	ff.fileWait = new(sync.WaitGroup)
+	err = ff.ffInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ff.close() })
+	return &ff
+}
+
+// close closes all the files, without syncing
+func (ff *flatFileState) close() {
+	ff.proofs.close()
+	ff.offsetFile.Close()
+	for _, f := range ff.ttlFiles {
+		f.Close()
+	}
+}
+
+// writeProofs writes the testUData of the blocks after ff's tip, up to
+// and including height
+func writeProofs(t *testing.T, ff *flatFileState, height int32) {
+	for h := ff.currentHeight; h <= height; h++ {
+		ff.fileWait.Add(1)
+		err := ff.writeProofBlock(testUData(h))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestProofPrune(t *testing.T) {
+	smallProofFiles(t, 3)
+	pd := testProofDir(t)
+	ff := openFlatFile(t, pd)
+
+	// before pruning everything's there
+	first, err := firstProofHeight(pd)
+	if err != nil || first != 1 {
+		t.Fatalf("firstProofHeight %d %v with nothing written", first, err)
+	}
+	writeProofs(t, ff, 20)
+	first, err = firstProofHeight(pd)
+	if err != nil || first != 1 {
+		t.Fatalf("firstProofHeight %d %v before pruning", first, err)
+	}
+
+	// blocks 1-3 are in file 0, 4-6 in file 1 and so on
+	if ff.offsets[10] != (proofPos{file: 3, offset: 0}) {
+		t.Fatalf("block 10 at %s", ff.offsets[10].String())
+	}
+	err = ff.prune(proofPrune{before: 11})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nums, err := pd.fileNums()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nums[0] != 3 || ff.firstFile != 3 {
+		t.Fatalf("first file %d, firstFile %d, expected 3",
+			nums[0], ff.firstFile)
+	}
+	first, err = firstProofHeight(pd)
+	if err != nil || first != 10 {
+		t.Fatalf("firstProofHeight %d %v, expected 10", first, err)
+	}
+
+	for h := int32(1); h <= 20; h++ {
+		_, err = GetUDataBytesFromFile(pd, h)
+		if h < first && err != ErrProofPruned {
+			t.Errorf("block %d: %v, expected pruned", h, err)
+		}
+		if h >= first && err != nil {
+			t.Errorf("block %d: %s", h, err.Error())
+		}
+	}
+
+	// TTLs for pruned blocks are dropped, the rest still get written
+	ff.fileWait.Add(1)
+	err = ff.writeTTLs(ttlResultBlock{Height: 21, Created: []txoStart{
+		{createHeight: 2, indexWithinBlock: 1},
+		{createHeight: 15, indexWithinBlock: 1},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GetUDataBytesFromFile(pd, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ud btcacc.UData
+	err = ud.Deserialize(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ud.TxoTTLs[1] != 6 {
+		t.Fatalf("block 15 TTLs %v", ud.TxoTTLs)
+	}
+
+	// pruning to the same place or before it does nothing
+	for _, before := range []int32{0, 5, 11} {
+		err = ff.prune(proofPrune{before: before})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	nums, _ = pd.fileNums()
+	if nums[0] != 3 {
+		t.Fatalf("first file %d after pruning again", nums[0])
+	}
+
+	// starting over finds the first file
+	ff.close()
+	ff = openFlatFile(t, pd)
+	if ff.firstFile != 3 || ff.currentHeight != 21 {
+		t.Fatalf("reopened at height %d, first file %d",
+			ff.currentHeight, ff.firstFile)
+	}
+	writeProofs(t, ff, 21)
+	_, err = GetUDataBytesFromFile(pd, 21)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProofPruneArchive(t *testing.T) {
+	smallProofFiles(t, 3)
+	pd := testProofDir(t)
+	ff := openFlatFile(t, pd)
+	writeProofs(t, ff, 10)
+
+	var files [][]byte
+	for num := uint32(0); num < 2; num++ {
+		b, err := ioutil.ReadFile(pd.fileName(num))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, b)
+	}
+
+	archive := t.TempDir()
+	err := pruneProofs(&Config{proofRetain: 3, proofArchiveDir: archive}, 10,
+		ffPruneChan(ff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// block 7 is the first in file 2
+	first, err := firstProofHeight(pd)
+	if err != nil || first != 7 {
+		t.Fatalf("firstProofHeight %d %v, expected 7", first, err)
+	}
+	for num, want := range files {
+		b, err := ioutil.ReadFile(filepath.Join(archive,
+			filepath.Base(pd.fileName(uint32(num)))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, want) {
+			t.Fatalf("archived proof file %d is different", num)
+		}
+		_, err = os.Stat(pd.fileName(uint32(num)))
+		if !os.IsNotExist(err) {
+			t.Fatalf("proof file %d still there: %v", num, err)
+		}
+	}
+
+	// no proofretain, no pruning
+	err = pruneProofs(&Config{}, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ffPruneChan runs ff.prune for one request sent on the channel it gives
+func ffPruneChan(ff *flatFileState) chan proofPrune {
+	pruneChan := make(chan proofPrune)
+	go func() {
+		p := <-pruneChan
+		p.errChan <- ff.prune(p)
+	}()
+	return pruneChan
+}
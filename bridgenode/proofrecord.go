@@ -0,0 +1,240 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+/*
+A proof record is
+4 bytes magic aaffaa + version (02)
+4 bytes size of the UData
+4 bytes crc32c of the UData, leaving out the TTLs
+4 bytes crc32c of the TTLs
+then the UData: 4 bytes height, 4 bytes number of TTLs, 4 bytes for each
+TTL, then the proof and leaf data
+
+The TTLs are filled in later, as the txos are spent, so they get their own
+checksum which is written along with them.  The TTL checksum and the TTLs
+are next to each other so that's one write.
+
+Both are checked whenever a record is read, so a record that got corrupted
+on disk is an error instead of something the CSN can't make sense of.  The
+TTLs are checked before new ones are written in, so bad TTLs don't get a
+good checksum.
+
+Records from before there were checksums have magic aaffaaff and no
+checksums, just the size and then the UData.  They're still read, they just
+can't be checked.
+*/
+
+// proofMagic starts a proof record.  Last byte is the version
+var proofMagic = [4]byte{0xaa, 0xff, 0xaa, 0x02}
+
+// oldProofMagic starts proof records without checksums
+var oldProofMagic = [4]byte{0xaa, 0xff, 0xaa, 0xff}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// proofHeader is the part of a proof record before the UData
+type proofHeader struct {
+	size     uint32 // of the UData
+	proofSum uint32
+	ttlSum   uint32
+	// false for the old records without checksums
+	checked bool
+}
+
+// len is how many bytes the header is
+func (h *proofHeader) len() int64 {
+	if h.checked {
+		return 16
+	}
+	return 8
+}
+
+// parseProofHeader reads a header from the start of b, which has to be at
+// least 16 bytes, or 8 for old records
+func parseProofHeader(b []byte) (h proofHeader, err error) {
+	if len(b) < 8 {
+		err = fmt.Errorf("proof header is %d bytes", len(b))
+		return
+	}
+	h.size = binary.BigEndian.Uint32(b[4:8])
+	switch {
+	case bytes.Equal(b[:4], proofMagic[:]):
+		if len(b) < 16 {
+			err = fmt.Errorf("proof header is %d bytes", len(b))
+			return
+		}
+		h.checked = true
+		h.proofSum = binary.BigEndian.Uint32(b[8:12])
+		h.ttlSum = binary.BigEndian.Uint32(b[12:16])
+	case bytes.Equal(b[:4], oldProofMagic[:]):
+	default:
+		err = fmt.Errorf("expect magic %x but read %x", proofMagic, b[:4])
+	}
+	return
+}
+
+// splitTTLs gives the TTLs in serialized UData, and the rest of it in two
+// parts, before and after
+func splitTTLs(ud []byte) (head, ttls, tail []byte, err error) {
+	if len(ud) < 8 {
+		err = fmt.Errorf("UData is %d bytes", len(ud))
+		return
+	}
+	numTTLs := int64(binary.BigEndian.Uint32(ud[4:8]))
+	if 8+numTTLs*4 > int64(len(ud)) {
+		err = fmt.Errorf("UData is %d bytes but says it has %d TTLs",
+			len(ud), numTTLs)
+		return
+	}
+	return ud[:8], ud[8 : 8+numTTLs*4], ud[8+numTTLs*4:], nil
+}
+
+// proofSum is the checksum of UData without the TTLs
+func proofSum(head, tail []byte) uint32 {
+	return crc32.Update(crc32.Checksum(head, castagnoli), castagnoli, tail)
+}
+
+// makeProofRecord serializes ud with a header in front
+func makeProofRecord(ud btcacc.UData) ([]byte, error) {
+	size := ud.SerializeSize()
+	buf := bytes.NewBuffer(make([]byte, 16, 16+size))
+	err := ud.Serialize(buf)
+	if err != nil {
+		return nil, err
+	}
+	rec := buf.Bytes()
+	if len(rec) != 16+size {
+		return nil, fmt.Errorf("h %d calculated length %d but observed %d",
+			ud.Height, size, len(rec)-16)
+	}
+	head, ttls, tail, err := splitTTLs(rec[16:])
+	if err != nil {
+		return nil, err
+	}
+	copy(rec[0:4], proofMagic[:])
+	binary.BigEndian.PutUint32(rec[4:8], uint32(size))
+	binary.BigEndian.PutUint32(rec[8:12], proofSum(head, tail))
+	binary.BigEndian.PutUint32(rec[12:16], crc32.Checksum(ttls, castagnoli))
+	return rec, nil
+}
+
+// readProofRecord reads the record at offset in f and checks it.  It gives
+// the UData bytes and where the record ends.
+func readProofRecord(f *os.File, offset int64) (
+	ud []byte, end int64, err error) {
+
+	var b [16]byte
+	_, err = f.ReadAt(b[:8], offset)
+	if err != nil {
+		return
+	}
+	if bytes.Equal(b[:4], proofMagic[:]) {
+		_, err = f.ReadAt(b[8:], offset+8)
+		if err != nil {
+			return
+		}
+	}
+	h, err := parseProofHeader(b[:])
+	if err != nil {
+		return
+	}
+	if h.size > 1<<24 {
+		err = fmt.Errorf("size says %d which is too big", h.size)
+		return
+	}
+	ud = make([]byte, h.size)
+	_, err = f.ReadAt(ud, offset+h.len())
+	if err != nil {
+		return
+	}
+	end = offset + h.len() + int64(h.size)
+	if !h.checked {
+		return
+	}
+
+	head, ttls, tail, err := splitTTLs(ud)
+	if err != nil {
+		return
+	}
+	if proofSum(head, tail) != h.proofSum {
+		err = fmt.Errorf("proof checksum mismatch")
+		return
+	}
+	if crc32.Checksum(ttls, castagnoli) != h.ttlSum {
+		err = fmt.Errorf("TTL checksum mismatch")
+		return
+	}
+	return
+}
+
+// writeRecordTTLs fills in TTLs of the record at offset in f, and updates
+// the TTL checksum.  The TTLs already there are checked first.  ttls are
+// index within the block, TTL pairs.
+func writeRecordTTLs(f *os.File, offset int64, ttls []txoTTL) error {
+	// header, then height and number of TTLs
+	var b [24]byte
+	_, err := f.ReadAt(b[:8], offset)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(b[:4], proofMagic[:]) {
+		_, err = f.ReadAt(b[8:], offset+8)
+	} else {
+		_, err = f.ReadAt(b[8:16], offset+8)
+	}
+	if err != nil {
+		return err
+	}
+	h, err := parseProofHeader(b[:])
+	if err != nil {
+		return fmt.Errorf("record at %d in %s: %s",
+			offset, f.Name(), err.Error())
+	}
+	numTTLs := binary.BigEndian.Uint32(b[h.len()+4 : h.len()+8])
+
+	ttlStart := offset + h.len() + 8
+	region := make([]byte, 4*int64(numTTLs))
+	_, err = f.ReadAt(region, ttlStart)
+	if err != nil {
+		return err
+	}
+	// don't put a good checksum over TTLs that went bad on disk
+	if h.checked && crc32.Checksum(region, castagnoli) != h.ttlSum {
+		return fmt.Errorf("record at %d in %s: TTL checksum mismatch",
+			offset, f.Name())
+	}
+	for _, t := range ttls {
+		if t.index >= numTTLs {
+			return fmt.Errorf("record at %d in %s has %d TTLs, no %d",
+				offset, f.Name(), numTTLs, t.index)
+		}
+		binary.BigEndian.PutUint32(region[t.index*4:], t.ttl)
+	}
+	if !h.checked {
+		_, err = f.WriteAt(region, ttlStart)
+		return err
+	}
+
+	// the TTL checksum, height and number of TTLs, then the TTLs
+	out := make([]byte, 12+len(region))
+	binary.BigEndian.PutUint32(out[0:4], crc32.Checksum(region, castagnoli))
+	copy(out[4:12], b[16:24])
+	copy(out[12:], region)
+	_, err = f.WriteAt(out, offset+12)
+	return err
+}
+
+// txoTTL is a TTL to write, and where it goes in its block's record
+type txoTTL struct {
+	index uint32
+	ttl   uint32
+}
@@ -0,0 +1,207 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+// fullUData is udata with something in every part of it: TTLs, a proof and
+// leaf data
+func fullUData(height int32) btcacc.UData {
+	ud := btcacc.UData{
+		Height:  height,
+		TxoTTLs: make([]int32, 3),
+		AccProof: accumulator.BatchProof{
+			Targets: []uint64{1, 4},
+			Proof:   []accumulator.Hash{{0x01}, {0x02}},
+		},
+	}
+	for i := range ud.AccProof.Targets {
+		ud.Stxos = append(ud.Stxos, btcacc.LeafData{
+			BlockHash: [32]byte{0x03, byte(i)},
+			TxHash:    btcacc.Hash{0x04, byte(i)},
+			Index:     uint32(i),
+			Height:    height - 1,
+			Coinbase:  i == 0,
+			Amt:       50,
+			PkScript:  []byte{0x51, byte(i)},
+		})
+	}
+	return ud
+}
+
+// oldProofRecord serializes ud the way it was before checksums
+func oldProofRecord(t *testing.T, ud btcacc.UData) []byte {
+	var buf bytes.Buffer
+	buf.Write(oldProofMagic[:])
+	binary.Write(&buf, binary.BigEndian, uint32(ud.SerializeSize()))
+	err := ud.Serialize(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// recordFile writes recs one after the other to a file, and gives the file
+// and where each record starts
+func recordFile(t *testing.T, recs ...[]byte) (*os.File, []int64) {
+	var all []byte
+	var offsets []int64
+	for _, rec := range recs {
+		offsets = append(offsets, int64(len(all)))
+		all = append(all, rec...)
+	}
+	name := filepath.Join(t.TempDir(), "proof00000.dat")
+	err := ioutil.WriteFile(name, all, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(name, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f, offsets
+}
+
+// readUData reads the record at offset and checks it's want, and ends at
+// end
+func readUData(t *testing.T, f *os.File, offset, end int64,
+	want btcacc.UData) {
+
+	t.Helper()
+	b, recEnd, err := readProofRecord(f, offset)
+	if err != nil {
+		t.Fatalf("record at %d: %v", offset, err)
+	}
+	if recEnd != end {
+		t.Fatalf("record at %d ends at %d, expected %d", offset, recEnd, end)
+	}
+	var ud btcacc.UData
+	err = ud.Deserialize(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ud, want) {
+		t.Fatalf("record at %d is\n%+v\nexpected\n%+v", offset, ud, want)
+	}
+}
+
+func TestProofRecord(t *testing.T) {
+	uds := []btcacc.UData{fullUData(5), fullUData(6), fullUData(7)}
+	uds[2].TxoTTLs = uds[2].TxoTTLs[:2]
+	var recs [][]byte
+	for _, ud := range uds {
+		rec, err := makeProofRecord(ud)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rec) != 16+ud.SerializeSize() {
+			t.Fatalf("record is %d bytes for %d bytes of udata",
+				len(rec), ud.SerializeSize())
+		}
+		recs = append(recs, rec)
+	}
+	// one from before checksums in with them
+	uds = append(uds, fullUData(8))
+	recs = append(recs, oldProofRecord(t, uds[3]))
+	f, offsets := recordFile(t, recs...)
+	for i, ud := range uds {
+		readUData(t, f, offsets[i], offsets[i]+int64(len(recs[i])), ud)
+	}
+
+	// TTLs go in, and the records still check out
+	for i, ud := range uds {
+		ttls := []txoTTL{{index: 0, ttl: 9}, {index: 1, ttl: 12}}
+		err := writeRecordTTLs(f, offsets[i], ttls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ud.TxoTTLs[0], ud.TxoTTLs[1] = 9, 12
+		readUData(t, f, offsets[i], offsets[i]+int64(len(recs[i])), ud)
+	}
+	// and more go in after that, leaving the ones already there
+	err := writeRecordTTLs(f, offsets[1], []txoTTL{{index: 2, ttl: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uds[1].TxoTTLs[2] = 3
+	readUData(t, f, offsets[1], offsets[2], uds[1])
+
+	// but not past the TTLs the record has
+	err = writeRecordTTLs(f, offsets[2], []txoTTL{{index: 2, ttl: 3}})
+	if err == nil {
+		t.Fatal("wrote TTL 2 of a record with 2 TTLs")
+	}
+	readUData(t, f, offsets[2], offsets[3], uds[2])
+}
+
+// TestProofRecordCorrupt changes a byte in each part of a record, and checks
+// that reading it is an error, and that TTLs aren't written over TTLs that
+// are bad
+func TestProofRecordCorrupt(t *testing.T) {
+	ud := fullUData(5)
+	good, err := makeProofRecord(ud)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := map[string]int{
+		"magic":       1,
+		"size":        7,
+		"proof sum":   9,
+		"TTL sum":     13,
+		"height":      19,
+		"TTL count":   23,
+		"TTLs":        24 + 3,
+		"proof":       len(good) - 2*84 - 5,
+		"leaf data":   len(good) - 1,
+		"leaf data 2": len(good) - 84,
+	}
+	for name, at := range parts {
+		rec := append([]byte{}, good...)
+		rec[at] ^= 0x40
+		f, _ := recordFile(t, rec)
+		_, _, err = readProofRecord(f, 0)
+		if err == nil {
+			t.Fatalf("read record with bad %s", name)
+		}
+
+		err = writeRecordTTLs(f, 0, []txoTTL{{index: 0, ttl: 9}})
+		if name == "TTL sum" || name == "TTLs" {
+			if err == nil {
+				t.Fatalf("wrote TTLs over bad %s", name)
+			}
+			b, err := ioutil.ReadFile(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, rec) {
+				t.Fatalf("record with bad %s changed", name)
+			}
+		}
+	}
+
+	// cut off
+	f, _ := recordFile(t, good[:len(good)-1])
+	_, _, err = readProofRecord(f, 0)
+	if err == nil {
+		t.Fatal("read record that's cut off")
+	}
+	f, _ = recordFile(t, good[:12])
+	_, _, err = readProofRecord(f, 0)
+	if err == nil {
+		t.Fatal("read record with the header cut off")
+	}
+	err = writeRecordTTLs(f, 0, []txoTTL{{index: 0, ttl: 9}})
+	if err == nil {
+		t.Fatal("wrote TTLs to record with the header cut off")
+	}
+}
@@ -0,0 +1,104 @@
+package bridgenode
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	dbutil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+/*
+A pruned bitcoind deletes its oldest blk and rev files once they add up to
+more than the prune target, so the blocks in them are gone.  The bridge node
+needs every block from 1 on, so it can only use a pruned node's blk files if
+it's never behind the oldest block the node still has.
+
+The block index says which blocks still have data: pruning clears the
+BlockHaveData and BlockHaveUndo status bits.  It also sets the
+"prunedblockfiles" flag once anything's been pruned.  Blocks that were
+never downloaded, like headers past the tip, don't have data either, but
+they also have no tx count, which pruning leaves alone.  So the first block
+there's sure to be data for is the one after the highest pruned block, the
+same as getblockchaininfo's pruneheight.
+
+Following a node over RPC works with a pruned node too, as long as the
+bridge node keeps up, since blocks are taken as they come in.  A pruned
+node keeps at least the last 288 blocks.
+*/
+
+// prunedFlagKey is where the block index has the "prunedblockfiles" flag:
+// 'F' and then the name as a serialized string
+var prunedFlagKey = append([]byte{'F', 16}, "prunedblockfiles"...)
+
+// minPruneKeep is how many of the latest blocks a pruned node always keeps
+const minPruneKeep = 288
+
+// pruneInfo is what the block index says about pruning
+type pruneInfo struct {
+	// some blk files have been deleted
+	pruned bool
+	// the height after the highest pruned block
+	firstHeight int32
+}
+
+// readPruneInfo reads the prune state out of bitcoind's block index
+func readPruneInfo(lvdb *leveldb.DB) (pi pruneInfo, err error) {
+	pi.firstHeight = 1
+	v, err := lvdb.Get(prunedFlagKey, nil)
+	if err == leveldb.ErrNotFound {
+		return pi, nil
+	}
+	if err != nil {
+		return
+	}
+	pi.pruned = len(v) == 1 && v[0] == '1'
+	if !pi.pruned {
+		return
+	}
+
+	iter := lvdb.NewIterator(dbutil.BytesPrefix([]byte{0x62}), nil)
+	for iter.Next() {
+		cbIdx := ReadCBlockFileIndex(bytes.NewReader(iter.Value()))
+		// downloaded once, but the data's gone
+		if cbIdx.TxCount > 0 && cbIdx.Status&BlockHaveData == 0 &&
+			cbIdx.Height >= pi.firstHeight {
+			pi.firstHeight = cbIdx.Height + 1
+		}
+	}
+	iter.Release()
+	err = iter.Error()
+	return
+}
+
+// readPruneInfoFromDir opens the block index in blockDir and reads the
+// prune state
+func readPruneInfoFromDir(blockDir string) (pruneInfo, error) {
+	lvdb, err := OpenIndexFile(blockDir)
+	if err != nil {
+		return pruneInfo{}, err
+	}
+	defer lvdb.Close()
+	return readPruneInfo(lvdb)
+}
+
+// check gives an error if block height is pruned away
+func (pi pruneInfo) check(blockDir string, height int32) error {
+	if !pi.pruned || height >= pi.firstHeight {
+		return nil
+	}
+	return fmt.Errorf("bitcoind in %s is pruned up to block %d, but block "+
+		"%d is needed.  Use a node that isn't pruned, or follow one with "+
+		"-rpc from before it prunes", blockDir, pi.firstHeight-1, height)
+}
+
+// prunedFileErr makes the error for a blk or rev file that isn't there
+// clearer, since the likely reason is pruning
+func prunedFileErr(err error, height int32) error {
+	if !os.IsNotExist(err) {
+		return err
+	}
+	return fmt.Errorf("block %d: %s.  Was it pruned by bitcoind?",
+		height, err.Error())
+}
@@ -0,0 +1,67 @@
+package bridgenode
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/mit-dci/utreexo/util"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// setPrunedFlag sets the "prunedblockfiles" flag in the block index
+func (tb *testBlocks) setPrunedFlag() {
+	db, err := leveldb.OpenFile(filepath.Join(tb.cfg.BlockDir, "index"), nil)
+	if err != nil {
+		tb.t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Put(prunedFlagKey, []byte{'1'}, nil)
+	if err != nil {
+		tb.t.Fatal(err)
+	}
+}
+
+// checkPruneInfo reads the prune state from the block index, and checks
+// it's what's expected
+func (tb *testBlocks) checkPruneInfo(pruned bool, firstHeight int32) {
+	tb.t.Helper()
+	pi, err := readPruneInfoFromDir(tb.cfg.BlockDir)
+	if err != nil {
+		tb.t.Fatal(err)
+	}
+	if pi.pruned != pruned || pi.firstHeight != firstHeight {
+		tb.t.Fatalf("pruned %v first height %d, expected %v %d",
+			pi.pruned, pi.firstHeight, pruned, firstHeight)
+	}
+	err = pi.check(tb.cfg.BlockDir, firstHeight-1)
+	if (err == nil) == pruned {
+		tb.t.Fatalf("block %d needed: %v", firstHeight-1, err)
+	}
+	err = pi.check(tb.cfg.BlockDir, firstHeight)
+	if err != nil {
+		tb.t.Fatal(err)
+	}
+}
+
+func TestReadPruneInfo(t *testing.T) {
+	tb := newTestBlocks(t)
+	genesis := util.Hash(*tb.cfg.params.GenesisHash)
+	tb.chain(0, genesis, 1, 10)
+	tb.chain(1, tb.hashes[10], 11, 20)
+	// headers past the tip, never downloaded
+	tb.block(2, tb.hashes[20], 21, BlockValidTree)
+	tb.block(2, tb.hashes[21], 22, BlockValidTree)
+	main := tb.hashesTo(10)
+	// a block that got reorged out, in a file that's not pruned
+	tb.block(2, tb.hashes[2], 3, BlockValidScripts|BlockHaveMask)
+	tb.writeIndex()
+	tb.checkPruneInfo(false, 1)
+
+	// blk00000.dat is gone
+	for i, hash := range main {
+		tb.setStatus(hash, int32(i+1), BlockValidScripts, nil)
+	}
+	tb.writeIndex()
+	tb.setPrunedFlag()
+	tb.checkPruneInfo(true, 11)
+}
@@ -43,40 +43,10 @@ type RawHeaderData struct {
 	UndoPos uint32
 }
 
-// BlockAndRevReader is a wrapper around GetRawBlockFromFile so that the process
-// can be made into a goroutine. As long as it's running, it keeps sending
-// the entire blocktxs and height to bchan with TxToWrite type.
-// It also puts in the proofs.  This will run on the archive server, and the
-// data will be sent over the network to the CSN.
-func BlockAndRevReader(
-	blockChan chan BlockAndRev, cfg *Config,
-	maxHeight, curHeight int32) {
-
-	var offsetFilePath = cfg.UtreeDir.OffsetDir.OffsetFile
-
-	for curHeight < maxHeight {
-		blocks, revs, err := GetRawBlocksFromDisk(curHeight, 100000, offsetFilePath, cfg.BlockDir)
-		if err != nil {
-			fmt.Printf(err.Error())
-			// close(blockChan)
-			return
-		}
-
-		for i := 0; i < len(blocks); i++ {
-			bnr := BlockAndRev{
-				Height: curHeight,
-				Blk:    blocks[i],
-				Rev:    revs[i],
-			}
-			blockChan <- bnr
-			curHeight++
-		}
-	}
-}
-
 // GetRawBlocksFromDisk retrives multiple consecutive blocks starting at height `startAt`.
 // `count` is a upper limit for the number of blocks read.
 // Only blocks that are contained in the same blk file are returned.
+// The files are un-obfuscated with the key in xor.dat, if there is one.
 func GetRawBlocksFromDisk(startAt int32, count int32, offsetFileName string,
 	blockDir string) (blocks []wire.MsgBlock, revs []RevBlock, err error) {
 	if startAt == 0 {
@@ -89,6 +59,11 @@ func GetRawBlocksFromDisk(startAt int32, count int32, offsetFileName string,
 		return
 	}
 
+	key, err := readXorKey(blockDir)
+	if err != nil {
+		return
+	}
+
 	offsetFile, err := os.Open(offsetFileName)
 	if err != nil {
 		return
@@ -138,6 +113,7 @@ func GetRawBlocksFromDisk(startAt int32, count int32, offsetFileName string,
 	blockFile, err := os.Open(filepath.Join(blockDir,
 		fmt.Sprintf("blk%05d.dat", datFileNum)))
 	if err != nil {
+		err = prunedFileErr(err, startAt+1)
 		return
 	}
 	defer blockFile.Close()
@@ -145,14 +121,16 @@ func GetRawBlocksFromDisk(startAt int32, count int32, offsetFileName string,
 	// Read all block data needed for the blocks into memory.
 	// 1<<27 = 128MB
 	blockData := make([]byte, 1<<27)
-	_, err = blockFile.Read(blockData)
+	n, err := blockFile.Read(blockData)
 	if err != nil {
 		return
 	}
+	key.apply(blockData[:n], 0)
 
 	revFile, err := os.Open(filepath.Join(blockDir,
 		fmt.Sprintf("rev%05d.dat", datFileNum)))
 	if err != nil {
+		err = prunedFileErr(err, startAt+1)
 		return
 	}
 	defer revFile.Close()
@@ -160,10 +138,11 @@ func GetRawBlocksFromDisk(startAt int32, count int32, offsetFileName string,
 	// Read all rev data needed for the blocks into memory.
 	// 1<<27 = 128MB
 	revData := make([]byte, 1<<27)
-	_, err = revFile.Read(revData)
+	n, err = revFile.Read(revData)
 	if err != nil {
 		return
 	}
+	key.apply(revData[:n], 0)
 
 	blocks = make([]wire.MsgBlock, offsetsRead)
 	revs = make([]RevBlock, offsetsRead)
@@ -223,6 +202,7 @@ func FetchBlockHeightFromBufDB(header [32]byte, db map[[32]byte]int32) (int32, e
 // returns the bytes without deserializing the block
 // If you ask for block 0, it will give you an error.  If you ask for block
 // 1, it gives you the block at offset 0 which is consensus height 1.
+// The bytes are un-obfuscated with the key in xor.dat, if there is one.
 func GetBlockBytesFromFile(
 	height int32, offsetFileName string, blockDir string) (b []byte, err error) {
 	if height == 0 {
@@ -231,6 +211,11 @@ func GetBlockBytesFromFile(
 	}
 	height--
 
+	key, err := readXorKey(blockDir)
+	if err != nil {
+		return
+	}
+
 	var datFile, offset, blklen uint32
 
 	offsetFile, err := os.Open(offsetFileName)
@@ -262,6 +247,7 @@ func GetBlockBytesFromFile(
 	bDir := filepath.Join(blockDir, blockFName)
 	blockFile, err := os.Open(bDir)
 	if err != nil {
+		err = prunedFileErr(err, height+1)
 		return
 	}
 	defer blockFile.Close() // file always closes
@@ -271,22 +257,87 @@ func GetBlockBytesFromFile(
 	if err != nil {
 		return
 	}
+	blockReader := &xorReader{r: blockFile, key: key, pos: int64(offset) + 4}
 
 	// read the 4 byte length before the block itself
-	err = binary.Read(blockFile, binary.LittleEndian, &blklen)
+	err = binary.Read(blockReader, binary.LittleEndian, &blklen)
 	if err != nil {
 		return
 	}
 
 	b = make([]byte, blklen)
 
-	n, err := blockFile.Read(b)
+	n, err := blockReader.Read(b)
 	if uint32(n) != blklen {
 		fmt.Printf("%d byte block but only read %d bytes\n", blklen, n)
 	}
 	return
 }
 
+// GetHeadersFromFile reads the headers of the blocks from through to
+// (inclusive) out of the blk files.  Only the 80 bytes of each header are
+// read, not the whole block.
+func GetHeadersFromFile(from, to int32,
+	offsetFileName string, blockDir string) ([]wire.BlockHeader, error) {
+
+	if from < 1 || to < from {
+		return nil, fmt.Errorf("no headers from %d to %d", from, to)
+	}
+	key, err := readXorKey(blockDir)
+	if err != nil {
+		return nil, err
+	}
+	offsetFile, err := os.Open(offsetFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer offsetFile.Close()
+
+	// the blk files opened so far
+	blkFiles := make(map[uint32]*os.File)
+	defer func() {
+		for _, f := range blkFiles {
+			f.Close()
+		}
+	}()
+
+	headers := make([]wire.BlockHeader, 0, to-from+1)
+	var pos [8]byte
+	var raw [80]byte
+	for h := from; h <= to; h++ {
+		// 12 bytes per block, starting at block 1
+		_, err = offsetFile.ReadAt(pos[:], int64(12*(h-1)))
+		if err != nil {
+			return nil, fmt.Errorf("no offset for block %d: %s",
+				h, err.Error())
+		}
+		datFile := binary.BigEndian.Uint32(pos[0:4])
+		offset := int64(binary.BigEndian.Uint32(pos[4:8]))
+		f, ok := blkFiles[datFile]
+		if !ok {
+			f, err = os.Open(filepath.Join(
+				blockDir, fmt.Sprintf("blk%05d.dat", datFile)))
+			if err != nil {
+				return nil, prunedFileErr(err, h)
+			}
+			blkFiles[datFile] = f
+		}
+		// +8 skips the magic bytes and the block length
+		_, err = f.ReadAt(raw[:], offset+8)
+		if err != nil {
+			return nil, err
+		}
+		key.apply(raw[:], offset+8)
+		var hdr wire.BlockHeader
+		err = hdr.Deserialize(bytes.NewReader(raw[:]))
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, hdr)
+	}
+	return headers, nil
+}
+
 // BlockAndRev is a regular block and a rev block stuck together
 type BlockAndRev struct {
 	Height int32
@@ -542,14 +593,22 @@ func ReadCBlockFileIndex(r io.ReadSeeker) (cbIdx CBlockFileIndex) {
 	nTx, _ := deserializeVLQ(r)
 	cbIdx.TxCount = int32(nTx)
 
-	nFile, _ := deserializeVLQ(r)
-	cbIdx.File = int32(nFile)
+	// the file and positions are only there if the block has data.  Once
+	// it's pruned they're gone
+	if cbIdx.Status&BlockHaveMask != 0 {
+		nFile, _ := deserializeVLQ(r)
+		cbIdx.File = int32(nFile)
+	}
 
-	nDataPos, _ := deserializeVLQ(r)
-	cbIdx.DataPos = uint32(nDataPos)
+	if cbIdx.Status&BlockHaveData != 0 {
+		nDataPos, _ := deserializeVLQ(r)
+		cbIdx.DataPos = uint32(nDataPos)
+	}
 
-	nUndoPos, _ := deserializeVLQ(r)
-	cbIdx.UndoPos = uint32(nUndoPos)
+	if cbIdx.Status&BlockHaveUndo != 0 {
+		nUndoPos, _ := deserializeVLQ(r)
+		cbIdx.UndoPos = uint32(nUndoPos)
+	}
 
 	// Need to seek 3 bytes if you're fetching the actual
 	// header information. Not sure why it's needed but there's
@@ -0,0 +1,311 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+/*
+RPCSource gets blocks from bitcoind (or btcd, or anything else with the same
+JSON-RPC calls) instead of from the blk files, and keeps going as new blocks
+come in, so the bridge node stays at the tip of the chain.  The calls used
+are
+
+getblockhash <height>     the hash of a block, error if there's none yet
+getblock <hash> 0         the serialized block, in hex
+getbestblockhash          polled to see when there's a new block
+getblockchaininfo         to see if the node is pruned
+
+There's no rev data over RPC, so this needs -norev.
+
+A pruned node works as long as the bridge node doesn't fall behind the
+blocks it still has; blocks are taken as soon as they have enough
+confirmations, which is before the node can prune them.
+
+The forest can't take blocks back out, so a block is only taken once it has
+Confirmations confirmations.  If a reorg goes deeper than that anyway, the
+block that doesn't connect is an error in BuildProofs and the bridge node
+stops.  That's checked across restarts too, as checkpoints keep the hash
+of the last block.
+*/
+
+// RPCSource is a BlockSource that follows a node over JSON-RPC.  It never
+// runs out of blocks; it just waits for the next one.
+type RPCSource struct {
+	// URL of the node, like http://127.0.0.1:8332
+	URL  string
+	User string
+	Pass string
+
+	// how deep a block has to be before it's taken.  1 is the tip.
+	Confirmations int32
+	// how often to ask for the best block when waiting
+	Poll time.Duration
+
+	client   http.Client
+	id       uint64
+	lastBest string
+}
+
+// rpcRequest is a JSON-RPC 1.0 request, which is what bitcoin-cli sends
+type rpcRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      uint64        `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+// rpcError is an error the node sent back, as opposed to not being able
+// to talk to it
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// NewRPCSource makes an RPCSource for the node at url.  If user is empty
+// the cookie file is used for the login, if there is one.
+func NewRPCSource(url, user, pass, cookieFile string,
+	confirmations int32) (*RPCSource, error) {
+
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	if user == "" && cookieFile != "" {
+		cookie, err := ioutil.ReadFile(cookieFile)
+		if err == nil {
+			up := strings.SplitN(strings.TrimSpace(string(cookie)), ":", 2)
+			if len(up) != 2 {
+				return nil, fmt.Errorf("can't read cookie file %s", cookieFile)
+			}
+			user, pass = up[0], up[1]
+		}
+	}
+	if confirmations < 1 {
+		return nil, fmt.Errorf("need at least 1 confirmation, got %d",
+			confirmations)
+	}
+	return &RPCSource{
+		URL:           url,
+		User:          user,
+		Pass:          pass,
+		Confirmations: confirmations,
+		Poll:          5 * time.Second,
+		client:        http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+// call does one RPC and puts the result in result
+func (s *RPCSource) call(
+	method string, result interface{}, params ...interface{}) error {
+
+	s.id++
+	if params == nil {
+		params = []interface{}{}
+	}
+	reqBytes, err := json.Marshal(rpcRequest{
+		JSONRPC: "1.0", ID: s.id, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(reqBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.User != "" {
+		req.SetBasicAuth(s.User, s.Pass)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	// bitcoind gives errors with a 500 or 404 status, but still in json
+	var r rpcResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return fmt.Errorf("%s: %s from %s", method, resp.Status, s.URL)
+	}
+	if r.Error != nil {
+		return r.Error
+	}
+	return json.Unmarshal(r.Result, result)
+}
+
+// getBlock gets the block at height, or an *rpcError if the node doesn't
+// have it (or anything else it doesn't like)
+func (s *RPCSource) getBlock(height int32) (*wire.MsgBlock, error) {
+	var hash string
+	err := s.call("getblockhash", &hash, height)
+	if err != nil {
+		return nil, err
+	}
+	var blockHex string
+	err = s.call("getblock", &blockHex, hash, 0)
+	if err != nil {
+		return nil, err
+	}
+	blockBytes, err := hex.DecodeString(blockHex)
+	if err != nil {
+		return nil, err
+	}
+	var blk wire.MsgBlock
+	err = blk.Deserialize(bytes.NewReader(blockBytes))
+	if err != nil {
+		return nil, fmt.Errorf("block %d %s: %s", height, hash, err.Error())
+	}
+	if blk.BlockHash().String() != hash {
+		return nil, fmt.Errorf("asked for block %s, got %s",
+			hash, blk.BlockHash().String())
+	}
+	return &blk, nil
+}
+
+// waitForTip waits until the best block is different from last time
+func (s *RPCSource) waitForTip() error {
+	for {
+		time.Sleep(s.Poll)
+		var best string
+		err := s.call("getbestblockhash", &best)
+		if isNetErr(err) {
+			// node's down or restarting, try again later
+			fmt.Printf("RPCSource: %s\n", err.Error())
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if best != s.lastBest {
+			s.lastBest = best
+			return nil
+		}
+	}
+}
+
+// haveConfirmed says whether the node has height with enough blocks on
+// top of it
+func (s *RPCSource) haveConfirmed(height int32) (bool, error) {
+	var hash string
+	err := s.call("getblockhash", &hash, height+s.Confirmations-1)
+	if err == nil {
+		return true, nil
+	}
+	if _, ok := err.(*rpcError); ok {
+		// out of range, so not there yet
+		return false, nil
+	}
+	if isNetErr(err) {
+		fmt.Printf("RPCSource: %s\n", err.Error())
+		return false, nil
+	}
+	return false, err
+}
+
+// isNetErr is true for errors talking to the node, which might go away
+// if we try again
+func isNetErr(err error) bool {
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// checkPruned gives an error if the node is pruned and doesn't have block
+// height any more.  Nodes without getblockchaininfo are taken to not be
+// pruned.
+func (s *RPCSource) checkPruned(height int32) error {
+	var info struct {
+		Pruned      bool  `json:"pruned"`
+		PruneHeight int32 `json:"pruneheight"`
+	}
+	err := s.call("getblockchaininfo", &info)
+	if _, ok := err.(*rpcError); ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Pruned {
+		return nil
+	}
+	if height < info.PruneHeight {
+		return fmt.Errorf("node at %s is pruned and the first block it has "+
+			"is %d, but block %d is needed", s.URL, info.PruneHeight, height)
+	}
+	if s.Confirmations > minPruneKeep {
+		fmt.Printf("WARNING: node at %s is pruned and only sure to keep "+
+			"%d blocks, but blocks are taken at %d confirmations\n",
+			s.URL, minPruneKeep, s.Confirmations)
+	}
+	return nil
+}
+
+// TipHeight is as high as it goes, as the RPCSource waits for new blocks
+func (s *RPCSource) TipHeight() (int32, error) {
+	return math.MaxInt32, nil
+}
+
+// ReadBlocks gets blocks from the node as they come in, until maxHeight
+func (s *RPCSource) ReadBlocks(
+	blockChan chan BlockAndRev, curHeight, maxHeight int32) error {
+
+	err := s.checkPruned(curHeight)
+	if err != nil {
+		return err
+	}
+	for ; curHeight < maxHeight; curHeight++ {
+		for {
+			ok, err := s.haveConfirmed(curHeight)
+			if err != nil {
+				return err
+			}
+			if ok {
+				break
+			}
+			err = s.waitForTip()
+			if err != nil {
+				return err
+			}
+		}
+		blk, err := s.getBlock(curHeight)
+		for isNetErr(err) {
+			fmt.Printf("RPCSource: %s\n", err.Error())
+			time.Sleep(s.Poll)
+			blk, err = s.getBlock(curHeight)
+		}
+		if _, ok := err.(*rpcError); ok {
+			// say so if it's because it was pruned
+			pruneErr := s.checkPruned(curHeight)
+			if pruneErr != nil {
+				return pruneErr
+			}
+		}
+		if err != nil {
+			return err
+		}
+		blockChan <- BlockAndRev{Height: curHeight, Blk: *blk}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// mockNode answers the RPCs RPCSource makes, with the blocks it's given
+type mockNode struct {
+	mu     sync.Mutex
+	blocks []wire.MsgBlock // blocks[0] is block 1
+}
+
+func (n *mockNode) setBlocks(tc *testChain) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.blocks = nil
+	for _, bnr := range tc.blocks {
+		n.blocks = append(n.blocks, bnr.Blk)
+	}
+}
+
+func (n *mockNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, pass, _ := r.BasicAuth()
+	if user != "user" || pass != "pass" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var req rpcRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var result interface{}
+	var rpcErr *rpcError
+	switch req.Method {
+	case "getblockhash":
+		h := int(req.Params[0].(float64))
+		if h < 1 || h > len(n.blocks) {
+			rpcErr = &rpcError{Code: -8, Message: "Block height out of range"}
+			break
+		}
+		result = n.blocks[h-1].BlockHash().String()
+	case "getblock":
+		rpcErr = &rpcError{Code: -5, Message: "Block not found"}
+		for _, blk := range n.blocks {
+			if blk.BlockHash().String() == req.Params[0].(string) {
+				var buf bytes.Buffer
+				blk.Serialize(&buf)
+				result, rpcErr = hex.EncodeToString(buf.Bytes()), nil
+			}
+		}
+	case "getbestblockhash":
+		result = n.blocks[len(n.blocks)-1].BlockHash().String()
+	case "getblockchaininfo":
+		result = map[string]interface{}{"pruned": false}
+	default:
+		rpcErr = &rpcError{Code: -32601, Message: "Method not found"}
+	}
+	if rpcErr != nil {
+		// like bitcoind
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"result": result, "error": rpcErr, "id": req.ID})
+}
+
+// newMockNode starts a mockNode with the blocks in tc, and an RPCSource
+// for it
+func newMockNode(t *testing.T, tc *testChain, confirmations int32) (
+	*mockNode, *RPCSource) {
+
+	node := &mockNode{}
+	node.setBlocks(tc)
+	srv := httptest.NewServer(node)
+	t.Cleanup(srv.Close)
+	src, err := NewRPCSource(
+		strings.TrimPrefix(srv.URL, "http://"), "user", "pass", "",
+		confirmations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.Poll = time.Millisecond
+	return node, src
+}
+
+// TestRPCSource reads blocks from a mock node, and checks it waits for
+// blocks to get enough confirmations
+func TestRPCSource(t *testing.T) {
+	tc := newTestChain()
+	tc.extend(10)
+	node, src := newMockNode(t, tc, 3)
+
+	blockChan := make(chan BlockAndRev, 20)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- src.ReadBlocks(blockChan, 2, 12)
+	}()
+	// confirmed blocks come right away
+	for h := int32(2); h <= 8; h++ {
+		bnr := <-blockChan
+		if bnr.Height != h ||
+			bnr.Blk.BlockHash() != tc.blocks[h-1].Blk.BlockHash() {
+			t.Fatalf("got block %d %s, expected %d %s", bnr.Height,
+				bnr.Blk.BlockHash(), h, tc.blocks[h-1].Blk.BlockHash())
+		}
+	}
+	// block 9 needs block 11
+	select {
+	case bnr := <-blockChan:
+		t.Fatalf("got block %d with 2 confirmations", bnr.Height)
+	case err := <-readErr:
+		t.Fatalf("stopped waiting for blocks: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	tc.extend(13)
+	node.setBlocks(tc)
+	for h := int32(9); h <= 11; h++ {
+		bnr := <-blockChan
+		if bnr.Height != h ||
+			bnr.Blk.BlockHash() != tc.blocks[h-1].Blk.BlockHash() {
+			t.Fatalf("got block %d, expected %d", bnr.Height, h)
+		}
+	}
+	err := <-readErr
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a wrong login is an error
+	src.Pass = "wrong"
+	err = src.ReadBlocks(blockChan, 2, 3)
+	if err == nil {
+		t.Fatal("read blocks with the wrong password")
+	}
+}
+
+// TestRPCSourceReorg follows a mock node with BuildProofs, and checks that
+// a reorg below the bridge node's tip is an error, even after a restart
+func TestRPCSourceReorg(t *testing.T) {
+	tc := newTestChain()
+	tc.extend(20)
+	node, src := newMockNode(t, tc, 1)
+	cfg := &Config{
+		forestType:       ramForest,
+		UtreeDir:         initUtreeDir(t.TempDir()),
+		noRev:            true,
+		checkpointBlocks: 7,
+		quitAt:           16,
+		Source:           src,
+	}
+	makePaths(cfg.UtreeDir)
+	err := BuildProofs(cfg, make(chan bool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, ok, err := readCheckpoint(cfg)
+	if err != nil || !ok || cp.height != 16 ||
+		cp.tipHash != tc.blocks[14].Blk.BlockHash() {
+		t.Fatalf("checkpoint %+v %v %v, block 15 is %s", cp, ok, err,
+			tc.blocks[14].Blk.BlockHash())
+	}
+
+	// the same blocks from 10 on, but on another chain
+	fork := newTestChain()
+	fork.extend(9)
+	fork.tag = 1
+	fork.extend(25)
+	node.setBlocks(fork)
+	cfg.quitAt = 25
+	err = BuildProofs(cfg, make(chan bool))
+	if err == nil || !strings.Contains(err.Error(), "reorged") {
+		t.Fatalf("no reorg error: %v", err)
+	}
+}
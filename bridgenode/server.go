@@ -9,7 +9,9 @@ import (
 	"runtime/trace"
 	"time"
 
+	"github.com/btcsuite/btcd/wire"
 	"github.com/mit-dci/utreexo/util"
+	uwire "github.com/mit-dci/utreexo/wire"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 )
@@ -37,6 +39,12 @@ func Start(cfg *Config, sig chan bool) error {
 		trace.Start(f)
 	}
 
+	// proofs from before they were split into files
+	err := migrateProofFile(cfg)
+	if err != nil {
+		return err
+	}
+
 	// If serve option wasn't given
 	if !cfg.serve {
 		err := BuildProofs(cfg, sig)
@@ -91,7 +99,15 @@ func ArchiveServer(cfg *Config, sig chan bool) error {
 		return err
 	}
 
-	blockServer(maxHeight, cfg, haltRequest, haltAccept)
+	// check and relay txs with proofs from CSNs.  The server still works
+	// without it, it just won't take txs.
+	relay, err := newUTxRelay(cfg, maxHeight)
+	if err != nil {
+		fmt.Printf("not relaying txs, can't get forest roots: %s\n",
+			err.Error())
+	}
+
+	blockServer(maxHeight, cfg, relay, haltRequest, haltAccept)
 	return nil
 }
 
@@ -116,10 +132,15 @@ func stopServer(sig, haltRequest, haltAccept chan bool) {
 	os.Exit(0)
 }
 
+// tipCheckInterval is how often the server checks if the data on disk got
+// to a new height
+const tipCheckInterval = 10 * time.Second
+
 // blockServer listens on a TCP port for incoming connections, then gives
-// ublocks blocks over that connection
-func blockServer(
-	endHeight int32, cfg *Config, haltRequest, haltAccept chan bool) {
+// ublocks blocks over that connection.  UTx requests on the connection go to
+// relay, which can be nil.
+func blockServer(endHeight int32, cfg *Config, relay *utxRelay,
+	haltRequest, haltAccept chan bool) {
 
 	// before doing anything... this breaks
 	/*
@@ -159,6 +180,9 @@ func blockServer(
 
 	cons := make(chan net.Conn)
 	go acceptConnections(listener, cons)
+	// another bridge node process can be building on the same files
+	tipCheck := time.NewTicker(tipCheckInterval)
+	defer tipCheck.Stop()
 	for {
 		select {
 		case <-haltRequest:
@@ -167,7 +191,26 @@ func blockServer(
 			close(cons)
 			return
 		case con := <-cons:
-			go serveBlocksWorker(cfg.UtreeDir, con, endHeight, cfg.BlockDir)
+			go serveBlocksWorker(
+				cfg.UtreeDir, con, endHeight, cfg.BlockDir, relay)
+		case <-tipCheck.C:
+			height, err := restoreHeight(cfg)
+			if err != nil {
+				continue
+			}
+			if height > endHeight {
+				endHeight = height
+				fmt.Printf("serving up to & including block height %d\n",
+					endHeight)
+			}
+			// keeps trying if it couldn't get all the blocks before
+			if relay != nil {
+				err = relay.newBlocks(cfg, height)
+				if err != nil {
+					fmt.Printf("relay can't follow block %d: %s\n",
+						height, err.Error())
+				}
+			}
 		}
 	}
 }
@@ -194,9 +237,9 @@ func acceptConnections(listener *net.TCPListener, cons chan net.Conn) {
 }
 
 // serveBlocksWorker gets height requests from client and sends out the ublock
-// for that height
+// for that height.  A negative height is a UTx request instead.
 func serveBlocksWorker(UtreeDir utreeDir,
-	c net.Conn, endHeight int32, blockDir string) {
+	c net.Conn, endHeight int32, blockDir string, relay *utxRelay) {
 	defer c.Close()
 	fmt.Printf("start serving %s\n", c.RemoteAddr().String())
 	var fromHeight, toHeight int32
@@ -207,6 +250,15 @@ func serveBlocksWorker(UtreeDir utreeDir,
 		return
 	}
 
+	if fromHeight == uwire.HeadersRequest {
+		serveHeaders(c, UtreeDir, endHeight, blockDir)
+		return
+	}
+	if fromHeight < 0 {
+		serveUTx(c, fromHeight, relay)
+		return
+	}
+
 	err = binary.Read(c, binary.BigEndian, &toHeight)
 	if err != nil {
 		fmt.Printf("pushBlocks Read %s\n", err.Error())
@@ -239,8 +291,25 @@ func serveBlocksWorker(UtreeDir utreeDir,
 		}
 
 		udb, err := GetUDataBytesFromFile(UtreeDir.ProofDir, curHeight)
+		if err == ErrProofPruned {
+			// tell them where we start so they can go elsewhere
+			oldest, err := firstProofHeight(UtreeDir.ProofDir)
+			if err != nil {
+				fmt.Printf("pushBlocks firstProofHeight %s\n", err.Error())
+				break
+			}
+			fmt.Printf("%s wanted %d but it's pruned, have %d and up\n",
+				c.RemoteAddr().String(), curHeight, oldest)
+			err = uwire.WritePrunedResponse(c, oldest)
+			if err != nil {
+				fmt.Printf("pushBlocks pruned write %s\n", err.Error())
+			}
+			break
+		}
 		if err != nil {
-			fmt.Printf("pushBlocks GetUDataBytesFromFile %s\n", err.Error())
+			// don't send anything we can't vouch for
+			fmt.Printf("pushBlocks refusing to serve block %d to %s: %s\n",
+				curHeight, c.RemoteAddr().String(), err.Error())
 			break
 		}
 
@@ -252,7 +321,7 @@ func serveBlocksWorker(UtreeDir utreeDir,
 		}
 
 		// send
-		_, err = c.Write(append(blkbytes, udb...))
+		err = uwire.WriteUBlockResponse(c, blkbytes, udb)
 		if err != nil {
 			fmt.Printf("pushBlocks blkbytes write %s\n", err.Error())
 			break
@@ -265,93 +334,82 @@ func serveBlocksWorker(UtreeDir utreeDir,
 	fmt.Printf("hung up on %s\n", c.RemoteAddr().String())
 }
 
-// GetUDataBytesFromFile reads the proof data from proof.dat and proofoffset.dat
-// and gives the proof & utxo data back.
-// Don't ask for block 0, there is no proof for that.
-// But there is an offset for block 0, which is 0, so it collides with block 1
-func GetUDataBytesFromFile(proofDir proofDir, height int32) (b []byte, err error) {
-	if height == 0 {
-		err = fmt.Errorf("Block 0 is not in blk files or utxo set")
-		return
-	}
+// serveHeaders replies to a headers request, with up to
+// MaxHeadersPerRequest headers and none past endHeight
+func serveHeaders(c net.Conn, UtreeDir utreeDir, endHeight int32,
+	blockDir string) {
 
-	var offset int64
-	var size uint32
-	var readMagic [4]byte
-	realMagic := [4]byte{0xaa, 0xff, 0xaa, 0xff}
-	offsetFile, err := os.OpenFile(proofDir.pOffsetFile, os.O_RDONLY, 0600)
-	if err != nil {
-		return
+	var fromHeight, toHeight int32
+	err := binary.Read(c, binary.BigEndian, &fromHeight)
+	if err == nil {
+		err = binary.Read(c, binary.BigEndian, &toHeight)
 	}
-
-	proofFile, err := os.OpenFile(proofDir.pFile, os.O_RDONLY, 0600)
 	if err != nil {
+		fmt.Printf("serveHeaders Read %s\n", err.Error())
 		return
 	}
-
-	// offset file consists of 8 bytes per block
-	// tipnum * 8 gives us the correct position for that block
-	// Note it's currently a int64, can go down to int32 for split files
-	_, err = offsetFile.Seek(int64(8*height), 0)
-	if err != nil {
-		err = fmt.Errorf("offsetFile.Seek %s", err.Error())
-		return
+	if toHeight > endHeight {
+		toHeight = endHeight
 	}
-
-	// read the offset of the block we want from the offset file
-	err = binary.Read(offsetFile, binary.BigEndian, &offset)
+	if toHeight-fromHeight >= uwire.MaxHeadersPerRequest {
+		toHeight = fromHeight + uwire.MaxHeadersPerRequest - 1
+	}
+	var headers []wire.BlockHeader
+	if fromHeight >= 1 && fromHeight <= toHeight {
+		headers, err = GetHeadersFromFile(fromHeight, toHeight,
+			UtreeDir.OffsetDir.OffsetFile, blockDir)
+		if err != nil {
+			fmt.Printf("serveHeaders %s\n", err.Error())
+			return
+		}
+	}
+	err = uwire.WriteHeaders(c, headers)
 	if err != nil {
-		err = fmt.Errorf("binary.Read h %d offset %d %s", height, offset, err.Error())
-		return
+		fmt.Printf("serveHeaders write %s\n", err.Error())
 	}
+}
 
-	// seek to that offset
-	_, err = proofFile.Seek(offset, 0)
-	if err != nil {
-		err = fmt.Errorf("proofFile.Seek %s", err.Error())
+// GetUDataBytesFromFile reads the proof data from the proof files and
+// proofoffset.dat and gives the proof & utxo data back.
+// Don't ask for block 0, there is no proof for that.
+// But there is an offset for block 0, which is 0, so it collides with block 1
+func GetUDataBytesFromFile(proofDir proofDir, height int32) (b []byte, err error) {
+	if height == 0 {
+		err = fmt.Errorf("Block 0 is not in blk files or utxo set")
 		return
 	}
 
-	// first read 4-byte magic aaffaaff
-	n, err := proofFile.Read(readMagic[:])
+	offsetFile, err := os.OpenFile(proofDir.pOffsetFile, os.O_RDONLY, 0600)
 	if err != nil {
-		return nil, err
-	}
-	if n != 4 {
-		return nil, fmt.Errorf("only read %d bytes from proof file", n)
-	}
-	if readMagic != realMagic {
-		return nil, fmt.Errorf("expect magic %x but read %x h %d offset %d",
-			realMagic, readMagic, height, offset)
+		return
 	}
+	defer offsetFile.Close()
 
-	// fmt.Printf("height %d offset %d says size %d\n", height, offset, size)
-
-	err = binary.Read(proofFile, binary.BigEndian, &size)
+	// offset file consists of 8 bytes per block
+	// tipnum * 8 gives us the correct position for that block
+	// read which proof file the block is in, and where
+	pos, err := readProofPos(offsetFile, height)
 	if err != nil {
 		return
 	}
 
-	if size > 1<<24 {
-		return nil, fmt.Errorf(
-			"size at offest %d says %d which is too big", offset, size)
+	proofFile, err := os.OpenFile(
+		proofDir.fileName(pos.file), os.O_RDONLY, 0600)
+	if os.IsNotExist(err) {
+		pruned, perr := proofPruned(proofDir, pos)
+		if perr == nil && pruned {
+			err = ErrProofPruned
+		}
 	}
-	// fmt.Printf("GetUDataBytesFromFile read size %d ", size)
-	b = make([]byte, size)
-
-	_, err = proofFile.Read(b)
 	if err != nil {
-		err = fmt.Errorf("proofFile.Read(ubytes) %s", err.Error())
 		return
 	}
+	defer proofFile.Close()
 
-	err = offsetFile.Close()
+	// read the record and check it's what was written
+	b, _, err = readProofRecord(proofFile, int64(pos.offset))
 	if err != nil {
-		return
-	}
-	err = proofFile.Close()
-	if err != nil {
-		return
+		err = errBadProof(height, pos, err)
 	}
 	return
 }
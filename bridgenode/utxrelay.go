@@ -0,0 +1,226 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// utxRelay takes UTxs pushed by CSNs, checks them against the roots of the
+// forest, and hands them out to anyone who asks.  The UTxs it takes are all
+// for the block after the last one it has.  When the server gets new
+// blocks, the relay puts them in its pollard and drops all its UTxs, since
+// their proofs are for the old roots.
+type utxRelay struct {
+	// guards pollard and height.  Checking UTxs only reads them.
+	pollardMtx sync.RWMutex
+	// just the roots of the forest, to check proofs against
+	pollard accumulator.Pollard
+	// the block the UTxs have to be for
+	height int32
+	params *chaincfg.Params
+
+	mtx  sync.Mutex
+	utxs []uwire.UTx
+	have map[chainhash.Hash]bool
+}
+
+// newUTxRelay gets the roots from the forest on disk.  height is the next
+// block, from restoreHeight.
+func newUTxRelay(cfg *Config, height int32) (*utxRelay, error) {
+	forest, err := restoreForest(cfg)
+	if err != nil {
+		return nil, err
+	}
+	numLeaves, _ := forest.ReconstructStats()
+	p, err := accumulator.NewPollardFromRoots(forest.GetRoots(), numLeaves)
+	if err != nil {
+		return nil, err
+	}
+	return &utxRelay{
+		pollard: p,
+		height:  height,
+		params:  &cfg.params,
+		have:    make(map[chainhash.Hash]bool),
+	}, nil
+}
+
+// accept checks a UTx and if it's OK, adds it to the ones being relayed
+func (r *utxRelay) accept(utx *uwire.UTx) error {
+	// held to the end so a UTx for the old roots can't get in after
+	// newBlocks dropped them
+	r.pollardMtx.RLock()
+	defer r.pollardMtx.RUnlock()
+
+	if utx.UtreexoData.Height != r.height {
+		return fmt.Errorf("proof is for block %d, server is at %d",
+			utx.UtreexoData.Height, r.height)
+	}
+	txid := utx.Tx.TxHash()
+	r.mtx.Lock()
+	have := r.have[txid]
+	full := len(r.utxs) >= uwire.MaxUTxRelay
+	r.mtx.Unlock()
+	if have {
+		return nil
+	}
+	if full {
+		return fmt.Errorf("relaying %d txs already, can't take more",
+			uwire.MaxUTxRelay)
+	}
+
+	nl, h := r.pollard.ReconstructStats()
+	err := utx.ProofSanity(nl, h)
+	if err != nil {
+		return err
+	}
+	// VerifyBatchProof only reads the pollard so it's fine to call it from
+	// many workers at once
+	_, err = r.pollard.VerifyBatchProof(utx.UtreexoData.AccProof)
+	if err != nil {
+		return fmt.Errorf("tx %s: %s", txid.String(), err.Error())
+	}
+	err = utx.CheckTx(r.params, true)
+	if err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if !r.have[txid] {
+		r.have[txid] = true
+		r.utxs = append(r.utxs, *utx)
+	}
+	return nil
+}
+
+// newBlocks brings the relay up to height, the new next block.  It puts
+// the blocks it doesn't have yet in its pollard the same way a CSN does,
+// with the proofs the server sends out, and drops the UTxs for the old
+// roots.
+func (r *utxRelay) newBlocks(cfg *Config, height int32) error {
+	r.pollardMtx.Lock()
+	defer r.pollardMtx.Unlock()
+	if r.height >= height {
+		return nil
+	}
+
+	r.mtx.Lock()
+	if len(r.utxs) > 0 {
+		fmt.Printf("block %d came in, dropping %d relayed txs\n",
+			r.height, len(r.utxs))
+	}
+	r.utxs = nil
+	r.have = make(map[chainhash.Hash]bool)
+	r.mtx.Unlock()
+
+	for r.height < height {
+		ub, err := readUBlock(cfg, r.height)
+		if err != nil {
+			return err
+		}
+		inskip, outskip := util.DedupeBlock(&ub.Block)
+		nl, h := r.pollard.ReconstructStats()
+		err = ub.ProofSanity(inskip, nl, h)
+		if err != nil {
+			return err
+		}
+		vp, err := r.pollard.VerifyBatchProof(ub.UtreexoData.AccProof)
+		if err != nil {
+			return fmt.Errorf("block %d: %s", r.height, err.Error())
+		}
+		err = r.pollard.PopulateBatchProof(vp)
+		if err != nil {
+			return fmt.Errorf("block %d: %s", r.height, err.Error())
+		}
+		err = r.pollard.Modify(
+			uwire.BlockToAddLeaves(ub.Block, nil, outskip, r.height),
+			ub.UtreexoData.AccProof.Targets)
+		if err != nil {
+			return fmt.Errorf("block %d: %s", r.height, err.Error())
+		}
+		r.height++
+	}
+	return nil
+}
+
+// readUBlock reads the ublock at height from the files the server sends it
+// from
+func readUBlock(cfg *Config, height int32) (uwire.UBlock, error) {
+	var ub uwire.UBlock
+	udb, err := GetUDataBytesFromFile(cfg.UtreeDir.ProofDir, height)
+	if err != nil {
+		return ub, err
+	}
+	blkbytes, err := GetBlockBytesFromFile(
+		height, cfg.UtreeDir.OffsetDir.OffsetFile, cfg.BlockDir)
+	if err != nil {
+		return ub, err
+	}
+	err = ub.Deserialize(bytes.NewReader(append(blkbytes, udb...)))
+	if err != nil {
+		return ub, fmt.Errorf("block %d: %s", height, err.Error())
+	}
+	return ub, nil
+}
+
+// relayed gives the UTxs being relayed
+func (r *utxRelay) relayed() []uwire.UTx {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return append([]uwire.UTx(nil), r.utxs...)
+}
+
+// serveUTx handles a UTx request on a connection; request is the code the
+// client sent instead of a block height.
+func serveUTx(c net.Conn, request int32, relay *utxRelay) {
+	switch request {
+	case uwire.UTxPushRequest:
+		var utx uwire.UTx
+		err := utx.Deserialize(c)
+		if err != nil {
+			fmt.Printf("serveUTx read UTx %s\n", err.Error())
+			return
+		}
+		if relay == nil {
+			err = fmt.Errorf("this server doesn't relay txs")
+		} else {
+			err = relay.accept(&utx)
+		}
+		if err != nil {
+			fmt.Printf("rejected tx %s from %s: %s\n", utx.Tx.TxHash().String(),
+				c.RemoteAddr().String(), err.Error())
+		} else {
+			fmt.Printf("relaying tx %s from %s\n", utx.Tx.TxHash().String(),
+				c.RemoteAddr().String())
+		}
+		err = uwire.WriteUTxReply(c, err)
+		if err != nil {
+			fmt.Printf("serveUTx reply %s\n", err.Error())
+		}
+
+	case uwire.UTxPullRequest:
+		var utxs []uwire.UTx
+		if relay != nil {
+			utxs = relay.relayed()
+		}
+		err := uwire.WriteUTxs(c, utxs)
+		if err != nil {
+			fmt.Printf("serveUTx send UTxs %s\n", err.Error())
+		}
+
+	default:
+		fmt.Printf("%s sent unknown request %d\n",
+			c.RemoteAddr().String(), request)
+		// still a reply so the client isn't left waiting
+		binary.Write(c, binary.BigEndian, uint32(0))
+	}
+}
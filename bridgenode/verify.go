@@ -0,0 +1,226 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+/*
+Before building on top of what's on disk, checkBridgeNodeData makes sure it
+all agrees with the forest's height.  Otherwise a broken datadir only shows
+up later as a panic somewhere in genproofs.
+
+What gets checked:
+the forest still hashes up from the leaves to the roots (Forest.Sanity)
+proofoffset.dat has an offset for every block before the height
+the proof for the last block starts with the magic bytes, its size fits in
+its proof file, and it deserializes to the right height
+the ttldb has the txos for every block before the height
+with -norev, the leafdb has the txos for every block before the height too
+
+Data past the height (from a crash without checkpoints) is an error, or with
+-repair it's cut off.  Anything wrong before the height can't be fixed by
+cutting things off, as the forest has to go back too.  -repair goes back a
+checkpoint at a time with the undo files (see checkpointundo.go) until it
+all checks out.  If none of them do it's still an error, unless -startover
+says to throw it all away and start over from block 1.
+*/
+
+// checkBridgeNodeData checks that the files on disk agree on height
+func checkBridgeNodeData(
+	cfg *Config, forest *accumulator.Forest, height int32) error {
+
+	err := forest.Sanity()
+	if err != nil {
+		return fmt.Errorf("forest: %s", err.Error())
+	}
+	err = checkProofs(cfg, height)
+	if err != nil {
+		return fmt.Errorf("proofs: %s", err.Error())
+	}
+	err = checkTTLDB(cfg, height)
+	if err != nil {
+		return fmt.Errorf("ttldb: %s", err.Error())
+	}
+	if cfg.noRev {
+		err = checkLeafDB(cfg, height)
+		if err != nil {
+			return fmt.Errorf("leafdb: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// checkProofs checks proofoffset.dat and the last proof in the proof files.
+// With cfg.repair it truncates proofs past height.
+func checkProofs(cfg *Config, height int32) error {
+	proofDir := cfg.UtreeDir.ProofDir
+	offsetFile, err := os.Open(proofDir.pOffsetFile)
+	if err != nil {
+		return err
+	}
+	defer offsetFile.Close()
+	fi, err := offsetFile.Stat()
+	if err != nil {
+		return err
+	}
+	offsetSize := fi.Size()
+
+	// one offset for every block, starting at block 0
+	numOffsets := int32(offsetSize / 8)
+	if numOffsets < height {
+		return fmt.Errorf("%s has offsets up to block %d "+
+			"but the forest is at height %d",
+			proofDir.pOffsetFile, numOffsets-1, height)
+	}
+
+	// parse the proof for the last block.  Nothing to do at height 1 as
+	// there aren't any blocks yet.
+	var proofEnd proofPos
+	if height > 1 {
+		pos, err := readProofPos(offsetFile, height-1)
+		if err != nil {
+			return err
+		}
+		name := proofDir.fileName(pos.file)
+		proofFile, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer proofFile.Close()
+
+		// a record cut off or corrupted is an error here too
+		udBytes, end, err := readProofRecord(proofFile, int64(pos.offset))
+		if err != nil {
+			return errBadProof(height-1, pos, err)
+		}
+		proofEnd = proofPos{file: pos.file, offset: uint32(end)}
+
+		var ud btcacc.UData
+		err = ud.Deserialize(bytes.NewReader(udBytes))
+		if err != nil {
+			return fmt.Errorf("block %d proof: %s", height-1, err.Error())
+		}
+		if ud.Height != height-1 {
+			return fmt.Errorf("proof for block %d says it's for block %d",
+				height-1, ud.Height)
+		}
+	}
+
+	// anything more is from blocks after height
+	lastEnd, err := proofDir.end()
+	if err != nil {
+		return err
+	}
+	if offsetSize == int64(height)*8 && lastEnd == proofEnd {
+		return nil
+	}
+	if !cfg.repair {
+		return fmt.Errorf("%s and the proof files in %s have data past "+
+			"height %d", proofDir.pOffsetFile, proofDir.base, height)
+	}
+	fmt.Printf("repair: cutting off proofs past height %d\n", height)
+	return rollBackToCheckpoint(cfg,
+		bridgeCheckpoint{height: height, proofEnd: proofEnd})
+}
+
+// checkTTLDB checks that the ttldb has the txos for every block before
+// height
+func checkTTLDB(cfg *Config, height int32) error {
+	if !util.HasAccess(cfg.UtreeDir.Ttldb) {
+		if height == 1 {
+			return nil
+		}
+		return fmt.Errorf("no ttldb at %s", cfg.UtreeDir.Ttldb)
+	}
+	lvdb, err := leveldb.OpenFile(cfg.UtreeDir.Ttldb,
+		&opt.Options{ReadOnly: true, ErrorIfMissing: true})
+	if err != nil {
+		return err
+	}
+	defer lvdb.Close()
+
+	hBytes, err := lvdb.Get(ttldbHeightKey, nil)
+	if err == leveldb.ErrNotFound {
+		fmt.Printf("ttldb has no height recorded (made before " +
+			"checkpoints), can't check it\n")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ttlHeight := int32(binary.BigEndian.Uint32(hBytes))
+	if ttlHeight < height {
+		return fmt.Errorf("has txos up to height %d but the forest "+
+			"is at height %d", ttlHeight, height)
+	}
+	return nil
+}
+
+// checkLeafDB checks that the leafdb has the txos for every block before
+// height.  Unlike the ttldb there's no leafdb from before it had a height.
+func checkLeafDB(cfg *Config, height int32) error {
+	if !util.HasAccess(cfg.UtreeDir.LeafDb) {
+		if height == 1 {
+			return nil
+		}
+		return fmt.Errorf("no leafdb at %s", cfg.UtreeDir.LeafDb)
+	}
+	lvdb, err := leveldb.OpenFile(cfg.UtreeDir.LeafDb,
+		&opt.Options{ReadOnly: true, ErrorIfMissing: true})
+	if err != nil {
+		return err
+	}
+	defer lvdb.Close()
+
+	hBytes, err := lvdb.Get(leafdbHeightKey, nil)
+	if err == leveldb.ErrNotFound || (err == nil && len(hBytes) != 4) {
+		if height == 1 {
+			return nil
+		}
+		return fmt.Errorf("no height recorded, was the bridge node run " +
+			"without -norev?")
+	}
+	if err != nil {
+		return err
+	}
+	leafHeight := int32(binary.BigEndian.Uint32(hBytes))
+	if leafHeight < height {
+		return fmt.Errorf("has txos up to height %d but the forest "+
+			"is at height %d", leafHeight, height)
+	}
+	return nil
+}
+
+// resetBridgeNodeData removes the forest, proofs and ttldb so the bridge
+// node starts over from block 1.  The blk file index in offsetdata is kept.
+func resetBridgeNodeData(cfg *Config) error {
+	forestDir := cfg.UtreeDir.ForestDir
+	for _, name := range []string{
+		forestDir.forestFile, forestDir.miscForestFile,
+		forestDir.forestLastSyncedBlockHeightFile, forestDir.checkpointFile,
+		forestDir.forestDirtyFile, forestDir.forestJournalFile,
+		forestDir.cowForestDir, forestDir.undoDir,
+		cfg.UtreeDir.Ttldb, cfg.UtreeDir.LeafDb} {
+
+		err := os.RemoveAll(name)
+		if err != nil {
+			return err
+		}
+	}
+	err := removeProofFiles(cfg.UtreeDir.ProofDir)
+	if err != nil {
+		return err
+	}
+	// the cow forest expects its directory to be there
+	return os.MkdirAll(forestDir.cowForestDir, os.ModePerm)
+}
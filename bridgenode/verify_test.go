@@ -0,0 +1,368 @@
+package bridgenode
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mit-dci/utreexo/util"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// writeTTLDBHeight makes a ttldb that says it has the txos up to height
+func writeTTLDBHeight(t *testing.T, cfg *Config, height int32) {
+	lvdb, err := leveldb.OpenFile(cfg.UtreeDir.Ttldb, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lvdb.Close()
+	var hBytes [4]byte
+	binary.BigEndian.PutUint32(hBytes[:], uint32(height))
+	err = lvdb.Put(ttldbHeightKey, hBytes[:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// corruptProof flips a bit in the proof of block h
+func corruptProof(t *testing.T, pd proofDir, h int32) {
+	offsetFile, err := os.Open(pd.pOffsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offsetFile.Close()
+	pos, err := readProofPos(offsetFile, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(pd.fileName(pos.file), os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var b [1]byte
+	// the height, after the header
+	at := int64(pos.offset) + 16 + 3
+	_, err = f.ReadAt(b[:], at)
+	if err == nil {
+		b[0] ^= 0x01
+		_, err = f.WriteAt(b[:], at)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// proofSizes gives the size of proofoffset.dat and where the proofs end
+func proofSizes(t *testing.T, pd proofDir) (int64, proofPos) {
+	fi, err := os.Stat(pd.pOffsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	end, err := pd.end()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size(), end
+}
+
+func TestCheckProofs(t *testing.T) {
+	smallProofFiles(t, 4)
+	cfg := &Config{UtreeDir: utreeDir{ProofDir: testProofDir(t)}}
+	pd := cfg.UtreeDir.ProofDir
+	ff := openFlatFile(t, pd)
+
+	// nothing at all yet is fine at height 1
+	err := checkProofs(cfg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeProofs(t, ff, 20)
+	err = checkProofs(cfg, 21)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// past the proofs there are
+	err = checkProofs(cfg, 22)
+	if err == nil {
+		t.Fatal("no error at height 22 with proofs to block 20")
+	}
+
+	// proofs past the height are an error, or cut off with repair
+	err = checkProofs(cfg, 15)
+	if err == nil {
+		t.Fatal("no error at height 15 with proofs to block 20")
+	}
+	offsetSize, end := proofSizes(t, pd)
+	if offsetSize != 21*8 {
+		t.Fatalf("proofs cut off without repair")
+	}
+	cfg.repair = true
+	err = checkProofs(cfg, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsetSize, end = proofSizes(t, pd)
+	offsetFile, err := os.Open(pd.pOffsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offsetFile.Close()
+	last, err := readProofPos(offsetFile, 14)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := makeProofRecord(testUData(14))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offsetSize != 15*8 || end.file != last.file ||
+		end.offset != last.offset+uint32(len(rec)) {
+		t.Fatalf("after repair %d offsets, proofs end at %v, block 14 "+
+			"at %v", offsetSize/8, end, last)
+	}
+	err = checkProofs(cfg, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the last proof has to check out, repair or not
+	corruptProof(t, pd, 14)
+	err = checkProofs(cfg, 15)
+	if err == nil {
+		t.Fatal("no error with the last proof corrupted")
+	}
+	// but the ones before aren't read
+	err = checkProofs(cfg, 14)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// and be for the right block
+	ff = openFlatFile(t, pd)
+	ff.fileWait.Add(1)
+	err = ff.writeProofBlock(testUData(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkProofs(cfg, 15)
+	if err == nil {
+		t.Fatal("no error with the last proof for the wrong block")
+	}
+}
+
+func TestCheckTTLDB(t *testing.T) {
+	dir := initUtreeDir(t.TempDir())
+	cfg := &Config{UtreeDir: dir}
+
+	// no ttldb is only OK at the start
+	err := checkTTLDB(cfg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkTTLDB(cfg, 5)
+	if err == nil {
+		t.Fatal("no error at height 5 without a ttldb")
+	}
+
+	// one from before checkpoints can't be checked
+	lvdb, err := leveldb.OpenFile(dir.Ttldb, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lvdb.Close()
+	err = checkTTLDB(cfg, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTTLDBHeight(t, cfg, 10)
+	for h := int32(1); h <= 11; h++ {
+		err = checkTTLDB(cfg, h)
+		if (err != nil) != (h > 10) {
+			t.Fatalf("ttldb at height 10, checked at %d: %v", h, err)
+		}
+	}
+}
+
+func TestCheckLeafDB(t *testing.T) {
+	cfg := &Config{UtreeDir: initUtreeDir(t.TempDir())}
+	err := checkLeafDB(cfg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkLeafDB(cfg, 5)
+	if err == nil {
+		t.Fatal("no error at height 5 without a leafdb")
+	}
+
+	// one with no height wasn't made with -norev
+	ls, err := openLeafStore(cfg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls.close()
+	err = checkLeafDB(cfg, 5)
+	if err == nil {
+		t.Fatal("no error at height 5 without a leafdb height")
+	}
+
+	ls, err = openLeafStore(cfg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ls.sync(10)
+	ls.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h := int32(1); h <= 11; h++ {
+		err = checkLeafDB(cfg, h)
+		if (err != nil) != (h > 10) {
+			t.Fatalf("leafdb at height 10, checked at %d: %v", h, err)
+		}
+	}
+
+}
+
+// checkpoints does blocks and a checkpoint n times, with blocks more after
+func (ft *forestTest) checkpoints(n int) {
+	for i := 0; i < n; i++ {
+		ft.blocks(10)
+		ft.checkpoint()
+	}
+	ft.blocks(5)
+}
+
+// init starts up the bridge node like genproofs does, and checks it's at
+// the height it should be, with the roots it had then
+func (ft *forestTest) init(want int32) {
+	ft.t.Helper()
+	forest, height, err := InitBridgeNodeState(ft.cfg)
+	if err != nil {
+		ft.t.Fatal(err)
+	}
+	ft.check(forest, height, want)
+	if height == 1 {
+		return
+	}
+	offsetSize, end := proofSizes(ft.t, ft.cfg.UtreeDir.ProofDir)
+	if offsetSize != int64(want)*8 {
+		ft.t.Fatalf("%d offsets at height %d", offsetSize/8, want)
+	}
+	cp, ok, err := readCheckpoint(ft.cfg)
+	if err != nil || !ok || cp.height != want || cp.proofEnd != end {
+		ft.t.Fatalf("checkpoint %+v %v %v, proofs end at %v", cp, ok, err,
+			end)
+	}
+}
+
+// undoHeights checks which undo files there are
+func (ft *forestTest) undoHeights(want ...int32) {
+	ft.t.Helper()
+	heights, err := ft.cfg.UtreeDir.ForestDir.undoHeights()
+	if err != nil {
+		ft.t.Fatal(err)
+	}
+	if len(heights) != len(want) {
+		ft.t.Fatalf("undo files for %v, expected %v", heights, want)
+	}
+	for i := range want {
+		if heights[i] != want[i] {
+			ft.t.Fatalf("undo files for %v, expected %v", heights, want)
+		}
+	}
+}
+
+// TestRepair checks that -repair goes back to the last checkpoint where
+// everything checks out, and only starts over when there isn't one and
+// -startover is given
+func TestRepair(t *testing.T) {
+	types := map[string]forestType{"disk": diskForest,
+		"cache": cacheForest, "cow": cowForest, "ram": ramForest}
+	for name, typ := range types {
+		t.Logf("%s forest", name)
+
+		// only the last few undo files are kept
+		ft := newForestTest(t, typ)
+		ft.checkpoints(5)
+		ft.undoHeights(31, 41, 51)
+		writeTTLDBHeight(t, ft.cfg, 100)
+		ft.init(51)
+
+		// the last proof's bad: back one checkpoint
+		ft = newForestTest(t, typ)
+		ft.checkpoints(3)
+		ft.undoHeights(21, 31)
+		writeTTLDBHeight(t, ft.cfg, 100)
+		corruptProof(t, ft.cfg.UtreeDir.ProofDir, 30)
+		_, _, err := InitBridgeNodeState(ft.cfg)
+		if err == nil {
+			t.Fatal("bad proof without -repair")
+		}
+		ft.cfg.repair = true
+		ft.init(21)
+		ft.undoHeights(21)
+		// and it stays there
+		ft.init(21)
+
+		// ttldb's behind: back two
+		ft = newForestTest(t, typ)
+		ft.checkpoints(3)
+		writeTTLDBHeight(t, ft.cfg, 15)
+		ft.cfg.repair = true
+		ft.init(11)
+		ft.undoHeights()
+
+		// nothing's good: an error, unless told to start over
+		ft = newForestTest(t, typ)
+		ft.checkpoints(3)
+		writeTTLDBHeight(t, ft.cfg, 5)
+		ft.cfg.repair = true
+		_, _, err = InitBridgeNodeState(ft.cfg)
+		if err == nil {
+			t.Fatal("no good checkpoint without -startover")
+		}
+		if !util.HasAccess(ft.cfg.UtreeDir.Ttldb) ||
+			!util.HasAccess(ft.cfg.UtreeDir.ForestDir.checkpointFile) {
+			t.Fatal("data removed without -startover")
+		}
+		ft.cfg.startOver = true
+		ft.init(1)
+		if util.HasAccess(ft.cfg.UtreeDir.Ttldb) {
+			t.Fatal("ttldb still there after starting over")
+		}
+	}
+}
+
+// TestUndoCheckpointCrash stops partway through going back a checkpoint,
+// after checkpoint.dat's written, and checks startup finishes it
+func TestUndoCheckpointCrash(t *testing.T) {
+	types := map[string]forestType{"disk": diskForest,
+		"cache": cacheForest, "cow": cowForest, "ram": ramForest}
+	for name, typ := range types {
+		t.Logf("%s forest", name)
+		ft := newForestTest(t, typ)
+		// across a remap
+		ft.checkpoints(3)
+		writeTTLDBHeight(t, ft.cfg, 100)
+
+		prev, journal, ok, err := readUndo(ft.cfg, 31)
+		if err != nil || !ok || prev.height != 21 {
+			t.Fatalf("undo file for 31: %+v %v %v", prev, ok, err)
+		}
+		err = writeJournalFile(journal, prev.height, ft.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(ft.cfg.UtreeDir.ForestDir.checkpointFile,
+			prev.serialize(), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ft.init(21)
+		ft.undoHeights(21)
+	}
+}
@@ -0,0 +1,64 @@
+package bridgenode
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/*
+Since version 28 Bitcoin Core obfuscates the blk and rev files with a key
+that's random for each datadir, kept in blocks/xor.dat.  Byte i of a file
+(counting from the start of the file) is XORed with key[i % 8].  Datadirs
+from before that have no xor.dat, and -blocksxor=0 makes a key of all zeros;
+either way the files are as they are.
+*/
+
+// xorKey is what the blk and rev files are XORed with
+type xorKey [8]byte
+
+// readXorKey reads xor.dat in blockDir.  If there isn't one the key is all
+// zeros, which doesn't change anything.
+func readXorKey(blockDir string) (key xorKey, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(blockDir, "xor.dat"))
+	if os.IsNotExist(err) {
+		return key, nil
+	}
+	if err != nil {
+		return
+	}
+	if len(b) != len(key) {
+		err = fmt.Errorf("xor.dat in %s is %d bytes, expected %d",
+			blockDir, len(b), len(key))
+		return
+	}
+	copy(key[:], b)
+	return
+}
+
+// apply XORs b, which is at position pos in its file, with the key.  Doing
+// it twice gives back what was there.
+func (k *xorKey) apply(b []byte, pos int64) {
+	if *k == (xorKey{}) {
+		return
+	}
+	for i := range b {
+		b[i] ^= k[(pos+int64(i))%int64(len(k))]
+	}
+}
+
+// xorReader un-obfuscates a blk or rev file as it's read
+type xorReader struct {
+	r   io.Reader
+	key xorKey
+	pos int64 // where in the file the next byte read is
+}
+
+func (x *xorReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	x.key.apply(p[:n], x.pos)
+	x.pos += int64(n)
+	return n, err
+}
@@ -0,0 +1,68 @@
+package bridgenode
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+)
+
+// TestXorReader reads an obfuscated file from an offset that isn't a
+// multiple of the key length, in reads of odd sizes
+func TestXorReader(t *testing.T) {
+	key := xorKey{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	plain := make([]byte, 100)
+	for i := range plain {
+		plain[i] = byte(i * 7)
+	}
+	file := append([]byte(nil), plain...)
+	key.apply(file, 0)
+	if bytes.Equal(file, plain) {
+		t.Fatal("key didn't change anything")
+	}
+
+	for _, offset := range []int64{0, 13, 99} {
+		x := &xorReader{r: iotest.HalfReader(bytes.NewReader(file[offset:])),
+			key: key, pos: offset}
+		got, err := ioutil.ReadAll(x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, plain[offset:]) {
+			t.Fatalf("from %d read %x, expected %x",
+				offset, got, plain[offset:])
+		}
+	}
+}
+
+func TestReadXorKey(t *testing.T) {
+	dir := t.TempDir()
+	// no xor.dat, no key
+	key, err := readXorKey(dir)
+	if err != nil || key != (xorKey{}) {
+		t.Fatalf("key %x %v with no xor.dat", key, err)
+	}
+
+	want := xorKey{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	name := filepath.Join(dir, "xor.dat")
+	for _, b := range [][]byte{want[:7], append(want[:], 0x00), {}} {
+		err = ioutil.WriteFile(name, b, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = readXorKey(dir)
+		if err == nil {
+			t.Fatalf("read a %d byte xor.dat", len(b))
+		}
+	}
+
+	err = ioutil.WriteFile(name, want[:], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err = readXorKey(dir)
+	if err != nil || key != want {
+		t.Fatalf("key %x %v, expected %x", key, err, want)
+	}
+}
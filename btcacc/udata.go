@@ -32,6 +32,7 @@ func (ud *UData) ProofSanity(nl uint64, h uint8) bool {
 	if len(ud.AccProof.Targets) != len(ud.Stxos) {
 		fmt.Printf("Verify failed: %d targets but %d leafdatas\n",
 			len(ud.AccProof.Targets), len(ud.Stxos))
+		return false
 	}
 
 	for i, pos := range ud.AccProof.Targets {
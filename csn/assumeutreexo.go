@@ -0,0 +1,127 @@
+package csn
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// utreexoCheckpoint is the accumulator state right after the block at height.
+// A CSN can start from here instead of from genesis.
+type utreexoCheckpoint struct {
+	height    int32
+	hash      chainhash.Hash
+	numLeaves uint64
+	roots     []accumulator.Hash // biggest tree first
+}
+
+/*
+There are no built in checkpoints, as the roots depend on the exact leaf
+hashing and none have been checked against a bridge node running this code.
+To start from one, -assumeutreexo needs a file from a bridge node you
+trust.  Checkpoint files are text, one thing per line:
+
+height
+block hash (hex, like block explorers show it)
+number of leaves
+root hashes (hex), biggest tree first, one per line
+
+Blank lines and lines starting with # are skipped.
+*/
+
+// readUtreexoCheckpoint reads a checkpoint from a file
+func readUtreexoCheckpoint(path string) (*utreexoCheckpoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) < 3 {
+		return nil, fmt.Errorf("%s: need height, hash and numleaves", path)
+	}
+
+	var cp utreexoCheckpoint
+	height, err := strconv.ParseInt(lines[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%s: height: %s", path, err.Error())
+	}
+	cp.height = int32(height)
+	hash, err := chainhash.NewHashFromStr(lines[1])
+	if err != nil {
+		return nil, fmt.Errorf("%s: block hash: %s", path, err.Error())
+	}
+	cp.hash = *hash
+	cp.numLeaves, err = strconv.ParseUint(lines[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s: numleaves: %s", path, err.Error())
+	}
+	for i, line := range lines[3:] {
+		b, err := hex.DecodeString(line)
+		if err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("%s: root %d isn't a 32 byte hex hash",
+				path, i)
+		}
+		var root accumulator.Hash
+		copy(root[:], b)
+		cp.roots = append(cp.roots, root)
+	}
+	return &cp, nil
+}
+
+// pollard gives a pollard with the checkpoint's roots
+func (cp *utreexoCheckpoint) pollard() (accumulator.Pollard, error) {
+	return accumulator.NewPollardFromRoots(cp.roots, cp.numLeaves)
+}
+
+// check says if the pollard p, after the block with hash, is at cp
+func (cp *utreexoCheckpoint) check(
+	hash chainhash.Hash, p *accumulator.Pollard) error {
+
+	if hash != cp.hash {
+		return fmt.Errorf("block %d is %s", cp.height, hash.String())
+	}
+	nl, _ := p.ReconstructStats()
+	if nl != cp.numLeaves {
+		return fmt.Errorf("%d leaves, not %d", nl, cp.numLeaves)
+	}
+	roots := p.GetRoots()
+	if len(roots) != len(cp.roots) {
+		return fmt.Errorf("%d roots, not %d", len(roots), len(cp.roots))
+	}
+	for i := range roots {
+		if roots[i] != cp.roots[i] {
+			return fmt.Errorf("root %d is %x, not %x", i, roots[i], cp.roots[i])
+		}
+	}
+	return nil
+}
+
+// writeUtreexoCheckpoint writes cp to a file readUtreexoCheckpoint can read
+func writeUtreexoCheckpoint(path string, cp *utreexoCheckpoint) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d\n%s\n%d\n", cp.height, cp.hash.String(), cp.numLeaves)
+	for _, root := range cp.roots {
+		fmt.Fprintf(&b, "%x\n", root[:])
+	}
+	return util.WriteFileAtomic(path, []byte(b.String()), 0600)
+}
@@ -0,0 +1,161 @@
+package csn
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// assumeValid is a block that's assumed to have valid ancestors.  Scripts
+// in blocks up to and including it aren't checked, as long as the blocks
+// are on its header chain.  Everything else (proofs, amounts, block
+// structure) still is.
+type assumeValid struct {
+	hash   chainhash.Hash
+	height int32
+
+	// the hashes of its header chain from height start on, ending with
+	// hash.  Only blocks with these hashes get their scripts skipped.
+	start int32
+	chain []chainhash.Hash
+}
+
+// assumeValidTable has the default assumevalid blocks, same as Bitcoin Core
+// 0.21.  Regtest doesn't get one.
+var assumeValidTable = map[wire.BitcoinNet]assumeValid{
+	wire.MainNet: {
+		hash: hashFromStr(
+			"0000000000000000000b9d2ec5a352ecba0592946514a92f14319dc2b367fc72"),
+		height: 654683,
+	},
+	wire.TestNet3: {
+		hash: hashFromStr(
+			"000000000000006433d1efec504c53ca332b64963c425395515b01977bd7b3b0"),
+		height: 1864000,
+	},
+}
+
+// hashFromStr is chainhash.NewHashFromStr for hardcoded hashes
+func hashFromStr(s string) chainhash.Hash {
+	h, err := chainhash.NewHashFromStr(s)
+	if err != nil {
+		panic(err)
+	}
+	return *h
+}
+
+// skipScripts says if scripts can be skipped for the block at height with
+// hash.  Only blocks on the assumevalid block's header chain can skip them;
+// any other block gets all its scripts checked.
+func (av *assumeValid) skipScripts(height int32, hash chainhash.Hash) bool {
+	if av == nil || height < av.start || height > av.height {
+		return false
+	}
+	return av.chain[height-av.start] == hash
+}
+
+// headerChain gets the headers from the block at height start up to av
+// from the server, and checks that they link from prev to av's hash.  It
+// gives a copy of av that can skip scripts on that chain.  The headers are
+// all tied to av's hash, so the server can't give a different chain.
+func (av *assumeValid) headerChain(remoteHost string, start int32,
+	prev chainhash.Hash, p *chaincfg.Params) (*assumeValid, error) {
+
+	headers, err := uwire.GetHeaders(remoteHost, start, av.height)
+	if err != nil {
+		return nil, err
+	}
+	if int32(len(headers)) != av.height-start+1 {
+		return nil, fmt.Errorf("got %d headers from %d to %d",
+			len(headers), start, av.height)
+	}
+	chain := make([]chainhash.Hash, len(headers))
+	for i := range headers {
+		if headers[i].PrevBlock != prev {
+			return nil, fmt.Errorf("header %d %s prev %s doesn't link to %s",
+				start+int32(i), headers[i].BlockHash().String(),
+				headers[i].PrevBlock.String(), prev.String())
+		}
+		chain[i] = headers[i].BlockHash()
+		prev = chain[i]
+	}
+	if prev != av.hash {
+		return nil, fmt.Errorf("block %d is %s not assumevalid %s",
+			av.height, prev.String(), av.hash.String())
+	}
+	err = blockchain.CheckProofOfWork(btcutil.NewBlock(
+		&wire.MsgBlock{Header: headers[len(headers)-1]}), p.PowLimit)
+	if err != nil {
+		return nil, fmt.Errorf("assumevalid block %s bad PoW: %s",
+			av.hash.String(), err.Error())
+	}
+	return &assumeValid{
+		hash: av.hash, height: av.height, start: start, chain: chain}, nil
+}
+
+// checkAssumeValid gets the header chain from our tip to the assumevalid
+// block from the server before IBD starts.  If the server's chain doesn't
+// lead there, the setting gets ignored and all scripts are checked.
+func (c *Csn) checkAssumeValid() {
+	if c.assumeValid == nil {
+		return
+	}
+	if !c.CheckSignatures || c.CurrentHeight > c.assumeValid.height {
+		// nothing to skip
+		c.assumeValid = nil
+		return
+	}
+
+	av, err := c.assumeValid.headerChain(
+		c.remoteHost, c.CurrentHeight, c.prevHash, &c.Params)
+	if err != nil {
+		fmt.Printf("checking all scripts, assumevalid block isn't on the "+
+			"server's chain: %s\n", err.Error())
+		c.assumeValid = nil
+		return
+	}
+	c.assumeValid = av
+	fmt.Printf("assuming valid scripts up to block %d %s\n",
+		av.height, av.hash.String())
+}
+
+// checkHeader checks that a block links up to prevHash, and does the
+// context free block checks.  (PoW, merkle root, witness commitment,
+// signet solution...)
+// Difficulty adjustments aren't checked since we don't keep old headers.
+// A zero prevHash isn't checked against.  prevHash is set to the block's
+// hash if it's OK.
+func checkHeader(ub *uwire.UBlock, prevHash *chainhash.Hash,
+	p *chaincfg.Params, timeSource blockchain.MedianTimeSource) error {
+
+	blk := btcutil.NewBlock(&ub.Block)
+	height := ub.UtreexoData.Height
+
+	if *prevHash != (chainhash.Hash{}) &&
+		ub.Block.Header.PrevBlock != *prevHash {
+		return fmt.Errorf("height %d block %s prev %s doesn't link to %s",
+			height, blk.Hash().String(),
+			ub.Block.Header.PrevBlock.String(), prevHash.String())
+	}
+	err := blockchain.CheckBlockSanity(blk, p.PowLimit, timeSource)
+	if err != nil {
+		return fmt.Errorf("height %d block %s: %s",
+			height, blk.Hash().String(), err.Error())
+	}
+	err = blockchain.ValidateWitnessCommitment(blk)
+	if err != nil {
+		return fmt.Errorf("height %d block %s: %s",
+			height, blk.Hash().String(), err.Error())
+	}
+	err = uwire.CheckSignetSolution(&ub.Block, p)
+	if err != nil {
+		return fmt.Errorf("height %d: %s", height, err.Error())
+	}
+	*prevHash = *blk.Hash()
+	return nil
+}
@@ -0,0 +1,237 @@
+package csn
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// ublockServer serves ubs, which start at block 1, like a bridge node.
+// It gives the address to connect to, and every ublock request's from
+// height goes to requests if it's not nil.
+func ublockServer(t *testing.T, ubs []uwire.UBlock,
+	requests chan int32) string {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			con, err := l.Accept()
+			if err != nil {
+				return
+			}
+			serveTestCon(con, ubs, requests)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+func serveTestCon(con net.Conn, ubs []uwire.UBlock, requests chan int32) {
+	defer con.Close()
+	var from, to int32
+	err := binary.Read(con, binary.BigEndian, &from)
+	if err != nil {
+		return
+	}
+	headers := from == uwire.HeadersRequest
+	if headers {
+		err = binary.Read(con, binary.BigEndian, &from)
+		if err != nil {
+			return
+		}
+	}
+	err = binary.Read(con, binary.BigEndian, &to)
+	if err != nil {
+		return
+	}
+	if to > int32(len(ubs)) {
+		to = int32(len(ubs))
+	}
+	if headers {
+		if to-from >= uwire.MaxHeadersPerRequest {
+			to = from + uwire.MaxHeadersPerRequest - 1
+		}
+		var reply []wire.BlockHeader
+		if from >= 1 && from <= to {
+			reply = headersOf(ubs[from-1 : to])
+		}
+		uwire.WriteHeaders(con, reply)
+		return
+	}
+	if requests != nil {
+		requests <- from
+	}
+	for h := from; h >= 1 && h <= to; h++ {
+		_, err = con.Write([]byte{uwire.UBlockResponse})
+		if err == nil {
+			err = ubs[h-1].Serialize(con)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// testChain mines n blocks on the regtest genesis, each spending an opTrue
+// utxo that's in its udata
+func testChain(t *testing.T, n int) []uwire.UBlock {
+	prev := *chaincfg.RegressionNetParams.GenesisHash
+	var ubs []uwire.UBlock
+	for h := int32(1); h <= int32(n); h++ {
+		ub := spendBlock(t, prev, h, 1000, 900, opTrue)
+		ubs = append(ubs, ub)
+		prev = ub.Block.BlockHash()
+	}
+	return ubs
+}
+
+func headersOf(ubs []uwire.UBlock) []wire.BlockHeader {
+	headers := make([]wire.BlockHeader, len(ubs))
+	for i := range ubs {
+		headers[i] = ubs[i].Block.Header
+	}
+	return headers
+}
+
+func TestAssumeValidHeaderChain(t *testing.T) {
+	p := &chaincfg.RegressionNetParams
+	ubs := testChain(t, 5)
+	host := ublockServer(t, ubs, nil)
+	tip := ubs[3].Block.BlockHash()
+	av := assumeValid{hash: tip, height: 4}
+
+	got, err := av.headerChain(host, 1, *p.GenesisHash, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ub := range ubs {
+		h := int32(i + 1)
+		want := h <= 4
+		if got.skipScripts(h, ub.Block.BlockHash()) != want {
+			t.Errorf("block %d skip should be %v", h, want)
+		}
+	}
+	// a block at the same height that isn't on the chain
+	other := spendBlock(t, *p.GenesisHash, 1, 1000, 800, opTrue)
+	if got.skipScripts(1, other.Block.BlockHash()) {
+		t.Error("skips scripts of a block not on the assumevalid chain")
+	}
+
+	// starting part way, from the tip we'd have then
+	got, err = av.headerChain(host, 3, ubs[1].Block.BlockHash(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.skipScripts(2, ubs[1].Block.BlockHash()) ||
+		!got.skipScripts(3, ubs[2].Block.BlockHash()) {
+		t.Error("wrong blocks skipped starting at 3")
+	}
+
+	// the server's chain doesn't lead to the assumevalid block
+	bad := assumeValid{hash: chainhash.Hash{0x01}, height: 4}
+	_, err = bad.headerChain(host, 1, *p.GenesisHash, p)
+	if err == nil {
+		t.Error("chain that doesn't lead to assumevalid accepted")
+	}
+
+	// the server's chain doesn't link to our tip
+	_, err = av.headerChain(host, 3, ubs[0].Block.BlockHash(), p)
+	if err == nil {
+		t.Error("chain that doesn't link to the tip accepted")
+	}
+
+	// the server doesn't have headers up to the assumevalid block
+	far := assumeValid{hash: tip, height: 9}
+	_, err = far.headerChain(host, 1, *p.GenesisHash, p)
+	if err == nil {
+		t.Error("too few headers accepted")
+	}
+}
+
+func TestCheckAssumeValidIgnored(t *testing.T) {
+	p := chaincfg.RegressionNetParams
+	ubs := testChain(t, 3)
+	c := Csn{
+		Params:          p,
+		CheckSignatures: true,
+		CurrentHeight:   1,
+		prevHash:        *p.GenesisHash,
+		remoteHost:      ublockServer(t, ubs, nil),
+		assumeValid:     &assumeValid{hash: chainhash.Hash{0x02}, height: 3},
+	}
+	c.checkAssumeValid()
+	if c.assumeValid != nil {
+		t.Fatal("assumevalid block not on the server's chain but kept")
+	}
+
+	c.assumeValid = &assumeValid{hash: ubs[2].Block.BlockHash(), height: 3}
+	c.checkAssumeValid()
+	if c.assumeValid == nil || c.assumeValid.start != 1 {
+		t.Fatal("assumevalid block on the server's chain but ignored")
+	}
+}
+
+// TestSigStageAssumeValid checks that only blocks on the assumevalid
+// chain get their scripts skipped, and others are checked right away
+// instead of when the assumevalid height comes up.
+func TestSigStageAssumeValid(t *testing.T) {
+	p := chaincfg.RegressionNetParams
+	ubs := testChain(t, 3)
+	av := assumeValid{hash: ubs[2].Block.BlockHash(), height: 3}
+	chain, err := av.headerChain(
+		ublockServer(t, ubs, nil), 1, *p.GenesisHash, &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every spend fails its script, so it only passes if skipped
+	badScripts := func(ub uwire.UBlock) uwire.UBlock {
+		ub.UtreexoData.Stxos[0].PkScript = []byte{txscript.OP_FALSE}
+		return ub
+	}
+	stage := func(blocks ...uwire.UBlock) []error {
+		c := Csn{
+			Params:          p,
+			CheckSignatures: true,
+			sigPool:         newSigPool(1),
+			timeSource:      blockchain.NewMedianTime(),
+			assumeValid:     chain,
+		}
+		in := make(chan uwire.UBlock, len(blocks))
+		for _, ub := range blocks {
+			in <- ub
+		}
+		close(in)
+		out := make(chan checkedBlock, len(blocks))
+		c.sigStage(in, out, make(chan struct{}))
+		var errs []error
+		for cb := range out {
+			errs = append(errs, cb.check.wait())
+		}
+		return errs
+	}
+
+	errs := stage(badScripts(ubs[0]), badScripts(ubs[1]))
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("block %d on the chain: %s", i+1, err.Error())
+		}
+	}
+
+	// a block 1 that's not the one on the assumevalid chain
+	fork := badScripts(spendBlock(t, *p.GenesisHash, 1, 1000, 800, opTrue))
+	errs = stage(fork)
+	if errs[0] == nil {
+		t.Error("scripts skipped for a block off the assumevalid chain")
+	}
+}
@@ -0,0 +1,185 @@
+package csn
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// bgVerifySaveBlocks is how many blocks background verification does
+// between saving its progress to BgVerifyFilePath
+var bgVerifySaveBlocks int32 = 10000
+
+// backgroundVerify replays the chain from genesis up to the utreexo
+// checkpoint in a second pollard, and checks that it ends up with the same
+// roots the CSN started from.  It gets its own connection to the server and
+// checks scripts with a single worker, so it stays out of the way of the
+// main IBD.  av is the assumevalid block from the config, or nil.  Once
+// the checkpoint checks out it's left out of the state file.
+func (c *Csn) backgroundVerify(cp *utreexoCheckpoint, av *assumeValid) {
+	fmt.Printf("background verification of blocks 1 to %d started\n",
+		cp.height)
+	starttime := time.Now()
+
+	err := c.replayToCheckpoint(cp, av)
+	if err != nil {
+		bgVerifyAlert(cp, err)
+		return
+	}
+	c.pollardMtx.Lock()
+	c.unverified = nil
+	c.pollardMtx.Unlock()
+	fmt.Printf("background verification OK: checkpoint at height %d %s "+
+		"matches the chain. took %.2f sec\n",
+		cp.height, cp.hash.String(), time.Since(starttime).Seconds())
+}
+
+// replayToCheckpoint does the work for backgroundVerify.  Any error means
+// the checkpoint (or the server) can't be trusted.  It picks up from
+// BgVerifyFilePath if an earlier run saved its progress there.
+func (c *Csn) replayToCheckpoint(
+	cp *utreexoCheckpoint, av *assumeValid) error {
+
+	var p accumulator.Pollard
+	pool := newSigPool(1)
+	defer pool.stop()
+	height := int32(1)
+	prevHash := *c.Params.GenesisHash
+
+	saved, err := readUtreexoCheckpoint(BgVerifyFilePath)
+	if err == nil && saved.height <= cp.height {
+		var sp accumulator.Pollard
+		sp, err = saved.pollard()
+		if err == nil {
+			p = sp
+			height = saved.height + 1
+			prevHash = saved.hash
+			fmt.Printf("background verification resuming at block %d\n",
+				height)
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("background verification starting over: %s\n",
+			err.Error())
+	}
+	if height > cp.height {
+		// done before
+		return cp.check(prevHash, &p)
+	}
+
+	// only skip scripts of blocks on the assumevalid block's header chain
+	if !c.CheckSignatures || av == nil || height > av.height {
+		av = nil
+	} else {
+		av, err = av.headerChain(c.remoteHost, height, prevHash, &c.Params)
+		if err != nil {
+			fmt.Printf("background verification checking all scripts, "+
+				"assumevalid block isn't on the server's chain: %s\n",
+				err.Error())
+			av = nil
+		}
+	}
+
+	ublockQueue := make(chan uwire.UBlock, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- uwire.UblockRangeReader(
+			ublockQueue, stop, c.remoteHost, height, cp.height)
+	}()
+
+	for ub := range ublockQueue {
+		if ub.UtreexoData.Height != height {
+			return fmt.Errorf("expected block %d but got %d",
+				height, ub.UtreexoData.Height)
+		}
+		inskip, outskip := util.DedupeBlock(&ub.Block)
+		err := checkHeader(&ub, &prevHash, &c.Params, c.timeSource)
+		if err != nil {
+			return err
+		}
+		nl, h := p.ReconstructStats()
+		err = ub.ProofSanity(inskip, nl, h)
+		if err != nil {
+			return err
+		}
+		vp, err := p.VerifyBatchProof(ub.UtreexoData.AccProof)
+		if err != nil {
+			return fmt.Errorf("height %d: %s", height, err.Error())
+		}
+		if c.CheckSignatures {
+			scripts := !av.skipScripts(height, prevHash)
+			err = pool.submit(&ub, outskip, &c.Params, scripts).wait()
+			if err != nil {
+				return fmt.Errorf("height %d: %s", height, err.Error())
+			}
+		}
+		err = p.PopulateBatchProof(vp)
+		if err != nil {
+			return fmt.Errorf("height %d: %s", height, err.Error())
+		}
+		err = p.Modify(uwire.BlockToAddLeaves(ub.Block, nil, outskip, height),
+			ub.UtreexoData.AccProof.Targets)
+		if err != nil {
+			return fmt.Errorf("height %d: %s", height, err.Error())
+		}
+
+		if height%bgVerifySaveBlocks == 0 || height == cp.height {
+			err = saveBgVerify(height, prevHash, &p)
+			if err != nil {
+				fmt.Printf("background verification save at block %d: %s\n",
+					height, err.Error())
+			}
+		}
+		if height%10000 == 0 {
+			fmt.Printf("background verification at block %d of %d\n",
+				height, cp.height)
+		}
+		height++
+	}
+	err = <-readErr
+	if err != nil {
+		return err
+	}
+
+	if height != cp.height+1 {
+		return fmt.Errorf("server stopped at block %d", height-1)
+	}
+	return cp.check(prevHash, &p)
+}
+
+// saveBgVerify saves the background verification pollard after the block
+// at height with hash, so a restart can go on from there
+func saveBgVerify(
+	height int32, hash chainhash.Hash, p *accumulator.Pollard) error {
+
+	nl, _ := p.ReconstructStats()
+	return writeUtreexoCheckpoint(BgVerifyFilePath, &utreexoCheckpoint{
+		height:    height,
+		hash:      hash,
+		numLeaves: nl,
+		roots:     p.GetRoots(),
+	})
+}
+
+// bgVerifyAlert yells about a failed background verification.  Everything
+// after the checkpoint was built on roots that didn't come from the chain.
+func bgVerifyAlert(cp *utreexoCheckpoint, err error) {
+	msg := fmt.Sprintf(`
+**********************************************************************
+BACKGROUND VERIFICATION FAILED
+The utreexo checkpoint at height %d %s
+does NOT match the chain from genesis: %s
+Everything this node has validated since then can't be trusted.
+Delete %s and sync again with -assumeutreexo=0
+**********************************************************************
+`, cp.height, cp.hash.String(), err.Error(), PollardFilePath)
+	fmt.Print(msg)
+	fmt.Fprint(os.Stderr, msg)
+}
@@ -0,0 +1,169 @@
+package csn
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// coinbaseChain mines n blocks with only a coinbase on the regtest genesis.
+// Nothing gets spent so they don't need proofs.  It also gives the
+// checkpoint after the last one.
+func coinbaseChain(t *testing.T, n int) ([]uwire.UBlock, *utreexoCheckpoint) {
+	var p accumulator.Pollard
+	prev := *chaincfg.RegressionNetParams.GenesisHash
+	var ubs []uwire.UBlock
+	for h := int32(1); h <= int32(n); h++ {
+		blk := mineBlock(t, prev, h)
+		ubs = append(ubs, uwire.UBlock{
+			Block:       blk,
+			UtreexoData: btcacc.UData{Height: h},
+		})
+		err := p.Modify(uwire.BlockToAddLeaves(blk, nil, nil, h), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prev = blk.BlockHash()
+	}
+	nl, _ := p.ReconstructStats()
+	return ubs, &utreexoCheckpoint{
+		height: int32(n), hash: prev, numLeaves: nl, roots: p.GetRoots()}
+}
+
+// bgVerifyTest points BgVerifyFilePath at a temp dir and saves progress
+// every 2 blocks, for the length of the test
+func bgVerifyTest(t *testing.T) {
+	oldPath, oldSave := BgVerifyFilePath, bgVerifySaveBlocks
+	BgVerifyFilePath = filepath.Join(t.TempDir(), "bgverifyFile")
+	bgVerifySaveBlocks = 2
+	t.Cleanup(func() {
+		BgVerifyFilePath, bgVerifySaveBlocks = oldPath, oldSave
+	})
+}
+
+func testCsn(remoteHost string) *Csn {
+	return &Csn{
+		Params:          chaincfg.RegressionNetParams,
+		CheckSignatures: true,
+		remoteHost:      remoteHost,
+		timeSource:      blockchain.NewMedianTime(),
+	}
+}
+
+func TestReplayToCheckpoint(t *testing.T) {
+	bgVerifyTest(t)
+	ubs, cp := coinbaseChain(t, 6)
+	c := testCsn(ublockServer(t, ubs, nil))
+
+	err := c.replayToCheckpoint(cp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := readUtreexoCheckpoint(BgVerifyFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.height != cp.height || saved.hash != cp.hash {
+		t.Fatalf("saved block %d %s, not %d %s", saved.height,
+			saved.hash.String(), cp.height, cp.hash.String())
+	}
+
+	// done already, so it doesn't need the server
+	c.remoteHost = "127.0.0.1:1"
+	err = c.replayToCheckpoint(cp, nil)
+	if err != nil {
+		t.Fatalf("after it was done: %s", err.Error())
+	}
+
+	// checkpoints that don't match the chain
+	bad := *cp
+	bad.roots = append([]accumulator.Hash{{0x01}}, cp.roots[1:]...)
+	if c.replayToCheckpoint(&bad, nil) == nil {
+		t.Error("bad root passed")
+	}
+	bad = *cp
+	bad.hash = chainhash.Hash{0x02}
+	if c.replayToCheckpoint(&bad, nil) == nil {
+		t.Error("bad block hash passed")
+	}
+}
+
+func TestReplayToCheckpointResume(t *testing.T) {
+	bgVerifyTest(t)
+	ubs, cp := coinbaseChain(t, 6)
+
+	// the first server dies after block 4
+	c := testCsn(ublockServer(t, ubs[:4], nil))
+	err := c.replayToCheckpoint(cp, nil)
+	if err == nil || !strings.Contains(err.Error(), "stopped at block 4") {
+		t.Fatalf("got %v, want server stopped at block 4", err)
+	}
+
+	// it saved block 4, so the next run asks for 5 on
+	requests := make(chan int32, 1)
+	c.remoteHost = ublockServer(t, ubs, requests)
+	err = c.replayToCheckpoint(cp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from := <-requests; from != 5 {
+		t.Fatalf("resumed at block %d, not 5", from)
+	}
+}
+
+func TestReplayToCheckpointAssumeValid(t *testing.T) {
+	ubs, cp := coinbaseChain(t, 4)
+	host := ublockServer(t, ubs, nil)
+	avs := []*assumeValid{
+		{hash: ubs[2].Block.BlockHash(), height: 3},
+		// not on the chain, so everything gets checked
+		{hash: chainhash.Hash{0x03}, height: 3},
+	}
+	for i, av := range avs {
+		bgVerifyTest(t)
+		err := testCsn(host).replayToCheckpoint(cp, av)
+		if err != nil {
+			t.Errorf("assumevalid %d: %s", i, err.Error())
+		}
+	}
+}
+
+func TestReplayToCheckpointNoServer(t *testing.T) {
+	bgVerifyTest(t)
+	_, cp := coinbaseChain(t, 2)
+	err := testCsn("127.0.0.1:1").replayToCheckpoint(cp, nil)
+	if err == nil {
+		t.Fatal("no server but no error")
+	}
+}
+
+// TestParseAssumeUtreexo checks that a checkpoint only comes from a file
+func TestParseAssumeUtreexo(t *testing.T) {
+	for _, path := range []string{"", "0"} {
+		cp, err := parseAssumeUtreexo(path)
+		if cp != nil || err != nil {
+			t.Fatalf("%q gave checkpoint %+v %v", path, cp, err)
+		}
+	}
+	_, want := coinbaseChain(t, 3)
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	err := writeUtreexoCheckpoint(path, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, err := parseAssumeUtreexo(path)
+	if err != nil || cp.height != want.height || cp.hash != want.hash {
+		t.Fatalf("checkpoint %+v %v, wrote %+v", cp, err, want)
+	}
+	_, err = parseAssumeUtreexo(path + "missing")
+	if err == nil {
+		t.Fatal("no error for a missing file")
+	}
+}
@@ -2,28 +2,59 @@ package csn
 
 import (
 	"flag"
+	"runtime"
 	"strings"
+	"time"
 
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	uwire "github.com/mit-dci/utreexo/wire"
 )
 
 var PollardFilePath string = "pollardFile"
 
+// BgVerifyFilePath is where background verification saves how far it got,
+// in the same format as a -assumeutreexo file
+var BgVerifyFilePath string = "bgverifyFile"
+
 var HelpMsg = `
 Usage: client [OPTION]
 A dynamic hash based accumulator designed for the Bitcoin UTXO set.
 client performs ibd (initial block download) on the Bitcoin blockchain.
-You can give a bech32 address to watch during IBD.
+You can give addresses or output descriptors to watch during IBD.
 
 OPTIONS:
   -net=mainnet                 configure whether to use mainnet. Optional.
   -net=regtest                 configure whether to use regtest. Optional.
+  -net=signet                  configure whether to use signet. Optional.
+  -netparams=<file>            use the network in a json params file, like
+                               a private signet. Overrides -net
 
   -cpuprof                     configure whether to use use cpu profiling
   -memprof                     configure whether to use use heap profiling
 
   -host                        server to connect to.  Default to localhost
                                if you need a public server, try 35.188.186.244
+
+  -watchaddr=<address>         address to watch for wallet txs. Any type:
+                               p2pkh, p2sh, p2wpkh, p2wsh or p2tr
+  -watch=<descriptor>          output descriptor to watch, addr(<address>) or
+                               raw(<hex pkscript>). Can be given more than
+                               once. Watched ones are saved and watched again
+                               on restart
+
+  -sigworkers                  number of signature checking goroutines.
+                               Defaults to the number of CPUs
+  -assumevalid=<hash>          skip scripts in this block and the ones before
+                               it. Use with -assumevalidheight. Defaults to a
+                               block from Bitcoin Core. 0 checks all scripts.
+  -assumeutreexo=<file>        start from the accumulator roots in the file
+                               instead of from genesis. There are no built
+                               in ones, without a file it starts at genesis.
+  -checkpointblocks=n          save state to disk every n blocks (1000)
+  -checkpointsecs=n            save state to disk at least every n seconds (300)
+  -bgverify=false              don't check the blocks before the
+                               -assumeutreexo checkpoint in the background
 `
 
 // bit of a hack. Standard flag lib doesn't allow flag.Parse(os.Args[2]).
@@ -31,7 +62,10 @@ OPTIONS:
 var (
 	argCmd = flag.NewFlagSet("", flag.ExitOnError)
 	netCmd = argCmd.String("net", "testnet",
-		"Target network. (testnet, regtest, mainnet) Usage: '-net=regtest'")
+		"Target network. (testnet, regtest, mainnet, signet) "+
+			"Usage: '-net=regtest'")
+	netParamsCmd = argCmd.String("netparams", "",
+		`json file with a custom network. Usage: '-netparams=mysignet.json'`)
 	cpuProfCmd = argCmd.String("cpuprof", "",
 		`Enable pprof cpu profiling. Usage: 'cpuprof='path/to/file'`)
 	memProfCmd = argCmd.String("memprof", "",
@@ -39,26 +73,58 @@ var (
 	traceCmd = argCmd.String("trace", "",
 		`Enable trace. Usage: 'trace='path/to/file'`)
 	watchAddr = argCmd.String("watchaddr", "",
-		`Address to watch & report transactions. Only bech32 p2wpkh supported`)
+		`Address to watch & report transactions`)
+	watchCmd   stringList
 	remoteHost = argCmd.String("host", "127.0.0.1",
 		`remote server to connect to`)
 
 	checkSig = argCmd.Bool("checksig", true,
 		`check signatures (slower)`)
+	sigWorkers = argCmd.Int("sigworkers", runtime.NumCPU(),
+		`number of goroutines checking signatures`)
+	assumeValidCmd = argCmd.String("assumevalid", "",
+		`skip scripts up to this block hash. 0 to check all scripts`)
+	assumeValidHeightCmd = argCmd.Int("assumevalidheight", 0,
+		`height of the -assumevalid block`)
+	assumeUtreexoCmd = argCmd.String("assumeutreexo", "",
+		`start from the utreexo checkpoint in this file instead of genesis`)
+	checkpointBlocksCmd = argCmd.Int("checkpointblocks", 1000,
+		`save state to disk every n blocks`)
+	checkpointSecsCmd = argCmd.Int("checkpointsecs", 300,
+		`save state to disk at least every n seconds`)
+	bgVerifyCmd = argCmd.Bool("bgverify", true,
+		`verify the blocks before the -assumeutreexo checkpoint in the background`)
 	lookahead = argCmd.Int("lookahead", 1000,
 		`size of the look-ahead cache in blocks`)
 	quitafter = argCmd.Int("quitafter", -1,
 		`quit ibd after n blocks. (for testing)`)
 )
 
+func init() {
+	argCmd.Var(&watchCmd, "watch",
+		`output descriptor to watch. Usage: '-watch=addr(bc1q...)'`)
+}
+
+// stringList is a flag that can be given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
 type Config struct {
 	params chaincfg.Params
 
 	// host server
 	remoteHost string
 
-	// address to watch for txs
-	watchAddr string
+	// descriptors to watch for txs, from -watch and -watchaddr
+	watch []string
 
 	// how much to remember
 	lookAhead int
@@ -69,6 +135,22 @@ type Config struct {
 	// Check Bitcoin tx signatures
 	checkSig bool
 
+	// how many workers check signatures
+	sigWorkers int
+
+	// block to skip scripts up to. nil to check all of them
+	assumeValid *assumeValid
+
+	// accumulator state to start from. nil to start from genesis
+	assumeUtreexo *utreexoCheckpoint
+
+	// check the blocks before assumeUtreexo in the background
+	bgVerify bool
+
+	// how often to save state to disk
+	checkpointBlocks   int32
+	checkpointInterval time.Duration
+
 	// enable tracing
 	TraceProf string
 
@@ -84,21 +166,36 @@ func Parse(args []string) (*Config, error) {
 
 	cfg := Config{}
 
-	if *netCmd == "testnet" {
-		cfg.params = chaincfg.TestNet3Params
-	} else if *netCmd == "regtest" {
-		cfg.params = chaincfg.RegressionNetParams
-	} else if *netCmd == "mainnet" {
-		cfg.params = chaincfg.MainNetParams
-	} else {
-		return nil, errInvalidNetwork(*netCmd)
+	params, err := uwire.NetParams(*netCmd, *netParamsCmd)
+	if err != nil {
+		return nil, errInvalidNetwork(err.Error())
 	}
+	cfg.params = *params
 
 	cfg.remoteHost = *remoteHost
-	cfg.watchAddr = *watchAddr
+	cfg.watch = watchCmd
+	if *watchAddr != "" {
+		cfg.watch = append(cfg.watch, *watchAddr)
+	}
 	cfg.lookAhead = *lookahead
 	cfg.quitafter = *quitafter
 	cfg.checkSig = *checkSig
+	cfg.sigWorkers = *sigWorkers
+
+	av, err := parseAssumeValid(*assumeValidCmd, *assumeValidHeightCmd, &cfg.params)
+	if err != nil {
+		return nil, err
+	}
+	cfg.assumeValid = av
+
+	cp, err := parseAssumeUtreexo(*assumeUtreexoCmd)
+	if err != nil {
+		return nil, err
+	}
+	cfg.assumeUtreexo = cp
+	cfg.bgVerify = *bgVerifyCmd
+	cfg.checkpointBlocks = int32(*checkpointBlocksCmd)
+	cfg.checkpointInterval = time.Duration(*checkpointSecsCmd) * time.Second
 
 	// if no host was given, default to localhost
 	if *remoteHost == "" {
@@ -116,3 +213,42 @@ func Parse(args []string) (*Config, error) {
 
 	return &cfg, nil
 }
+
+// parseAssumeValid gives the assumevalid block from the command line, or the
+// default for the network if none was given.
+func parseAssumeValid(
+	hashStr string, height int, p *chaincfg.Params) (*assumeValid, error) {
+
+	switch hashStr {
+	case "0":
+		return nil, nil
+	case "":
+		av, ok := assumeValidTable[p.Net]
+		if !ok {
+			return nil, nil
+		}
+		return &av, nil
+	}
+
+	hash, err := chainhash.NewHashFromStr(hashStr)
+	if err != nil {
+		return nil, errInvalidAssumeValid(err.Error())
+	}
+	if height <= 0 {
+		return nil, errInvalidAssumeValid("-assumevalidheight not given")
+	}
+	return &assumeValid{hash: *hash, height: int32(height)}, nil
+}
+
+// parseAssumeUtreexo gives the checkpoint from the file given on the command
+// line.  There are no built in ones, so without a file it's nil.
+func parseAssumeUtreexo(path string) (*utreexoCheckpoint, error) {
+	if path == "" || path == "0" {
+		return nil, nil
+	}
+	cp, err := readUtreexoCheckpoint(path)
+	if err != nil {
+		return nil, errInvalidAssumeUtreexo(err.Error())
+	}
+	return cp, nil
+}
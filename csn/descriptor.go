@@ -0,0 +1,144 @@
+package csn
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/adiabat/bech32"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil"
+)
+
+/*
+The wallet matches outputs by their whole PkScript, so anything that turns
+into a script can be watched.  What to watch is given as a simple output
+descriptor:
+
+addr(<address>)  p2pkh, p2sh, p2wpkh, p2wsh (anything btcutil decodes) or
+                 a bech32m p2tr address
+raw(<hex>)       this exact PkScript
+
+A plain address without addr() works too.  These are a small part of Bitcoin
+Core's descriptors; no keys or derivation paths.
+
+The descriptors are saved in the CSN state file so they're still watched
+after a restart.
+*/
+
+// bech32mConst is what the checksum of a bech32m string (BIP350) comes out
+// to.  For regular bech32 it's 1.
+const bech32mConst = 0x2bc830a3
+
+// watchDesc is one output descriptor the wallet watches for
+type watchDesc struct {
+	desc     string // as it's saved, like "addr(bc1q...)"
+	pkScript []byte
+}
+
+// parseWatchDesc parses a descriptor or plain address for network p
+func parseWatchDesc(s string, p *chaincfg.Params) (watchDesc, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, "raw(") && strings.HasSuffix(s, ")"):
+		script, err := hex.DecodeString(s[4 : len(s)-1])
+		if err != nil {
+			return watchDesc{}, errInvalidWatch(s, err.Error())
+		}
+		if len(script) == 0 {
+			return watchDesc{}, errInvalidWatch(s, "empty script")
+		}
+		return watchDesc{
+			desc:     "raw(" + hex.EncodeToString(script) + ")",
+			pkScript: script,
+		}, nil
+
+	case strings.HasPrefix(s, "addr(") && strings.HasSuffix(s, ")"):
+		s = s[5 : len(s)-1]
+	}
+
+	script, err := addrToScript(s, p)
+	if err != nil {
+		return watchDesc{}, errInvalidWatch(s, err.Error())
+	}
+	return watchDesc{desc: "addr(" + s + ")", pkScript: script}, nil
+}
+
+// addrToScript gives the PkScript that pays to an address on network p
+func addrToScript(adr string, p *chaincfg.Params) ([]byte, error) {
+	a, err := btcutil.DecodeAddress(adr, p)
+	if err != nil {
+		// btcutil doesn't know about bech32m yet
+		script, trErr := taprootScript(adr, p)
+		if trErr == nil {
+			return script, nil
+		}
+		return nil, err
+	}
+	if !a.IsForNet(p) {
+		return nil, fmt.Errorf("not a %s address", p.Name)
+	}
+	return txscript.PayToAddrScript(a)
+}
+
+// taprootScript decodes a bech32m segwit v1 address and gives its
+// PkScript: OP_1 and the 32 byte output key.
+func taprootScript(adr string, p *chaincfg.Params) ([]byte, error) {
+	// all upper or all lower case, never mixed
+	if strings.ToUpper(adr) != adr && strings.ToLower(adr) != adr {
+		return nil, fmt.Errorf("%s is mixed case", adr)
+	}
+	adr = strings.ToLower(adr)
+	sep := strings.LastIndexByte(adr, '1')
+	// need a hrp and at least a version and the 6 checksum characters
+	if sep < 1 || len(adr)-sep-1 < 7 {
+		return nil, fmt.Errorf("%s isn't bech32m", adr)
+	}
+	hrp := adr[:sep]
+	if hrp != p.Bech32HRPSegwit {
+		return nil, fmt.Errorf("not a %s address", p.Name)
+	}
+	for _, c := range adr[sep+1:] {
+		if c >= 128 {
+			return nil, fmt.Errorf("%s isn't bech32m", adr)
+		}
+	}
+	data, err := bech32.StringToSquashedBytes(adr[sep+1:])
+	if err != nil {
+		return nil, err
+	}
+	if bech32.PolyMod(append(bech32.HRPExpand(hrp), data...)) !=
+		bech32mConst {
+		return nil, fmt.Errorf("%s bech32m checksum mismatch", adr)
+	}
+	data = data[:len(data)-6]
+	if data[0] != 1 {
+		return nil, fmt.Errorf("witness version %d not supported", data[0])
+	}
+	key, err := bech32.Bytes5to8(data[1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("p2tr output key is %d bytes", len(key))
+	}
+	return append([]byte{txscript.OP_1, txscript.OP_DATA_32}, key...), nil
+}
+
+// RegisterDescriptor starts watching for outputs matching an output
+// descriptor (or plain address).  See parseWatchDesc for the format.
+func (ch *Csn) RegisterDescriptor(desc string) error {
+	wd, err := parseWatchDesc(desc, &ch.Params)
+	if err != nil {
+		return err
+	}
+	for _, have := range ch.watchDescs {
+		if have.desc == wd.desc {
+			return nil
+		}
+	}
+	ch.watchDescs = append(ch.watchDescs, wd)
+	ch.RegisterScript(wd.pkScript)
+	return nil
+}
@@ -0,0 +1,149 @@
+package csn
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// paramsFor gives the network params for a bech32 address's hrp
+func paramsFor(adr string) *chaincfg.Params {
+	if strings.HasPrefix(strings.ToLower(adr), "tb1") {
+		return &chaincfg.TestNet3Params
+	}
+	return &chaincfg.MainNetParams
+}
+
+// TestTaprootScriptValid has the p2tr addresses from the BIP350 valid
+// address vectors
+func TestTaprootScriptValid(t *testing.T) {
+	tests := []struct {
+		adr    string
+		script string
+	}{
+		{"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0",
+			"512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"},
+		{"tb1pqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesf3hn0c",
+			"5120000000c4a5cad46221b2a187905e5266362b99d5e91c6ce24d165dab93e86433"},
+	}
+	for _, test := range tests {
+		for _, adr := range []string{test.adr, strings.ToUpper(test.adr)} {
+			script, err := taprootScript(adr, paramsFor(adr))
+			if err != nil {
+				t.Errorf("%s: %s", adr, err.Error())
+				continue
+			}
+			if hex.EncodeToString(script) != test.script {
+				t.Errorf("%s: script %x, want %s", adr, script, test.script)
+			}
+		}
+	}
+}
+
+// TestTaprootScriptInvalid has the BIP350 invalid address vectors, and the
+// valid ones that aren't p2tr, which can't be watched.  None of them are
+// taproot addresses on either network.
+func TestTaprootScriptInvalid(t *testing.T) {
+	tests := []string{
+		// invalid
+		"tc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq5zuyut",
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqh2y7hd",
+		"tb1z0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqglt7rf",
+		"BC1S0XLXVLHEMJA6C4DQV22UAPCTQUPFHLXM9H8Z3K2E72Q4K9HCZ7VQ54WELL",
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kemeawh",
+		"tb1q0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq24jc47",
+		"bc1p38j9r5y49hruaue7wxjce0updqjuyyx0kh56v8s25huc6995vvpql3jow4",
+		"BC130XLXVLHEMJA6C4DQV22UAPCTQUPFHLXM9H8Z3K2E72Q4K9HCZ7VQ7ZWS8R",
+		"bc1pw5dgrnzv",
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7v8n0nx0muaewav253zgeav",
+		"BC1QR508D6QEJXTDG4Y5R3ZARVARYV98GJ9P",
+		"tb1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq47Zagq",
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7v07qwwzcrf",
+		"tb1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vpggkg4j",
+		"bc1gmk9yu",
+		// valid, but not v1 with a 32 byte program
+		"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4",
+		"bc1pw508d6qejxtdg4y5r3zarvary0c5xw7kw508d6qejxtdg4y5r3zarvary0c5xw7kt5nd6y",
+		"BC1SW50QGDZ25J",
+		"bc1zw508d6qejxtdg4y5r3zarvaryvaxxpcs",
+		"tb1qqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesrxh6hy",
+	}
+	nets := []*chaincfg.Params{
+		&chaincfg.MainNetParams, &chaincfg.TestNet3Params}
+	for _, adr := range tests {
+		for _, p := range nets {
+			script, err := taprootScript(adr, p)
+			if err == nil {
+				t.Errorf("%s on %s: got script %x", adr, p.Name, script)
+			}
+		}
+	}
+}
+
+func TestParseWatchDesc(t *testing.T) {
+	tests := []struct {
+		in     string
+		desc   string
+		script string
+	}{
+		// p2pkh of the genesis coinbase
+		{"1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa",
+			"addr(1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa)",
+			"76a91462e907b15cbf27d5425399ebf6f0fb50ebb88f1888ac"},
+		{" addr(bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4) ",
+			"addr(bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4)",
+			"0014751e76e8199196d454941c45d1b3a323f1433bd6"},
+		{"addr(bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0)",
+			"addr(bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0)",
+			"512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"},
+		{"raw(6A0401020304)", "raw(6a0401020304)", "6a0401020304"},
+	}
+	p := &chaincfg.MainNetParams
+	for _, test := range tests {
+		wd, err := parseWatchDesc(test.in, p)
+		if err != nil {
+			t.Errorf("%s: %s", test.in, err.Error())
+			continue
+		}
+		if wd.desc != test.desc {
+			t.Errorf("%s: desc %s, want %s", test.in, wd.desc, test.desc)
+		}
+		if hex.EncodeToString(wd.pkScript) != test.script {
+			t.Errorf("%s: script %x, want %s", test.in, wd.pkScript, test.script)
+		}
+
+		// what gets saved has to parse back the same
+		again, err := parseWatchDesc(wd.desc, p)
+		if err != nil {
+			t.Errorf("%s: saved as %s: %s", test.in, wd.desc, err.Error())
+			continue
+		}
+		if again.desc != wd.desc ||
+			hex.EncodeToString(again.pkScript) != test.script {
+			t.Errorf("%s: saved as %s, came back %s %x",
+				test.in, wd.desc, again.desc, again.pkScript)
+		}
+	}
+}
+
+func TestParseWatchDescInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"raw()",
+		"raw(zz)",
+		"raw(abc)",
+		"addr()",
+		"addr(nope)",
+		// testnet addresses on mainnet
+		"addr(tb1pqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesf3hn0c)",
+		"mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn",
+	}
+	for _, s := range tests {
+		wd, err := parseWatchDesc(s, &chaincfg.MainNetParams)
+		if err == nil {
+			t.Errorf("%q parsed as %s %x", s, wd.desc, wd.pkScript)
+		}
+	}
+}
@@ -6,9 +6,24 @@ import (
 )
 
 var (
-	ErrInvalidNetwork = errors.New("Invalid/not supported net flag given")
+	ErrInvalidNetwork       = errors.New("Invalid/not supported net flag given")
+	ErrInvalidAssumeValid   = errors.New("Invalid assumevalid flag given")
+	ErrInvalidAssumeUtreexo = errors.New("Invalid assumeutreexo checkpoint")
+	ErrInvalidWatch         = errors.New("Invalid watch descriptor")
 )
 
 func errInvalidNetwork(nType string) error {
 	return fmt.Errorf("%s: %s", ErrInvalidNetwork, nType)
 }
+
+func errInvalidAssumeValid(reason string) error {
+	return fmt.Errorf("%s: %s", ErrInvalidAssumeValid, reason)
+}
+
+func errInvalidAssumeUtreexo(reason string) error {
+	return fmt.Errorf("%s: %s", ErrInvalidAssumeUtreexo, reason)
+}
+
+func errInvalidWatch(desc, reason string) error {
+	return fmt.Errorf("%s %s: %s", ErrInvalidWatch, desc, reason)
+}
@@ -1,9 +1,12 @@
 package csn
 
 import (
-	"fmt"
+	"sync"
+	"time"
 
+	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/mit-dci/utreexo/btcacc"
@@ -40,16 +43,46 @@ a separate unconfirmed TX channel if there's interest in that...e
 type Csn struct {
 	CurrentHeight int32
 	pollard       accumulator.Pollard
-
-	WatchOPs  map[wire.OutPoint]bool
-	WatchAdrs map[[20]byte]bool
-	// TODO use better addresses, either []byte or something fancy
+	// held while the pollard or utxoStore change, so WalletProof can run
+	// during IBD
+	pollardMtx sync.Mutex
+	// the next block for the pollard.  CurrentHeight runs ahead of it while
+	// a block is being put in.
+	pollardHeight int32
+	// unconfirmed txs with proofs, also guarded by pollardMtx
+	mempool mempool
+
+	WatchOPs map[wire.OutPoint]bool
+	// PkScripts to watch for, keyed by string(PkScript)
+	WatchScripts map[string]bool
+	// the descriptors the scripts came from, to save to disk
+	watchDescs []watchDesc
 	TxChan     chan wire.MsgTx
 	HeightChan chan int32
 
 	CheckSignatures bool
 	Params          chaincfg.Params
 
+	// sigPool checks input scripts for all blocks
+	sigPool *sigPool
+
+	// skip scripts up to this block.  nil to check everything
+	assumeValid *assumeValid
+	// the -assumeutreexo checkpoint the pollard started from, until
+	// background verification checks it.  Guarded by pollardMtx.
+	unverified *utreexoCheckpoint
+	// hash of the last block header checked, so the next one can link to it
+	prevHash   chainhash.Hash
+	timeSource blockchain.MedianTimeSource
+
+	// hash of the last block in the pollard
+	tipHash chainhash.Hash
+
+	// save state to disk every this many blocks or this much time,
+	// whichever comes first
+	checkpointBlocks   int32
+	checkpointInterval time.Duration
+
 	remoteHost string
 	utxoStore  map[wire.OutPoint]btcacc.LeafData
 	totalScore int64
@@ -63,13 +96,16 @@ func (ch *Csn) UnegisterOutPoint(op wire.OutPoint) {
 	delete(ch.WatchOPs, op)
 }
 
+// RegisterAddress watches for outputs to a p2wpkh pubkey hash.  Use
+// RegisterDescriptor for other kinds of addresses.
 func (ch *Csn) RegisterAddress(adr [20]byte) {
-	ch.WatchAdrs[adr] = true
+	ch.RegisterScript(append([]byte{0x00, 0x14}, adr[:]...))
 }
 
-// TODO implement.  I guess push to the bridge node.  But really it'd
-// be better to just push it out to the regular p2p network.
-func PushTx(tx *wire.MsgTx) error {
-	fmt.Printf("no PushTx yet\n")
-	return nil
+// RegisterScript watches for outputs with exactly this PkScript
+func (ch *Csn) RegisterScript(pkScript []byte) {
+	if ch.WatchScripts == nil {
+		ch.WatchScripts = make(map[string]bool)
+	}
+	ch.WatchScripts[string(pkScript)] = true
 }
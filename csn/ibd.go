@@ -5,8 +5,6 @@ import (
 	"time"
 
 	"github.com/btcsuite/btcd/wire"
-	"github.com/mit-dci/utreexo/btcacc"
-	"github.com/mit-dci/utreexo/util"
 	uwire "github.com/mit-dci/utreexo/wire"
 )
 
@@ -36,8 +34,18 @@ func (c *Csn) IBDThread(sig chan bool, quitafter int) {
 
 	// Reads blocks asynchronously from blk*.dat files, and the proof.dat, and DB
 	// this will be a network reader, with the server sending the same stuff over
-	go uwire.UblockNetworkReader(
-		ublockQueue, c.remoteHost, c.CurrentHeight, lookahead)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- uwire.UblockNetworkReader(
+			ublockQueue, c.remoteHost, c.CurrentHeight, lookahead)
+	}()
+
+	// blocks then go through the sig stage, which starts checking their
+	// scripts while the pollard is busy with the blocks before them
+	checkedQueue := make(chan checkedBlock, 2)
+	sigDone := make(chan struct{})
+	defer close(sigDone)
+	go c.sigStage(ublockQueue, checkedQueue, sigDone)
 
 	var plustime time.Duration
 	starttime := time.Now()
@@ -45,16 +53,38 @@ func (c *Csn) IBDThread(sig chan bool, quitafter int) {
 	// bool for stopping the below for loop
 	var stop bool
 	var blockCount int
+
+	// when state was last saved to disk
+	var sinceSave int32
+	lastSave := time.Now()
 	for ; !stop; c.CurrentHeight++ {
 
-		blocknproof, open := <-ublockQueue
+		blocknproof, open := <-checkedQueue
 		if !open {
-			fmt.Printf("ublockQueue channel closed ")
+			fmt.Printf("checkedQueue channel closed ")
+			err := <-readErr
+			if perr, ok := err.(*uwire.PrunedError); ok {
+				fmt.Printf("\n%s.  Use a server that has it, or start from "+
+					"an -assumeutreexo checkpoint at block %d or later.\n",
+					perr.Error(), perr.Oldest-1)
+			} else if err != nil {
+				fmt.Printf("\nreading blocks: %s\n", err.Error())
+			} else {
+				// caught up with the server, so it takes our txs now
+				c.relayTxs()
+			}
 			sig <- true
 			break
 		}
 
+		c.pollardMtx.Lock()
+		nl, _ := c.pollard.ReconstructStats()
 		err := c.putBlockInPollard(blocknproof, &totalTXOAdded, &totalDels, plustime)
+		if err == nil {
+			c.updateMempool(&blocknproof.ub.Block,
+				blocknproof.ub.UtreexoData.AccProof.Targets, nl)
+		}
+		c.pollardMtx.Unlock()
 		if err != nil {
 			// crash if there's a bad proof or signature, OK for testing
 			panic(err)
@@ -62,7 +92,22 @@ func (c *Csn) IBDThread(sig chan bool, quitafter int) {
 
 		c.HeightChan <- c.CurrentHeight
 
-		c.ScanBlock(blocknproof.Block)
+		c.ScanBlock(blocknproof.ub.Block)
+		c.tipHash = blocknproof.ub.Block.BlockHash()
+
+		// save state every so often so a crash doesn't lose everything
+		sinceSave++
+		if (c.checkpointBlocks > 0 && sinceSave >= c.checkpointBlocks) ||
+			(c.checkpointInterval > 0 &&
+				time.Since(lastSave) >= c.checkpointInterval) {
+			err = saveIBDsimData(c, c.CurrentHeight+1)
+			if err != nil {
+				fmt.Printf("checkpoint at height %d error: %s\n",
+					c.CurrentHeight, err.Error())
+			}
+			sinceSave = 0
+			lastSave = time.Now()
+		}
 
 		if c.CurrentHeight%10000 == 0 {
 			fmt.Printf("Block %d add %d del %d %s plus %.2f total %.2f \n",
@@ -89,7 +134,10 @@ func (c *Csn) IBDThread(sig chan bool, quitafter int) {
 		c.CurrentHeight, totalTXOAdded, totalDels, c.pollard.Stats(),
 		plustime.Seconds(), time.Since(starttime).Seconds())
 
-	saveIBDsimData(c)
+	err := saveIBDsimData(c, c.CurrentHeight)
+	if err != nil {
+		fmt.Printf("saveIBDsimData error: %s\n", err.Error())
+	}
 
 	fmt.Printf("Found %d satoshis in %d utxos\n", c.totalScore, len(c.utxoStore))
 
@@ -101,15 +149,16 @@ func (c *Csn) IBDThread(sig chan bool, quitafter int) {
 // ScanBlock looks through a block using the CSN's maps and sends matches
 // into the tx channel.
 func (c *Csn) ScanBlock(b wire.MsgBlock) {
-	var curAdr [20]byte
-	for _, tx := range b.Transactions {
+	for txInBlock, tx := range b.Transactions {
 		// first check utxo loss
 		for _, in := range tx.TxIn {
 			lostTxo, exists := c.utxoStore[in.PreviousOutPoint]
 			if !exists {
 				continue
 			}
+			c.pollardMtx.Lock()
 			delete(c.utxoStore, in.PreviousOutPoint)
+			c.pollardMtx.Unlock()
 			c.totalScore -= lostTxo.Amt
 			fmt.Printf("tx %s lost %d satoshis :( But still have %d in %d utxos\n",
 				tx.TxHash().String(), lostTxo.Amt, c.totalScore, len(c.utxoStore))
@@ -118,15 +167,14 @@ func (c *Csn) ScanBlock(b wire.MsgBlock) {
 
 		// now check utxo gain
 		for i, out := range tx.TxOut {
-			if len(out.PkScript) != 22 {
-				continue
-			}
-			copy(curAdr[:], out.PkScript[2:])
-			if c.WatchAdrs[curAdr] {
+			if c.WatchScripts[string(out.PkScript)] {
 				newOut := wire.OutPoint{Hash: tx.TxHash(), Index: uint32(i)}
 				c.RegisterOutPoint(newOut)
+				// keep all the LeafData so WalletProof can prove it
+				c.pollardMtx.Lock()
 				c.utxoStore[newOut] =
-					btcacc.LeafData{TxHash: btcacc.Hash(newOut.Hash), Index: newOut.Index, Amt: out.Value}
+					walletLeaf(tx, txInBlock == 0, i, c.CurrentHeight)
+				c.pollardMtx.Unlock()
 				c.totalScore += out.Value
 				fmt.Printf("got utxo %s with %d satoshis! Now have %d in %d utxos\n",
 					newOut.String(), out.Value, c.totalScore, len(c.utxoStore))
@@ -141,14 +189,14 @@ func (c *Csn) ScanBlock(b wire.MsgBlock) {
 // All the inputs are saved as 32byte sha256 hashes.
 // All the outputs are saved as Leaf type.
 func (c *Csn) putBlockInPollard(
-	ub uwire.UBlock, totalTXOAdded, totalDels *int, plustime time.Duration) error {
+	cb checkedBlock, totalTXOAdded, totalDels *int, plustime time.Duration) error {
 
 	plusstart := time.Now()
 
-	inskip, outskip := util.DedupeBlock(&ub.Block)
+	ub := cb.ub
 	nl, h := c.pollard.ReconstructStats()
 
-	err := ub.ProofSanity(inskip, nl, h)
+	err := ub.ProofSanity(cb.inskip, nl, h)
 	if err != nil {
 		return fmt.Errorf(
 			"uData missing utxo data for block %d err: %e", ub.UtreexoData.Height, err)
@@ -156,25 +204,25 @@ func (c *Csn) putBlockInPollard(
 
 	*totalDels += len(ub.UtreexoData.AccProof.Targets) // for benchmarking
 
-	// **************************************
-	// check transactions and signatures here
-	// TODO: it'd be better to do it after IngestBatchProof(),
-	// or really in the middle of IngestBatchProof(), after it does
-	// verifyBatchProof(), but before it actually starts populating / modifying
-	// the pollard.  This is because verifying the proof should be faster than
-	// checking all the signatures in the block, so we'd rather do the fast
-	// thing first.  (Especially since that thing isn't committed to in the
-	// PoW, but the signatures are...
-
-	if c.CheckSignatures {
-		if !ub.CheckBlock(outskip, &c.Params) {
-			return fmt.Errorf("height %d hash %s block invalid",
-				ub.UtreexoData.Height, ub.Block.BlockHash().String())
-		}
+	// Verify the accumulator proof first.  It's much faster than checking
+	// all the signatures in the block, and it doesn't touch the pollard, so
+	// a bad proof gets thrown out early.  (Especially since the proof isn't
+	// committed to in the PoW, but the signatures are...)
+	vp, err := c.pollard.VerifyBatchProof(ub.UtreexoData.AccProof)
+	if err != nil {
+		fmt.Printf("height %d verify error\n", ub.UtreexoData.Height)
+		return err
 	}
 
-	// Fills in the empty(nil) nieces for verification && deletion
-	err = c.pollard.IngestBatchProof(ub.UtreexoData.AccProof)
+	// wait for the transaction and signature checks started in sigStage
+	err = cb.check.wait()
+	if err != nil {
+		return fmt.Errorf("height %d hash %s block invalid: %s",
+			ub.UtreexoData.Height, ub.Block.BlockHash().String(), err.Error())
+	}
+
+	// Fills in the empty(nil) nieces for deletion
+	err = c.pollard.PopulateBatchProof(vp)
 	if err != nil {
 		fmt.Printf("height %d ingest error\n", ub.UtreexoData.Height)
 		return err
@@ -188,7 +236,9 @@ func (c *Csn) putBlockInPollard(
 
 	// get hashes to add into the accumulator
 	blockAdds := uwire.BlockToAddLeaves(
-		ub.Block, remember, outskip, ub.UtreexoData.Height)
+		ub.Block, remember, cb.outskip, ub.UtreexoData.Height)
+	// never forget the wallet's own utxos
+	c.pinWalletLeaves(&ub.Block, ub.UtreexoData.Height, blockAdds)
 	*totalTXOAdded += len(blockAdds) // for benchmarking
 
 	// for i, leaf := range blockAdds {
@@ -204,6 +254,8 @@ func (c *Csn) putBlockInPollard(
 		return fmt.Errorf("csn h %d modify %s", c.CurrentHeight, err.Error())
 	}
 
+	c.pollardHeight = ub.UtreexoData.Height + 1
+
 	donetime := time.Now()
 	plustime += donetime.Sub(plusstart)
 
@@ -7,10 +7,9 @@ import (
 	"runtime/trace"
 	"time"
 
-	"github.com/adiabat/bech32"
-
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/wire"
-	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/mit-dci/utreexo/btcacc"
 	"github.com/mit-dci/utreexo/util"
 )
@@ -41,39 +40,37 @@ func RunIBD(cfg *Config, sig chan bool) error {
 	}
 
 	// check on disk for pre-existing state and load it
-	pol, height, utxos, err := initCSNState()
+	st, err := initCSNState(&cfg.params, cfg.assumeUtreexo)
 	if err != nil {
 		return fmt.Errorf("initCSNState error: %s", err.Error())
 	}
 
-	pol.Lookahead = int32(cfg.lookAhead)
+	st.pollard.Lookahead = int32(cfg.lookAhead)
 
 	// make a new CSN struct and load the pollard into it
 	c := Csn{
-		pollard:         pol,
+		pollard:         st.pollard,
 		CheckSignatures: cfg.checkSig,
-		utxoStore:       utxos,
-	}
-
-	txChan, heightChan, err := c.Start(cfg, height, "compactstate", "", sig)
-	if err != nil {
-		return fmt.Errorf("CSN start error: %s", err.Error())
+		Params:          cfg.params,
+		utxoStore:       st.utxos,
+		tipHash:         st.tipHash,
+		unverified:      st.unverified,
 	}
 
-	var pkh [20]byte
-	if cfg.watchAddr != "" {
-		fmt.Printf("decode len %d %s\n", len(cfg.watchAddr), *watchAddr)
-		adrBytes, err := bech32.SegWitAddressDecode(cfg.watchAddr)
+	// watch what was watched before, and what's on the command line
+	for _, desc := range append(st.watch, cfg.watch...) {
+		err = c.RegisterDescriptor(desc)
 		if err != nil {
-			return fmt.Errorf("SegWitAddressDecode error: %s", err.Error())
-		}
-		if len(adrBytes) != 22 {
-			return fmt.Errorf("need a bech32 p2wpkh address, %s has %d bytes",
-				*watchAddr, len(adrBytes))
+			return err
 		}
+	}
+	for _, wd := range c.watchDescs {
+		fmt.Printf("watching %s\n", wd.desc)
+	}
 
-		copy(pkh[:], adrBytes[2:])
-		c.RegisterAddress(pkh)
+	txChan, heightChan, err := c.Start(cfg, st.height, "compactstate", "", sig)
+	if err != nil {
+		return fmt.Errorf("CSN start error: %s", err.Error())
 	}
 
 	for {
@@ -93,9 +90,13 @@ func RunIBD(cfg *Config, sig chan bool) error {
 func (c *Csn) Start(cfg *Config, height int32, path, proxyURL string, haltSig chan bool) (
 	chan wire.MsgTx, chan int32, error) {
 
-	// initialize maps
-	c.WatchAdrs = make(map[[20]byte]bool)
-	c.WatchOPs = make(map[wire.OutPoint]bool)
+	// initialize maps, keeping anything registered before starting
+	if c.WatchScripts == nil {
+		c.WatchScripts = make(map[string]bool)
+	}
+	if c.WatchOPs == nil {
+		c.WatchOPs = make(map[wire.OutPoint]bool)
+	}
 	//c.utxoStore = make(map[wire.OutPoint]util.LeafData)
 	for _, utxo := range c.utxoStore {
 		c.totalScore += utxo.Amt
@@ -106,42 +107,72 @@ func (c *Csn) Start(cfg *Config, height int32, path, proxyURL string, haltSig ch
 	c.HeightChan = make(chan int32, 10)
 
 	c.CurrentHeight = height
+	c.pollardHeight = height
 	c.Params = cfg.params
 	c.remoteHost = cfg.remoteHost
+	c.sigPool = newSigPool(cfg.sigWorkers)
+	c.timeSource = blockchain.NewMedianTime()
+	c.checkpointBlocks = cfg.checkpointBlocks
+	c.checkpointInterval = cfg.checkpointInterval
+	// the first block has to link to the last one in the pollard.  Old state
+	// files don't have it, so then the first block isn't checked.
+	c.prevHash = c.tipHash
+
+	c.assumeValid = cfg.assumeValid
+	c.checkAssumeValid()
 
 	// start client & connect
 	go c.IBDThread(haltSig, cfg.quitafter)
 
+	// from the command line, or from the state file if it hadn't finished
+	// before a restart
+	if c.unverified != nil && cfg.bgVerify {
+		go c.backgroundVerify(c.unverified, cfg.assumeValid)
+	}
+
 	return c.TxChan, c.HeightChan, nil
 }
 
 // initCSNState attempts to load and initialize the CSN state from the disk.
-// If a CSN state is not present, chain is initialized to the genesis
-func initCSNState() (
-	p accumulator.Pollard, height int32, utxos map[wire.OutPoint]btcacc.LeafData, err error) {
+// If a CSN state is not present, chain is initialized to the checkpoint cp,
+// or to the genesis if cp is nil.
+func initCSNState(
+	params *chaincfg.Params, cp *utreexoCheckpoint) (st csnState, err error) {
 
 	// bool to check if the pollarddata is present
 	pollardInitialized := util.HasAccess(PollardFilePath)
 
 	if pollardInitialized {
 		fmt.Println("Has access to forestdata, resuming")
-		height, p, utxos, err = restorePollard()
+		st, err = restorePollard()
 		if err != nil {
 			err = fmt.Errorf("restorePollard error: %s", err.Error())
 			return
 		}
+		// older state files don't have it, so it's given again
+		if st.unverified == nil {
+			st.unverified = cp
+		}
 	} else {
 		fmt.Println("Creating new pollarddata")
 		// start at height 1
-		height = 1
-		utxos = make(map[wire.OutPoint]btcacc.LeafData)
-		// Create file needed for pollard
-		_, err = os.OpenFile(PollardFilePath, os.O_CREATE, 0600)
-		if err != nil {
-			err = fmt.Errorf("Open pollard file %s error: %s",
-				PollardFilePath, err.Error())
-			return
+		st.height = 1
+		st.tipHash = *params.GenesisHash
+		st.utxos = make(map[wire.OutPoint]btcacc.LeafData)
+		if cp != nil {
+			st.pollard, err = cp.pollard()
+			if err != nil {
+				err = errInvalidAssumeUtreexo(err.Error())
+				return
+			}
+			st.height = cp.height + 1
+			st.tipHash = cp.hash
+			st.unverified = cp
+			fmt.Printf("Starting from utreexo checkpoint at height %d %s. "+
+				"Wallet txs before it won't be found\n",
+				cp.height, cp.hash.String())
 		}
+		// the state file gets written at the first checkpoint
 	}
 
 	return
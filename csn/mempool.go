@@ -0,0 +1,241 @@
+package csn
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+/*
+The mempool holds unconfirmed txs that came with proofs for their inputs
+(UTxs).  Every tx in it was checked against the pollard, the proof and the
+scripts (if CheckSignatures is on), and no two of them spend the same utxo.
+
+The pollard remembers the inputs of mempool txs, same as the wallet's utxos,
+so the proofs can be made again after each block.  When a block comes in,
+txs that are in it or that spend something it spent are taken out, and the
+rest get new proofs against the new roots.  The positions of the inputs are
+moved along with the block's deletions, so the pollard doesn't have to be
+searched for them.
+
+The pollard can't tell who remembered a leaf; lookahead, TTLs or the wallet
+may have too.  So the mempool only forgets the inputs it pinned itself, the
+ones that weren't remembered already when the tx came in.
+
+A tx spending the output of another unconfirmed tx can't be proven, so
+those aren't taken.
+*/
+
+// mempool is the unconfirmed txs.  It's guarded by pollardMtx along with the
+// pollard.
+type mempool struct {
+	txs map[chainhash.Hash]*uwire.UTx
+	// the mempool tx spending each utxo
+	spends map[wire.OutPoint]chainhash.Hash
+	// the inputs the mempool had the pollard remember
+	pinned map[wire.OutPoint]bool
+}
+
+// add puts a checked UTx in
+func (mp *mempool) add(utx *uwire.UTx) {
+	if mp.txs == nil {
+		mp.txs = make(map[chainhash.Hash]*uwire.UTx)
+		mp.spends = make(map[wire.OutPoint]chainhash.Hash)
+		mp.pinned = make(map[wire.OutPoint]bool)
+	}
+	txid := utx.Tx.TxHash()
+	mp.txs[txid] = utx
+	for _, in := range utx.Tx.TxIn {
+		mp.spends[in.PreviousOutPoint] = txid
+	}
+}
+
+// AcceptToMempool checks a UTx against the pollard and adds it to the
+// mempool.  It's an error if it spends something a tx in the mempool
+// already spends.
+func (c *Csn) AcceptToMempool(utx *uwire.UTx) error {
+	txid := utx.Tx.TxHash()
+	// the inputs are pinned by their targets below
+	targets := utx.UtreexoData.AccProof.Targets
+	if len(targets) != len(utx.Tx.TxIn) {
+		return fmt.Errorf("tx %s has %d inputs but %d targets",
+			txid.String(), len(utx.Tx.TxIn), len(targets))
+	}
+
+	c.pollardMtx.Lock()
+	defer c.pollardMtx.Unlock()
+
+	if _, ok := c.mempool.txs[txid]; ok {
+		return nil
+	}
+	for _, in := range utx.Tx.TxIn {
+		other, ok := c.mempool.spends[in.PreviousOutPoint]
+		if ok {
+			return fmt.Errorf("tx %s double spends %s, already spent by %s",
+				txid.String(), in.PreviousOutPoint.String(), other.String())
+		}
+	}
+
+	vp, err := c.checkUTx(utx)
+	if err != nil {
+		return err
+	}
+	// keep the inputs in the pollard so they can be proven again later
+	err = c.pollard.PopulateBatchProof(vp)
+	if err != nil {
+		return err
+	}
+	marked, err := c.pollard.RememberLeaves(targets)
+	if err != nil {
+		return err
+	}
+
+	// the targets get moved with each block, so they have to be ours
+	mine := *utx
+	mine.UtreexoData.AccProof.Targets = append([]uint64(nil), targets...)
+	c.mempool.add(&mine)
+	newlyMarked := make(map[uint64]bool, len(marked))
+	for _, pos := range marked {
+		newlyMarked[pos] = true
+	}
+	for i, in := range utx.Tx.TxIn {
+		if newlyMarked[targets[i]] {
+			c.mempool.pinned[in.PreviousOutPoint] = true
+		}
+	}
+	fmt.Printf("mempool took tx %s, has %d txs\n",
+		txid.String(), len(c.mempool.txs))
+	return nil
+}
+
+// MempoolTxs gives all the txs in the mempool, with proofs against the
+// current pollard roots.
+func (c *Csn) MempoolTxs() []uwire.UTx {
+	c.pollardMtx.Lock()
+	defer c.pollardMtx.Unlock()
+	utxs := make([]uwire.UTx, 0, len(c.mempool.txs))
+	for _, utx := range c.mempool.txs {
+		utxs = append(utxs, *utx)
+	}
+	return utxs
+}
+
+// updateMempool takes out the txs a block confirmed or conflicts with and
+// makes new proofs for the rest.  The block has to be in the pollard
+// already; dels are the positions it deleted and numLeaves is how many
+// leaves there were before it.
+func (c *Csn) updateMempool(
+	blk *wire.MsgBlock, dels []uint64, numLeaves uint64) {
+
+	if len(c.mempool.txs) == 0 {
+		return
+	}
+	confirmed := make(map[chainhash.Hash]bool, len(blk.Transactions))
+	spent := make(map[wire.OutPoint]bool)
+	for txInBlock, tx := range blk.Transactions {
+		confirmed[tx.TxHash()] = true
+		if txInBlock == 0 {
+			continue // coinbase input doesn't spend anything
+		}
+		for _, in := range tx.TxIn {
+			spent[in.PreviousOutPoint] = true
+		}
+	}
+
+	// move the inputs the block didn't spend to where they are now
+	type input struct {
+		utx *uwire.UTx
+		i   int
+	}
+	var inputs []input
+	var positions []uint64
+	for _, utx := range c.mempool.txs {
+		for i, in := range utx.Tx.TxIn {
+			if spent[in.PreviousOutPoint] {
+				continue
+			}
+			inputs = append(inputs, input{utx, i})
+			positions = append(positions, utx.UtreexoData.AccProof.Targets[i])
+		}
+	}
+	moved := accumulator.LeafMoves(positions, dels, numLeaves)
+	for j, in := range inputs {
+		in.utx.UtreexoData.AccProof.Targets[in.i] = moved[j]
+	}
+
+	for txid, utx := range c.mempool.txs {
+		if confirmed[txid] {
+			c.removeFromMempool(txid, spent)
+			continue
+		}
+		for _, in := range utx.Tx.TxIn {
+			if spent[in.PreviousOutPoint] {
+				fmt.Printf("mempool tx %s conflicts with block, input %s "+
+					"spent\n", txid.String(), in.PreviousOutPoint.String())
+				c.removeFromMempool(txid, spent)
+				break
+			}
+		}
+	}
+
+	// prove the rest again where they are now
+	for txid, utx := range c.mempool.txs {
+		hs := stxoHashes(utx)
+		bp, err := c.pollard.ProveAt(hs, utx.UtreexoData.AccProof.Targets)
+		if err == nil {
+			_, err = c.pollard.VerifyBatchProof(bp)
+		}
+		if err != nil {
+			// shouldn't happen, but looking for them still might work
+			bp, err = c.pollard.ProveBatch(hs)
+		}
+		if err != nil {
+			fmt.Printf("mempool tx %s can't be proven any more: %s\n",
+				txid.String(), err.Error())
+			c.removeFromMempool(txid, spent)
+			continue
+		}
+		utx.UtreexoData.AccProof = bp
+		utx.UtreexoData.Height = c.pollardHeight
+	}
+}
+
+// removeFromMempool takes a tx out and has the pollard forget the inputs the
+// mempool pinned, except the ones in spent, which are gone already.  The
+// tx's targets have to be where its inputs are now.
+func (c *Csn) removeFromMempool(
+	txid chainhash.Hash, spent map[wire.OutPoint]bool) {
+
+	utx, ok := c.mempool.txs[txid]
+	if !ok {
+		return
+	}
+	delete(c.mempool.txs, txid)
+
+	var forget []uint64
+	for i, in := range utx.Tx.TxIn {
+		delete(c.mempool.spends, in.PreviousOutPoint)
+		pinned := c.mempool.pinned[in.PreviousOutPoint]
+		delete(c.mempool.pinned, in.PreviousOutPoint)
+		if !pinned || spent[in.PreviousOutPoint] {
+			continue
+		}
+		forget = append(forget, utx.UtreexoData.AccProof.Targets[i])
+	}
+	err := c.pollard.ForgetLeaves(forget)
+	if err != nil {
+		fmt.Printf("removeFromMempool %s: %s\n", txid.String(), err.Error())
+	}
+}
+
+// stxoHashes gives the leaf hashes of the inputs of a UTx
+func stxoHashes(utx *uwire.UTx) []accumulator.Hash {
+	hs := make([]accumulator.Hash, len(utx.UtreexoData.Stxos))
+	for i, l := range utx.UtreexoData.Stxos {
+		hs[i] = l.LeafHash()
+	}
+	return hs
+}
@@ -0,0 +1,238 @@
+package csn
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// mempoolTest is a csn with an empty pollard and a full pollard with the
+// same leaves to make proofs with, like a bridge node
+type mempoolTest struct {
+	t     *testing.T
+	c     *Csn
+	full  accumulator.Pollard
+	next  byte
+	utxos []btcacc.LeafData
+}
+
+func newMempoolTest(t *testing.T) *mempoolTest {
+	c := testCsn("")
+	c.CheckSignatures = false
+	return &mempoolTest{t: t, c: c, full: accumulator.NewFullPollard()}
+}
+
+// block deletes the utxos spent by txs, and adds n new ones, remembering
+// the ones in remember, then updates the mempool
+func (m *mempoolTest) block(n int, remember map[int]bool,
+	txs ...*wire.MsgTx) {
+
+	spent := make(map[wire.OutPoint]bool)
+	for _, tx := range txs {
+		for _, in := range tx.TxIn {
+			spent[in.PreviousOutPoint] = true
+		}
+	}
+	var delHashes []accumulator.Hash
+	left := m.utxos[:0]
+	for _, l := range m.utxos {
+		op := wire.OutPoint{Hash: chainhash.Hash(l.TxHash), Index: l.Index}
+		if spent[op] {
+			delHashes = append(delHashes, l.LeafHash())
+			continue
+		}
+		left = append(left, l)
+	}
+	m.utxos = left
+
+	adds := make([]accumulator.Leaf, n)
+	for i := range adds {
+		m.next++
+		l := btcacc.LeafData{
+			TxHash:   btcacc.Hash{m.next},
+			Height:   1,
+			Amt:      1000,
+			PkScript: opTrue,
+		}
+		m.utxos = append(m.utxos, l)
+		adds[i] = accumulator.Leaf{Hash: l.LeafHash(), Remember: remember[i]}
+	}
+
+	bp, err := m.full.ProveBatch(delHashes)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	err = m.c.pollard.IngestBatchProof(bp)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	nl, _ := m.c.pollard.ReconstructStats()
+	err = m.full.Modify(adds, bp.Targets)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	err = m.c.pollard.Modify(adds, bp.Targets)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	m.c.pollardHeight++
+
+	blk := mineBlock(m.t, chainhash.Hash{}, m.c.pollardHeight, txs...)
+	m.c.updateMempool(&blk, bp.Targets, nl)
+}
+
+// utx spends the utxos at is
+func (m *mempoolTest) utx(is ...int) *uwire.UTx {
+	tx := wire.NewMsgTx(1)
+	var stxos []btcacc.LeafData
+	var hs []accumulator.Hash
+	for _, i := range is {
+		l := m.utxos[i]
+		op := wire.OutPoint{Hash: chainhash.Hash(l.TxHash), Index: l.Index}
+		tx.AddTxIn(wire.NewTxIn(&op, nil, nil))
+		stxos = append(stxos, l)
+		hs = append(hs, l.LeafHash())
+	}
+	tx.AddTxOut(wire.NewTxOut(900, opTrue))
+	bp, err := m.full.ProveBatch(hs)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return &uwire.UTx{
+		UtreexoData: btcacc.UData{
+			Height:   m.c.pollardHeight,
+			AccProof: bp,
+			Stxos:    stxos,
+		},
+		Tx: *tx,
+	}
+}
+
+// check checks that every mempool tx has the proof the full pollard gives
+func (m *mempoolTest) check() {
+	for txid, utx := range m.c.mempool.txs {
+		want, err := m.full.ProveBatch(stxoHashes(utx))
+		if err != nil {
+			m.t.Fatal(err)
+		}
+		if !reflect.DeepEqual(utx.UtreexoData.AccProof, want) {
+			m.t.Fatalf("tx %s proof %s, expected %s", txid.String(),
+				utx.UtreexoData.AccProof.ToString(), want.ToString())
+		}
+		if utx.UtreexoData.Height != m.c.pollardHeight {
+			m.t.Fatalf("tx %s proof for %d, pollard at %d", txid.String(),
+				utx.UtreexoData.Height, m.c.pollardHeight)
+		}
+		err = m.c.CheckUTx(utx)
+		if err != nil {
+			m.t.Fatal(err)
+		}
+	}
+}
+
+// TestUpdateMempool keeps some txs in the mempool over many blocks that
+// move their inputs around, and checks their proofs after each one
+func TestUpdateMempool(t *testing.T) {
+	rand.Seed(1)
+	m := newMempoolTest(t)
+	m.block(20, nil)
+	for _, is := range [][]int{{0}, {3, 7}, {12}} {
+		err := m.c.AcceptToMempool(m.utx(is...))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.check()
+
+	for b := 0; b < 30; b++ {
+		// spend a utxo no mempool tx spends
+		var txs []*wire.MsgTx
+		i := rand.Intn(len(m.utxos))
+		l := m.utxos[i]
+		op := wire.OutPoint{Hash: chainhash.Hash(l.TxHash), Index: l.Index}
+		if _, ok := m.c.mempool.spends[op]; !ok {
+			txs = append(txs, spendTx(op, 900, opTrue))
+		}
+		m.block(rand.Intn(4), nil, txs...)
+		m.check()
+	}
+	if len(m.c.mempool.txs) != 3 {
+		t.Fatalf("%d txs left in the mempool, expected 3",
+			len(m.c.mempool.txs))
+	}
+}
+
+// TestUpdateMempoolRemove checks that txs the block confirms or conflicts
+// with are taken out, and that only the inputs the mempool pinned get
+// forgotten.
+func TestUpdateMempoolRemove(t *testing.T) {
+	m := newMempoolTest(t)
+	// utxo 1 is remembered already, like for lookahead
+	m.block(8, map[int]bool{1: true})
+	confirmed := m.utx(0)
+	conflicting := m.utx(1, 2)
+	kept := m.utx(4)
+	for _, utx := range []*uwire.UTx{confirmed, conflicting, kept} {
+		err := m.c.AcceptToMempool(utx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.c.mempool.pinned) != 3 {
+		t.Fatalf("%d inputs pinned, expected 3", len(m.c.mempool.pinned))
+	}
+	lookahead := m.utxos[1]
+
+	// a different tx spending utxo 2
+	op := wire.OutPoint{Hash: chainhash.Hash(m.utxos[2].TxHash)}
+	m.block(2, nil, &confirmed.Tx, spendTx(op, 500, opTrue))
+
+	if len(m.c.mempool.txs) != 1 {
+		t.Fatalf("%d txs left in the mempool, expected 1",
+			len(m.c.mempool.txs))
+	}
+	if _, ok := m.c.mempool.txs[kept.Tx.TxHash()]; !ok {
+		t.Fatal("lost the tx the block didn't touch")
+	}
+	if len(m.c.mempool.pinned) != 1 || len(m.c.mempool.spends) != 1 {
+		t.Fatalf("pinned %v spends %v", m.c.mempool.pinned,
+			m.c.mempool.spends)
+	}
+	m.check()
+
+	// the lookahead leaf is still remembered after more blocks
+	m.block(3, nil)
+	_, err := m.c.pollard.ProveBatch([]accumulator.Hash{lookahead.LeafHash()})
+	if err != nil {
+		t.Fatalf("lookahead leaf forgotten: %s", err.Error())
+	}
+	m.check()
+}
+
+// TestAcceptToMempoolTargets checks that a tx with fewer targets than
+// inputs is turned away, not proven with what targets it has
+func TestAcceptToMempoolTargets(t *testing.T) {
+	m := newMempoolTest(t)
+	m.block(8, nil)
+	utx := m.utx(0, 3)
+	one := m.utx(0)
+	utx.UtreexoData.AccProof = one.UtreexoData.AccProof
+	utx.UtreexoData.Stxos[1].Amt = 50e8
+	err := m.c.AcceptToMempool(utx)
+	if err == nil {
+		t.Fatal("took a tx with an input that isn't proven")
+	}
+	if len(m.c.MempoolTxs()) != 0 {
+		t.Fatal("mempool has the tx it didn't take")
+	}
+	err = m.c.AcceptToMempool(m.utx(0, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,40 +1,153 @@
 package csn
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
-	"os"
+	"io"
+	"io/ioutil"
 
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
 )
 
+/*
+CSN state file (pollardFile) is:
+4 bytes magic "csn" + version (3)
+4 bytes height (the next block to process)
+32 bytes hash of the last block processed
+4 bytes number of wallet utxos
+[]utxos (LeafData serialization)
+4 bytes number of watch descriptors
+[]descriptors, each 2 bytes length and the descriptor string
+the -assumeutreexo checkpoint background verification hasn't finished:
+    4 bytes height, 0 if there isn't one, and if there is
+    32 bytes block hash, 8 bytes numLeaves, 1 byte number of roots, roots
+the pollard (WritePollard serialization)
+32 bytes sha256 of everything before it
+
+It's always written whole with util.WriteFileAtomic so a crash leaves
+either the old checkpoint or the new one.  Version 2 (no -assumeutreexo
+checkpoint), version 1 (no descriptors either) and the old format (no
+magic, no checksum: utxos, height, pollard roots) can still be read.
+
+The checkpoint is kept so that background verification carries on after
+a restart without -assumeutreexo being given again.  Once it's checked out
+the next save leaves it off.
+*/
+
+// csnStateMagic starts a CSN state file.  Last byte is the version
+var csnStateMagic = [4]byte{'c', 's', 'n', 0x03}
+
+// csnStateMagicV2 is the version before the -assumeutreexo checkpoint
+// was saved
+var csnStateMagicV2 = [4]byte{'c', 's', 'n', 0x02}
+
+// csnStateMagicV1 is the version before watch descriptors were saved
+var csnStateMagicV1 = [4]byte{'c', 's', 'n', 0x01}
+
+// csnState is what gets saved to disk so the CSN can resume
+type csnState struct {
+	height  int32          // next block to process
+	tipHash chainhash.Hash // last block processed
+	pollard accumulator.Pollard
+	utxos   map[wire.OutPoint]btcacc.LeafData
+	watch   []string // descriptors the wallet watches
+	// the -assumeutreexo checkpoint, if it's not verified yet
+	unverified *utreexoCheckpoint
+}
+
 // restorePollard restores the pollard from disk to memory.
-// If starting anew, it just returns a empty pollard.
-func restorePollard() (height int32, p accumulator.Pollard,
-	utxos map[wire.OutPoint]btcacc.LeafData, err error) {
-	// Restore Pollard
-	pollardFile, err := os.OpenFile(PollardFilePath, os.O_RDWR, 0600)
+// The checksum has to match, otherwise the file is corrupt and we don't
+// try to use it.
+func restorePollard() (st csnState, err error) {
+	b, err := ioutil.ReadFile(PollardFilePath)
 	if err != nil {
 		return
 	}
 
-	// restore utxos
-	var numUtxos uint32
-	err = binary.Read(pollardFile, binary.BigEndian, &numUtxos)
+	var r io.Reader
+	if len(b) >= 4 && (bytes.Equal(b[:4], csnStateMagic[:]) ||
+		bytes.Equal(b[:4], csnStateMagicV2[:]) ||
+		bytes.Equal(b[:4], csnStateMagicV1[:])) {
+		if len(b) < 4+sha256.Size {
+			err = fmt.Errorf("%s too short", PollardFilePath)
+			return
+		}
+		payload := b[:len(b)-sha256.Size]
+		sum := sha256.Sum256(payload)
+		if !bytes.Equal(sum[:], b[len(payload):]) {
+			err = fmt.Errorf("%s checksum mismatch, file is corrupt",
+				PollardFilePath)
+			return
+		}
+		r = bytes.NewReader(payload[4:])
+		err = binary.Read(r, binary.BigEndian, &st.height)
+		if err != nil {
+			return
+		}
+		_, err = io.ReadFull(r, st.tipHash[:])
+		if err != nil {
+			return
+		}
+		st.utxos, err = readUtxos(r)
+		if err != nil {
+			return
+		}
+		if b[3] != csnStateMagicV1[3] {
+			st.watch, err = readWatchDescs(r)
+			if err != nil {
+				return
+			}
+		}
+		if b[3] == csnStateMagic[3] {
+			st.unverified, err = readUnverified(r)
+			if err != nil {
+				return
+			}
+		}
+	} else {
+		// old format
+		r = bufio.NewReader(bytes.NewReader(b))
+		st.utxos, err = readUtxos(r)
+		if err != nil {
+			return
+		}
+		err = binary.Read(r, binary.BigEndian, &st.height)
+		if err != nil {
+			return
+		}
+	}
+
+	err = st.pollard.RestorePollard(r)
 	if err != nil {
+		fmt.Printf("restore error\n")
 		return
 	}
 
-	utxos = make(map[wire.OutPoint]btcacc.LeafData)
+	return
+}
+
+// readUtxos reads the number of wallet utxos and then the utxos
+func readUtxos(r io.Reader) (map[wire.OutPoint]btcacc.LeafData, error) {
+	var numUtxos uint32
+	err := binary.Read(r, binary.BigEndian, &numUtxos)
+	if err != nil {
+		return nil, err
+	}
+
+	utxos := make(map[wire.OutPoint]btcacc.LeafData)
 	for ; numUtxos > 0; numUtxos-- {
 		var utxo btcacc.LeafData
 
-		err = utxo.Deserialize(pollardFile)
+		err = utxo.Deserialize(r)
 		if err != nil {
-			return
+			return nil, err
 		}
 
 		op := wire.OutPoint{
@@ -43,51 +156,150 @@ func restorePollard() (height int32, p accumulator.Pollard,
 		}
 		utxos[op] = utxo
 	}
+	return utxos, nil
+}
 
-	err = binary.Read(pollardFile, binary.BigEndian, &height)
+// readWatchDescs reads the number of watch descriptors and then the
+// descriptors
+func readWatchDescs(r io.Reader) ([]string, error) {
+	var numDescs uint32
+	err := binary.Read(r, binary.BigEndian, &numDescs)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	err = p.RestorePollard(pollardFile)
+	descs := make([]string, numDescs)
+	for i := range descs {
+		var descLen uint16
+		err = binary.Read(r, binary.BigEndian, &descLen)
+		if err != nil {
+			return nil, err
+		}
+		desc := make([]byte, descLen)
+		_, err = io.ReadFull(r, desc)
+		if err != nil {
+			return nil, err
+		}
+		descs[i] = string(desc)
+	}
+	return descs, nil
+}
+
+// readUnverified reads the -assumeutreexo checkpoint that's not verified
+// yet, nil if there isn't one
+func readUnverified(r io.Reader) (*utreexoCheckpoint, error) {
+	var cp utreexoCheckpoint
+	err := binary.Read(r, binary.BigEndian, &cp.height)
+	if err != nil || cp.height == 0 {
+		return nil, err
+	}
+	_, err = io.ReadFull(r, cp.hash[:])
 	if err != nil {
-		fmt.Printf("restore error\n")
-		return
+		return nil, err
+	}
+	err = binary.Read(r, binary.BigEndian, &cp.numLeaves)
+	if err != nil {
+		return nil, err
+	}
+	var numRoots uint8
+	err = binary.Read(r, binary.BigEndian, &numRoots)
+	if err != nil {
+		return nil, err
 	}
+	cp.roots = make([]accumulator.Hash, numRoots)
+	for i := range cp.roots {
+		_, err = io.ReadFull(r, cp.roots[i][:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &cp, nil
+}
 
-	return
+// writeUnverified writes cp for readUnverified.  cp can be nil.
+func writeUnverified(buf *bytes.Buffer, cp *utreexoCheckpoint) error {
+	if cp == nil {
+		return binary.Write(buf, binary.BigEndian, int32(0))
+	}
+	err := binary.Write(buf, binary.BigEndian, cp.height)
+	if err != nil {
+		return err
+	}
+	buf.Write(cp.hash[:])
+	err = binary.Write(buf, binary.BigEndian, cp.numLeaves)
+	if err != nil {
+		return err
+	}
+	// there's a root for each bit of numLeaves
+	buf.WriteByte(uint8(len(cp.roots)))
+	for _, root := range cp.roots {
+		buf.Write(root[:])
+	}
+	return nil
 }
 
 // saveIBDsimData saves the state of ibdsim so that when the
 // user restarts, they'll be able to resume.
-// Saves height for ibdsim and pollard itself
-func saveIBDsimData(csn *Csn) error {
-	polFile, err := os.OpenFile(PollardFilePath, os.O_WRONLY, 0600)
+// Saves height (the next block to process), the hash of the last
+// block, the wallet utxos and descriptors, the checkpoint background
+// verification is still checking and the pollard itself.
+// WalletProof and the mempool can change the pollard and utxos at any time,
+// so they're serialized with pollardMtx held.
+func saveIBDsimData(csn *Csn, height int32) error {
+	var buf bytes.Buffer
+	buf.Write(csnStateMagic[:])
+	csn.pollardMtx.Lock()
+	err := writeCSNState(&buf, csn, height)
+	csn.pollardMtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+
+	return util.WriteFileAtomic(PollardFilePath, buf.Bytes(), 0600)
+}
+
+// writeCSNState writes the state file after the magic bytes, without the
+// checksum
+func writeCSNState(buf *bytes.Buffer, csn *Csn, height int32) error {
+	// write the height and tip
+	err := binary.Write(buf, binary.BigEndian, height)
 	if err != nil {
 		return err
 	}
+	buf.Write(csn.tipHash[:])
 
 	// save all found utxos
-	err = binary.Write(polFile, binary.BigEndian, uint32(len(csn.utxoStore)))
+	err = binary.Write(buf, binary.BigEndian, uint32(len(csn.utxoStore)))
 	if err != nil {
 		return err
 	}
 
 	for _, utxo := range csn.utxoStore {
-		err = utxo.Serialize(polFile)
+		err = utxo.Serialize(buf)
 		if err != nil {
 			return err
 		}
 	}
 
-	// write to the heightfile
-	err = binary.Write(polFile, binary.BigEndian, csn.CurrentHeight)
+	// and what the wallet's watching for
+	err = binary.Write(buf, binary.BigEndian, uint32(len(csn.watchDescs)))
 	if err != nil {
 		return err
 	}
-	err = csn.pollard.WritePollard(polFile)
+	for _, wd := range csn.watchDescs {
+		err = binary.Write(buf, binary.BigEndian, uint16(len(wd.desc)))
+		if err != nil {
+			return err
+		}
+		buf.WriteString(wd.desc)
+	}
+
+	err = writeUnverified(buf, csn.unverified)
 	if err != nil {
 		return err
 	}
-	return polFile.Close()
+	return csn.pollard.WritePollard(buf)
 }
@@ -0,0 +1,181 @@
+package csn
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// stateFileTest points PollardFilePath at a temp dir for the length of the
+// test, and gives a csn with some leaves, a wallet utxo and a descriptor
+func stateFileTest(t *testing.T) *Csn {
+	old := PollardFilePath
+	PollardFilePath = filepath.Join(t.TempDir(), "pollardFile")
+	t.Cleanup(func() { PollardFilePath = old })
+
+	m := newMempoolTest(t)
+	m.block(8, map[int]bool{1: true, 3: true})
+	c := m.c
+	c.tipHash = chainhash.Hash{0x07}
+	l := m.utxos[3]
+	c.utxoStore = map[wire.OutPoint]btcacc.LeafData{
+		{Hash: chainhash.Hash(l.TxHash), Index: l.Index}: l}
+	c.watchDescs = []watchDesc{{desc: "raw(51)", pkScript: opTrue}}
+	_, c.unverified = coinbaseChain(t, 3)
+	return c
+}
+
+// sameState checks that st is what c saved at height
+func sameState(t *testing.T, st csnState, c *Csn, height int32) {
+	t.Helper()
+	if st.height != height || st.tipHash != c.tipHash {
+		t.Fatalf("restored height %d tip %s, saved %d %s", st.height,
+			st.tipHash.String(), height, c.tipHash.String())
+	}
+	if !reflect.DeepEqual(st.utxos, c.utxoStore) {
+		t.Fatalf("restored utxos %v, saved %v", st.utxos, c.utxoStore)
+	}
+	if len(st.watch) != 1 || st.watch[0] != c.watchDescs[0].desc {
+		t.Fatalf("restored descriptors %v", st.watch)
+	}
+	if !reflect.DeepEqual(st.unverified, c.unverified) {
+		t.Fatalf("restored checkpoint %+v, saved %+v",
+			st.unverified, c.unverified)
+	}
+	nl, rows := st.pollard.ReconstructStats()
+	wantNl, wantRows := c.pollard.ReconstructStats()
+	if nl != wantNl || rows != wantRows ||
+		!reflect.DeepEqual(st.pollard.GetRoots(), c.pollard.GetRoots()) {
+		t.Fatalf("restored pollard %d leaves %v, saved %d leaves %v", nl,
+			st.pollard.GetRoots(), wantNl, c.pollard.GetRoots())
+	}
+}
+
+// TestSaveIBDsimData saves the state file and reads it back
+func TestSaveIBDsimData(t *testing.T) {
+	c := stateFileTest(t)
+	err := saveIBDsimData(c, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := restorePollard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameState(t, st, c, 2)
+
+	// saving again replaces it whole, with nothing left over
+	c.tipHash = chainhash.Hash{0x08}
+	c.unverified = nil
+	err = saveIBDsimData(c, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err = restorePollard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameState(t, st, c, 3)
+	if util.HasAccess(PollardFilePath + ".tmp") {
+		t.Fatal("temp file left after saving")
+	}
+
+	// a crash while writing leaves half a temp file, not half a state file
+	err = ioutil.WriteFile(PollardFilePath+".tmp", []byte("csn"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err = restorePollard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameState(t, st, c, 3)
+}
+
+// TestRestorePollardCorrupt flips a byte in the state file, and cuts it
+// short, and checks it isn't used
+func TestRestorePollardCorrupt(t *testing.T) {
+	c := stateFileTest(t)
+	err := saveIBDsimData(c, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := ioutil.ReadFile(PollardFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// in the height, the utxos, the pollard and the checksum
+	for _, i := range []int{5, 50, len(good) - 40, len(good) - 1} {
+		b := append([]byte(nil), good...)
+		b[i] ^= 0x01
+		err = ioutil.WriteFile(PollardFilePath, b, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = restorePollard()
+		if err == nil {
+			t.Fatalf("restored with byte %d of %d flipped", i, len(b))
+		}
+	}
+	err = ioutil.WriteFile(PollardFilePath, good[:len(good)-10], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = restorePollard()
+	if err == nil {
+		t.Fatal("restored a state file that's cut short")
+	}
+}
+
+// TestUnverifiedCheckpoint checks that the -assumeutreexo checkpoint is
+// still there to verify after a restart without it, and isn't once it's
+// verified
+func TestUnverifiedCheckpoint(t *testing.T) {
+	stateFileTest(t)
+	bgVerifyTest(t)
+	ubs, cp := coinbaseChain(t, 4)
+	params := &chaincfg.RegressionNetParams
+	st, err := initCSNState(params, cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.unverified != cp || st.height != 5 {
+		t.Fatalf("started at %d with checkpoint %+v", st.height, st.unverified)
+	}
+	c := testCsn(ublockServer(t, ubs, nil))
+	c.pollard, c.tipHash, c.unverified = st.pollard, st.tipHash, st.unverified
+	err = saveIBDsimData(c, st.height)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// restarted with no -assumeutreexo
+	st, err = initCSNState(params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(st.unverified, cp) {
+		t.Fatalf("restored checkpoint %+v, expected %+v", st.unverified, cp)
+	}
+
+	c.backgroundVerify(st.unverified, nil)
+	if c.unverified != nil {
+		t.Fatal("checkpoint still unverified after background verification")
+	}
+	err = saveIBDsimData(c, st.height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err = initCSNState(params, nil)
+	if err != nil || st.unverified != nil {
+		t.Fatalf("restored checkpoint %+v %v after it was verified",
+			st.unverified, err)
+	}
+}
@@ -0,0 +1,205 @@
+package csn
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/util"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// sigCacheSize is how many signatures the shared sig cache holds.  Same as
+// btcd's default.
+const sigCacheSize = 100000
+
+// sigPool is a fixed set of workers that check input scripts.  It's shared
+// across blocks so the scripts of the next block can be checked while the
+// pollard is still working on the current one.
+type sigPool struct {
+	jobs     chan sigJob
+	sigCache *txscript.SigCache
+	workers  sync.WaitGroup
+}
+
+// sigJob is a single input script to check
+type sigJob struct {
+	tx       *wire.MsgTx
+	idx      int
+	pkScript []byte
+	amt      int64
+	flags    txscript.ScriptFlags
+	hashes   *txscript.TxSigHashes
+	check    *blockCheck
+}
+
+// blockCheck keeps track of the script checks for a single block.
+type blockCheck struct {
+	wg sync.WaitGroup
+
+	errOnce sync.Once
+	err     error
+}
+
+// fail records the first error found in a block
+func (bc *blockCheck) fail(err error) {
+	bc.errOnce.Do(func() { bc.err = err })
+}
+
+// wait blocks until all the scripts in the block are checked and returns the
+// first error found, if any.  A nil blockCheck means nothing was checked.
+func (bc *blockCheck) wait() error {
+	if bc == nil {
+		return nil
+	}
+	bc.wg.Wait()
+	return bc.err
+}
+
+// newSigPool starts up a pool with the given number of workers
+func newSigPool(workers int) *sigPool {
+	if workers < 1 {
+		workers = 1
+	}
+	sp := &sigPool{
+		jobs:     make(chan sigJob, workers*16),
+		sigCache: txscript.NewSigCache(sigCacheSize),
+	}
+	sp.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go sp.worker()
+	}
+	return sp
+}
+
+// stop lets the workers finish the scripts already submitted and waits for
+// them to exit.  Nothing can be submitted after.
+func (sp *sigPool) stop() {
+	close(sp.jobs)
+	sp.workers.Wait()
+}
+
+// worker checks scripts until the jobs channel is closed
+func (sp *sigPool) worker() {
+	defer sp.workers.Done()
+	for job := range sp.jobs {
+		vm, err := txscript.NewEngine(job.pkScript, job.tx, job.idx,
+			job.flags, sp.sigCache, job.hashes, job.amt)
+		if err == nil {
+			err = vm.Execute()
+		}
+		if err != nil {
+			job.check.fail(fmt.Errorf("tx %s input %d fails script check: %s",
+				job.tx.TxHash().String(), job.idx, err.Error()))
+		}
+		job.check.wg.Done()
+	}
+}
+
+// submit does the cheap per-tx checks for a block right away and queues up
+// all of its input scripts, unless scripts is false.  It returns before the
+// scripts are done; call wait() on the returned blockCheck to get the result.
+func (sp *sigPool) submit(ub *uwire.UBlock, outskip []uint32,
+	p *chaincfg.Params, scripts bool) *blockCheck {
+
+	bc := new(blockCheck)
+	height := ub.UtreexoData.Height
+
+	flags, err := uwire.ScriptFlags(p, height, ub.Block.BlockHash())
+	if err != nil {
+		bc.fail(err)
+		return bc
+	}
+
+	view := ub.UtxoView(outskip)
+
+	for txnum, tx := range ub.Block.Transactions {
+		if txnum == 0 {
+			continue // skip checks for coinbase TX for now.
+		}
+		utilTx := btcutil.NewTx(tx)
+		_, err = blockchain.CheckTransactionInputs(utilTx, height, view, p)
+		if err != nil {
+			bc.fail(fmt.Errorf("tx %s fails CheckTransactionInputs: %s",
+				utilTx.Hash().String(), err.Error()))
+			return bc
+		}
+		if !scripts {
+			continue
+		}
+
+		// sighashes are shared by all the inputs of a tx
+		hashes := txscript.NewTxSigHashes(tx)
+		for i, in := range tx.TxIn {
+			utxo := view.LookupEntry(in.PreviousOutPoint)
+			if utxo == nil {
+				bc.fail(fmt.Errorf("tx %s input %d missing utxo %s",
+					utilTx.Hash().String(), i, in.PreviousOutPoint.String()))
+				return bc
+			}
+			bc.wg.Add(1)
+			sp.jobs <- sigJob{
+				tx:       tx,
+				idx:      i,
+				pkScript: utxo.PkScript(),
+				amt:      utxo.Amount(),
+				flags:    flags,
+				hashes:   hashes,
+				check:    bc,
+			}
+		}
+	}
+	return bc
+}
+
+// checkedBlock is a ublock on its way from the network to the pollard, along
+// with the (possibly still running) script checks for it.
+type checkedBlock struct {
+	ub      uwire.UBlock
+	inskip  []uint32
+	outskip []uint32
+	check   *blockCheck
+}
+
+// sigStage sits between the network reader and the pollard.  It dedupes
+// and checks the header of each block and starts its script checks, then
+// passes it on.  As out is buffered, this runs ahead of the pollard by a
+// few blocks.  It stops once done is closed, so it doesn't hang around
+// when the pollard side quits.
+func (c *Csn) sigStage(
+	in chan uwire.UBlock, out chan checkedBlock, done chan struct{}) {
+
+	defer close(out)
+	for {
+		var ub uwire.UBlock
+		var ok bool
+		select {
+		case ub, ok = <-in:
+		case <-done:
+			return
+		}
+		if !ok {
+			return
+		}
+		cb := checkedBlock{ub: ub}
+		cb.inskip, cb.outskip = util.DedupeBlock(&cb.ub.Block)
+		err := checkHeader(&cb.ub, &c.prevHash, &c.Params, c.timeSource)
+		if err != nil {
+			cb.check = new(blockCheck)
+			cb.check.fail(err)
+		} else if c.CheckSignatures {
+			scripts := !c.assumeValid.skipScripts(
+				cb.ub.UtreexoData.Height, c.prevHash)
+			cb.check = c.sigPool.submit(&cb.ub, cb.outskip, &c.Params, scripts)
+		}
+		select {
+		case out <- cb:
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package csn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/btcacc"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// opTrue is a pkScript anyone can spend with an empty scriptSig
+var opTrue = []byte{txscript.OP_TRUE}
+
+// mineBlock makes a regtest block on prev with a coinbase and then txs,
+// and grinds the nonce until it has valid PoW
+func mineBlock(t *testing.T, prev chainhash.Hash, height int32,
+	txs ...*wire.MsgTx) wire.MsgBlock {
+
+	cb := wire.NewMsgTx(1)
+	cb.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+		SignatureScript:  []byte{txscript.OP_DATA_4, byte(height), 0, 0, 0},
+	})
+	cb.AddTxOut(wire.NewTxOut(50e8, opTrue))
+
+	blk := wire.MsgBlock{
+		Header: wire.BlockHeader{
+			Version:   4,
+			PrevBlock: prev,
+			Timestamp: time.Unix(time.Now().Unix(), 0),
+			Bits:      chaincfg.RegressionNetParams.PowLimitBits,
+		},
+		Transactions: append([]*wire.MsgTx{cb}, txs...),
+	}
+	utxs := make([]*btcutil.Tx, len(blk.Transactions))
+	for i, tx := range blk.Transactions {
+		utxs[i] = btcutil.NewTx(tx)
+	}
+	merkles := blockchain.BuildMerkleTreeStore(utxs, false)
+	blk.Header.MerkleRoot = *merkles[len(merkles)-1]
+
+	for {
+		err := blockchain.CheckProofOfWork(btcutil.NewBlock(&blk),
+			chaincfg.RegressionNetParams.PowLimit)
+		if err == nil {
+			return blk
+		}
+		blk.Header.Nonce++
+		if blk.Header.Nonce == 0 {
+			t.Fatal("ran out of nonces")
+		}
+	}
+}
+
+// spendTx spends an opTrue output worth amt and pays out to pkScript
+func spendTx(op wire.OutPoint, amt int64, pkScript []byte) *wire.MsgTx {
+	tx := wire.NewMsgTx(1)
+	tx.AddTxIn(wire.NewTxIn(&op, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(amt, pkScript))
+	return tx
+}
+
+// spendBlock is a ublock with one tx spending an opTrue utxo of amt
+// created at height 1, paying out to pkScript
+func spendBlock(t *testing.T, prev chainhash.Hash, height int32,
+	amt, out int64, pkScript []byte) uwire.UBlock {
+
+	op := wire.OutPoint{Hash: chainhash.Hash{0x01}, Index: 0}
+	blk := mineBlock(t, prev, height, spendTx(op, out, pkScript))
+	return uwire.UBlock{
+		Block: blk,
+		UtreexoData: btcacc.UData{
+			Height: height,
+			Stxos: []btcacc.LeafData{{
+				TxHash:   btcacc.Hash(op.Hash),
+				Index:    op.Index,
+				Height:   1,
+				Amt:      amt,
+				PkScript: opTrue,
+			}},
+		},
+	}
+}
+
+func TestSigPoolSubmit(t *testing.T) {
+	sp := newSigPool(2)
+	defer sp.stop()
+	p := &chaincfg.RegressionNetParams
+	var prev chainhash.Hash
+
+	tests := []struct {
+		name    string
+		ub      uwire.UBlock
+		scripts bool
+		ok      bool
+	}{
+		{"good", spendBlock(t, prev, 2, 1000, 900, opTrue), true, true},
+		{"bad script", spendBlock(t, prev, 2, 1000, 900, opTrue), true, false},
+		{"bad script skipped",
+			spendBlock(t, prev, 2, 1000, 900, opTrue), false, true},
+		{"spends too much",
+			spendBlock(t, prev, 2, 1000, 1100, opTrue), false, false},
+	}
+	// the utxo being spent can only be spent with something that fails
+	tests[1].ub.UtreexoData.Stxos[0].PkScript = []byte{txscript.OP_FALSE}
+	tests[2].ub.UtreexoData.Stxos[0].PkScript = []byte{txscript.OP_FALSE}
+
+	for _, test := range tests {
+		err := sp.submit(&test.ub, nil, p, test.scripts).wait()
+		if test.ok && err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+// TestSigPoolStop checks that stopping a pool finishes the scripts already
+// submitted before the workers exit
+func TestSigPoolStop(t *testing.T) {
+	sp := newSigPool(3)
+	p := &chaincfg.RegressionNetParams
+	var prev chainhash.Hash
+	good := spendBlock(t, prev, 2, 1000, 900, opTrue)
+	bad := spendBlock(t, prev, 2, 1000, 900, opTrue)
+	bad.UtreexoData.Stxos[0].PkScript = []byte{txscript.OP_FALSE}
+	goodCheck := sp.submit(&good, nil, p, true)
+	badCheck := sp.submit(&bad, nil, p, true)
+
+	stopped := make(chan struct{})
+	go func() {
+		sp.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("workers didn't exit")
+	}
+	if goodCheck.wait() != nil || badCheck.wait() == nil {
+		t.Fatalf("good block %v, bad block %v",
+			goodCheck.wait(), badCheck.wait())
+	}
+}
+
+func TestSigStage(t *testing.T) {
+	c := Csn{
+		Params:          chaincfg.RegressionNetParams,
+		CheckSignatures: true,
+		sigPool:         newSigPool(2),
+		timeSource:      blockchain.NewMedianTime(),
+	}
+
+	// a chain of good blocks, then one that doesn't link up
+	in := make(chan uwire.UBlock, 5)
+	prev := chaincfg.RegressionNetParams.GenesisHash
+	for h := int32(1); h <= 3; h++ {
+		ub := spendBlock(t, *prev, h, 1000, 900, opTrue)
+		in <- ub
+		hash := ub.Block.BlockHash()
+		prev = &hash
+	}
+	in <- spendBlock(t, chainhash.Hash{0xff}, 4, 1000, 900, opTrue)
+	close(in)
+
+	out := make(chan checkedBlock)
+	go c.sigStage(in, out, make(chan struct{}))
+	var n int
+	for cb := range out {
+		n++
+		err := cb.check.wait()
+		if n <= 3 && err != nil {
+			t.Fatalf("block %d: %s", n, err.Error())
+		}
+		if n == 4 && err == nil {
+			t.Fatalf("block %d doesn't link but passed", n)
+		}
+	}
+	if n != 4 {
+		t.Fatalf("got %d blocks, sent 4", n)
+	}
+}
+
+// TestSigStageDone checks that sigStage quits when nothing takes its blocks
+// any more, instead of blocking forever.
+func TestSigStageDone(t *testing.T) {
+	c := Csn{
+		Params:          chaincfg.RegressionNetParams,
+		CheckSignatures: true,
+		sigPool:         newSigPool(1),
+		timeSource:      blockchain.NewMedianTime(),
+	}
+	in := make(chan uwire.UBlock, 3)
+	prev := chaincfg.RegressionNetParams.GenesisHash
+	for h := int32(1); h <= 3; h++ {
+		ub := spendBlock(t, *prev, h, 1000, 900, opTrue)
+		in <- ub
+		hash := ub.Block.BlockHash()
+		prev = &hash
+	}
+
+	out := make(chan checkedBlock)
+	done := make(chan struct{})
+	go c.sigStage(in, out, done)
+	<-out
+	// like IBDThread giving up after a bad block
+	close(done)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-out:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("sigStage still running after done was closed")
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package csn
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// MakeUTx puts the proofs for the inputs of a tx on it.  All the inputs have
+// to be wallet utxos.
+func (c *Csn) MakeUTx(tx *wire.MsgTx) (*uwire.UTx, error) {
+	ops := make([]wire.OutPoint, len(tx.TxIn))
+	for i, in := range tx.TxIn {
+		ops[i] = in.PreviousOutPoint
+	}
+
+	c.pollardMtx.Lock()
+	defer c.pollardMtx.Unlock()
+	bp, leaves, err := c.walletProof(ops)
+	if err != nil {
+		return nil, err
+	}
+	return &uwire.UTx{
+		UtreexoData: btcacc.UData{
+			Height:   c.pollardHeight,
+			AccProof: bp,
+			Stxos:    leaves,
+		},
+		Tx: *tx,
+	}, nil
+}
+
+// CheckUTx checks a UTx against the pollard.  Its proof has to be for the
+// block after the last one in the pollard, and match the roots, and the tx
+// has to be valid.
+func (c *Csn) CheckUTx(utx *uwire.UTx) error {
+	c.pollardMtx.Lock()
+	defer c.pollardMtx.Unlock()
+	_, err := c.checkUTx(utx)
+	return err
+}
+
+// checkUTx is CheckUTx without locking pollardMtx.  It gives back the
+// verified proof so it can be put in the pollard.
+func (c *Csn) checkUTx(
+	utx *uwire.UTx) (*accumulator.VerifiedProof, error) {
+
+	if utx.UtreexoData.Height != c.pollardHeight {
+		return nil, fmt.Errorf("tx %s proof is for block %d, pollard is at %d",
+			utx.Tx.TxHash().String(), utx.UtreexoData.Height, c.pollardHeight)
+	}
+	nl, h := c.pollard.ReconstructStats()
+	err := utx.ProofSanity(nl, h)
+	if err != nil {
+		return nil, err
+	}
+	vp, err := c.pollard.VerifyBatchProof(utx.UtreexoData.AccProof)
+	if err != nil {
+		return nil, fmt.Errorf("tx %s: %s",
+			utx.Tx.TxHash().String(), err.Error())
+	}
+	// amounts and such get checked even without CheckSignatures
+	err = utx.CheckTx(&c.Params, c.CheckSignatures)
+	if err != nil {
+		return nil, err
+	}
+	return vp, nil
+}
+
+// RelayUTx puts a UTx in the mempool and sends it to the bridge node,
+// which relays it to other CSNs.
+func (c *Csn) RelayUTx(utx *uwire.UTx) error {
+	err := c.AcceptToMempool(utx)
+	if err != nil {
+		return err
+	}
+	return uwire.PushUTx(c.remoteHost, utx)
+}
+
+// PushTx broadcasts a wallet tx.  It goes in the mempool with proofs for its
+// inputs, and gets sent to the bridge node along with the rest of the
+// mempool once IBD catches up to it.
+func (c *Csn) PushTx(tx *wire.MsgTx) error {
+	utx, err := c.MakeUTx(tx)
+	if err != nil {
+		return err
+	}
+	return c.AcceptToMempool(utx)
+}
+
+// GetRelayedUTxs gets the UTxs the bridge node is relaying, puts the ones
+// that check out in the mempool and gives those back.
+func (c *Csn) GetRelayedUTxs() ([]uwire.UTx, error) {
+	utxs, err := uwire.GetUTxs(c.remoteHost)
+	if err != nil {
+		return nil, err
+	}
+	good := utxs[:0]
+	for i := range utxs {
+		err = c.AcceptToMempool(&utxs[i])
+		if err != nil {
+			fmt.Printf("relayed %s\n", err.Error())
+			continue
+		}
+		good = append(good, utxs[i])
+	}
+	return good, nil
+}
+
+// relayTxs sends everything in the mempool to the bridge node, and takes
+// the txs it's relaying from other CSNs.  The bridge node only takes txs
+// proven against the roots at its tip, so this is for once IBD has caught
+// up to it.
+func (c *Csn) relayTxs() {
+	var sent int
+	for _, utx := range c.MempoolTxs() {
+		err := c.RelayUTx(&utx)
+		if err != nil {
+			fmt.Printf("relay tx %s: %s\n",
+				utx.Tx.TxHash().String(), err.Error())
+			continue
+		}
+		sent++
+	}
+	got, err := c.GetRelayedUTxs()
+	if err != nil {
+		fmt.Printf("getting relayed txs: %s\n", err.Error())
+	}
+	fmt.Printf("sent %d txs to %s, took %d from it\n",
+		sent, c.remoteHost, len(got))
+}
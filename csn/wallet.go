@@ -0,0 +1,113 @@
+package csn
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
+)
+
+/*
+The pollard only remembers leaves that are spent within Lookahead blocks,
+so left alone it would forget the wallet's own utxos and the wallet couldn't
+prove its coins to anyone.  To keep them, outputs paying to a watched script
+are always added with Remember set, whatever their TTL.  The pollard keeps
+remembered leaves until they're deleted, so from then on WalletProof can
+prove them against the current roots.
+
+utxos found before this (saved without their height and PkScript) can't be
+proven; the leaf hash can't be rebuilt for them.
+*/
+
+// walletLeaf gives the LeafData of output i of tx, the same way
+// BlockToAddLeaves makes it, so its LeafHash is the leaf in the pollard.
+func walletLeaf(
+	tx *wire.MsgTx, coinbase bool, i int, height int32) btcacc.LeafData {
+
+	return btcacc.LeafData{
+		TxHash:   btcacc.Hash(tx.TxHash()),
+		Index:    uint32(i),
+		Height:   height,
+		Coinbase: coinbase,
+		Amt:      tx.TxOut[i].Value,
+		PkScript: tx.TxOut[i].PkScript,
+	}
+}
+
+// pinWalletLeaves sets Remember on the leaves in adds that pay to watched
+// scripts.  adds are the leaves BlockToAddLeaves made for blk.
+func (c *Csn) pinWalletLeaves(
+	blk *wire.MsgBlock, height int32, adds []accumulator.Leaf) {
+
+	if len(c.WatchScripts) == 0 {
+		return
+	}
+	mine := make(map[accumulator.Hash]bool)
+	for txInBlock, tx := range blk.Transactions {
+		for i, out := range tx.TxOut {
+			if util.IsUnspendable(out) || !c.WatchScripts[string(out.PkScript)] {
+				continue
+			}
+			l := walletLeaf(tx, txInBlock == 0, i, height)
+			mine[l.LeafHash()] = true
+		}
+	}
+	if len(mine) == 0 {
+		return
+	}
+	for i := range adds {
+		if mine[adds[i].Hash] {
+			adds[i].Remember = true
+		}
+	}
+}
+
+// WalletProof gives a proof for wallet utxos against the current pollard
+// roots, along with their LeafData in the same order as the proof targets.
+func (c *Csn) WalletProof(
+	ops []wire.OutPoint) (accumulator.BatchProof, []btcacc.LeafData, error) {
+
+	c.pollardMtx.Lock()
+	defer c.pollardMtx.Unlock()
+	return c.walletProof(ops)
+}
+
+// walletProof is WalletProof without locking pollardMtx
+func (c *Csn) walletProof(
+	ops []wire.OutPoint) (accumulator.BatchProof, []btcacc.LeafData, error) {
+
+	leaves := make([]btcacc.LeafData, len(ops))
+	hashes := make([]accumulator.Hash, len(ops))
+	for i, op := range ops {
+		l, ok := c.utxoStore[op]
+		if !ok {
+			return accumulator.BatchProof{}, nil,
+				fmt.Errorf("%s isn't a wallet utxo", op.String())
+		}
+		if l.PkScript == nil {
+			return accumulator.BatchProof{}, nil,
+				fmt.Errorf("%s was found before wallet proofs, can't prove it",
+					op.String())
+		}
+		leaves[i] = l
+		hashes[i] = l.LeafHash()
+	}
+	bp, err := c.pollard.ProveBatch(hashes)
+	if err != nil {
+		return accumulator.BatchProof{}, nil, err
+	}
+	return bp, leaves, nil
+}
+
+// ProveLeaves gives a proof for any leaves the pollard remembers, the
+// wallet's or not, so they can be given to peers.  If some can't be
+// proven the error is an *accumulator.MissingProofError saying which.
+func (c *Csn) ProveLeaves(
+	hs []accumulator.Hash) (accumulator.BatchProof, error) {
+
+	c.pollardMtx.Lock()
+	defer c.pollardMtx.Unlock()
+	return c.pollard.ProveBatch(hs)
+}
@@ -0,0 +1,137 @@
+package csn
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// walletTest puts the same blocks in a csn watching a script and one that
+// isn't, both with a short lookahead, and a full pollard to make proofs
+type walletTest struct {
+	t        *testing.T
+	wallet   *Csn
+	noWallet *Csn
+	full     accumulator.Pollard
+	prev     chainhash.Hash
+	height   int32
+}
+
+func newWalletTest(t *testing.T, watched []byte) *walletTest {
+	wt := &walletTest{t: t, full: accumulator.NewFullPollard(), height: 1}
+	for _, c := range []**Csn{&wt.wallet, &wt.noWallet} {
+		*c = testCsn("")
+		(*c).pollard.Lookahead = 2
+		(*c).WatchOPs = make(map[wire.OutPoint]bool)
+		(*c).utxoStore = make(map[wire.OutPoint]btcacc.LeafData)
+		(*c).TxChan = make(chan wire.MsgTx, 10)
+	}
+	wt.wallet.RegisterScript(watched)
+	return wt
+}
+
+// block mines a block with txs, spending the txos in spent, and puts it in
+// both csns.  Everything it makes is spent ttl blocks later.
+func (wt *walletTest) block(
+	ttl int32, spent []btcacc.LeafData, txs ...*wire.MsgTx) wire.MsgBlock {
+
+	blk := mineBlock(wt.t, wt.prev, wt.height, txs...)
+	var hs []accumulator.Hash
+	for _, l := range spent {
+		hs = append(hs, l.LeafHash())
+	}
+	bp, err := wt.full.ProveBatch(hs)
+	if err != nil {
+		wt.t.Fatal(err)
+	}
+	inskip, outskip := util.DedupeBlock(&blk)
+	ub := uwire.UBlock{Block: blk, UtreexoData: btcacc.UData{
+		Height:   wt.height,
+		AccProof: bp,
+		Stxos:    spent,
+	}}
+	for range uwire.BlockToAddLeaves(blk, nil, outskip, wt.height) {
+		ub.UtreexoData.TxoTTLs = append(ub.UtreexoData.TxoTTLs, ttl)
+	}
+	for _, c := range []*Csn{wt.wallet, wt.noWallet} {
+		var adds, dels int
+		err = c.putBlockInPollard(
+			checkedBlock{ub: ub, inskip: inskip, outskip: outskip},
+			&adds, &dels, 0)
+		if err != nil {
+			wt.t.Fatal(err)
+		}
+		c.CurrentHeight = wt.height
+		c.ScanBlock(blk)
+	}
+	err = wt.full.Modify(
+		uwire.BlockToAddLeaves(blk, nil, outskip, wt.height), bp.Targets)
+	if err != nil {
+		wt.t.Fatal(err)
+	}
+	wt.prev = blk.BlockHash()
+	wt.height++
+	return blk
+}
+
+// TestWalletProof checks that a wallet output stays provable after the
+// lookahead would have forgotten it, and is gone once it's spent
+func TestWalletProof(t *testing.T) {
+	watched := []byte{txscript.OP_TRUE, txscript.OP_TRUE}
+	wt := newWalletTest(t, watched)
+	cb := wt.block(2, nil)
+	cbLeaf := walletLeaf(cb.Transactions[0], true, 0, 1)
+	// a lone leaf has no proof
+	wt.block(100, nil)
+
+	// pays to the wallet, and isn't spent for a long time
+	pay := spendTx(outPoint(cbLeaf), 40e8, watched)
+	wt.block(100, []btcacc.LeafData{cbLeaf}, pay)
+	op := wire.OutPoint{Hash: pay.TxHash(), Index: 0}
+	leaf := walletLeaf(pay, false, 0, 3)
+	for i := 0; i < 10; i++ {
+		wt.block(100, nil)
+	}
+
+	bp, lds, err := wt.wallet.WalletProof([]wire.OutPoint{op})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lds) != 1 || lds[0].LeafHash() != leaf.LeafHash() {
+		t.Fatalf("proof for %v, expected %s", lds, leaf.ToString())
+	}
+	_, err = wt.wallet.pollard.VerifyBatchProof(bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without the wallet it's forgotten
+	_, err = wt.noWallet.ProveLeaves([]accumulator.Hash{leaf.LeafHash()})
+	if err == nil {
+		t.Fatal("lookahead remembered a txo spent 100 blocks later")
+	}
+
+	// once it's spent it's not the wallet's, and the pollard lets it go
+	wt.block(100, []btcacc.LeafData{leaf}, spendTx(op, 30e8, opTrue))
+	_, _, err = wt.wallet.WalletProof([]wire.OutPoint{op})
+	if err == nil {
+		t.Fatal("proved a wallet utxo that's spent")
+	}
+	_, err = wt.wallet.ProveLeaves([]accumulator.Hash{leaf.LeafHash()})
+	if err == nil {
+		t.Fatal("pollard still has a spent wallet txo")
+	}
+	if len(wt.wallet.utxoStore) != 0 {
+		t.Fatalf("wallet has %d utxos after spending", len(wt.wallet.utxoStore))
+	}
+}
+
+// outPoint gives the outpoint of the txo l is for
+func outPoint(l btcacc.LeafData) wire.OutPoint {
+	return wire.OutPoint{Hash: chainhash.Hash(l.TxHash), Index: l.Index}
+}
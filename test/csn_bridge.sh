@@ -182,7 +182,8 @@ compare_proofs() {
 	eval "$GENPROOFS -datadir=$BITCOIN_DATA/ -net=regtest -bridgedir=$STOP_DIR -quitat=150 -noserve> /dev/null"
 	eval "$GENPROOFS -datadir=$BITCOIN_DATA/ -net=regtest -bridgedir=$STOP_DIR -quitat=200 -noserve> /dev/null"
 
-	if cmp -s $NOSTOP_DIR/regtest/proofdata/proof.dat $STOP_DIR/regtest/proofdata/proof.dat; then
+	# every proof file and proofoffset.dat, and no more files in one
+	if diff -rq $NOSTOP_DIR/regtest/proofdata $STOP_DIR/regtest/proofdata > /dev/null; then
 		log "proofs match up"
 	else
 		log "Proof mismatch"
@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
 
 	"github.com/btcsuite/btcd/chaincfg"
@@ -49,7 +50,12 @@ func GenHashForNet(p chaincfg.Params) (*Hash, error) {
 	case "regtest":
 		return &regTestGenHash, nil
 	}
-	return nil, fmt.Errorf("net not supported")
+	// signet and networks from a params file
+	if p.GenesisHash != nil {
+		h := Hash(*p.GenesisHash)
+		return &h, nil
+	}
+	return nil, fmt.Errorf("net %s not supported", p.Name)
 }
 
 // HashFromString hashes the given string with sha256
@@ -173,13 +179,11 @@ func PopPrefixLen16(b []byte) ([]byte, []byte, error) {
 	return payload[:l], payload[l:], nil
 }
 
-// CheckMagicByte checks for the Bitcoin magic bytes.
-// returns false if it didn't read the Bitcoin magic bytes.
-// Checks only for testnet3 and mainnet
-func CheckMagicByte(bytesgiven []byte) bool {
-	if bytes.Compare(bytesgiven, []byte{0x0b, 0x11, 0x09, 0x07}) != 0 && //testnet
-		bytes.Compare(bytesgiven, []byte{0xf9, 0xbe, 0xb4, 0xd9}) != 0 && // mainnet
-		bytes.Compare(bytesgiven, []byte{0xfa, 0xbf, 0xb5, 0xda}) != 0 { // regtest
+// CheckMagicByte checks for the magic bytes of network net.
+// returns false if it didn't read the magic bytes.
+func CheckMagicByte(bytesgiven []byte, net wire.BitcoinNet) bool {
+	if len(bytesgiven) < 4 ||
+		binary.LittleEndian.Uint32(bytesgiven) != uint32(net) {
 		fmt.Printf("got non magic bytes %x, finishing\n", bytesgiven)
 		return false
 	}
@@ -199,6 +203,52 @@ func HasAccess(fileName string) bool {
 	return true
 }
 
+// WriteFileAtomic writes data to a file so that after a crash, the file is
+// either all the old data or all the new data.  It writes to a temp file,
+// fsyncs it, renames it over the old one and then fsyncs the directory so
+// the rename sticks.
+func WriteFileAtomic(fileName string, data []byte, perm os.FileMode) error {
+	tmpName := fileName + ".tmp"
+	f, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpName, fileName)
+	if err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(fileName))
+}
+
+// SyncDir fsyncs a directory, so that files created or renamed in it are
+// still there after a crash.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
 //IsUnspendable determines whether a tx is spendable or not.
 //returns true if spendable, false if unspendable.
 func IsUnspendable(o *wire.TxOut) bool {
@@ -0,0 +1,111 @@
+package wire
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// noHeight is used for soft forks that aren't known to be active on a network
+const noHeight = math.MaxInt32
+
+// deployments holds the heights at which script related soft forks started
+// being enforced on a network.  These are the buried deployment heights
+// that Bitcoin Core uses, so blocks are checked with the same flags Core
+// would check them with.
+type deployments struct {
+	// bip16Exception is the one historical block that violates P2SH.
+	// Core leaves P2SH (and witness) on for every other block.
+	bip16ExceptionHeight int32
+	bip16Exception       *chainhash.Hash
+
+	bip66Height   int32 // DERSIG
+	bip65Height   int32 // CHECKLOCKTIMEVERIFY
+	csvHeight     int32 // CHECKSEQUENCEVERIFY (bip68, 112, 113)
+	segwitHeight  int32 // NULLDUMMY comes in with segwit
+	taprootHeight int32
+}
+
+// newHashFromStr is chainhash.NewHashFromStr for hardcoded hashes
+func newHashFromStr(s string) *chainhash.Hash {
+	h, err := chainhash.NewHashFromStr(s)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// deploymentTable gives the deployments for each network we know of
+var deploymentTable = map[wire.BitcoinNet]deployments{
+	wire.MainNet: {
+		bip16ExceptionHeight: 170060,
+		bip16Exception: newHashFromStr(
+			"00000000000002dc756eebf4f49723ed8d30cc28a5f108eb94b1ba88ac4f9c22"),
+		bip66Height:   363725,
+		bip65Height:   388381,
+		csvHeight:     419328,
+		segwitHeight:  481824,
+		taprootHeight: 709632,
+	},
+	wire.TestNet3: {
+		bip16ExceptionHeight: 514,
+		bip16Exception: newHashFromStr(
+			"00000000dd30457c001f4095d208cc1296b0eed002427aa599874af7a432b105"),
+		bip66Height:  330776,
+		bip65Height:  581885,
+		csvHeight:    770112,
+		segwitHeight: 834624,
+		// taproot was a bip9 deployment on testnet3 and never got buried
+		taprootHeight: noHeight,
+	},
+	wire.TestNet: { // regtest
+		// buried at 1 since Core v23.  Before that they were at 1251,
+		// 1351 and 432
+		bip16ExceptionHeight: -1,
+		bip66Height:          1,
+		bip65Height:          1,
+		csvHeight:            1,
+		segwitHeight:         0,
+		taprootHeight:        0,
+	},
+}
+
+// ScriptFlags returns the script verification flags for a block at the
+// given height on network p.  blockHash is only looked at for the bip16
+// exception block.
+//
+// Taproot heights are in the table but aren't turned into flags, as the
+// btcd script engine we use doesn't know about bip341/342.  Until it does,
+// segwit v1 spends pass as anyone-can-spend, which is how pre-taproot
+// nodes see them too.
+func ScriptFlags(p *chaincfg.Params, height int32,
+	blockHash chainhash.Hash) (txscript.ScriptFlags, error) {
+
+	d, ok := deploymentTable[p.Net]
+	if !ok {
+		return 0, fmt.Errorf("no deployment heights for network %s", p.Name)
+	}
+
+	var flags txscript.ScriptFlags
+	if height != d.bip16ExceptionHeight || !d.bip16Exception.IsEqual(&blockHash) {
+		flags |= txscript.ScriptBip16 | txscript.ScriptVerifyWitness
+	}
+	if height >= d.bip66Height {
+		flags |= txscript.ScriptVerifyDERSignatures
+	}
+	if height >= d.bip65Height {
+		flags |= txscript.ScriptVerifyCheckLockTimeVerify
+	}
+	if height >= d.csvHeight {
+		flags |= txscript.ScriptVerifyCheckSequenceVerify
+	}
+	if height >= d.segwitHeight {
+		// ScriptStrictMultiSig is what btcd calls NULLDUMMY
+		flags |= txscript.ScriptStrictMultiSig
+	}
+	return flags, nil
+}
@@ -0,0 +1,70 @@
+package wire
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+func TestScriptFlags(t *testing.T) {
+	const (
+		p2sh    = txscript.ScriptBip16 | txscript.ScriptVerifyWitness
+		dersig  = txscript.ScriptVerifyDERSignatures
+		cltv    = txscript.ScriptVerifyCheckLockTimeVerify
+		csv     = txscript.ScriptVerifyCheckSequenceVerify
+		dummy   = txscript.ScriptStrictMultiSig
+		regtest = p2sh | dersig | cltv | csv | dummy
+	)
+	exception := *deploymentTable[chaincfg.MainNetParams.Net].bip16Exception
+	tests := []struct {
+		params *chaincfg.Params
+		height int32
+		hash   chainhash.Hash
+		want   txscript.ScriptFlags
+	}{
+		{&chaincfg.MainNetParams, 1, chainhash.Hash{}, p2sh},
+		{&chaincfg.MainNetParams, 170060, exception, 0},
+		{&chaincfg.MainNetParams, 170060, chainhash.Hash{1}, p2sh},
+		{&chaincfg.MainNetParams, 363724, chainhash.Hash{}, p2sh},
+		{&chaincfg.MainNetParams, 363725, chainhash.Hash{}, p2sh | dersig},
+		{&chaincfg.MainNetParams, 388380, chainhash.Hash{}, p2sh | dersig},
+		{&chaincfg.MainNetParams, 388381, chainhash.Hash{},
+			p2sh | dersig | cltv},
+		{&chaincfg.MainNetParams, 419327, chainhash.Hash{},
+			p2sh | dersig | cltv},
+		{&chaincfg.MainNetParams, 419328, chainhash.Hash{},
+			p2sh | dersig | cltv | csv},
+		{&chaincfg.MainNetParams, 481823, chainhash.Hash{},
+			p2sh | dersig | cltv | csv},
+		{&chaincfg.MainNetParams, 481824, chainhash.Hash{},
+			p2sh | dersig | cltv | csv | dummy},
+		{&chaincfg.TestNet3Params, 330775, chainhash.Hash{}, p2sh},
+		{&chaincfg.TestNet3Params, 330776, chainhash.Hash{}, p2sh | dersig},
+		{&chaincfg.TestNet3Params, 834623, chainhash.Hash{},
+			p2sh | dersig | cltv | csv},
+		{&chaincfg.TestNet3Params, 834624, chainhash.Hash{},
+			p2sh | dersig | cltv | csv | dummy},
+		// everything's on from the start on regtest
+		{&chaincfg.RegressionNetParams, 0, chainhash.Hash{}, p2sh | dummy},
+		{&chaincfg.RegressionNetParams, 1, chainhash.Hash{}, regtest},
+		{&chaincfg.RegressionNetParams, 432, chainhash.Hash{}, regtest},
+		{&chaincfg.RegressionNetParams, 1351, chainhash.Hash{}, regtest},
+	}
+	for _, test := range tests {
+		got, err := ScriptFlags(test.params, test.height, test.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%s height %d: flags %x, expected %x",
+				test.params.Name, test.height, got, test.want)
+		}
+	}
+
+	_, err := ScriptFlags(&chaincfg.SimNetParams, 1, chainhash.Hash{})
+	if err == nil {
+		t.Fatal("flags for a network with no deployment heights")
+	}
+}
@@ -0,0 +1,284 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+/*
+The btcd we use knows about mainnet, testnet3 and regtest.  Signet (bip325)
+is here, along with networks that aren't built in at all, which are read
+from a json params file like
+
+{
+  "name": "mysignet",
+  "base": "signet",
+  "signetchallenge": "5121...52ae",
+  "magic": "0a03cf40",
+  "genesis": "00000008819873e925422c1ff0f99f7cc9bbb232af63a077a480a3633bee1ef6",
+  "powlimit": "00000377ae000000000000000000000000000000000000000000000000000000",
+  "bip66height": 1,
+  "bip65height": 1,
+  "csvheight": 1,
+  "segwitheight": 1,
+  "taprootheight": 0
+}
+
+Everything but name and base is optional and comes from the base network
+if not given.  A signet's magic comes from its challenge, same as in
+Bitcoin Core, so a private signet only needs name, base and
+signetchallenge.  magic is the 4 bytes at the start of each block in the
+blk files, in the order they're in there.
+*/
+
+// defaultSignetChallenge is the 1 of 2 multisig the public signet uses
+var defaultSignetChallenge, _ = hex.DecodeString(
+	"512103ad5e0edad18cb1f0fc0d28a3d4f1f3e445640337489abb10404f2d1e086be4" +
+		"30210359ef5021964fe22d6f8e05b2463c9540ce96883fe3b278760f048f5189f2e6" +
+		"c452ae")
+
+// sigNetGenesisBlock is the same for every signet.  It has mainnet's
+// coinbase, but a different time, nonce and difficulty.
+var sigNetGenesisBlock = wire.MsgBlock{
+	Header: wire.BlockHeader{
+		Version:    1,
+		MerkleRoot: chaincfg.MainNetParams.GenesisBlock.Header.MerkleRoot,
+		Timestamp:  time.Unix(1598918400, 0),
+		Bits:       0x1e0377ae,
+		Nonce:      52613770,
+	},
+	Transactions: chaincfg.MainNetParams.GenesisBlock.Transactions,
+}
+
+var sigNetGenesisHash = sigNetGenesisBlock.BlockHash()
+
+// SigNetParams are the params of the public signet
+var SigNetParams = newSigNetParams("signet", defaultSignetChallenge)
+
+// signetChallenges has the challenge for each signet we know of.  The
+// blocks of these networks are checked against it.
+var signetChallenges = map[wire.BitcoinNet][]byte{
+	SigNetParams.Net: defaultSignetChallenge,
+}
+
+// bitcoindDirs is the directory in bitcoind's datadir for each network
+var bitcoindDirs = map[wire.BitcoinNet]string{
+	wire.MainNet:     "",
+	wire.TestNet3:    "testnet3",
+	wire.TestNet:     "regtest",
+	SigNetParams.Net: "signet",
+}
+
+// signetMagic is the magic of a signet, which is the first 4 bytes of the
+// double sha256 of the challenge (serialized with its length)
+func signetMagic(challenge []byte) wire.BitcoinNet {
+	var buf bytes.Buffer
+	wire.WriteVarBytes(&buf, 0, challenge)
+	h := chainhash.DoubleHashB(buf.Bytes())
+	return wire.BitcoinNet(binary.LittleEndian.Uint32(h[:4]))
+}
+
+// newSigNetParams makes the params for a signet.  Bitcoin Core buries all
+// the soft forks at block 1 on signet, and has taproot on from the start.
+func newSigNetParams(name string, challenge []byte) chaincfg.Params {
+	p := chaincfg.TestNet3Params
+	p.Name = name
+	p.Net = signetMagic(challenge)
+	p.DefaultPort = "38333"
+	p.DNSSeeds = nil
+	p.GenesisBlock = &sigNetGenesisBlock
+	p.GenesisHash = &sigNetGenesisHash
+	p.PowLimit, _ = new(big.Int).SetString(
+		"00000377ae000000000000000000000000000000000000000000000000000000", 16)
+	p.PowLimitBits = 0x1e0377ae
+	p.BIP0034Height = 1
+	p.BIP0065Height = 1
+	p.BIP0066Height = 1
+	p.ReduceMinDifficulty = false
+	p.MinDiffReductionTime = 0
+	p.Checkpoints = nil
+
+	deploymentTable[p.Net] = deployments{
+		bip16ExceptionHeight: -1,
+		bip66Height:          1,
+		bip65Height:          1,
+		csvHeight:            1,
+		segwitHeight:         1,
+		taprootHeight:        0,
+	}
+	return p
+}
+
+// NetParams gives the params for the network called net, or for the one in
+// paramsFile if it's not empty.  net can be mainnet, testnet, regtest or
+// signet.
+func NetParams(net, paramsFile string) (*chaincfg.Params, error) {
+	if paramsFile != "" {
+		return LoadParamsFile(paramsFile)
+	}
+	switch net {
+	case "mainnet":
+		return &chaincfg.MainNetParams, nil
+	case "testnet":
+		return &chaincfg.TestNet3Params, nil
+	case "regtest":
+		return &chaincfg.RegressionNetParams, nil
+	case "signet":
+		return &SigNetParams, nil
+	}
+	return nil, fmt.Errorf("unknown network %s", net)
+}
+
+// BitcoindDir is the directory bitcoind keeps network p in, inside its
+// datadir.  It's empty for mainnet, which is right in the datadir.
+func BitcoindDir(p *chaincfg.Params) string {
+	return bitcoindDirs[p.Net]
+}
+
+// paramsFile is what's in a params file.  Pointers are nil if not given.
+type paramsFile struct {
+	Name            string `json:"name"`
+	Base            string `json:"base"`
+	SignetChallenge string `json:"signetchallenge"`
+	Magic           string `json:"magic"`
+	Genesis         string `json:"genesis"`
+	PowLimit        string `json:"powlimit"`
+
+	BIP66Height   *int32 `json:"bip66height"`
+	BIP65Height   *int32 `json:"bip65height"`
+	CSVHeight     *int32 `json:"csvheight"`
+	SegwitHeight  *int32 `json:"segwitheight"`
+	TaprootHeight *int32 `json:"taprootheight"`
+}
+
+// LoadParamsFile reads the network in a json params file, and registers
+// its deployment heights (and signet challenge, if it has one) so that
+// its blocks can be checked.
+func LoadParamsFile(path string) (*chaincfg.Params, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pf paramsFile
+	err = json.Unmarshal(b, &pf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	p, err := pf.params()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return p, nil
+}
+
+// params turns the params file into chaincfg.Params
+func (pf *paramsFile) params() (*chaincfg.Params, error) {
+	switch pf.Name {
+	case "":
+		return nil, fmt.Errorf("no name")
+	case "mainnet", "testnet3", "regtest", "signet":
+		return nil, fmt.Errorf("name %s is taken by a built in network",
+			pf.Name)
+	}
+
+	var challenge []byte
+	if pf.SignetChallenge != "" {
+		if pf.Base != "signet" {
+			return nil, fmt.Errorf("signetchallenge needs base signet")
+		}
+		var err error
+		challenge, err = hex.DecodeString(pf.SignetChallenge)
+		if err != nil {
+			return nil, fmt.Errorf("signetchallenge: %s", err.Error())
+		}
+	}
+
+	var p chaincfg.Params
+	switch pf.Base {
+	case "mainnet":
+		p = chaincfg.MainNetParams
+	case "testnet":
+		p = chaincfg.TestNet3Params
+	case "regtest":
+		p = chaincfg.RegressionNetParams
+	case "signet":
+		if challenge == nil {
+			challenge = defaultSignetChallenge
+		}
+		p = newSigNetParams(pf.Name, challenge)
+		// bitcoind keeps every signet in the same place
+		bitcoindDirs[p.Net] = "signet"
+	default:
+		return nil, fmt.Errorf("base %q isn't mainnet, testnet, regtest "+
+			"or signet", pf.Base)
+	}
+	p.Name = pf.Name
+	d := deploymentTable[p.Net]
+	dataDir := bitcoindDirs[p.Net]
+
+	if pf.Magic != "" {
+		magic, err := hex.DecodeString(pf.Magic)
+		if err != nil || len(magic) != 4 {
+			return nil, fmt.Errorf("magic %s isn't 4 hex bytes", pf.Magic)
+		}
+		p.Net = wire.BitcoinNet(binary.LittleEndian.Uint32(magic))
+	}
+	if pf.Genesis != "" {
+		hash, err := chainhash.NewHashFromStr(pf.Genesis)
+		if err != nil {
+			return nil, fmt.Errorf("genesis: %s", err.Error())
+		}
+		if !hash.IsEqual(p.GenesisHash) {
+			// we only have the hash, not the block
+			p.GenesisBlock = nil
+		}
+		p.GenesisHash = hash
+	}
+	if pf.PowLimit != "" {
+		powLimit, ok := new(big.Int).SetString(pf.PowLimit, 16)
+		if !ok {
+			return nil, fmt.Errorf("powlimit %s isn't hex", pf.PowLimit)
+		}
+		p.PowLimit = powLimit
+		p.PowLimitBits = blockchain.BigToCompact(powLimit)
+	}
+
+	if pf.BIP66Height != nil {
+		d.bip66Height = *pf.BIP66Height
+	}
+	if pf.BIP65Height != nil {
+		d.bip65Height = *pf.BIP65Height
+	}
+	if pf.CSVHeight != nil {
+		d.csvHeight = *pf.CSVHeight
+	}
+	if pf.SegwitHeight != nil {
+		d.segwitHeight = *pf.SegwitHeight
+	}
+	if pf.TaprootHeight != nil {
+		d.taprootHeight = *pf.TaprootHeight
+	}
+	if p.Net != wire.MainNet && p.Net != wire.TestNet3 {
+		// the bip16 exception block is only on the real mainnet and testnet
+		d.bip16ExceptionHeight = -1
+		d.bip16Exception = nil
+	}
+
+	deploymentTable[p.Net] = d
+	bitcoindDirs[p.Net] = dataDir
+	if challenge != nil {
+		signetChallenges[p.Net] = challenge
+	}
+	return &p, nil
+}
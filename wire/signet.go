@@ -0,0 +1,223 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+/*
+Signet blocks are signed (bip325).  The solution goes in the coinbase's
+witness commitment output, as a push that starts with signetHeader after
+the commitment.  It's a scriptSig and a witness, which have to satisfy the
+network's challenge script when spending a made up tx that commits to the
+block.  The tx that spends it is made up too; the block data it signs is
+the header with a merkle root of the block without the solution in it.
+*/
+
+// signetHeader starts the push with the solution in it
+var signetHeader = []byte{0xec, 0xc7, 0xda, 0xa2}
+
+// signetFlags are the script flags the solution is checked with
+const signetFlags = txscript.ScriptBip16 | txscript.ScriptVerifyWitness |
+	txscript.ScriptVerifyDERSignatures | txscript.ScriptStrictMultiSig
+
+// CheckSignetSolution checks that a block is signed with the challenge of
+// network p.  It does nothing for networks that aren't signets.
+func CheckSignetSolution(blk *wire.MsgBlock, p *chaincfg.Params) error {
+	challenge, ok := signetChallenges[p.Net]
+	if !ok {
+		return nil
+	}
+	hash := blk.BlockHash()
+	if hash.IsEqual(p.GenesisHash) {
+		return nil
+	}
+	if len(blk.Transactions) == 0 {
+		return fmt.Errorf("signet block %s has no coinbase", hash.String())
+	}
+
+	cb := blk.Transactions[0].Copy()
+	cidx := -1
+	for i := len(cb.TxOut) - 1; i >= 0; i-- {
+		pkScript := cb.TxOut[i].PkScript
+		if len(pkScript) >= blockchain.CoinbaseWitnessPkScriptLength &&
+			bytes.HasPrefix(pkScript, blockchain.WitnessMagicBytes) {
+			cidx = i
+			break
+		}
+	}
+	if cidx == -1 {
+		return fmt.Errorf("signet block %s has no witness commitment",
+			hash.String())
+	}
+
+	toSign := wire.NewMsgTx(0)
+	toSign.AddTxIn(&wire.TxIn{})
+	toSign.AddTxOut(wire.NewTxOut(0, []byte{txscript.OP_RETURN}))
+
+	// with no solution it's an empty scriptSig and witness, which is OK if
+	// the challenge is something like OP_TRUE
+	cleared, solution, found := clearSignetSolution(cb.TxOut[cidx].PkScript)
+	if found {
+		cb.TxOut[cidx].PkScript = cleared
+		r := bytes.NewReader(solution)
+		sigScript, err := wire.ReadVarBytes(
+			r, 0, uint32(len(solution)), "signet scriptSig")
+		if err != nil {
+			return fmt.Errorf("signet block %s: %s", hash.String(), err.Error())
+		}
+		toSign.TxIn[0].SignatureScript = sigScript
+		n, err := wire.ReadVarInt(r, 0)
+		if err != nil {
+			return fmt.Errorf("signet block %s: %s", hash.String(), err.Error())
+		}
+		if n > uint64(len(solution)) {
+			return fmt.Errorf("signet block %s: %d witness items in %d bytes",
+				hash.String(), n, len(solution))
+		}
+		for i := uint64(0); i < n; i++ {
+			item, err := wire.ReadVarBytes(
+				r, 0, uint32(len(solution)), "signet witness")
+			if err != nil {
+				return fmt.Errorf("signet block %s: %s",
+					hash.String(), err.Error())
+			}
+			toSign.TxIn[0].Witness = append(toSign.TxIn[0].Witness, item)
+		}
+		if r.Len() != 0 {
+			return fmt.Errorf("signet block %s: %d extra bytes after solution",
+				hash.String(), r.Len())
+		}
+	}
+
+	// merkle root of the block with the solution taken out
+	txs := make([]*btcutil.Tx, len(blk.Transactions))
+	txs[0] = btcutil.NewTx(cb)
+	for i := 1; i < len(txs); i++ {
+		txs[i] = btcutil.NewTx(blk.Transactions[i])
+	}
+	merkles := blockchain.BuildMerkleTreeStore(txs, false)
+	root := merkles[len(merkles)-1]
+
+	// version, prev block, merkle root and time, pushed after an OP_0
+	blockData := make([]byte, 0, 2+72)
+	blockData = append(blockData, txscript.OP_0, txscript.OP_DATA_72)
+	blockData = appendUint32(blockData, uint32(blk.Header.Version))
+	blockData = append(blockData, blk.Header.PrevBlock[:]...)
+	blockData = append(blockData, root[:]...)
+	blockData = appendUint32(blockData, uint32(blk.Header.Timestamp.Unix()))
+
+	toSpend := wire.NewMsgTx(0)
+	toSpend.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+		SignatureScript:  blockData,
+	})
+	toSpend.AddTxOut(wire.NewTxOut(0, challenge))
+	toSign.TxIn[0].PreviousOutPoint = wire.OutPoint{Hash: toSpend.TxHash()}
+
+	vm, err := txscript.NewEngine(challenge, toSign, 0, signetFlags,
+		nil, txscript.NewTxSigHashes(toSign), 0)
+	if err == nil {
+		err = vm.Execute()
+	}
+	if err != nil {
+		return fmt.Errorf("signet block %s bad solution: %s",
+			hash.String(), err.Error())
+	}
+	return nil
+}
+
+// clearSignetSolution finds the push in the witness commitment script that
+// starts with the signet header and has something after it.  It gives the
+// script with only the header left in that push, and what was after the
+// header.  Pushes are written back the way Bitcoin Core writes them, so the
+// script comes out the same as it does there.
+func clearSignetSolution(script []byte) (
+	cleared, solution []byte, found bool) {
+
+	for pc := 0; pc < len(script); {
+		op := script[pc]
+		pc++
+		if op > txscript.OP_PUSHDATA4 {
+			cleared = append(cleared, op)
+			continue
+		}
+		var n int
+		switch op {
+		case txscript.OP_PUSHDATA1:
+			if pc+1 > len(script) {
+				return cleared, solution, found
+			}
+			n = int(script[pc])
+			pc++
+		case txscript.OP_PUSHDATA2:
+			if pc+2 > len(script) {
+				return cleared, solution, found
+			}
+			n = int(binary.LittleEndian.Uint16(script[pc:]))
+			pc += 2
+		case txscript.OP_PUSHDATA4:
+			if pc+4 > len(script) {
+				return cleared, solution, found
+			}
+			n = int(binary.LittleEndian.Uint32(script[pc:]))
+			pc += 4
+		default:
+			n = int(op)
+		}
+		if n < 0 || pc+n > len(script) {
+			return cleared, solution, found
+		}
+		data := script[pc : pc+n]
+		pc += n
+
+		if len(data) == 0 {
+			cleared = append(cleared, op)
+			continue
+		}
+		if !found && len(data) > len(signetHeader) &&
+			bytes.HasPrefix(data, signetHeader) {
+			solution = append([]byte(nil), data[len(signetHeader):]...)
+			data = signetHeader
+			found = true
+		}
+		cleared = appendPush(cleared, data)
+	}
+	return cleared, solution, found
+}
+
+// appendPush appends a push of data, using the smallest push opcode that
+// fits it (but never OP_1 to OP_16, like Bitcoin Core)
+func appendPush(script, data []byte) []byte {
+	switch {
+	case len(data) < txscript.OP_PUSHDATA1:
+		script = append(script, byte(len(data)))
+	case len(data) <= 0xff:
+		script = append(script, txscript.OP_PUSHDATA1, byte(len(data)))
+	case len(data) <= 0xffff:
+		var l [2]byte
+		binary.LittleEndian.PutUint16(l[:], uint16(len(data)))
+		script = append(script, txscript.OP_PUSHDATA2)
+		script = append(script, l[:]...)
+	default:
+		var l [4]byte
+		binary.LittleEndian.PutUint32(l[:], uint32(len(data)))
+		script = append(script, txscript.OP_PUSHDATA4)
+		script = append(script, l[:]...)
+	}
+	return append(script, data...)
+}
+
+// appendUint32 appends n little endian, as it is in block headers
+func appendUint32(b []byte, n uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], n)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,299 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// testKey is a private key made from one byte
+func testKey(b byte) *btcec.PrivateKey {
+	key, _ := btcec.PrivKeyFromBytes(
+		btcec.S256(), bytes.Repeat([]byte{b}, 32))
+	return key
+}
+
+// multisigChallenge is a 1 of 1 bare multisig, the same kind of challenge
+// the public signet has
+func multisigChallenge(key *btcec.PrivateKey) []byte {
+	return append(append([]byte{txscript.OP_1, txscript.OP_DATA_33},
+		key.PubKey().SerializeCompressed()...),
+		txscript.OP_1, txscript.OP_CHECKMULTISIG)
+}
+
+// testSignet loads a signet with challenge from a params file
+func testSignet(
+	t *testing.T, name string, challenge []byte) *chaincfg.Params {
+
+	path := filepath.Join(t.TempDir(), name+".json")
+	err := ioutil.WriteFile(path, []byte(`{"name": "`+name+
+		`", "base": "signet", "signetchallenge": "`+
+		hex.EncodeToString(challenge)+`"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadParamsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// unsignedSignetBlock is a block with a coinbase with a witness commitment
+// and one other tx.  It has no signet solution.
+func unsignedSignetBlock(prev chainhash.Hash) wire.MsgBlock {
+	cb := wire.NewMsgTx(1)
+	cb.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+		SignatureScript:  []byte{txscript.OP_DATA_4, 5, 0, 0, 0},
+		Witness:          wire.TxWitness{make([]byte, 32)},
+	})
+	cb.AddTxOut(wire.NewTxOut(50e8, []byte{txscript.OP_TRUE}))
+
+	tx := wire.NewMsgTx(1)
+	op := wire.OutPoint{Hash: chainhash.Hash{0x01}}
+	tx.AddTxIn(wire.NewTxIn(&op, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(1000, []byte{txscript.OP_TRUE}))
+
+	// the witness nonce is all 0s
+	wroot := blockchain.BuildMerkleTreeStore(
+		[]*btcutil.Tx{btcutil.NewTx(cb), btcutil.NewTx(tx)}, true)[2]
+	commitment := chainhash.DoubleHashB(
+		append(wroot[:], make([]byte, 32)...))
+	cb.AddTxOut(wire.NewTxOut(0, append(
+		append([]byte{}, blockchain.WitnessMagicBytes...), commitment...)))
+
+	blk := wire.MsgBlock{
+		Header: wire.BlockHeader{
+			Version:   0x20000000,
+			PrevBlock: prev,
+			Timestamp: time.Unix(1600000000, 0),
+			Bits:      0x1e0377ae,
+		},
+		Transactions: []*wire.MsgTx{cb, tx},
+	}
+	blk.Header.MerkleRoot = merkleRoot(blk.Transactions)
+	return blk
+}
+
+func merkleRoot(txs []*wire.MsgTx) chainhash.Hash {
+	utxs := make([]*btcutil.Tx, len(txs))
+	for i, tx := range txs {
+		utxs[i] = btcutil.NewTx(tx)
+	}
+	merkles := blockchain.BuildMerkleTreeStore(utxs, false)
+	return *merkles[len(merkles)-1]
+}
+
+// signSignetBlock signs blk with key the way bip325 says: the signed tx
+// commits to the header with the merkle root of the block with an empty
+// solution, then the solution goes in and the merkle root is updated.
+func signSignetBlock(t *testing.T, blk *wire.MsgBlock,
+	key *btcec.PrivateKey, challenge []byte) {
+
+	commit := blk.Transactions[0].TxOut[1]
+	commit.PkScript = appendPush(commit.PkScript, signetHeader)
+	root := merkleRoot(blk.Transactions)
+
+	var blockData bytes.Buffer
+	blockData.Write([]byte{txscript.OP_0, txscript.OP_DATA_72})
+	hdr := blk.Header
+	hdr.MerkleRoot = root
+	var hdrBytes bytes.Buffer
+	hdr.Serialize(&hdrBytes)
+	// version, prev, merkle root, time
+	blockData.Write(hdrBytes.Bytes()[:72])
+
+	toSpend := wire.NewMsgTx(0)
+	toSpend.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+		SignatureScript:  blockData.Bytes(),
+	})
+	toSpend.AddTxOut(wire.NewTxOut(0, challenge))
+	toSign := wire.NewMsgTx(0)
+	toSign.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Hash: toSpend.TxHash()}})
+	toSign.AddTxOut(wire.NewTxOut(0, []byte{txscript.OP_RETURN}))
+
+	sig, err := txscript.RawTxInSignature(
+		toSign, 0, challenge, txscript.SigHashAll, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// scriptSig OP_0 <sig> for the multisig, and no witness
+	var solution bytes.Buffer
+	wire.WriteVarBytes(&solution, 0,
+		append([]byte{txscript.OP_0, byte(len(sig))}, sig...))
+	wire.WriteVarInt(&solution, 0, 0)
+
+	commit.PkScript = appendPush(
+		commit.PkScript[:len(commit.PkScript)-1-len(signetHeader)],
+		append(append([]byte{}, signetHeader...), solution.Bytes()...))
+	blk.Header.MerkleRoot = merkleRoot(blk.Transactions)
+}
+
+func TestCheckSignetSolution(t *testing.T) {
+	key := testKey(0x11)
+	challenge := multisigChallenge(key)
+	p := testSignet(t, "testsignet", challenge)
+
+	good := unsignedSignetBlock(chainhash.Hash{0x22})
+	signSignetBlock(t, &good, key, challenge)
+	err := CheckSignetSolution(&good, p)
+	if err != nil {
+		t.Fatalf("good block: %s", err.Error())
+	}
+
+	// the block checks out as a whole too
+	err = blockchain.ValidateWitnessCommitment(btcutil.NewBlock(&good))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrongKey := unsignedSignetBlock(chainhash.Hash{0x22})
+	signSignetBlock(t, &wrongKey, testKey(0x12), challenge)
+
+	// changing the header after signing
+	otherTime := good
+	otherTime.Header.Timestamp = good.Header.Timestamp.Add(time.Second)
+
+	// a different tx, with the merkle root updated
+	otherTx := unsignedSignetBlock(chainhash.Hash{0x22})
+	signSignetBlock(t, &otherTx, key, challenge)
+	otherTx.Transactions[1] = otherTx.Transactions[1].Copy()
+	otherTx.Transactions[1].TxOut[0].Value = 999
+	otherTx.Header.MerkleRoot = merkleRoot(otherTx.Transactions)
+
+	unsigned := unsignedSignetBlock(chainhash.Hash{0x22})
+
+	noCommitment := unsignedSignetBlock(chainhash.Hash{0x22})
+	cb := noCommitment.Transactions[0]
+	cb.TxOut = cb.TxOut[:1]
+
+	for name, blk := range map[string]*wire.MsgBlock{
+		"wrong key":     &wrongKey,
+		"header change": &otherTime,
+		"tx change":     &otherTx,
+		"no solution":   &unsigned,
+		"no commitment": &noCommitment,
+	} {
+		err = CheckSignetSolution(blk, p)
+		if err == nil {
+			t.Errorf("%s: no error", name)
+			continue
+		}
+		t.Logf("%s: %s", name, err.Error())
+	}
+
+	// only signets get checked
+	err = CheckSignetSolution(&unsigned, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatalf("regtest: %s", err.Error())
+	}
+	// a signet that anyone can sign doesn't need a solution
+	anyone := testSignet(t, "anyonesignet", []byte{txscript.OP_TRUE})
+	err = CheckSignetSolution(&unsigned, anyone)
+	if err != nil {
+		t.Fatalf("OP_TRUE challenge: %s", err.Error())
+	}
+	// and one that's there anyway doesn't get in the way
+	if CheckSignetSolution(&good, anyone) != nil {
+		t.Fatal("OP_TRUE challenge with a solution failed")
+	}
+}
+
+func TestClearSignetSolution(t *testing.T) {
+	commitment := append(append([]byte{}, blockchain.WitnessMagicBytes...),
+		make([]byte, 32)...)
+	short := []byte{1, 2, 3}
+	long := bytes.Repeat([]byte{4}, 100)
+
+	tests := []struct {
+		name     string
+		script   []byte
+		cleared  []byte
+		solution []byte
+		found    bool
+	}{
+		{"none", commitment, commitment, nil, false},
+		{"short", appendPush(append([]byte{}, commitment...),
+			append(append([]byte{}, signetHeader...), short...)),
+			appendPush(append([]byte{}, commitment...), signetHeader),
+			short, true},
+		// over 75 bytes is a OP_PUSHDATA1, which goes back to a plain push
+		{"long", appendPush(append([]byte{}, commitment...),
+			append(append([]byte{}, signetHeader...), long...)),
+			appendPush(append([]byte{}, commitment...), signetHeader),
+			long, true},
+		// just the header isn't a solution
+		{"header only", appendPush(append([]byte{}, commitment...),
+			signetHeader),
+			appendPush(append([]byte{}, commitment...), signetHeader),
+			nil, false},
+		// a push with OP_PUSHDATA1 when it didn't have to gets rewritten
+		{"non minimal", append(append([]byte{}, commitment...),
+			txscript.OP_PUSHDATA1, 2, 0xaa, 0xbb),
+			append(append([]byte{}, commitment...), 2, 0xaa, 0xbb),
+			nil, false},
+	}
+	for _, test := range tests {
+		cleared, solution, found := clearSignetSolution(test.script)
+		if !bytes.Equal(cleared, test.cleared) ||
+			!bytes.Equal(solution, test.solution) || found != test.found {
+			t.Errorf("%s: got %x %x %v, expected %x %x %v", test.name,
+				cleared, solution, found,
+				test.cleared, test.solution, test.found)
+		}
+	}
+
+	// only the first solution is taken out
+	two := appendPush(appendPush(append([]byte{}, commitment...),
+		append(append([]byte{}, signetHeader...), short...)),
+		append(append([]byte{}, signetHeader...), long...))
+	cleared, solution, _ := clearSignetSolution(two)
+	if !bytes.Equal(solution, short) || !bytes.Equal(cleared,
+		appendPush(appendPush(append([]byte{}, commitment...), signetHeader),
+			append(append([]byte{}, signetHeader...), long...))) {
+		t.Errorf("two solutions: got %x %x", cleared, solution)
+	}
+}
+
+func TestSignetMagic(t *testing.T) {
+	// 0a03cf40 at the start of each message, same as Bitcoin Core
+	if SigNetParams.Net != wire.BitcoinNet(0x40cf030a) {
+		t.Fatalf("signet magic %08x, expected 40cf030a",
+			uint32(SigNetParams.Net))
+	}
+	if signetMagic(defaultSignetChallenge) != SigNetParams.Net {
+		t.Fatal("signetMagic doesn't give the public signet's magic")
+	}
+	p, err := NetParams("signet", "")
+	if err != nil || p.Net != SigNetParams.Net {
+		t.Fatalf("NetParams signet gave %v %v", p, err)
+	}
+
+	// another challenge is another network
+	challenge := multisigChallenge(testKey(0x11))
+	p = testSignet(t, "magicsignet", challenge)
+	if p.Net == SigNetParams.Net || p.Net != signetMagic(challenge) {
+		t.Fatalf("signet with its own challenge has magic %08x",
+			uint32(p.Net))
+	}
+	if !p.GenesisHash.IsEqual(SigNetParams.GenesisHash) {
+		t.Fatal("signets should all have the same genesis block")
+	}
+	if BitcoindDir(p) != "signet" {
+		t.Fatalf("bitcoind dir %q", BitcoindDir(p))
+	}
+}
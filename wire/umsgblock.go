@@ -1,67 +1,276 @@
 package wire
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"math"
 	"net"
-	"sync"
 	"time"
 
 	"github.com/btcsuite/btcd/blockchain"
-	"github.com/btcsuite/btcd/chaincfg"
-	"github.com/btcsuite/btcd/chaincfg/chainhash"
-	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
-	"github.com/btcsuite/btcutil"
 	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/mit-dci/utreexo/btcacc"
 	"github.com/mit-dci/utreexo/util"
 )
 
 // UblockNetworkReader gets Ublocks from the remote host and puts em in the
-// channel.  It'll try to fill the channel buffer.
+// channel.  It'll try to fill the channel buffer.  It gives the same errors
+// as UblockRangeReader.
 func UblockNetworkReader(
 	blockChan chan UBlock, remoteServer string,
-	curHeight, lookahead int32) {
+	curHeight, lookahead int32) error {
+	// request range from curHeight to latest block
+	return UblockRangeReader(
+		blockChan, nil, remoteServer, curHeight, math.MaxInt32)
+}
 
+// UblockRangeReader gets the Ublocks fromHeight to toHeight (inclusive) from
+// the remote host and puts em in the channel.  The channel is closed when it
+// returns.  It stops early once done is closed; done can be nil.  The server
+// hanging up between blocks isn't an error, it just doesn't have any more.
+// If the server has pruned a block the error is a *PrunedError.
+func UblockRangeReader(blockChan chan UBlock, done chan struct{},
+	remoteServer string, fromHeight, toHeight int32) error {
+
+	defer close(blockChan)
 	d := net.Dialer{Timeout: 2 * time.Second}
 	con, err := d.Dial("tcp", remoteServer)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer con.Close()
-	defer close(blockChan)
 
-	var ub UBlock
-	// var ublen uint32
-	// request range from curHeight to latest block
-	err = binary.Write(con, binary.BigEndian, curHeight)
+	err = requestUBlocks(con, fromHeight, toHeight)
 	if err != nil {
-		e := fmt.Errorf("UblockNetworkReader: write error to connection %s %s\n",
+		return err
+	}
+
+	// TODO goroutines for only the Deserialize part might be nice.
+	// Need to sort the blocks though if you're doing that
+	for curHeight := fromHeight; curHeight <= toHeight; curHeight++ {
+		var ub UBlock
+		err = readUBlock(con, curHeight, &ub)
+		if err == io.EOF {
+			return nil
+		}
+		if perr, ok := err.(*PrunedError); ok {
+			perr.Server = remoteServer
+			return perr
+		}
+		if err != nil {
+			return fmt.Errorf("Deserialize error from connection %s %s",
+				con.RemoteAddr().String(), err.Error())
+		}
+		select {
+		case blockChan <- ub:
+		case <-done:
+			return nil
+		}
+	}
+	return nil
+}
+
+// GetUBlock gets the single ublock at height from the remote host
+func GetUBlock(remoteServer string, height int32) (ub UBlock, err error) {
+	d := net.Dialer{Timeout: 2 * time.Second}
+	con, err := d.Dial("tcp", remoteServer)
+	if err != nil {
+		return
+	}
+	defer con.Close()
+
+	err = requestUBlocks(con, height, height)
+	if err != nil {
+		return
+	}
+	err = readUBlock(con, height, &ub)
+	if perr, ok := err.(*PrunedError); ok {
+		perr.Server = remoteServer
+	} else if err != nil {
+		err = fmt.Errorf("GetUBlock: height %d from %s: %s",
+			height, con.RemoteAddr().String(), err.Error())
+	}
+	return
+}
+
+// requestUBlocks asks the server for ublocks fromHeight to toHeight
+func requestUBlocks(con net.Conn, fromHeight, toHeight int32) error {
+	err := binary.Write(con, binary.BigEndian, fromHeight)
+	if err != nil {
+		return fmt.Errorf("requestUBlocks: write error to connection %s %s\n",
 			con.RemoteAddr().String(), err.Error())
-		panic(e)
 	}
-	err = binary.Write(con, binary.BigEndian, int32(math.MaxInt32))
+	err = binary.Write(con, binary.BigEndian, toHeight)
 	if err != nil {
-		e := fmt.Errorf("UblockNetworkReader: write error to connection %s %s\n",
+		return fmt.Errorf("requestUBlocks: write error to connection %s %s\n",
 			con.RemoteAddr().String(), err.Error())
-		panic(e)
 	}
+	return nil
+}
 
-	// TODO goroutines for only the Deserialize part might be nice.
-	// Need to sort the blocks though if you're doing that
-	for ; ; curHeight++ {
+/*
+Headers can be asked for on their own, to check that blocks are on the
+chain of some block (like the assumevalid one) before getting them.  The
+request is HeadersRequest, then the from and to heights.  The server
+replies with a 4 byte count and then that many 80 byte headers starting at
+from, at most MaxHeadersPerRequest.  Fewer than asked for means it doesn't
+have any more.
+*/
+
+// HeadersRequest starts a request for headers instead of ublocks
+const HeadersRequest int32 = -3
 
-		err = ub.Deserialize(con)
+// MaxHeadersPerRequest is the most headers a server sends back for one
+// request
+const MaxHeadersPerRequest = 2000
+
+// GetHeaders gets the headers fromHeight to toHeight (inclusive) from the
+// remote host, in as many requests as it takes
+func GetHeaders(remoteServer string, fromHeight, toHeight int32) (
+	[]wire.BlockHeader, error) {
+
+	var headers []wire.BlockHeader
+	for fromHeight <= toHeight {
+		d := net.Dialer{Timeout: 2 * time.Second}
+		con, err := d.Dial("tcp", remoteServer)
 		if err != nil {
-			fmt.Printf("Deserialize error from connection %s %s\n",
-				con.RemoteAddr().String(), err.Error())
-			return
+			return nil, err
+		}
+		err = binary.Write(con, binary.BigEndian, HeadersRequest)
+		if err == nil {
+			err = requestUBlocks(con, fromHeight, toHeight)
+		}
+		var got []wire.BlockHeader
+		if err == nil {
+			got, err = ReadHeaders(con)
+		}
+		con.Close()
+		if err != nil {
+			return nil, fmt.Errorf("GetHeaders: from %d: %s",
+				fromHeight, err.Error())
+		}
+		if len(got) == 0 {
+			return nil, fmt.Errorf("GetHeaders: %s has no header %d",
+				remoteServer, fromHeight)
+		}
+		headers = append(headers, got...)
+		fromHeight += int32(len(got))
+	}
+	return headers, nil
+}
+
+// WriteHeaders sends the reply to a headers request
+func WriteHeaders(w io.Writer, headers []wire.BlockHeader) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(headers)))
+	for _, h := range headers {
+		err := h.Serialize(&buf)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ReadHeaders reads the reply to a headers request
+func ReadHeaders(r io.Reader) ([]wire.BlockHeader, error) {
+	var n uint32
+	err := binary.Read(r, binary.BigEndian, &n)
+	if err != nil {
+		return nil, err
+	}
+	if n > MaxHeadersPerRequest {
+		return nil, fmt.Errorf("%d headers, max is %d",
+			n, MaxHeadersPerRequest)
+	}
+	headers := make([]wire.BlockHeader, n)
+	for i := range headers {
+		err = headers[i].Deserialize(r)
+		if err != nil {
+			return nil, err
 		}
-		blockChan <- ub
 	}
+	return headers, nil
+}
+
+/*
+Each ublock the server sends starts with a byte saying what it is:
+
+UBlockResponse   then the ublock
+PrunedResponse   then 4 bytes, the lowest height the server still has
+
+A server that only keeps the proofs of recent blocks (the bridgenode's
+-proofretain) can't send the blocks before those.  When it gets to one it
+sends a pruned response in its place and hangs up.
+*/
+
+const (
+	UBlockResponse byte = 0x00
+	PrunedResponse byte = 0x01
+)
+
+// PrunedError is what reading a ublock gives if the server has pruned it
+type PrunedError struct {
+	Server string // who has it pruned
+	Height int32  // the block asked for
+	Oldest int32  // lowest height the server still has
+}
+
+func (e *PrunedError) Error() string {
+	return fmt.Sprintf("%s has pruned block %d, only has %d and up",
+		e.Server, e.Height, e.Oldest)
+}
+
+// WriteUBlockResponse sends a ublock, already serialized as the block and
+// then its udata
+func WriteUBlockResponse(w io.Writer, blk, udata []byte) error {
+	msg := make([]byte, 0, 1+len(blk)+len(udata))
+	msg = append(msg, UBlockResponse)
+	msg = append(msg, blk...)
+	_, err := w.Write(append(msg, udata...))
+	return err
+}
+
+// WritePrunedResponse tells the client the block it wants is pruned, and
+// that the server has blocks from oldest on
+func WritePrunedResponse(w io.Writer, oldest int32) error {
+	var b [5]byte
+	b[0] = PrunedResponse
+	binary.BigEndian.PutUint32(b[1:], uint32(oldest))
+	_, err := w.Write(b[:])
+	return err
+}
+
+// readUBlock reads the ublock at height from the server.  If the server
+// says it's pruned the error is a *PrunedError.
+func readUBlock(r io.Reader, height int32, ub *UBlock) error {
+	var msgType [1]byte
+	_, err := io.ReadFull(r, msgType[:])
+	if err != nil {
+		return err
+	}
+	switch msgType[0] {
+	case UBlockResponse:
+		err = ub.Deserialize(r)
+		if err == io.EOF {
+			// hung up partway through, not between blocks
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	case PrunedResponse:
+		var oldest int32
+		err = binary.Read(r, binary.BigEndian, &oldest)
+		if err != nil {
+			return err
+		}
+		return &PrunedError{Height: height, Oldest: oldest}
+	}
+	return fmt.Errorf("unknown response type %x for block %d",
+		msgType[0], height)
 }
 
 // BlockToAdds turns all the new utxos in a msgblock into leafTxos
@@ -151,35 +360,17 @@ func (ub *UBlock) ProofSanity(inputSkipList []uint32, nl uint64, h uint8) error
 // all the data is there, just a bit different format.
 // Note that this needs blockchain.NewUtxoEntry() in btcd
 func (ub *UBlock) ToUtxoView() *blockchain.UtxoViewpoint {
-	v := blockchain.NewUtxoViewpoint()
-	m := v.Entries()
-	// loop through leafDatas and convert them into UtxoEntries (pretty much the
-	// same thing
-	for _, ld := range ub.UtreexoData.Stxos {
-		txo := wire.NewTxOut(ld.Amt, ld.PkScript)
-		utxo := blockchain.NewUtxoEntry(txo, ld.Height, ld.Coinbase)
-		op := wire.OutPoint{
-			Hash:  chainhash.Hash(ld.TxHash),
-			Index: ld.Index,
-		}
-		m[op] = utxo
-	}
-
-	return v
+	return stxoView(ub.UtreexoData.Stxos)
 }
 
-// CheckBlock does all internal block checks for a UBlock
-// right now checks the signatures
-func (ub *UBlock) CheckBlock(outskip []uint32, p *chaincfg.Params) bool {
-	// NOTE Whatever happens here is done a million times
-	// be efficient here
+// UtxoView is ToUtxoView but also has the outputs that are created and
+// spent in this same block, which aren't in the udata.  outskip is the
+// output skiplist from DedupeBlock.
+func (ub *UBlock) UtxoView(outskip []uint32) *blockchain.UtxoViewpoint {
 	view := ub.ToUtxoView()
 	viewMap := view.Entries()
 	var txonum uint32
 
-	sigCache := txscript.NewSigCache(0)
-	hashCache := txscript.NewHashCache(0)
-
 	for txnum, tx := range ub.Block.Transactions {
 		outputsInTx := uint32(len(tx.TxOut))
 		if txnum == 0 {
@@ -202,38 +393,7 @@ func (ub *UBlock) CheckBlock(outskip []uint32, p *chaincfg.Params) bool {
 		}
 		txonum += outputsInTx
 	}
-
-	var wg sync.WaitGroup
-	wg.Add(len(ub.Block.Transactions) - 1) // subtract coinbase
-	for txnum, tx := range ub.Block.Transactions {
-		if txnum == 0 {
-			continue // skip checks for coinbase TX for now.  Or maybe it'll work?
-		}
-		utilTx := btcutil.NewTx(tx)
-		go func(w *sync.WaitGroup, tx *btcutil.Tx) {
-			// hardcoded testnet3 for now
-			_, err := blockchain.CheckTransactionInputs(
-				utilTx, ub.UtreexoData.Height, view, p)
-			if err != nil {
-				fmt.Printf("Tx %s fails CheckTransactionInputs: %s\n",
-					utilTx.Hash().String(), err.Error())
-				panic(err)
-			}
-
-			// no scriptflags for now
-			err = blockchain.ValidateTransactionScripts(
-				utilTx, view, 0, sigCache, hashCache)
-			if err != nil {
-				fmt.Printf("Tx %s fails ValidateTransactionScripts: %s\n",
-					utilTx.Hash().String(), err.Error())
-				panic(err)
-			}
-			w.Done()
-		}(&wg, utilTx)
-	}
-	wg.Wait()
-
-	return true
+	return view
 }
 
 /*
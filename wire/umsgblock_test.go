@@ -0,0 +1,170 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+// testUBlock is a ublock with just a coinbase
+func testUBlock(height int32) UBlock {
+	cb := wire.NewMsgTx(1)
+	cb.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+		SignatureScript:  []byte{txscript.OP_DATA_4, byte(height), 0, 0, 0},
+	})
+	cb.AddTxOut(wire.NewTxOut(50e8, []byte{txscript.OP_TRUE}))
+	return UBlock{
+		Block: wire.MsgBlock{
+			Header:       wire.BlockHeader{Nonce: uint32(height)},
+			Transactions: []*wire.MsgTx{cb},
+		},
+		UtreexoData: btcacc.UData{Height: height},
+	}
+}
+
+// prunedServer serves ublocks up to tip, and pruned responses for the ones
+// before oldest, like a bridge node with -proofretain
+func prunedServer(t *testing.T, oldest, tip int32) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			con, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var from, to int32
+			binary.Read(con, binary.BigEndian, &from)
+			binary.Read(con, binary.BigEndian, &to)
+			for h := from; h <= to && h <= tip; h++ {
+				if h < oldest {
+					WritePrunedResponse(con, oldest)
+					break
+				}
+				ub := testUBlock(h)
+				var blk, udata bytes.Buffer
+				ub.Block.Serialize(&blk)
+				ub.UtreexoData.Serialize(&udata)
+				err = WriteUBlockResponse(con, blk.Bytes(), udata.Bytes())
+				if err != nil {
+					break
+				}
+			}
+			con.Close()
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+func TestUblockRangeReaderPruned(t *testing.T) {
+	addr := prunedServer(t, 3, 6)
+
+	// all there, and the server hanging up at its tip is fine
+	blockChan := make(chan UBlock, 10)
+	err := UblockRangeReader(blockChan, nil, addr, 3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var heights []int32
+	for ub := range blockChan {
+		heights = append(heights, ub.UtreexoData.Height)
+	}
+	if !reflect.DeepEqual(heights, []int32{3, 4, 5, 6}) {
+		t.Fatalf("got blocks %v", heights)
+	}
+
+	blockChan = make(chan UBlock, 10)
+	err = UblockRangeReader(blockChan, nil, addr, 1, 10)
+	perr, ok := err.(*PrunedError)
+	if !ok {
+		t.Fatalf("expected *PrunedError, got %v", err)
+	}
+	if *perr != (PrunedError{Server: addr, Height: 1, Oldest: 3}) {
+		t.Fatalf("wrong error %+v", perr)
+	}
+	if _, open := <-blockChan; open {
+		t.Fatal("got a block before the pruned response")
+	}
+
+	_, err = GetUBlock(addr, 2)
+	perr, ok = err.(*PrunedError)
+	if !ok || perr.Height != 2 || perr.Oldest != 3 || perr.Server != addr {
+		t.Fatalf("GetUBlock pruned block gave %v", err)
+	}
+	ub, err := GetUBlock(addr, 4)
+	if err != nil || ub.UtreexoData.Height != 4 {
+		t.Fatalf("GetUBlock gave block %d, %v", ub.UtreexoData.Height, err)
+	}
+}
+
+func TestReadUBlock(t *testing.T) {
+	ub := testUBlock(7)
+	var blk, udata, buf bytes.Buffer
+	ub.Block.Serialize(&blk)
+	ub.UtreexoData.Serialize(&udata)
+	err := WriteUBlockResponse(&buf, blk.Bytes(), udata.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := buf.Bytes()
+
+	var got UBlock
+	err = readUBlock(bytes.NewReader(msg), 7, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Block.BlockHash() != ub.Block.BlockHash() ||
+		got.UtreexoData.Height != 7 {
+		t.Fatal("ublock came back different")
+	}
+
+	// nothing at all is the server being done
+	err = readUBlock(bytes.NewReader(nil), 7, &got)
+	if err != io.EOF {
+		t.Fatalf("empty read gave %v", err)
+	}
+	// but not partway through a block
+	err = readUBlock(bytes.NewReader(msg[:1]), 7, &got)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("cut off block gave %v", err)
+	}
+	err = readUBlock(bytes.NewReader(msg[:len(msg)/2]), 7, &got)
+	if err == nil || err == io.EOF {
+		t.Fatalf("cut off block gave %v", err)
+	}
+
+	// a block with version -1 isn't a pruned response
+	ub.Block.Header.Version = -1
+	blk.Reset()
+	buf.Reset()
+	ub.Block.Serialize(&blk)
+	WriteUBlockResponse(&buf, blk.Bytes(), udata.Bytes())
+	err = readUBlock(&buf, 7, &got)
+	if err != nil || got.Block.Header.Version != -1 {
+		t.Fatalf("version -1 block gave %v", err)
+	}
+
+	buf.Reset()
+	WritePrunedResponse(&buf, 5)
+	err = readUBlock(&buf, 2, &got)
+	if perr, ok := err.(*PrunedError); !ok || perr.Oldest != 5 ||
+		perr.Height != 2 {
+		t.Fatalf("pruned response gave %v", err)
+	}
+
+	err = readUBlock(bytes.NewReader([]byte{0x07}), 2, &got)
+	if _, ok := err.(*PrunedError); err == nil || ok {
+		t.Fatalf("unknown response gave %v", err)
+	}
+}
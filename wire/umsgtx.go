@@ -0,0 +1,266 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
+)
+
+/*
+A UTx is a transaction with the utreexo data for its inputs, so anyone with
+the accumulator roots can check that it spends utxos that exist.  Like a
+UBlock it's the regular tx and then a UData:
+
+the tx, same as on the bitcoin p2p network
+the UData: the height, no TTLs, the BatchProof for the inputs and the
+LeafData of every input, in the same order as the inputs
+
+The height is the block the tx could go in next, so the proof is against
+the roots after block height-1.  That's the same as for a UBlock, whose proof
+is against the roots before it.
+
+UTxs go over the same connection as ublocks.  Instead of a block height, the
+request starts with one of the negative UTx request codes:
+
+UTxPushRequest   then a UTx.  The server replies with a 2 byte length and an
+                 error string, which is empty if it took the tx.
+UTxPullRequest   nothing else.  The server replies with a 4 byte count and
+                 then the UTxs it's relaying, at most MaxUTxRelay.
+*/
+
+const (
+	UTxPushRequest int32 = -1
+	UTxPullRequest int32 = -2
+)
+
+// MaxUTxRelay is the most UTxs a server sends back for one pull request
+const MaxUTxRelay = 1000
+
+// UTx is a regular transaction, with Udata for its inputs stuck on
+type UTx struct {
+	UtreexoData btcacc.UData
+	Tx          wire.MsgTx
+}
+
+// Deserialize a UTx.  It's just a tx then udata.
+func (utx *UTx) Deserialize(r io.Reader) (err error) {
+	err = utx.Tx.Deserialize(r)
+	if err != nil {
+		return err
+	}
+	err = utx.UtreexoData.Deserialize(r)
+	return
+}
+
+// Serialize a UTx, tx then udata
+func (utx *UTx) Serialize(w io.Writer) (err error) {
+	err = utx.Tx.Serialize(w)
+	if err != nil {
+		return
+	}
+	err = utx.UtreexoData.Serialize(w)
+	return
+}
+
+// SerializeSize: how big is it, in bytes.
+func (utx *UTx) SerializeSize() int {
+	return utx.Tx.SerializeSize() + utx.UtreexoData.SerializeSize()
+}
+
+// ProofSanity checks that the udata is for the inputs of the tx and that the
+// LeafData hash to the targets in the proof.  It doesn't check the proof
+// against any roots.
+func (utx *UTx) ProofSanity(nl uint64, h uint8) error {
+	ud := &utx.UtreexoData
+	// every input needs its own target, or LeafData that isn't proven
+	// gets through with the ones that are
+	if len(utx.Tx.TxIn) != len(ud.Stxos) ||
+		len(ud.AccProof.Targets) != len(ud.Stxos) {
+		return fmt.Errorf("tx %s has %d inputs, %d LeafData and %d targets",
+			utx.Tx.TxHash().String(), len(utx.Tx.TxIn), len(ud.Stxos),
+			len(ud.AccProof.Targets))
+	}
+	for i, in := range utx.Tx.TxIn {
+		if btcacc.Hash(in.PreviousOutPoint.Hash) != ud.Stxos[i].TxHash ||
+			in.PreviousOutPoint.Index != ud.Stxos[i].Index {
+			return fmt.Errorf("tx/utxoData mismatch %s v %s",
+				in.PreviousOutPoint.String(), ud.Stxos[i].OPString())
+		}
+	}
+	if !ud.ProofSanity(nl, h) {
+		return fmt.Errorf("tx %s LeafData / Proof mismatch",
+			utx.Tx.TxHash().String())
+	}
+	return nil
+}
+
+// ToUtxoView converts the UData of a UTx into a btcd
+// blockchain.UtxoViewpoint, same as UBlock.ToUtxoView.
+func (utx *UTx) ToUtxoView() *blockchain.UtxoViewpoint {
+	return stxoView(utx.UtreexoData.Stxos)
+}
+
+// CheckTx does the checks a node does on a tx before putting it in its
+// mempool: sanity, input amounts and coinbase maturity, and the scripts if
+// scripts is true.  The inputs come from the udata, so check that with
+// ProofSanity and the proof against the roots first.
+func (utx *UTx) CheckTx(p *chaincfg.Params, scripts bool) error {
+	height := utx.UtreexoData.Height
+	tx := btcutil.NewTx(&utx.Tx)
+	if blockchain.IsCoinBase(tx) {
+		return fmt.Errorf("tx %s is a coinbase", tx.Hash().String())
+	}
+	err := blockchain.CheckTransactionSanity(tx)
+	if err != nil {
+		return fmt.Errorf("tx %s fails CheckTransactionSanity: %s",
+			tx.Hash().String(), err.Error())
+	}
+	view := utx.ToUtxoView()
+	_, err = blockchain.CheckTransactionInputs(tx, height, view, p)
+	if err != nil {
+		return fmt.Errorf("tx %s fails CheckTransactionInputs: %s",
+			tx.Hash().String(), err.Error())
+	}
+	if !scripts {
+		return nil
+	}
+	// the block hash is only needed for the bip16 exception block
+	flags, err := ScriptFlags(p, height, chainhash.Hash{})
+	if err != nil {
+		return err
+	}
+	err = blockchain.ValidateTransactionScripts(tx, view, flags, nil, nil)
+	if err != nil {
+		return fmt.Errorf("tx %s fails ValidateTransactionScripts: %s",
+			tx.Hash().String(), err.Error())
+	}
+	return nil
+}
+
+// stxoView makes a UtxoViewpoint out of the LeafData of spent txos
+func stxoView(stxos []btcacc.LeafData) *blockchain.UtxoViewpoint {
+	v := blockchain.NewUtxoViewpoint()
+	m := v.Entries()
+	for _, ld := range stxos {
+		txo := wire.NewTxOut(ld.Amt, ld.PkScript)
+		utxo := blockchain.NewUtxoEntry(txo, ld.Height, ld.Coinbase)
+		op := wire.OutPoint{
+			Hash:  chainhash.Hash(ld.TxHash),
+			Index: ld.Index,
+		}
+		m[op] = utxo
+	}
+	return v
+}
+
+// PushUTx sends a UTx to the remote host to relay.  It returns the error
+// the host gives if it doesn't take it.
+func PushUTx(remoteServer string, utx *UTx) error {
+	d := net.Dialer{Timeout: 2 * time.Second}
+	con, err := d.Dial("tcp", remoteServer)
+	if err != nil {
+		return err
+	}
+	defer con.Close()
+
+	err = binary.Write(con, binary.BigEndian, UTxPushRequest)
+	if err != nil {
+		return err
+	}
+	err = utx.Serialize(con)
+	if err != nil {
+		return err
+	}
+
+	var msgLen uint16
+	err = binary.Read(con, binary.BigEndian, &msgLen)
+	if err != nil {
+		return fmt.Errorf("PushUTx: no reply from %s: %s",
+			con.RemoteAddr().String(), err.Error())
+	}
+	if msgLen == 0 {
+		return nil
+	}
+	msg := make([]byte, msgLen)
+	_, err = io.ReadFull(con, msg)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%s rejected tx %s: %s", con.RemoteAddr().String(),
+		utx.Tx.TxHash().String(), string(msg))
+}
+
+// WriteUTxReply writes the reply to a UTxPushRequest.  A nil error means the
+// UTx was taken.
+func WriteUTxReply(w io.Writer, rejected error) error {
+	var msg []byte
+	if rejected != nil {
+		msg = []byte(rejected.Error())
+		if len(msg) > 0xffff {
+			msg = msg[:0xffff]
+		}
+	}
+	_, err := w.Write(util.PrefixLen16(msg))
+	return err
+}
+
+// GetUTxs gets the UTxs the remote host is relaying
+func GetUTxs(remoteServer string) ([]UTx, error) {
+	d := net.Dialer{Timeout: 2 * time.Second}
+	con, err := d.Dial("tcp", remoteServer)
+	if err != nil {
+		return nil, err
+	}
+	defer con.Close()
+
+	err = binary.Write(con, binary.BigEndian, UTxPullRequest)
+	if err != nil {
+		return nil, err
+	}
+	var count uint32
+	err = binary.Read(con, binary.BigEndian, &count)
+	if err != nil {
+		return nil, err
+	}
+	if count > MaxUTxRelay {
+		return nil, fmt.Errorf("%s says it's sending %d UTxs, max is %d",
+			con.RemoteAddr().String(), count, MaxUTxRelay)
+	}
+	utxs := make([]UTx, count)
+	for i := range utxs {
+		err = utxs[i].Deserialize(con)
+		if err != nil {
+			return nil, fmt.Errorf("GetUTxs: UTx %d from %s: %s",
+				i, con.RemoteAddr().String(), err.Error())
+		}
+	}
+	return utxs, nil
+}
+
+// WriteUTxs writes the reply to a UTxPullRequest
+func WriteUTxs(w io.Writer, utxs []UTx) error {
+	if len(utxs) > MaxUTxRelay {
+		utxs = utxs[:MaxUTxRelay]
+	}
+	err := binary.Write(w, binary.BigEndian, uint32(len(utxs)))
+	if err != nil {
+		return err
+	}
+	for i := range utxs {
+		err = utxs[i].Serialize(w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
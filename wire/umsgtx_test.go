@@ -0,0 +1,201 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+// testUTx spends two opTrue utxos of 1000 each and pays out out
+func testUTx(out int64) UTx {
+	tx := wire.NewMsgTx(1)
+	var stxos []btcacc.LeafData
+	for i := uint32(0); i < 2; i++ {
+		op := wire.OutPoint{Hash: chainhash.Hash{0x01, byte(i)}, Index: i}
+		tx.AddTxIn(wire.NewTxIn(&op, nil, nil))
+		stxos = append(stxos, btcacc.LeafData{
+			TxHash:   btcacc.Hash(op.Hash),
+			Index:    op.Index,
+			Height:   5,
+			Amt:      1000,
+			PkScript: []byte{txscript.OP_TRUE},
+		})
+	}
+	tx.AddTxOut(wire.NewTxOut(out, []byte{txscript.OP_TRUE}))
+	return UTx{
+		UtreexoData: btcacc.UData{
+			Height: 200,
+			AccProof: accumulator.BatchProof{
+				Targets: []uint64{3, 9},
+				Proof:   []accumulator.Hash{{0x02}, {0x03}, {0x04}},
+			},
+			Stxos: stxos,
+		},
+		Tx: *tx,
+	}
+}
+
+func TestUTxSerialize(t *testing.T) {
+	utx := testUTx(1500)
+	var buf bytes.Buffer
+	err := utx.Serialize(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != utx.SerializeSize() {
+		t.Fatalf("wrote %d bytes, SerializeSize %d",
+			buf.Len(), utx.SerializeSize())
+	}
+	var got UTx
+	err = got.Deserialize(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Tx.TxHash() != utx.Tx.TxHash() {
+		t.Fatalf("tx %s came back %s",
+			utx.Tx.TxHash().String(), got.Tx.TxHash().String())
+	}
+	ud, gud := utx.UtreexoData, got.UtreexoData
+	if gud.Height != ud.Height || len(gud.TxoTTLs) != 0 ||
+		!reflect.DeepEqual(gud.AccProof, ud.AccProof) ||
+		!reflect.DeepEqual(gud.Stxos, ud.Stxos) {
+		t.Fatalf("udata %+v came back %+v", ud, gud)
+	}
+
+	// cut short anywhere, it's an error
+	buf.Reset()
+	utx.Serialize(&buf)
+	b := buf.Bytes()
+	for _, n := range []int{0, 10, len(b) / 2, len(b) - 1} {
+		err = got.Deserialize(bytes.NewReader(b[:n]))
+		if err == nil {
+			t.Errorf("%d of %d bytes deserialized", n, len(b))
+		}
+	}
+}
+
+func TestWriteUTxs(t *testing.T) {
+	utxs := []UTx{testUTx(1500), testUTx(1800)}
+	var buf bytes.Buffer
+	err := WriteUTxs(&buf, utxs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count uint32
+	err = binary.Read(&buf, binary.BigEndian, &count)
+	if err != nil || count != 2 {
+		t.Fatalf("count %d %v", count, err)
+	}
+	for i := range utxs {
+		var got UTx
+		err = got.Deserialize(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Tx.TxHash() != utxs[i].Tx.TxHash() {
+			t.Fatalf("UTx %d is %s not %s", i,
+				got.Tx.TxHash().String(), utxs[i].Tx.TxHash().String())
+		}
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%d bytes left over", buf.Len())
+	}
+}
+
+func TestWriteUTxReply(t *testing.T) {
+	for _, msg := range []string{"", "no good"} {
+		var rejected error
+		if msg != "" {
+			rejected = errors.New(msg)
+		}
+		var buf bytes.Buffer
+		err := WriteUTxReply(&buf, rejected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n uint16
+		binary.Read(&buf, binary.BigEndian, &n)
+		if int(n) != len(msg) || buf.String() != msg {
+			t.Fatalf("reply %d %q, want %q", n, buf.String(), msg)
+		}
+	}
+}
+
+// TestCheckTxNoScripts checks that amounts are checked even when scripts
+// aren't
+func TestCheckTxNoScripts(t *testing.T) {
+	p := &chaincfg.RegressionNetParams
+	good := testUTx(1500)
+	overspend := testUTx(2500)
+	badScript := testUTx(1500)
+	badScript.UtreexoData.Stxos[1].PkScript = []byte{txscript.OP_FALSE}
+
+	for _, scripts := range []bool{true, false} {
+		if err := good.CheckTx(p, scripts); err != nil {
+			t.Errorf("scripts %v: good tx: %s", scripts, err.Error())
+		}
+		if overspend.CheckTx(p, scripts) == nil {
+			t.Errorf("scripts %v: tx spending more than its inputs passed",
+				scripts)
+		}
+	}
+	if badScript.CheckTx(p, true) == nil {
+		t.Error("bad script passed")
+	}
+	if err := badScript.CheckTx(p, false); err != nil {
+		t.Errorf("bad script not checked, but: %s", err.Error())
+	}
+}
+
+// TestUTxProofSanity checks that every input of a UTx has to be proven,
+// not just some of them
+func TestUTxProofSanity(t *testing.T) {
+	utx := testUTx(1500)
+	stxos := utx.UtreexoData.Stxos
+	f := accumulator.NewForest(nil, false, "", 0)
+	adds := []accumulator.Leaf{
+		{Hash: stxos[0].LeafHash()}, {Hash: accumulator.Hash{0x05}},
+		{Hash: stxos[1].LeafHash()}, {Hash: accumulator.Hash{0x06}},
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nl, h := f.ReconstructStats()
+	prove := func(lds ...btcacc.LeafData) accumulator.BatchProof {
+		var hs []accumulator.Hash
+		for _, ld := range lds {
+			hs = append(hs, ld.LeafHash())
+		}
+		bp, err := f.ProveBatch(hs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bp
+	}
+
+	utx.UtreexoData.AccProof = prove(stxos[0], stxos[1])
+	err = utx.ProofSanity(nl, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second input's LeafData is made up, and only the first is proven
+	stxos[1].Amt = 50e8
+	utx.UtreexoData.AccProof = prove(stxos[0])
+	if utx.ProofSanity(nl, h) == nil {
+		t.Fatal("tx with an unproven input passed")
+	}
+	if utx.UtreexoData.ProofSanity(nl, h) {
+		t.Fatal("udata with fewer targets than LeafData passed")
+	}
+}